@@ -0,0 +1,66 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrChecksumMismatch is returned if the downloaded artifact does not match the
+// checksum advertised by the server; the download is corrupted and is retried.
+var ErrChecksumMismatch = errors.New("artifact checksum mismatch")
+
+// checksumReader verifies the SHA256 checksum of the stream once it is read to
+// the end, failing with ErrChecksumMismatch instead of io.EOF on mismatch.
+type checksumReader struct {
+	io.ReadCloser
+	h        hash.Hash
+	expected string
+}
+
+func newChecksumReader(r io.ReadCloser, expected string) *checksumReader {
+	return &checksumReader{
+		ReadCloser: r,
+		h:          sha256.New(),
+		expected:   expected,
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF {
+		if verr := verifyChecksum(hex.EncodeToString(c.h.Sum(nil)),
+			c.expected); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// verifyChecksum compares the hex encoded checksum of the downloaded artifact
+// with the expected one.
+func verifyChecksum(sum, expected string) error {
+	if !strings.EqualFold(sum, expected) {
+		return errors.Wrapf(ErrChecksumMismatch, "expected %s, got %s",
+			expected, sum)
+	}
+	return nil
+}
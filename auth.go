@@ -14,8 +14,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"os"
+	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -34,6 +42,12 @@ type AuthManager interface {
 	HasKey() bool
 	// generate device key (will overwrite an already existing key)
 	GenerateKey() error
+	// removes device key
+	RemoveKey() error
+	// returns fingerprint of the device's public key
+	KeyFingerprint() (string, error)
+	// returns PEM encoded public key of the device
+	PublicKeyPEM() (string, error)
 
 	client.AuthDataMessenger
 }
@@ -47,6 +61,7 @@ const (
 type MenderAuthManager struct {
 	store       store.Store
 	keyStore    *store.Keystore
+	signer      *externalSigner
 	idSrc       IdentityDataGetter
 	tenantToken client.AuthToken
 }
@@ -56,6 +71,12 @@ type AuthManagerConfig struct {
 	KeyStore       *store.Keystore    // key storage
 	IdentitySource IdentityDataGetter // provider of identity data
 	TenantToken    []byte             // tenant token
+	// command signing the requests instead of using the key from KeyStore,
+	// along with the time it must complete in and the PEM encoded public key
+	// of the signer
+	SignCommand        []string
+	SignCommandTimeout time.Duration
+	PublicKey          string
 }
 
 func NewAuthManager(conf AuthManagerConfig) AuthManager {
@@ -72,8 +93,23 @@ func NewAuthManager(conf AuthManagerConfig) AuthManager {
 		tenantToken: client.AuthToken(conf.TenantToken),
 	}
 
+	if len(conf.SignCommand) != 0 {
+		signer, err := newExternalSigner(conf.SignCommand,
+			conf.SignCommandTimeout, conf.PublicKey)
+		if err != nil {
+			log.Errorf("failed to set up the external signer: %v", err)
+			return nil
+		}
+		mgr.signer = signer
+		return mgr
+	}
+
 	if err := mgr.keyStore.Load(); err != nil && !store.IsNoKeys(err) {
 		log.Errorf("failed to load device keys: %v", err)
+		if store.IsInsecureKeyPermissions(err) {
+			// do not replace the key with a new one
+			return nil
+		}
 		// Otherwise ignore error returned from Load() call. It will
 		// just result in an empty keyStore which in turn will cause
 		// regeneration of keys.
@@ -110,7 +146,11 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 	authd.IdData = idata
 
 	// fill device public key
-	authd.Pubkey, err = m.keyStore.PublicPEM()
+	if m.signer != nil {
+		authd.Pubkey = m.signer.publicKey
+	} else {
+		authd.Pubkey, err = m.keyStore.PublicPEM()
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to obtain device public key")
 	}
@@ -130,7 +170,12 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 	}
 
 	// generate signature
-	sig, err := m.keyStore.Sign(reqdata)
+	var sig []byte
+	if m.signer != nil {
+		sig, err = m.signer.Sign(reqdata)
+	} else {
+		sig, err = m.keyStore.Sign(reqdata)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to sign auth request")
 	}
@@ -174,10 +219,43 @@ func (m *MenderAuthManager) RemoveAuthToken() error {
 }
 
 func (m *MenderAuthManager) HasKey() bool {
+	if m.signer != nil {
+		return true
+	}
 	return m.keyStore.Private() != nil
 }
 
+func (m *MenderAuthManager) RemoveKey() error {
+	if m.signer != nil {
+		return errors.New("device key is managed by the external signer")
+	}
+	if err := m.keyStore.Remove(); err != nil {
+		return errors.Wrapf(err, "failed to remove device key")
+	}
+	return nil
+}
+
+func (m *MenderAuthManager) KeyFingerprint() (string, error) {
+	if m.signer != nil {
+		return m.signer.Fingerprint(), nil
+	}
+	return m.keyStore.Fingerprint()
+}
+
+func (m *MenderAuthManager) PublicKeyPEM() (string, error) {
+	if m.signer != nil {
+		return m.signer.publicKey, nil
+	}
+	if !m.HasKey() {
+		return "", errors.New("device key is not available")
+	}
+	return m.keyStore.PublicPEM()
+}
+
 func (m *MenderAuthManager) GenerateKey() error {
+	if m.signer != nil {
+		return errors.New("device key is managed by the external signer")
+	}
 	if err := m.keyStore.Generate(); err != nil {
 		log.Errorf("failed to generate device key: %v", err)
 		return errors.Wrapf(err, "failed to generate device key")
@@ -189,3 +267,55 @@ func (m *MenderAuthManager) GenerateKey() error {
 	}
 	return nil
 }
+
+// externalSigner signs the authorization requests with a command, e.g. one
+// using a key kept in a TPM or HSM that the private key can not be read from.
+// The command receives the data to sign on stdin and writes the raw signature
+// to stdout.
+type externalSigner struct {
+	command []string
+	// the command is killed if it does not complete in time
+	timeout time.Duration
+	// PEM encoded public key
+	publicKey string
+	publicDER []byte
+}
+
+func newExternalSigner(command []string, timeout time.Duration,
+	publicKey string) (*externalSigner, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("failed to decode the public key")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the public key")
+	}
+	return &externalSigner{
+		command:   command,
+		timeout:   timeout,
+		publicKey: publicKey,
+		publicDER: block.Bytes,
+	}, nil
+}
+
+func (s *externalSigner) Sign(data []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.command[0], s.command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := waitCommand(context.Background(), cmd, s.timeout); err != nil {
+		return nil, errors.Wrapf(err, "sign command failed: %s", stderr.String())
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("sign command returned empty signature")
+	}
+	return stdout.Bytes(), nil
+}
+
+// Fingerprint returns the hex encoded SHA256 digest of the DER encoded public
+// key.
+func (s *externalSigner) Fingerprint() string {
+	sum := sha256.Sum256(s.publicDER)
+	return hex.EncodeToString(sum[:])
+}
@@ -14,12 +14,21 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
 	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewAuthManager(t *testing.T) {
@@ -155,6 +164,53 @@ func TestAuthManagerRequest(t *testing.T) {
 	assert.Equal(t, sign, req.Signature)
 }
 
+func TestAuthManagerRequestIdentity(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "identity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	// identity command configured for the device
+	helper := filepath.Join(tdir, "identity")
+	require.NoError(t, ioutil.WriteFile(helper, []byte(`#!/bin/sh
+echo mac=de:ad:be:ef:00:01
+echo serial_number=SN-0042
+echo imei=356938035643809
+echo interface=eth0
+echo interface=wlan0
+`), 0755))
+
+	config := menderConfig{IdentityCommand: helper}
+	ms := store.NewMemStore()
+	idSrc := NewIdentityDataGetter(config.GetIdentityCommand(),
+		config.GetStateScriptTimeout())
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore:  ms,
+		IdentitySource: idSrc,
+		KeyStore:       store.NewKeystore(ms, "key"),
+	})
+	require.NotNil(t, am)
+	require.NoError(t, am.GenerateKey())
+
+	req, err := am.MakeAuthRequest()
+	require.NoError(t, err)
+
+	var ard client.AuthReqData
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+
+	// every attribute printed by the command identifies the device
+	var id map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(ard.IdData), &id))
+	assert.Equal(t, map[string]interface{}{
+		"mac":           "de:ad:be:ef:00:01",
+		"serial_number": "SN-0042",
+		"imei":          "356938035643809",
+		"interface":     []interface{}{"eth0", "wlan0"},
+	}, id)
+
+	// the default command is used unless one is configured
+	assert.Equal(t, identityDataHelper, menderConfig{}.GetIdentityCommand())
+}
+
 func TestAuthManagerResponse(t *testing.T) {
 	ms := store.NewMemStore()
 
@@ -185,3 +241,82 @@ func TestAuthManagerResponse(t *testing.T) {
 	assert.Equal(t, []byte("fooresp"), tokdata)
 	assert.True(t, am.IsAuthorized())
 }
+
+func TestAuthManagerExternalSigner(t *testing.T) {
+	ms := store.NewMemStore()
+	cmdr := newTestOSCalls("mac=foobar", 0)
+
+	// the key is kept by the signer
+	ks := store.NewKeystore(store.NewMemStore(), "key")
+	require.NoError(t, ks.Generate())
+	pub, err := ks.PublicPEM()
+	require.NoError(t, err)
+
+	newManager := func(command []string, pubKey string) AuthManager {
+		return NewAuthManager(AuthManagerConfig{
+			AuthDataStore: ms,
+			IdentitySource: IdentityDataRunner{
+				cmdr: &cmdr,
+			},
+			KeyStore:           store.NewKeystore(ms, "key"),
+			TenantToken:        []byte("tenant"),
+			SignCommand:        command,
+			SignCommandTimeout: time.Second,
+			PublicKey:          pubKey,
+		})
+	}
+
+	// fake signer returning the digest of the data
+	am := newManager([]string{"sh", "-c",
+		`printf %s $(sha256sum | cut -d " " -f 1)`}, pub)
+	require.NotNil(t, am)
+
+	assert.True(t, am.HasKey())
+	assert.Error(t, am.GenerateKey())
+	fp, err := am.KeyFingerprint()
+	assert.NoError(t, err)
+	ksfp, _ := ks.Fingerprint()
+	assert.Equal(t, ksfp, fp)
+
+	req, err := am.MakeAuthRequest()
+	require.NoError(t, err)
+	sum := sha256.Sum256(req.Data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), string(req.Signature))
+
+	var ard client.AuthReqData
+	assert.NoError(t, json.Unmarshal(req.Data, &ard))
+	assert.Equal(t, pub, ard.Pubkey)
+
+	// signature is sent to the server
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Auth.Authorize = true
+	srv.Auth.Token = []byte("token")
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:   ms,
+				authMgr: am,
+			},
+		})
+	assert.Nil(t, mender.Authorize())
+	assert.Equal(t, req.Signature, srv.Auth.Signature)
+
+	// signer failing
+	am = newManager([]string{"false"}, pub)
+	require.NotNil(t, am)
+	_, err = am.MakeAuthRequest()
+	assert.Error(t, err)
+
+	// signer hanging; killed once the time is up
+	am = newManager([]string{"sleep", "10"}, pub)
+	require.NotNil(t, am)
+	start := time.Now()
+	_, err = am.MakeAuthRequest()
+	assert.Error(t, err)
+	assert.Equal(t, errCommandTimeout, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// public key not valid
+	assert.Nil(t, newManager([]string{"true"}, "not a key"))
+}
@@ -40,6 +40,9 @@ func (e *uBootEnv) ReadEnv(names ...string) (BootVars, error) {
 func (e *uBootEnv) WriteEnv(vars BootVars) error {
 	// Make environment update atomic by using fw_setenv "-s" option.
 	setEnvCmd := e.Command("fw_setenv", "-s", "-")
+	output := &commandOutput{}
+	setEnvCmd.Stdout = output
+	setEnvCmd.Stderr = output
 	pipe, err := setEnvCmd.StdinPipe()
 	if err != nil {
 		log.Errorln("Could not set up pipe to fw_setenv command: ", err)
@@ -62,6 +65,7 @@ func (e *uBootEnv) WriteEnv(vars BootVars) error {
 	pipe.Close()
 	err = setEnvCmd.Wait()
 	if err != nil {
+		err = commandError(err, "fw_setenv", output)
 		log.Errorln("fw_setenv returned failure: ", err)
 		return err
 	}
@@ -69,6 +73,8 @@ func (e *uBootEnv) WriteEnv(vars BootVars) error {
 }
 
 func getEnvironmentVariable(cmd *exec.Cmd) (BootVars, error) {
+	stderr := &commandOutput{}
+	cmd.Stderr = stderr
 	cmdReader, err := cmd.StdoutPipe()
 
 	if err != nil {
@@ -105,7 +111,7 @@ func getEnvironmentVariable(cmd *exec.Cmd) (BootVars, error) {
 
 	err = cmd.Wait()
 	if err != nil {
-		return nil, err
+		return nil, commandError(err, "fw_printenv", stderr)
 	}
 
 	if len(env_variables) > 0 {
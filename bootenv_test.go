@@ -13,7 +13,11 @@
 //    limitations under the License.
 package main
 
-import "testing"
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
 
 //if no config file is present
 //Cannot parse config file: No such file or directory
@@ -128,3 +132,39 @@ func Test_EnvRead_NonExisting_FailsReading(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// shellCommander runs the script in place of any command.
+type shellCommander struct {
+	script string
+}
+
+func (s shellCommander) Command(name string, arg ...string) *exec.Cmd {
+	return exec.Command("sh", "-c", s.script)
+}
+
+func Test_EnvWrite_OSResponseError_ReportsOutput(t *testing.T) {
+	fakeEnv := uBootEnv{shellCommander{
+		"cat > /dev/null; echo 'Cannot access MTD device /mnt/uboot.env' >&2; exit 1"}}
+	err := fakeEnv.WriteEnv(BootVars{"bootcnt": "3"})
+	if err == nil || !strings.Contains(err.Error(),
+		"fw_setenv failed: Cannot access MTD device /mnt/uboot.env") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fakeEnv = uBootEnv{shellCommander{
+		"echo 'Cannot access MTD device /mnt/uboot.env' >&2; exit 1"}}
+	_, err = fakeEnv.ReadEnv("bootcnt")
+	if err == nil || !strings.Contains(err.Error(),
+		"fw_printenv failed: Cannot access MTD device /mnt/uboot.env") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// only the beginning of long output is kept
+	fakeEnv = uBootEnv{shellCommander{
+		"cat > /dev/null; head -c 100000 /dev/zero | tr '\\0' x >&2; exit 1"}}
+	err = fakeEnv.WriteEnv(BootVars{"bootcnt": "3"})
+	if err == nil || len(err.Error()) > 2*maxCommandOutput ||
+		!strings.Contains(err.Error(), "[...]") {
+		t.Fatalf("unexpected error: %.100v", err)
+	}
+}
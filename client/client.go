@@ -18,9 +18,11 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -30,11 +32,31 @@ import (
 )
 
 const (
-	apiPrefix = "/api/devices/v1/"
+	// DefaultAPIVersion is the version of the device API used unless
+	// another one is configured
+	DefaultAPIVersion = "v1"
+
+	apiPrefix = "/api/devices/" + DefaultAPIVersion + "/"
 )
 
+// versions of the device API the client can talk to
+var apiVersions = []string{"v1", "v2"}
+
 var (
 	errorAddingServerCertificateToPool = errors.New("Error adding trusted server certificate to pool.")
+
+	// headers set by the client itself, which must not be overridden by
+	// the extra headers
+	reservedHeaders = []string{
+		"Authorization",
+		"Content-Encoding",
+		"Content-Length",
+		"Content-Type",
+		"Host",
+		"Range",
+		RequestIDHeader,
+		CorrelationIDHeader,
+	}
 )
 
 var (
@@ -58,6 +80,19 @@ var (
 
 	// connection keepalive options
 	connectionKeepaliveTime = 10 * time.Second
+
+	// how long establishing a connection to the server may take; much
+	// shorter than the timeout of the whole exchange, so that an unreachable
+	// server is given up on quickly
+	defaultConnectTimeout = 30 * time.Second
+
+	// DefaultMaxResponseSize is the default limit of the size of JSON
+	// responses read into memory; artifact downloads are not limited
+	DefaultMaxResponseSize int64 = 1024 * 1024
+
+	// ErrResponseTooLarge is returned when reading a response larger than
+	// allowed
+	ErrResponseTooLarge = errors.New("response body too large")
 )
 
 // Mender API Client wrapper. A standard http.Client is compatible with this
@@ -74,6 +109,199 @@ type RequestProcessingFunc func(response *http.Response) (interface{}, error)
 // wrapper for http.Client with additional methods
 type ApiClient struct {
 	http.Client
+	// headers added to every request
+	extraHeaders http.Header
+	// maximum size of JSON responses; zero for default
+	maxResponseSize int64
+	// version of the device API; empty for default
+	apiVersion string
+	// dialer of the connections to the server
+	dialer net.Dialer
+	// set once the server rejected a compressed request body; accessed
+	// atomically
+	compressionRejected int32
+}
+
+// SetExtraHeaders configures headers that are added to every request sent by
+// the client. Reserved headers, such as Authorization, are ignored.
+func (a *ApiClient) SetExtraHeaders(headers map[string]string) {
+	a.extraHeaders = http.Header{}
+	for name, value := range headers {
+		if isReservedHeader(name) {
+			log.Warnf("header %s can not be overridden; ignoring", name)
+			continue
+		}
+		a.extraHeaders.Set(name, value)
+	}
+}
+
+// SetMaxResponseSize limits the size of JSON responses read by the client, so
+// that a misbehaving server can not exhaust the memory of the device. Zero or
+// negative size restores the default limit.
+func (a *ApiClient) SetMaxResponseSize(size int64) {
+	a.maxResponseSize = size
+}
+
+// SetKeepAlive sets the period of TCP keep-alive probes sent on the
+// connections to the server. Zero restores the default period, negative
+// disables the probes.
+func (a *ApiClient) SetKeepAlive(period time.Duration) {
+	if period == 0 {
+		period = connectionKeepaliveTime
+	}
+	a.dialer.KeepAlive = period
+	a.setDialer()
+}
+
+// SetConnectTimeout limits how long establishing a connection to the server
+// may take, separately from the timeout of the whole request. Zero restores
+// the default timeout, negative disables it.
+func (a *ApiClient) SetConnectTimeout(timeout time.Duration) {
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	} else if timeout < 0 {
+		timeout = 0
+	}
+	a.dialer.Timeout = timeout
+	a.setDialer()
+}
+
+// setDialer makes the transport open the connections with the dialer
+// configured for the client.
+func (a *ApiClient) setDialer() {
+	if transport, ok := a.Client.Transport.(*http.Transport); ok {
+		dialer := a.dialer
+		transport.DialContext = dialer.DialContext
+	}
+}
+
+// SetIdleConnections configures the idle connections kept open for reuse by
+// the following requests, so that the connection, and the TLS session, is not
+// set up again for every poll of the server. Zero maximum number of
+// connections or timeout leaves the respective limit unset.
+func (a *ApiClient) SetIdleConnections(max int, timeout time.Duration) {
+	transport, ok := a.Client.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	transport.MaxIdleConns = max
+	if max > 0 {
+		transport.MaxIdleConnsPerHost = max
+	}
+	transport.IdleConnTimeout = timeout
+}
+
+// CheckAPIVersion returns an error if the client can not talk to the given
+// version of the device API. Empty version selects the default one.
+func CheckAPIVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	for _, v := range apiVersions {
+		if v == version {
+			return nil
+		}
+	}
+	return errors.Errorf("unsupported API version %q; supported versions: %s",
+		version, strings.Join(apiVersions, ", "))
+}
+
+// SetAPIVersion selects the version of the device API the requests are sent
+// to. Empty version restores the default one.
+func (a *ApiClient) SetAPIVersion(version string) error {
+	if err := CheckAPIVersion(version); err != nil {
+		return err
+	}
+	a.apiVersion = version
+	return nil
+}
+
+func (a *ApiClient) apiPrefix() string {
+	if a.apiVersion == "" {
+		return apiPrefix
+	}
+	return "/api/devices/" + a.apiVersion + "/"
+}
+
+// apiPathPrefix returns the path prefix of the device API of the version
+// configured for the API client, or of the default version for other
+// requesters.
+func apiPathPrefix(api ApiRequester) string {
+	switch a := api.(type) {
+	case *ApiClient:
+		return a.apiPrefix()
+	case *ApiRequest:
+		return a.api.apiPrefix()
+	default:
+		return apiPrefix
+	}
+}
+
+func (a *ApiClient) responseSizeLimit() int64 {
+	if a.maxResponseSize <= 0 {
+		return DefaultMaxResponseSize
+	}
+	return a.maxResponseSize
+}
+
+// responseSizeLimit returns the response size limit configured for the API
+// client, or the default one for other requesters.
+func responseSizeLimit(api ApiRequester) int64 {
+	switch a := api.(type) {
+	case *ApiClient:
+		return a.responseSizeLimit()
+	case *ApiRequest:
+		return a.api.responseSizeLimit()
+	}
+	return DefaultMaxResponseSize
+}
+
+// limitedBody is a response body failing with ErrResponseTooLarge once more
+// than limit bytes are read.
+type limitedBody struct {
+	io.Closer
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{
+		Closer: body,
+		// read one byte past the limit to tell if it was exceeded
+		r:     io.LimitReader(body, limit+1),
+		limit: limit,
+	}
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+func isReservedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, h := range reservedHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ApiClient) Do(req *http.Request) (*http.Response, error) {
+	setTracingHeaders(req)
+	log.Debugf("sending %s request %s", req.Method, req.Header.Get(RequestIDHeader))
+	for name, values := range a.extraHeaders {
+		if req.Header.Get(name) == "" {
+			req.Header[name] = values
+		}
+	}
+	return a.Client.Do(req)
 }
 
 // Return a new ApiRequest sharing this ApiClient helper
@@ -100,6 +328,34 @@ func (ar *ApiRequest) Do(req *http.Request) (*http.Response, error) {
 	return ar.api.Do(req)
 }
 
+// requestError adds the operation and the endpoint of a request to the server
+// to its error, along with the category of the failure. User info and query of
+// the URL are left out, as they may carry credentials, e.g. in pre-signed
+// artifact download links.
+func requestError(err error, op string, req *http.Request) error {
+	if err == nil {
+		return nil
+	}
+	category := requestErrorCategory(err)
+	if uerr, ok := err.(*url.Error); ok {
+		// the method and the complete URL would be repeated otherwise
+		err = uerr.Err
+	}
+	if req == nil {
+		return withCategory(errors.Wrapf(err, "%s request failed", op), category)
+	}
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	if id := req.Header.Get(RequestIDHeader); id != "" {
+		return withCategory(errors.Wrapf(err, "%s request to %s failed (request ID %s)",
+			op, u.String(), id), category)
+	}
+	return withCategory(errors.Wrapf(err, "%s request to %s failed", op, u.String()),
+		category)
+}
+
 func NewApiClient(conf Config) (*ApiClient, error) {
 	return New(conf)
 }
@@ -108,7 +364,7 @@ func NewApiClient(conf Config) (*ApiClient, error) {
 func New(conf Config) (*ApiClient, error) {
 
 	var client *http.Client
-	if conf == (Config{}) {
+	if conf.ServerCert == "" && !conf.IsHttps && !conf.NoVerify {
 		client = newHttpClient()
 	} else {
 		var err error
@@ -125,16 +381,29 @@ func New(conf Config) (*ApiClient, error) {
 	client.Timeout = defaultClientReadingTimeout
 
 	transport := client.Transport.(*http.Transport)
-	//set keepalive options
-	transport.DialContext = (&net.Dialer{
-		KeepAlive: connectionKeepaliveTime,
-	}).DialContext
+	//set keepalive and connect timeout options
+	api := &ApiClient{
+		dialer: net.Dialer{
+			KeepAlive: connectionKeepaliveTime,
+			Timeout:   defaultConnectTimeout,
+		},
+	}
+	transport.DialContext = api.dialer.DialContext
 
-	if err := http2.ConfigureTransport(transport); err != nil {
+	// connections negotiating an older TLS version are refused
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.MinVersion = conf.minTLSVersion()
+
+	if conf.DisableHTTP2 {
+		log.Debug("HTTP/2 is disabled")
+	} else if err := http2.ConfigureTransport(transport); err != nil {
 		log.Warnf("failed to enable HTTP/2 for client: %v", err)
 	}
 
-	return &ApiClient{*client}, nil
+	api.Client = *client
+	return api, nil
 }
 
 func newHttpClient() *http.Client {
@@ -170,6 +439,18 @@ type Config struct {
 	ServerCert string
 	IsHttps    bool
 	NoVerify   bool
+	// lowest TLS version accepted from the server, one of the tls.Version*
+	// constants; zero selects TLS 1.2
+	MinTLSVersion uint16
+	// use only HTTP/1.1, even if the server supports HTTP/2
+	DisableHTTP2 bool
+}
+
+func (c Config) minTLSVersion() uint16 {
+	if c.MinTLSVersion == 0 {
+		return tls.VersionTLS12
+	}
+	return c.MinTLSVersion
 }
 
 func loadServerTrust(conf Config) (*x509.CertPool, error) {
@@ -228,11 +509,14 @@ func buildURL(server string) string {
 	return "https://" + server
 }
 
-func buildApiURL(server, url string) string {
+// buildApiURL returns URL of the API endpoint, of the API version the requester
+// is configured for. If the server URL has a path component (the server is
+// behind a reverse proxy), the API path is appended to it.
+func buildApiURL(api ApiRequester, server, url string) string {
 	if strings.HasPrefix(url, "/") {
 		url = url[1:]
 	}
-	return buildURL(server) + apiPrefix + url
+	return strings.TrimRight(buildURL(server), "/") + apiPathPrefix(api) + url
 }
 
 // Normally one minute, but used in tests to lower the interval to avoid
@@ -42,12 +42,13 @@ func NewAuth() *AuthClient {
 	return &ac
 }
 
-func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMessenger) ([]byte, error) {
+func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMessenger) (_ []byte, err error) {
 
-	req, err := makeAuthRequest(server, dataSrc)
+	req, err := makeAuthRequest(api, server, dataSrc)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to build authorization request")
 	}
+	defer func() { err = requestError(err, "authorization", req) }()
 
 	log.Debugf("making authorization request to server %s with req: %s", server, req)
 	rsp, err := api.Do(req)
@@ -68,6 +69,14 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 				return nil, errors.Wrapf(err, "certificate signed by unknown authority")
 
 			case x509.CertificateInvalidError:
+				if now := time.Now(); isClockSkew(certErr, now) {
+					log.Errorf("Certificate is not valid at the current clock %s.", now)
+					log.Error("The clock on the device is most likely wrong; make sure " +
+						"it is set, e.g. with NTP, before the client connects to the server.")
+
+					return nil, errors.Wrapf(ErrClockNotSynced,
+						"certificate not valid at %s", now.Format(time.RFC3339))
+				}
 				switch certErr.Reason {
 				case x509.Expired:
 					log.Error("Certificate has expired or is not yet valid.")
@@ -86,8 +95,7 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 				log.Errorf("authorization request error: %v", certErr)
 			}
 		}
-		return nil, errors.Wrapf(err,
-			"generic error occured while executing authorization request")
+		return nil, err
 	}
 	defer rsp.Body.Close()
 
@@ -96,9 +104,11 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 	switch rsp.StatusCode {
 	case http.StatusUnauthorized:
 		return nil, AuthErrorUnauthorized
+	case http.StatusTooManyRequests:
+		return nil, newRateLimitError(rsp)
 	case http.StatusOK:
 		log.Debugf("receive response data")
-		data, err := ioutil.ReadAll(rsp.Body)
+		data, err := ioutil.ReadAll(newLimitedBody(rsp.Body, responseSizeLimit(api)))
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to receive authorization response data")
 		}
@@ -110,8 +120,8 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 	}
 }
 
-func makeAuthRequest(server string, dataSrc AuthDataMessenger) (*http.Request, error) {
-	url := buildApiURL(server, "/authentication/auth_requests")
+func makeAuthRequest(api ApiRequester, server string, dataSrc AuthDataMessenger) (*http.Request, error) {
+	url := buildApiURL(api, server, "/authentication/auth_requests")
 
 	req, err := dataSrc.MakeAuthRequest()
 	if err != nil {
@@ -52,13 +52,13 @@ func TestClientAuthMakeReq(t *testing.T) {
 	var req *http.Request
 	var err error
 
-	req, err = makeAuthRequest("foo", &testAuthDataMessenger{
+	req, err = makeAuthRequest(nil, "foo", &testAuthDataMessenger{
 		reqError: errors.New("req failed"),
 	})
 	assert.Nil(t, req)
 	assert.Error(t, err)
 
-	req, err = makeAuthRequest("mender.io", &testAuthDataMessenger{
+	req, err = makeAuthRequest(nil, "mender.io", &testAuthDataMessenger{
 		reqData: []byte("foobar data"),
 		code:    "tenanttoken",
 		sigData: []byte("foobar"),
@@ -98,7 +98,7 @@ func TestClientAuth(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -127,7 +127,7 @@ func TestClientAuthExpiredCert(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.expired.crt", true, false},
+		Config{ServerCert: "server.expired.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -150,7 +150,7 @@ func TestClientAuthUnknownAuthorityCert(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.unknown-authority.crt", true, false},
+		Config{ServerCert: "server.unknown-authority.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -173,7 +173,7 @@ func TestClientAuthNoCert(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.non-existing.crt", true, false},
+		Config{ServerCert: "server.non-existing.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.Nil(t, ac)
 	assert.Error(t, err)
@@ -0,0 +1,90 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// RemoteConfig is the configuration delivered by the server, letting operators
+// change the settings of the devices that may change at run time centrally.
+// Fields which are not set are left as configured on the device.
+type RemoteConfig struct {
+	UpdatePollIntervalSeconds    int `json:"update_poll_interval_seconds,omitempty"`
+	InventoryPollIntervalSeconds int `json:"inventory_poll_interval_seconds,omitempty"`
+	RetryPollIntervalSeconds     int `json:"retry_poll_interval_seconds,omitempty"`
+	// upper bound of the random delay of the first update check after
+	// start-up
+	StartupDelayMaxSeconds int `json:"startup_delay_max_seconds,omitempty"`
+	// one of the levels accepted by the -log-level option
+	LogLevel string `json:"log_level,omitempty"`
+}
+
+type ConfigFetcher interface {
+	// Fetch returns the configuration delivered by the server; nil if
+	// there is none
+	Fetch(ctx context.Context, api ApiRequester, server string) (*RemoteConfig, error)
+}
+
+type ConfigClient struct {
+}
+
+func NewConfig() ConfigFetcher {
+	return &ConfigClient{}
+}
+
+// Fetch requests the configuration of the device. Servers not delivering
+// configuration respond with 404 Not Found, or 204 No Content if there is no
+// configuration for the device.
+func (c *ConfigClient) Fetch(ctx context.Context, api ApiRequester,
+	server string) (_ *RemoteConfig, err error) {
+	req, err := http.NewRequest(http.MethodGet,
+		buildApiURL(api, server, "/deviceconfig/configuration"), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create configuration request")
+	}
+	req = req.WithContext(ctx)
+	defer func() { err = requestError(err, "configuration", req) }()
+
+	r, err := api.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		log.Debugf("no configuration delivered by the server")
+		return nil, nil
+	case http.StatusUnauthorized:
+		return nil, ErrNotAuthorized
+	case http.StatusTooManyRequests:
+		return nil, newRateLimitError(r)
+	default:
+		return nil, errors.Errorf("bad status %v", r.StatusCode)
+	}
+
+	var config RemoteConfig
+	body := newLimitedBody(r.Body, responseSizeLimit(api))
+	if err := json.NewDecoder(body).Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse configuration")
+	}
+	return &config, nil
+}
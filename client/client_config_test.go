@@ -0,0 +1,66 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFetch(t *testing.T) {
+	status := http.StatusOK
+	body := `{"update_poll_interval_seconds": 60, "log_level": "debug"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/api/devices/v1/deviceconfig/configuration", r.URL.Path)
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(body))
+		}
+	}))
+	defer ts.Close()
+
+	client := NewConfig()
+	config, err := client.Fetch(context.Background(), &http.Client{}, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, &RemoteConfig{
+		UpdatePollIntervalSeconds: 60,
+		LogLevel:                  "debug",
+	}, config)
+
+	// no configuration for the device, or not supported by the server
+	for _, status = range []int{http.StatusNoContent, http.StatusNotFound} {
+		config, err = client.Fetch(context.Background(), &http.Client{}, ts.URL)
+		assert.NoError(t, err)
+		assert.Nil(t, config)
+	}
+
+	status = http.StatusUnauthorized
+	_, err = client.Fetch(context.Background(), &http.Client{}, ts.URL)
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+
+	status = http.StatusInternalServerError
+	_, err = client.Fetch(context.Background(), &http.Client{}, ts.URL)
+	assert.Error(t, err)
+
+	status = http.StatusOK
+	body = "garbage"
+	_, err = client.Fetch(context.Background(), &http.Client{}, ts.URL)
+	assert.Error(t, err)
+}
@@ -14,8 +14,9 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/mendersoftware/log"
@@ -23,9 +24,21 @@ import (
 )
 
 type InventorySubmitter interface {
-	Submit(api ApiRequester, server string, data interface{}) error
+	Submit(ctx context.Context, api ApiRequester, server string, data interface{}) error
+	// SubmitVersioned submits the inventory as Submit does, returning the
+	// version the server accepted it as
+	SubmitVersioned(ctx context.Context, api ApiRequester, server string,
+		data interface{}) (string, error)
+	// Confirm asks the server whether it still holds the inventory of the
+	// given version, without sending it again
+	Confirm(ctx context.Context, api ApiRequester, server string, version string) error
 }
 
+// ErrInventoryResync is returned by Confirm if the server does not hold the
+// inventory of the version anymore, e.g. after it was restored from a backup;
+// the complete inventory must be submitted again.
+var ErrInventoryResync = errors.New("server requested a full inventory resync")
+
 type InventoryClient struct {
 }
 
@@ -33,38 +46,80 @@ func NewInventory() InventorySubmitter {
 	return &InventoryClient{}
 }
 
-// Submit reports status information to the backend
-func (i *InventoryClient) Submit(api ApiRequester, url string, data interface{}) error {
-	req, err := makeInventorySubmitRequest(url, data)
+// Submit reports status information to the backend. The request is aborted
+// once ctx is done.
+func (i *InventoryClient) Submit(ctx context.Context, api ApiRequester,
+	url string, data interface{}) error {
+	_, err := i.SubmitVersioned(ctx, api, url, data)
+	return err
+}
+
+// SubmitVersioned reports status information to the backend. The server
+// acknowledges the version of the inventory it accepted with the ETag of the
+// response; empty version is returned if it does not.
+func (i *InventoryClient) SubmitVersioned(ctx context.Context, api ApiRequester,
+	url string, data interface{}) (string, error) {
+	body, err := json.Marshal(&data)
 	if err != nil {
-		return errors.Wrapf(err, "failed to prepare inventory submit request")
+		return "", errors.Wrapf(err, "failed to prepare inventory submit request")
 	}
+	return submitInventory(ctx, api, url, body, "")
+}
 
-	r, err := api.Do(req)
+// Confirm sends an empty inventory update conditional on the server holding
+// the inventory of the version, i.e. with the version in the If-Match header.
+// Returns ErrInventoryResync if the server responds with 412 Precondition
+// Failed.
+func (i *InventoryClient) Confirm(ctx context.Context, api ApiRequester,
+	url string, version string) error {
+	_, err := submitInventory(ctx, api, url, []byte("[]"), version)
+	return err
+}
+
+func submitInventory(ctx context.Context, api ApiRequester, url string,
+	body []byte, ifMatch string) (_ string, err error) {
+	var sent *http.Request
+	defer func() { err = requestError(err, "inventory submit", sent) }()
+
+	r, err := doCompressed(api, body, func(body io.Reader) (*http.Request, error) {
+		req, err := makeInventorySubmitRequest(api, url, body)
+		if err != nil {
+			return nil, err
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		sent = req.WithContext(ctx)
+		return sent, nil
+	})
 	if err != nil {
 		log.Error("failed to submit inventory data: ", err)
-		return errors.Wrapf(err, "inventory submit failed")
+		return "", err
 	}
 
 	defer r.Body.Close()
 
-	if r.StatusCode != http.StatusOK {
+	switch {
+	case r.StatusCode == http.StatusUnauthorized:
+		log.Warn("client not authorized to submit inventory")
+		return "", ErrNotAuthorized
+	case r.StatusCode == http.StatusTooManyRequests:
+		return "", newRateLimitError(r)
+	case r.StatusCode == http.StatusPreconditionFailed && ifMatch != "":
+		return "", ErrInventoryResync
+	case r.StatusCode != http.StatusOK:
 		log.Errorf("got unexpected HTTP status when submitting to inventory: %v", r.StatusCode)
-		return errors.Errorf("inventory submit failed, bad status %v", r.StatusCode)
+		return "", errors.Errorf("bad status %v", r.StatusCode)
 	}
 	log.Debugf("inventory update sent, response %v", r)
 
-	return nil
+	return r.Header.Get("ETag"), nil
 }
 
-func makeInventorySubmitRequest(server string, data interface{}) (*http.Request, error) {
-	url := buildApiURL(server, "/inventory/device/attributes")
-
-	out := &bytes.Buffer{}
-	enc := json.NewEncoder(out)
-	enc.Encode(&data)
+func makeInventorySubmitRequest(api ApiRequester, server string, body io.Reader) (*http.Request, error) {
+	url := buildApiURL(api, server, "/inventory/device/attributes")
 
-	hreq, err := http.NewRequest(http.MethodPatch, url, out)
+	hreq, err := http.NewRequest(http.MethodPatch, url, body)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create inventory HTTP request")
 	}
@@ -14,6 +14,7 @@
 package client
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -44,7 +45,7 @@ func TestInventoryClient(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -52,14 +53,14 @@ func TestInventoryClient(t *testing.T) {
 	client := NewInventory()
 	assert.NotNil(t, client)
 
-	err = client.Submit(NewMockApiClient(nil, errors.New("foo")),
+	err = client.Submit(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		ts.URL,
 		InventoryData{
 			{"foo", "bar"},
 		})
 	assert.Error(t, err)
 
-	err = client.Submit(ac, ts.URL, InventoryData{
+	err = client.Submit(context.Background(), ac, ts.URL, InventoryData{
 		{"foo", "bar"},
 		{"bar", []string{"baz", "zen"}},
 	})
@@ -71,6 +72,36 @@ func TestInventoryClient(t *testing.T) {
 	assert.Equal(t, apiPrefix+"inventory/device/attributes", responder.path)
 
 	responder.httpStatus = 401
-	err = client.Submit(ac, ts.URL, nil)
+	err = client.Submit(context.Background(), ac, ts.URL, nil)
 	assert.Error(t, err)
 }
+
+func TestInventoryConfirm(t *testing.T) {
+	version := ""
+	var ifMatch []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		if v := r.Header.Get("If-Match"); v != "" && v != version {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		version = "v1"
+		w.Header().Set("ETag", version)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	client := NewInventory()
+	v, err := client.SubmitVersioned(context.Background(), &http.Client{}, ts.URL,
+		InventoryData{{"foo", "bar"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", v)
+
+	assert.NoError(t, client.Confirm(context.Background(), &http.Client{}, ts.URL, v))
+
+	// the server lost the inventory
+	version = ""
+	err = client.Confirm(context.Background(), &http.Client{}, ts.URL, v)
+	assert.Equal(t, ErrInventoryResync, errors.Cause(err))
+	assert.Equal(t, []string{"", "v1", "v1"}, ifMatch)
+}
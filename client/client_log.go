@@ -14,8 +14,8 @@
 package client
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/mendersoftware/log"
@@ -39,40 +39,50 @@ func NewLog() LogUploader {
 }
 
 // Report status information to the backend
-func (u *LogUploadClient) Upload(api ApiRequester, url string, logs LogData) error {
-	req, err := makeLogUploadRequest(url, &logs)
-	if err != nil {
-		return errors.Wrapf(err, "failed to prepare log upload request")
-	}
+func (u *LogUploadClient) Upload(api ApiRequester, url string, logs LogData) (err error) {
+	var sent *http.Request
+	defer func() { err = requestError(err, "log upload", sent) }()
 
-	r, err := api.Do(req)
+	r, err := doCompressed(api, logs.Messages, func(body io.Reader) (*http.Request, error) {
+		req, err := makeLogUploadRequest(api, url, logs.DeploymentID, body)
+		sent = req
+		return req, err
+	})
 	if err != nil {
 		log.Error("failed to upload logs: ", err)
-		return errors.Wrapf(err, "uploading logs failed")
+		return err
 	}
 
 	defer r.Body.Close()
 
 	// HTTP 204 No Content
-	if r.StatusCode != http.StatusNoContent {
+	switch {
+	case r.StatusCode == http.StatusUnauthorized:
+		log.Warn("client not authorized to upload logs")
+		return ErrNotAuthorized
+	case r.StatusCode == http.StatusTooManyRequests:
+		return newRateLimitError(r)
+	case r.StatusCode != http.StatusNoContent:
 		log.Errorf("got unexpected HTTP status when uploading log: %v", r.StatusCode)
-		return errors.Errorf("uploading logs failed, bad status %v", r.StatusCode)
+		return errors.Errorf("bad status %v", r.StatusCode)
 	}
 	log.Debugf("logs uploaded, response %v", r)
 
 	return nil
 }
 
-func makeLogUploadRequest(server string, logs *LogData) (*http.Request, error) {
+func makeLogUploadRequest(api ApiRequester, server string, deploymentID string,
+	body io.Reader) (*http.Request, error) {
 	path := fmt.Sprintf("/deployments/device/deployments/%s/log",
-		logs.DeploymentID)
-	url := buildApiURL(server, path)
+		deploymentID)
+	url := buildApiURL(api, server, path)
 
-	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(logs.Messages))
+	hreq, err := http.NewRequest(http.MethodPut, url, body)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create log sending HTTP request")
 	}
 
 	hreq.Header.Add("Content-Type", "application/json")
+	setCorrelationID(hreq, deploymentID)
 	return hreq, nil
 }
@@ -32,6 +32,14 @@ const (
 	StatusAlreadyInstalled = "already-installed"
 )
 
+// Sources of the installed artifact, sent along with the status reports.
+const (
+	// SourceRemote is an artifact downloaded from the server
+	SourceRemote = "remote"
+	// SourceLocal is an artifact read from local media
+	SourceLocal = "local"
+)
+
 var (
 	ErrDeploymentAborted = errors.New("deployment was aborted")
 )
@@ -44,6 +52,12 @@ type StatusReport struct {
 	DeploymentID string `json:"-"`
 	Status       string `json:"status"`
 	SubState     string `json:"substate,omitempty"`
+	// artifact installed before the update; sent along with the success
+	// report
+	PreviousArtifactName string `json:"previous_artifact_name,omitempty"`
+	// where the artifact is installed from; one of SourceRemote and
+	// SourceLocal
+	Source string `json:"source,omitempty"`
 }
 
 // StatusReportWrapper holds the data that is passed to the
@@ -63,16 +77,17 @@ func NewStatus() StatusReporter {
 }
 
 // Report status information to the backend
-func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport) error {
-	req, err := makeStatusReportRequest(url, report)
+func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport) (err error) {
+	req, err := makeStatusReportRequest(api, url, report)
 	if err != nil {
 		return errors.Wrapf(err, "failed to prepare status report request")
 	}
+	defer func() { err = requestError(err, "status report", req) }()
 
 	r, err := api.Do(req)
 	if err != nil {
 		log.Error("failed to report status: ", err)
-		return errors.Wrapf(err, "reporting status failed")
+		return err
 	}
 
 	defer r.Body.Close()
@@ -82,9 +97,14 @@ func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport)
 	case r.StatusCode == http.StatusConflict:
 		log.Warnf("status report rejected, deployment aborted at the backend")
 		return ErrDeploymentAborted
+	case r.StatusCode == http.StatusUnauthorized:
+		log.Warn("client not authorized to report status")
+		return ErrNotAuthorized
+	case r.StatusCode == http.StatusTooManyRequests:
+		return newRateLimitError(r)
 	case r.StatusCode != http.StatusNoContent:
 		log.Errorf("got unexpected HTTP status when reporting status: %v", r.StatusCode)
-		return errors.Errorf("reporting status failed, bad status %v", r.StatusCode)
+		return errors.Errorf("bad status %v", r.StatusCode)
 	}
 
 	log.Debugf("status reported, response %v", r)
@@ -92,10 +112,10 @@ func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport)
 	return nil
 }
 
-func makeStatusReportRequest(server string, report StatusReport) (*http.Request, error) {
+func makeStatusReportRequest(api ApiRequester, server string, report StatusReport) (*http.Request, error) {
 	path := fmt.Sprintf("/deployments/device/deployments/%s/status",
 		report.DeploymentID)
-	url := buildApiURL(server, path)
+	url := buildApiURL(api, server, path)
 
 	out := &bytes.Buffer{}
 	enc := json.NewEncoder(out)
@@ -107,5 +127,6 @@ func makeStatusReportRequest(server string, report StatusReport) (*http.Request,
 	}
 
 	hreq.Header.Add("Content-Type", "application/json")
+	setCorrelationID(hreq, report.DeploymentID)
 	return hreq, nil
 }
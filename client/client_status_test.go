@@ -44,7 +44,7 @@ func TestStatusClient(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -59,7 +59,7 @@ func TestStatusClient(t *testing.T) {
 			Status:       StatusFailure,
 		})
 	assert.Error(t, err)
-	assert.NotEqual(t, err, ErrDeploymentAborted)
+	assert.NotEqual(t, ErrDeploymentAborted, errors.Cause(err))
 
 	err = client.Report(ac, ts.URL, StatusReport{
 		DeploymentID: "deployment1",
@@ -75,13 +75,12 @@ func TestStatusClient(t *testing.T) {
 		DeploymentID: "deployment1",
 		Status:       StatusSuccess,
 	})
-	assert.Error(t, err)
-	assert.NotEqual(t, err, ErrDeploymentAborted)
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
 
 	responder.httpStatus = http.StatusConflict
 	err = client.Report(ac, ts.URL, StatusReport{
 		DeploymentID: "deployment1",
 		Status:       StatusSuccess,
 	})
-	assert.Equal(t, err, ErrDeploymentAborted)
+	assert.Equal(t, ErrDeploymentAborted, errors.Cause(err))
 }
@@ -14,12 +14,16 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/mendersoftware/log"
 	"github.com/pkg/errors"
@@ -30,14 +34,32 @@ const (
 )
 
 type Updater interface {
-	GetScheduledUpdate(api ApiRequester, server string, current CurrentUpdate) (interface{}, error)
-	FetchUpdate(api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error)
+	GetScheduledUpdate(ctx context.Context, api ApiRequester, server string,
+		current CurrentUpdate) (interface{}, CacheValidators, error)
+	FetchUpdate(ctx context.Context, api ApiRequester, url string,
+		retry DownloadRetryPolicy) (io.ReadCloser, int64, error)
+	FetchUpdateFrom(ctx context.Context, api ApiRequester, url string,
+		offset int64) (io.ReadCloser, int64, error)
 }
 
 var (
 	ErrNotAuthorized = errors.New("client not authorized")
+
+	// ErrResumeNotSupported is returned if the server can not send the
+	// update starting at the requested offset
+	ErrResumeNotSupported = errors.New("server does not support resuming downloads")
+
+	// ErrUpdateGone is returned if the update can not be downloaded as it
+	// is not found on the server; there is no point in retrying
+	ErrUpdateGone = errors.New("update not available for download")
 )
 
+// updateGone tells if the response status means the update can not be
+// downloaded any more, e.g. it was removed or the link has expired.
+func updateGone(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone
+}
+
 type UpdateClient struct {
 	minImageSize int64
 }
@@ -54,50 +76,87 @@ func NewUpdate() *UpdateClient {
 type CurrentUpdate struct {
 	Artifact   string
 	DeviceType string
+	// validators of the previous update check response; the server responds
+	// with 304 Not Modified if nothing changed since
+	Validators CacheValidators
 }
 
-func (u *UpdateClient) GetScheduledUpdate(api ApiRequester, server string,
-	current CurrentUpdate) (interface{}, error) {
+// CacheValidators identify the version of the update check response.
+type CacheValidators struct {
+	ETag         string
+	LastModified string
+}
 
-	return u.getUpdateInfo(api, processUpdateResponse, server, current)
+// GetScheduledUpdate asks the server for the next update. The request is
+// aborted once ctx is done. Returns the validators of the response, to be
+// passed in CurrentUpdate with the next update check; no update is returned if
+// the response has not been modified since.
+func (u *UpdateClient) GetScheduledUpdate(ctx context.Context, api ApiRequester,
+	server string, current CurrentUpdate) (interface{}, CacheValidators, error) {
+
+	var validators CacheValidators
+	process := func(r *http.Response) (interface{}, error) {
+		validators = CacheValidators{
+			ETag:         r.Header.Get("ETag"),
+			LastModified: r.Header.Get("Last-Modified"),
+		}
+		return processUpdateResponse(r)
+	}
+	data, err := u.getUpdateInfo(ctx, api, process, server, current)
+	return data, validators, err
 }
 
-func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessingFunc,
-	server string, current CurrentUpdate) (interface{}, error) {
-	req, err := makeUpdateCheckRequest(server, current)
+func (u *UpdateClient) getUpdateInfo(ctx context.Context, api ApiRequester,
+	process RequestProcessingFunc, server string,
+	current CurrentUpdate) (data interface{}, err error) {
+	req, err := makeUpdateCheckRequest(api, server, current)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create update check request")
 	}
+	req = req.WithContext(ctx)
+	defer func() { err = requestError(err, "update check", req) }()
 
 	r, err := api.Do(req)
 
 	if err != nil {
 		log.Debug("Sending request error: ", err)
-		return nil, errors.Wrapf(err, "update check request failed")
+		return nil, err
 	}
 
 	defer r.Body.Close()
 
-	data, err := process(r)
-	return data, err
+	r.Body = newLimitedBody(r.Body, responseSizeLimit(api))
+	return process(r)
 }
 
 // FetchUpdate returns a byte stream which is a download of the given link.
-func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error) {
+// The download, including reading the stream, is aborted once ctx is done. If
+// the connection breaks the download is resumed where it stopped according to
+// the retry policy.
+func (u *UpdateClient) FetchUpdate(ctx context.Context, api ApiRequester, url string,
+	retry DownloadRetryPolicy) (_ io.ReadCloser, _ int64, err error) {
 	req, err := makeUpdateFetchRequest(url)
 	if err != nil {
 		return nil, -1, errors.Wrapf(err, "failed to create update fetch request")
 	}
+	req = req.WithContext(ctx)
+	defer func() { err = requestError(err, "update fetch", req) }()
 
 	r, err := api.Do(req)
 	if err != nil {
 		log.Error("Can not fetch update image: ", err)
-		return nil, -1, errors.Wrapf(err, "update fetch request failed")
+		return nil, -1, err
 	}
 
 	log.Debugf("Received fetch update response %v+", r)
 
-	if r.StatusCode != http.StatusOK {
+	if r.StatusCode == http.StatusTooManyRequests {
+		r.Body.Close()
+		return nil, -1, newRateLimitError(r)
+	} else if updateGone(r.StatusCode) {
+		r.Body.Close()
+		return nil, -1, errors.Wrapf(ErrUpdateGone, "update fetch failed: %s", r.Status)
+	} else if r.StatusCode != http.StatusOK {
 		r.Body.Close()
 		log.Errorf("Error fetching shcheduled update info: code (%d)", r.StatusCode)
 		return nil, -1, errors.New("Error receiving scheduled update information.")
@@ -112,7 +171,82 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Du
 		return nil, -1, errors.New("Image size is smaller than expected. Aborting.")
 	}
 
-	return NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req), r.ContentLength, nil
+	return NewUpdateResumer(r.Body, r.ContentLength, retry, api, req), r.ContentLength, nil
+}
+
+// FetchUpdateFrom resumes the download of the update interrupted at the given
+// offset. Returns the stream of the remaining data and the size of the whole
+// update.
+func (u *UpdateClient) FetchUpdateFrom(ctx context.Context, api ApiRequester,
+	url string, offset int64) (_ io.ReadCloser, _ int64, err error) {
+	req, err := makeUpdateFetchRequest(url)
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "failed to create update fetch request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	defer func() { err = requestError(err, "update fetch", req) }()
+
+	r, err := api.Do(req)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusTooManyRequests:
+		r.Body.Close()
+		return nil, -1, newRateLimitError(r)
+	case http.StatusOK:
+		// range was ignored, the whole update is sent
+		r.Body.Close()
+		return nil, -1, ErrResumeNotSupported
+	case http.StatusNotFound, http.StatusGone:
+		r.Body.Close()
+		return nil, -1, errors.Wrapf(ErrUpdateGone,
+			"failed to resume update download: %s", r.Status)
+	default:
+		r.Body.Close()
+		return nil, -1, errors.Errorf("failed to resume update download: %s", r.Status)
+	}
+
+	start, size, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		r.Body.Close()
+		return nil, -1, err
+	}
+	if start != offset || size < 0 {
+		r.Body.Close()
+		return nil, -1, errors.Wrapf(ErrResumeNotSupported,
+			"unexpected range %q", r.Header.Get("Content-Range"))
+	}
+
+	return r.Body, size, nil
+}
+
+// parseContentRange parses the Content-Range header, returning the offset the
+// content starts at and the complete size, or -1 if it is not known.
+func parseContentRange(value string) (int64, int64, error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return -1, -1, errors.Errorf("invalid content range %q", value)
+	}
+	rangeAndSize := strings.SplitN(strings.TrimPrefix(value, "bytes "), "/", 2)
+	if len(rangeAndSize) != 2 {
+		return -1, -1, errors.Errorf("invalid content range %q", value)
+	}
+	startAndEnd := strings.SplitN(rangeAndSize[0], "-", 2)
+	start, err := strconv.ParseInt(startAndEnd[0], 10, 64)
+	if err != nil || len(startAndEnd) != 2 {
+		return -1, -1, errors.Errorf("invalid content range %q", value)
+	}
+	if rangeAndSize[1] == "*" {
+		return start, -1, nil
+	}
+	size, err := strconv.ParseInt(rangeAndSize[1], 10, 64)
+	if err != nil {
+		return -1, -1, errors.Errorf("invalid content range %q", value)
+	}
+	return start, size, nil
 }
 
 // have update for the client
@@ -121,11 +255,35 @@ type UpdateResponse struct {
 		Source struct {
 			URI    string
 			Expire string
+			// hex encoded SHA256 checksum of the artifact, if
+			// known to the server
+			Checksum string `json:"checksum,omitempty"`
 		}
 		CompatibleDevices []string `json:"device_types_compatible"`
 		ArtifactName      string   `json:"artifact_name"`
 	}
-	ID string
+	// optional delta update; applicable only if the device has the base
+	// artifact installed
+	Delta *DeltaSource `json:"delta,omitempty"`
+	// custom key/value meta-data attached to the deployment, passed on to
+	// the state scripts
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// poll interval requested for the duration of the deployment, e.g. to
+	// poll faster during an urgent one
+	PollIntervalSeconds int `json:"poll_interval_seconds,omitempty"`
+	// oldest version of the client the update can be installed with, e.g.
+	// if the artifact relies on features of newer clients
+	MinClientVersion string `json:"min_client_version,omitempty"`
+	// further updates of the chain offered by the server, installed in order
+	// once this one succeeds
+	Next []UpdateResponse `json:"next,omitempty"`
+	ID   string
+}
+
+type DeltaSource struct {
+	BaseArtifactName string `json:"base_artifact_name"`
+	URI              string
+	Expire           string
 }
 
 func (ur UpdateResponse) CompatibleDevices() []string {
@@ -140,6 +298,21 @@ func (ur UpdateResponse) URI() string {
 	return ur.Artifact.Source.URI
 }
 
+// Checksum returns the hex encoded SHA256 checksum of the artifact advertised
+// by the server, or an empty string.
+func (ur UpdateResponse) Checksum() string {
+	return ur.Artifact.Source.Checksum
+}
+
+// DeltaURI returns the URI of the delta update if the delta can be applied to
+// the given artifact, otherwise the URI of the full update.
+func (ur UpdateResponse) DeltaURI(artifactName string) string {
+	if d := ur.Delta; d != nil && d.BaseArtifactName == artifactName {
+		return d.URI
+	}
+	return ur.URI()
+}
+
 func validateGetUpdate(update UpdateResponse) error {
 	// check if we have JSON data correctly decoded
 	if update.ID == "" ||
@@ -168,6 +341,11 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 	case http.StatusOK:
 		log.Debug("Have update available")
 
+		// the server must use 204 No Content if there is no update
+		if len(bytes.TrimSpace(respBody)) == 0 {
+			return nil, errors.New("empty update response")
+		}
+
 		var data UpdateResponse
 		if err := json.Unmarshal(respBody, &data); err != nil {
 			return nil, errors.Wrapf(err, "failed to parse response")
@@ -183,17 +361,24 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 		log.Debug("No update available")
 		return nil, nil
 
+	case http.StatusNotModified:
+		log.Debug("Update check response not modified; no new update")
+		return nil, nil
+
 	case http.StatusUnauthorized:
 		log.Warn("Client not authorized to get update schedule.")
 		return nil, ErrNotAuthorized
 
+	case http.StatusTooManyRequests:
+		return nil, newRateLimitError(response)
+
 	default:
 		log.Warn("Client recieved invalid response status code: ", response.StatusCode)
 		return nil, errors.New("Invalid response received from server")
 	}
 }
 
-func makeUpdateCheckRequest(server string, current CurrentUpdate) (*http.Request, error) {
+func makeUpdateCheckRequest(api ApiRequester, server string, current CurrentUpdate) (*http.Request, error) {
 	vals := url.Values{}
 	if current.DeviceType != "" {
 		vals.Add("device_type", current.DeviceType)
@@ -206,11 +391,17 @@ func makeUpdateCheckRequest(server string, current CurrentUpdate) (*http.Request
 	if len(vals) != 0 {
 		ep = ep + "?" + vals.Encode()
 	}
-	url := buildApiURL(server, ep)
+	url := buildApiURL(api, server, ep)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if current.Validators.ETag != "" {
+		req.Header.Set("If-None-Match", current.Validators.ETag)
+	}
+	if current.Validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", current.Validators.LastModified)
+	}
 	return req, nil
 }
 
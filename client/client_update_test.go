@@ -14,15 +14,19 @@
 package client
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -116,6 +120,7 @@ var updateTest = []struct {
 	{200, []byte(correctUpdateResponseMultipleDevices), false, true, http.StatusOK},
 	{200, []byte(updateResponseEmptyDevices), true, false, 0},
 	{204, []byte(""), false, true, http.StatusNoContent},
+	{304, []byte(""), false, true, http.StatusNotModified},
 	{404, []byte(`{
 	 "error": "Not found"
 	 }`), true, true, http.StatusNotFound},
@@ -175,7 +180,7 @@ func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -185,7 +190,7 @@ func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 
 	fakeProcessUpdate := func(response *http.Response) (interface{}, error) { return nil, errors.New("") }
 
-	_, err = client.getUpdateInfo(ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
+	_, err = client.getUpdateInfo(context.Background(), ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
 	assert.Error(t, err)
 }
 
@@ -200,7 +205,7 @@ func Test_GetScheduledUpdate_responseMissingParameters_UpdateFailing(t *testing.
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -209,7 +214,7 @@ func Test_GetScheduledUpdate_responseMissingParameters_UpdateFailing(t *testing.
 	assert.NotNil(t, client)
 	fakeProcessUpdate := func(response *http.Response) (interface{}, error) { return nil, nil }
 
-	_, err = client.getUpdateInfo(ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
+	_, err = client.getUpdateInfo(context.Background(), ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
 	assert.NoError(t, err)
 }
 
@@ -224,7 +229,7 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -232,7 +237,7 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	data, err := client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{})
+	data, _, err := client.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
 	assert.NoError(t, err)
 	update, ok := data.(UpdateResponse)
 	assert.True(t, ok)
@@ -250,7 +255,7 @@ func Test_FetchUpdate_noContent_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -258,7 +263,8 @@ func Test_FetchUpdate_noContent_UpdateFailing(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL,
+		DownloadRetryPolicy{MaxWait: time.Minute})
 	assert.Error(t, err)
 }
 
@@ -273,7 +279,7 @@ func Test_FetchUpdate_invalidRequest_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -281,7 +287,8 @@ func Test_FetchUpdate_invalidRequest_UpdateFailing(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	_, _, err = client.FetchUpdate(ac, "broken-request", 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), ac, "broken-request",
+		DownloadRetryPolicy{MaxWait: time.Minute})
 	assert.Error(t, err)
 }
 
@@ -296,7 +303,7 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -305,24 +312,25 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	assert.NotNil(t, client)
 	client.minImageSize = 1
 
-	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL,
+		DownloadRetryPolicy{MaxWait: time.Minute})
 	assert.NoError(t, err)
 }
 
 func Test_UpdateApiClientError(t *testing.T) {
 	client := NewUpdate()
 
-	_, err := client.GetScheduledUpdate(NewMockApiClient(nil, errors.New("foo")),
+	_, _, err := client.GetScheduledUpdate(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		"http://foo.bar", CurrentUpdate{})
 	assert.Error(t, err)
 
-	_, _, err = client.FetchUpdate(NewMockApiClient(nil, errors.New("foo")),
-		"http://foo.bar", 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), NewMockApiClient(nil, errors.New("foo")),
+		"http://foo.bar", DownloadRetryPolicy{MaxWait: time.Minute})
 	assert.Error(t, err)
 }
 
 func TestMakeUpdateCheckRequest(t *testing.T) {
-	req, err := makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{})
+	req, err := makeUpdateCheckRequest(nil, "http://foo.bar", CurrentUpdate{})
 	assert.NotNil(t, req)
 	assert.NoError(t, err)
 
@@ -330,7 +338,7 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
 
-	req, err = makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{
+	req, err = makeUpdateCheckRequest(nil, "http://foo.bar", CurrentUpdate{
 		Artifact: "foo",
 	})
 	assert.NotNil(t, req)
@@ -340,7 +348,7 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
 
-	req, err = makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{
+	req, err = makeUpdateCheckRequest(nil, "http://foo.bar", CurrentUpdate{
 		Artifact:   "foo",
 		DeviceType: "hammer",
 	})
@@ -350,4 +358,309 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 	assert.Equal(t, "http://foo.bar/api/devices/v1/deployments/device/deployments/next?artifact_name=foo&device_type=hammer",
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
+	assert.Empty(t, req.Header.Get("If-None-Match"))
+	assert.Empty(t, req.Header.Get("If-Modified-Since"))
+
+	req, err = makeUpdateCheckRequest(nil, "http://foo.bar", CurrentUpdate{
+		Artifact: "foo",
+		Validators: CacheValidators{
+			ETag:         `"abc"`,
+			LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `"abc"`, req.Header.Get("If-None-Match"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", req.Header.Get("If-Modified-Since"))
+}
+
+func TestUpdateResponseDeltaURI(t *testing.T) {
+	var update UpdateResponse
+	err := json.Unmarshal([]byte(`{
+	"id": "deployment-123",
+	"artifact": {
+		"artifact_name": "release-2",
+		"device_types_compatible": ["BBB"],
+		"source": {
+			"uri": "https://menderupdate.com/full"
+		}
+	},
+	"delta": {
+		"base_artifact_name": "release-1",
+		"uri": "https://menderupdate.com/delta"
+	}
+}`), &update)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "https://menderupdate.com/delta", update.DeltaURI("release-1"))
+	// delta can not be applied; use full update
+	assert.Equal(t, "https://menderupdate.com/full", update.DeltaURI("release-0"))
+
+	update.Delta = nil
+	assert.Equal(t, "https://menderupdate.com/full", update.DeltaURI("release-1"))
+}
+
+func TestFetchUpdateFrom(t *testing.T) {
+	content := "some content to be fetched"
+	ignoreRange := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "artifact.mender", time.Time{},
+			strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "", IsHttps: true, NoVerify: false},
+	)
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	body, size, err := client.FetchUpdateFrom(context.Background(), ac, ts.URL, 5)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(content), size)
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content[5:], string(data))
+
+	// server sends the whole update
+	ignoreRange = true
+	_, _, err = client.FetchUpdateFrom(context.Background(), ac, ts.URL, 5)
+	assert.Equal(t, ErrResumeNotSupported, errors.Cause(err))
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, size, err := parseContentRange("bytes 5-25/26")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, start)
+	assert.EqualValues(t, 26, size)
+
+	start, size, err = parseContentRange("bytes 5-25/*")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, start)
+	assert.EqualValues(t, -1, size)
+
+	for _, value := range []string{"", "bytes */26", "bytes 5-25", "items 5-25/26"} {
+		_, _, err = parseContentRange(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestFetchUpdateCancel(t *testing.T) {
+	sent := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8192")
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		close(sent)
+		// stall the download
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "", IsHttps: true, NoVerify: false},
+	)
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, size, err := client.FetchUpdate(ctx, ac, ts.URL,
+		DownloadRetryPolicy{MaxWait: time.Minute})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 8192, size)
+	defer body.Close()
+
+	<-sent
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = ioutil.ReadAll(body)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestFetchUpdateResume(t *testing.T) {
+	data := []byte(strings.Repeat("mender artifact data ", 1000))
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		offset := 0
+		if r.Header.Get("Range") != "" {
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+			w.Header().Set("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.WriteHeader(http.StatusOK)
+		}
+		if len(ranges) > 2 {
+			w.Write(data[offset:])
+			return
+		}
+		// break the connection after a part of the data
+		w.Write(data[offset : offset+5000])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		assert.NoError(t, err)
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	retry := DownloadRetryPolicy{
+		MaxAttempts: 2,
+		InitialWait: time.Millisecond,
+		MaxWait:     10 * time.Millisecond,
+	}
+	body, size, err := NewUpdate().FetchUpdate(context.Background(), ac, ts.URL, retry)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), size)
+	defer body.Close()
+
+	received, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+	assert.Equal(t, []string{"", "bytes=5000-", "bytes=10000-"}, ranges)
+
+	// the download is not resumed more times than allowed
+	ranges = nil
+	retry.MaxAttempts = 1
+	body, _, err = NewUpdate().FetchUpdate(context.Background(), ac, ts.URL, retry)
+	assert.NoError(t, err)
+	defer body.Close()
+	_, err = ioutil.ReadAll(body)
+	assert.Error(t, err)
+	assert.Len(t, ranges, 2)
+}
+
+func TestFetchUpdateReconnect(t *testing.T) {
+	const drops = 4
+	data := []byte(strings.Repeat("mender artifact data ", 1000))
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		offset := 0
+		if r.Header.Get("Range") != "" {
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+			w.Header().Set("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.WriteHeader(http.StatusOK)
+		}
+		if n > drops {
+			w.Write(data[offset:])
+			return
+		}
+		// drop the connection after a part of the data
+		w.Write(data[offset : offset+2000])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		assert.NoError(t, err)
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	// a single attempt per reconnect
+	retry := DownloadRetryPolicy{
+		MaxAttempts:   1,
+		MaxReconnects: drops,
+		InitialWait:   time.Millisecond,
+	}
+	body, _, err := NewUpdate().FetchUpdate(context.Background(), ac, ts.URL, retry)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	// the reader sees a single uninterrupted stream
+	received, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+	assert.EqualValues(t, drops+1, atomic.LoadInt32(&requests))
+
+	// the connection breaking once more than allowed fails the download
+	atomic.StoreInt32(&requests, 0)
+	retry.MaxReconnects = drops - 1
+	body, _, err = NewUpdate().FetchUpdate(context.Background(), ac, ts.URL, retry)
+	assert.NoError(t, err)
+	defer body.Close()
+	_, err = ioutil.ReadAll(body)
+	assert.Equal(t, ErrReconnectsExhausted, errors.Cause(err))
+	assert.EqualValues(t, drops, atomic.LoadInt32(&requests))
+}
+
+func TestFetchUpdateGone(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Range") != "" || r.URL.Path == "/removed" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Length", "8192")
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 4096))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		assert.NoError(t, err)
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	retry := DownloadRetryPolicy{InitialWait: time.Millisecond}
+
+	_, _, err = NewUpdate().FetchUpdate(context.Background(), ac, ts.URL+"/removed", retry)
+	assert.Equal(t, ErrUpdateGone, errors.Cause(err))
+
+	// the update removed during the download is not retried
+	requests = 0
+	body, _, err := NewUpdate().FetchUpdate(context.Background(), ac, ts.URL, retry)
+	assert.NoError(t, err)
+	defer body.Close()
+	_, err = ioutil.ReadAll(body)
+	assert.Equal(t, ErrUpdateGone, errors.Cause(err))
+	assert.Equal(t, 2, requests)
+
+	_, _, err = NewUpdate().FetchUpdateFrom(context.Background(), ac, ts.URL, 10)
+	assert.Equal(t, ErrUpdateGone, errors.Cause(err))
+}
+
+func TestDownloadRetryPolicy(t *testing.T) {
+	retry := DownloadRetryPolicy{
+		MaxAttempts: 5,
+		InitialWait: time.Second,
+		MaxWait:     5 * time.Second,
+	}
+	for tried, expected := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	} {
+		wait, err := retry.backoff(tried)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, wait)
+	}
+	_, err := retry.backoff(5)
+	assert.Error(t, err)
+
+	// the default backoff
+	retry = DownloadRetryPolicy{MaxWait: time.Minute}
+	wait, err := retry.backoff(0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, wait)
 }
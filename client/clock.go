@@ -0,0 +1,51 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClockNotSynced is returned if the server certificate is rejected
+	// most likely because the clock of the device is wrong
+	ErrClockNotSynced = errors.New("device clock is not synchronized")
+
+	// devices without a real time clock usually start with the clock set
+	// to the epoch or to the build time of the image; anything before this
+	// time is certainly wrong
+	minimumValidTime = time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// ClockSynced is a heuristic telling if the clock of the device is set.
+func ClockSynced(now time.Time) bool {
+	return !now.Before(minimumValidTime)
+}
+
+// isClockSkew tells if the certificate validation error is likely caused by a
+// wrong clock of the device rather than by the certificate itself.
+func isClockSkew(certErr x509.CertificateInvalidError, now time.Time) bool {
+	if certErr.Reason != x509.Expired {
+		return false
+	}
+	if !ClockSynced(now) {
+		return true
+	}
+	// certificates are issued before they are used, while expired ones
+	// might be the fault of the server
+	return certErr.Cert != nil && now.Before(certErr.Cert.NotBefore)
+}
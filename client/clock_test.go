@@ -0,0 +1,65 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockSynced(t *testing.T) {
+	assert.False(t, ClockSynced(time.Unix(0, 0)))
+	assert.True(t, ClockSynced(time.Now()))
+}
+
+func TestClientAuthClockSkew(t *testing.T) {
+	now := time.Now()
+	certError := func(notBefore, notAfter time.Time) error {
+		return &url.Error{
+			Op:  "Post",
+			URL: "https://localhost",
+			Err: x509.CertificateInvalidError{
+				Cert: &x509.Certificate{
+					NotBefore: notBefore,
+					NotAfter:  notAfter,
+				},
+				Reason: x509.Expired,
+			},
+		}
+	}
+	msger := &testAuthDataMessenger{
+		reqData: []byte("foobar"),
+	}
+
+	// certificate is not valid yet; device clock is behind
+	ac := NewMockApiClient((*http.Response)(nil),
+		certError(now.Add(time.Hour), now.Add(365*24*time.Hour)))
+	_, err := NewAuth().Request(ac, "https://localhost", msger)
+	assert.Error(t, err)
+	assert.Equal(t, ErrClockNotSynced, errors.Cause(err))
+
+	// certificate has expired; it is up to the server to fix it
+	ac = NewMockApiClient((*http.Response)(nil),
+		certError(now.Add(-365*24*time.Hour), now.Add(-time.Hour)))
+	_, err = NewAuth().Request(ac, "https://localhost", msger)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrClockNotSynced, errors.Cause(err))
+	assert.Contains(t, err.Error(), "certificate has expired")
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// request bodies larger than this are sent gzip compressed
+const compressThreshold = 1024
+
+type requestMaker func(body io.Reader) (*http.Request, error)
+
+// doCompressed sends the request with the body gzip compressed if the body is
+// larger than compressThreshold. If the server does not support compressed
+// request bodies, which it indicates with 415 Unsupported Media Type, the
+// request is sent once again uncompressed, and so are the following requests
+// of the same ApiClient. Compressed responses are handled by http.Transport.
+func doCompressed(api ApiRequester, body []byte, makeRequest requestMaker) (*http.Response, error) {
+	client := apiClientOf(api)
+	if len(body) <= compressThreshold ||
+		(client != nil && atomic.LoadInt32(&client.compressionRejected) != 0) {
+		return doUncompressed(api, body, makeRequest)
+	}
+
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	if _, err := zw.Write(body); err != nil {
+		return nil, errors.Wrapf(err, "failed to compress request body")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrapf(err, "failed to compress request body")
+	}
+
+	req, err := makeRequest(compressed)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	r, err := api.Do(req)
+	if err != nil || r.StatusCode != http.StatusUnsupportedMediaType {
+		return r, err
+	}
+	r.Body.Close()
+
+	log.Infof("server does not accept compressed requests; sending uncompressed")
+	if client != nil {
+		atomic.StoreInt32(&client.compressionRejected, 1)
+	}
+	return doUncompressed(api, body, makeRequest)
+}
+
+// apiClientOf returns the ApiClient the requests of api are sent with; nil if
+// not known.
+func apiClientOf(api ApiRequester) *ApiClient {
+	switch a := api.(type) {
+	case *ApiClient:
+		return a
+	case *ApiRequest:
+		return a.api
+	}
+	return nil
+}
+
+func doUncompressed(api ApiRequester, body []byte, makeRequest requestMaker) (*http.Response, error) {
+	req, err := makeRequest(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return api.Do(req)
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type compressResponder struct {
+	acceptGzip bool
+	encodings  []string
+	body       []byte
+}
+
+func (c *compressResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	encoding := r.Header.Get("Content-Encoding")
+	c.encodings = append(c.encodings, encoding)
+
+	var body io.Reader = r.Body
+	if encoding == "gzip" {
+		if !c.acceptGzip {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	c.body, _ = ioutil.ReadAll(body)
+
+	if r.Method == http.MethodPut {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestInventoryClientCompressed(t *testing.T) {
+	responder := &compressResponder{acceptGzip: true}
+	ts := httptest.NewServer(responder)
+	defer ts.Close()
+
+	client := NewInventory()
+
+	// small inventory is sent as is
+	small := InventoryData{{"foo", "bar"}}
+	err := client.Submit(context.Background(), http.DefaultClient, ts.URL, small)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, responder.encodings)
+	assert.JSONEq(t, `[{"name": "foo", "value": "bar"}]`, string(responder.body))
+
+	// large inventory is compressed
+	large := InventoryData{}
+	for i := 0; i < 100; i++ {
+		large = append(large, InventoryAttribute{fmt.Sprintf("attr%d", i), "value"})
+	}
+	expected, _ := json.Marshal(large)
+	assert.True(t, len(expected) > compressThreshold)
+
+	responder.encodings = nil
+	err = client.Submit(context.Background(), http.DefaultClient, ts.URL, large)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gzip"}, responder.encodings)
+	assert.JSONEq(t, string(expected), string(responder.body))
+
+	// server does not support compression
+	responder.encodings = nil
+	responder.acceptGzip = false
+	err = client.Submit(context.Background(), http.DefaultClient, ts.URL, large)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gzip", ""}, responder.encodings)
+	assert.JSONEq(t, string(expected), string(responder.body))
+
+	// which is remembered by the ApiClient
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	api := ac.Request("token")
+	responder.encodings = nil
+	err = client.Submit(context.Background(), api, ts.URL, large)
+	assert.NoError(t, err)
+	err = client.Submit(context.Background(), api, ts.URL, large)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gzip", "", ""}, responder.encodings)
+	assert.JSONEq(t, string(expected), string(responder.body))
+}
+
+func TestLogUploadClientCompressed(t *testing.T) {
+	responder := &compressResponder{acceptGzip: true}
+	ts := httptest.NewServer(responder)
+	defer ts.Close()
+
+	logs := []byte(`{"messages": [` +
+		strings.Repeat(`{"time": "12:12:12", "level": "error", "msg": "log foo"},`, 50) +
+		`{"time": "12:12:13", "level": "debug", "msg": "log bar"}]}`)
+
+	client := NewLog()
+	err := client.Upload(http.DefaultClient, ts.URL, LogData{
+		DeploymentID: "deployment1",
+		Messages:     logs,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gzip"}, responder.encodings)
+	assert.Equal(t, logs, responder.body)
+}
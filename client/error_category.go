@@ -0,0 +1,133 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorCategory tells why a request to the server failed; whether the server
+// could not be reached, or it was reached but rejected the request.
+type ErrorCategory string
+
+const (
+	// the failure is not related to the server, e.g. the request was
+	// cancelled
+	ErrorCategoryOther ErrorCategory = ""
+	// the connection to the server could not be established or was lost,
+	// e.g. it was refused, reset or timed out
+	ErrorCategoryConnection ErrorCategory = "connection"
+	// the name of the server could not be resolved
+	ErrorCategoryDNS ErrorCategory = "dns"
+	// the TLS handshake with the server failed, e.g. the server certificate
+	// is not trusted
+	ErrorCategoryTLS ErrorCategory = "tls"
+	// the server responded with an error status, or with an invalid response
+	ErrorCategoryHTTP ErrorCategory = "http"
+)
+
+// categorizedError carries the category of the failure of a request along
+// with its error.
+type categorizedError struct {
+	category ErrorCategory
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Cause() error {
+	return e.err
+}
+
+// Category returns the category of the failure of the request err was returned
+// for; ErrorCategoryOther if err was not returned for a request to the server.
+func Category(err error) ErrorCategory {
+	for err != nil {
+		if ce, ok := err.(*categorizedError); ok {
+			return ce.category
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return ErrorCategoryOther
+}
+
+// ServerUnreachable returns true if the request err was returned for failed
+// because the server could not be reached, as opposed to the server rejecting
+// it.
+func ServerUnreachable(err error) bool {
+	switch Category(err) {
+	case ErrorCategoryConnection, ErrorCategoryDNS:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestErrorCategory returns the category of the error of a request; errors
+// returned by sending the request are failures to reach the server, other
+// errors are caused by its response.
+func requestErrorCategory(err error) ErrorCategory {
+	if uerr, ok := errors.Cause(err).(*url.Error); ok {
+		return transportErrorCategory(uerr.Err)
+	}
+	return ErrorCategoryHTTP
+}
+
+func withCategory(err error, category ErrorCategory) error {
+	if category == ErrorCategoryOther {
+		return err
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+func transportErrorCategory(err error) ErrorCategory {
+	for err != nil {
+		if err == context.Canceled {
+			return ErrorCategoryOther
+		}
+		switch err.(type) {
+		case *net.DNSError:
+			return ErrorCategoryDNS
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError,
+			x509.HostnameError, tls.RecordHeaderError:
+			return ErrorCategoryTLS
+		}
+		// TLS alerts are not exported
+		if strings.HasPrefix(err.Error(), "tls: ") {
+			return ErrorCategoryTLS
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+	return ErrorCategoryConnection
+}
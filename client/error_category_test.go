@@ -0,0 +1,90 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCategory(t *testing.T) {
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	report := StatusReport{DeploymentID: "1", Status: StatusSuccess}
+
+	// connection refused
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	refused := ts.URL
+	ts.Close()
+
+	err = NewStatus().Report(ac, refused, report)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorCategoryConnection, Category(err))
+	assert.True(t, ServerUnreachable(err))
+	assert.Contains(t, err.Error(), "status report request to "+refused)
+
+	_, err = NewAuth().Request(ac, refused, &testAuthDataMessenger{})
+	assert.Equal(t, ErrorCategoryConnection, Category(err))
+
+	// server error
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	err = NewStatus().Report(ac, ts.URL, report)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorCategoryHTTP, Category(err))
+	assert.False(t, ServerUnreachable(err))
+	assert.Contains(t, err.Error(), "bad status 500")
+
+	// the category is kept when the error is wrapped further
+	wrapped := errors.Wrap(err, "update failed")
+	assert.Equal(t, ErrorCategoryHTTP, Category(wrapped))
+
+	assert.Equal(t, ErrorCategoryOther, Category(errors.New("foo")))
+	assert.Equal(t, ErrorCategoryOther, Category(nil))
+}
+
+func TestTransportErrorCategory(t *testing.T) {
+	tcs := []struct {
+		err      error
+		category ErrorCategory
+	}{
+		{&net.DNSError{Err: "no such host", Name: "mender.io"}, ErrorCategoryDNS},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Name: "mender.io"}}, ErrorCategoryDNS},
+		{x509.UnknownAuthorityError{}, ErrorCategoryTLS},
+		{x509.HostnameError{Host: "mender.io", Certificate: &x509.Certificate{}},
+			ErrorCategoryTLS},
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")},
+			ErrorCategoryTLS},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			ErrorCategoryConnection},
+		{context.DeadlineExceeded, ErrorCategoryConnection},
+		{context.Canceled, ErrorCategoryOther},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.category, transportErrorCategory(tc.err), "%v", tc.err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// RateLimitError is returned when the server rejects a request with HTTP 429
+// Too Many Requests.
+type RateLimitError struct {
+	// delay requested by the server in the Retry-After header; zero if the
+	// header was missing or malformed
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("request rate limited by the server, retry after %v",
+			e.RetryAfter)
+	}
+	return "request rate limited by the server"
+}
+
+func newRateLimitError(r *http.Response) *RateLimitError {
+	err := &RateLimitError{
+		RetryAfter: parseRetryAfter(r.Header.Get("Retry-After"), time.Now()),
+	}
+	log.Warn(err.Error())
+	return err
+}
+
+// parseRetryAfter parses the value of the Retry-After header, which is either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// RetryAfter returns the delay requested by the server if err was caused by
+// the request being rate limited, otherwise zero.
+func RetryAfter(err error) time.Duration {
+	if rle, ok := errors.Cause(err).(*RateLimitError); ok {
+		return rle.RetryAfter
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeRateLimitedResponse(retryAfter string) *http.Response {
+	rsp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}
+	if retryAfter != "" {
+		rsp.Header.Set("Retry-After", retryAfter)
+	}
+	return rsp
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, 90*time.Second,
+		parseRetryAfter("Tue, 02 Jan 2018 10:01:30 GMT", now))
+	// date in the past
+	assert.Equal(t, time.Duration(0),
+		parseRetryAfter("Tue, 02 Jan 2018 09:00:00 GMT", now))
+}
+
+func TestUpdateCheckRateLimited(t *testing.T) {
+	_, err := processUpdateResponse(makeRateLimitedResponse("300"))
+	assert.Error(t, err)
+	assert.IsType(t, &RateLimitError{}, err)
+	assert.Equal(t, 300*time.Second,
+		RetryAfter(errors.Wrap(err, "update check failed")))
+
+	// no header; the server did not suggest any delay
+	_, err = processUpdateResponse(makeRateLimitedResponse(""))
+	assert.IsType(t, &RateLimitError{}, err)
+	assert.Equal(t, time.Duration(0), RetryAfter(err))
+}
+
+func TestInventoryRateLimited(t *testing.T) {
+	client := NewInventory()
+	err := client.Submit(context.Background(), NewMockApiClient(makeRateLimitedResponse("60"), nil),
+		"https://localhost", InventoryData{{"foo", "bar"}})
+	assert.Error(t, err)
+	assert.Equal(t, time.Minute, RetryAfter(err))
+
+	assert.Equal(t, time.Duration(0), RetryAfter(errors.New("foo")))
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// RequestIDHeader carries the ID generated for every request, so that a
+	// failed request can be found in the logs of the server
+	RequestIDHeader = "X-Request-ID"
+	// CorrelationIDHeader carries the ID tying together all the requests
+	// of one deployment
+	CorrelationIDHeader = "X-Correlation-ID"
+)
+
+// namespace of the deployment correlation IDs
+var correlationNamespace = []byte("mender-deployment")
+
+type deploymentIDKey struct{}
+
+// WithDeploymentID returns a context marking the requests sent with it as a
+// part of the deployment.
+func WithDeploymentID(ctx context.Context, deploymentID string) context.Context {
+	return context.WithValue(ctx, deploymentIDKey{}, deploymentID)
+}
+
+// DeploymentCorrelationID returns the correlation ID of the requests of the
+// deployment. The ID is derived from the deployment ID, so that it stays the
+// same across restarts of the client.
+func DeploymentCorrelationID(deploymentID string) string {
+	h := sha1.New()
+	h.Write(correlationNamespace)
+	h.Write([]byte(deploymentID))
+	sum := h.Sum(nil)
+	// name based UUID, version 5
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return formatUUID(sum[:16])
+}
+
+// newRequestID returns a random UUID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b)
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// setCorrelationID marks the request as a part of the deployment.
+func setCorrelationID(req *http.Request, deploymentID string) {
+	req.Header.Set(CorrelationIDHeader, DeploymentCorrelationID(deploymentID))
+}
+
+// setTracingHeaders adds the request ID, and the correlation ID of the
+// deployment the request is sent for, unless they are set already.
+func setTracingHeaders(req *http.Request) {
+	if req.Header.Get(RequestIDHeader) == "" {
+		req.Header.Set(RequestIDHeader, newRequestID())
+	}
+	id, ok := req.Context().Value(deploymentIDKey{}).(string)
+	if ok && id != "" && req.Header.Get(CorrelationIDHeader) == "" {
+		setCorrelationID(req, id)
+	}
+}
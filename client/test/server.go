@@ -15,6 +15,8 @@ package test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -34,6 +36,9 @@ type updateType struct {
 	Unauthorized bool
 	Called       bool
 	Current      client.CurrentUpdate
+	// send Body as is instead of encoding Data
+	Raw  bool
+	Body []byte
 }
 
 type updateDownloadType struct {
@@ -46,12 +51,18 @@ type authType struct {
 	Token     []byte
 	Called    bool
 	Verify    bool
+	// signature of the last auth request
+	Signature []byte
 }
 
 type statusType struct {
-	Status  string
-	Aborted bool
-	Called  bool
+	// deployment ID of the last status report
+	ID                   string
+	Status               string
+	PreviousArtifactName string
+	Source               string
+	Aborted              bool
+	Called               bool
 }
 
 type logType struct {
@@ -62,6 +73,16 @@ type logType struct {
 type inventoryType struct {
 	Called bool
 	Attrs  []client.InventoryAttribute
+	// version the accepted inventory is acknowledged with; conditional
+	// requests for other versions are refused. Empty if the versions are
+	// not acknowledged
+	Version string
+}
+
+type configType struct {
+	Called bool
+	// configuration delivered to the device; none if nil
+	Data *client.RemoteConfig
 }
 
 type ClientTestServer struct {
@@ -73,6 +94,9 @@ type ClientTestServer struct {
 	Status         statusType
 	Log            logType
 	Inventory      inventoryType
+	Config         configType
+	// headers of the most recent request
+	Header http.Header
 }
 
 func NewClientTestServer() *ClientTestServer {
@@ -81,6 +105,7 @@ func NewClientTestServer() *ClientTestServer {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/devices/v1/authentication/auth_requests", cts.authReq)
 	mux.HandleFunc("/api/devices/v1/inventory/device/attributes", cts.inventoryReq)
+	mux.HandleFunc("/api/devices/v1/deviceconfig/configuration", cts.configReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/next", cts.updateReq)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/log", cts.logReq)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/status", cts.statusReq)
@@ -91,7 +116,11 @@ func NewClientTestServer() *ClientTestServer {
 		w.WriteHeader(http.StatusBadRequest)
 	})
 
-	srv := httptest.NewServer(mux)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			cts.Header = r.Header
+			mux.ServeHTTP(w, r)
+		}))
 	cts.Server = srv
 
 	return cts
@@ -107,13 +136,23 @@ func fromJSON(in io.Reader, data interface{}) error {
 	return dec.Decode(data)
 }
 
+// requestBody returns the request body, decompressed if needed
+func requestBody(r *http.Request) (io.Reader, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
 func (cts *ClientTestServer) Reset() {
 	cts.Update = updateType{}
 	cts.UpdateDownload = updateDownloadType{}
 	cts.Auth = authType{}
 	cts.Log = logType{}
 	cts.Inventory = inventoryType{}
+	cts.Config = configType{}
 	cts.Status = statusType{}
+	cts.Header = nil
 }
 
 func isMethod(method string, w http.ResponseWriter, r *http.Request) bool {
@@ -178,6 +217,9 @@ func (cts *ClientTestServer) authReq(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cts.Auth.Signature, _ = base64.StdEncoding.DecodeString(
+		r.Header.Get("X-MEN-Signature"))
+
 	if cts.Auth.Authorize {
 		w.WriteHeader(http.StatusOK)
 		if cts.Auth.Token != nil {
@@ -190,6 +232,27 @@ func (cts *ClientTestServer) authReq(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (cts *ClientTestServer) configReq(w http.ResponseWriter, r *http.Request) {
+	log.Infof("got configuration request %v", r)
+	cts.Config.Called = true
+
+	if !isMethod(http.MethodGet, w, r) {
+		return
+	}
+
+	if !cts.verifyAuth(w, r) {
+		return
+	}
+
+	if cts.Config.Data == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, cts.Config.Data)
+}
+
 func (cts *ClientTestServer) inventoryReq(w http.ResponseWriter, r *http.Request) {
 	log.Infof("got inventory request %v", r)
 	cts.Inventory.Called = true
@@ -206,15 +269,34 @@ func (cts *ClientTestServer) inventoryReq(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if v := r.Header.Get("If-Match"); v != "" {
+		if v != cts.Inventory.Version {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", cts.Inventory.Version)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	var attrs []client.InventoryAttribute
 
-	if err := fromJSON(r.Body, &attrs); err != nil {
+	body, err := requestBody(r)
+	if err != nil {
+		log.Errorf("failed to decompress attrs data: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := fromJSON(body, &attrs); err != nil {
 		log.Errorf("failed to parse attrs data: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	log.Infof("got attrs: %v", attrs)
 	cts.Inventory.Attrs = attrs
+	if cts.Inventory.Version != "" {
+		w.Header().Set("ETag", cts.Inventory.Version)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -259,7 +341,13 @@ func (cts *ClientTestServer) logReq(w http.ResponseWriter, r *http.Request, id s
 		return
 	}
 
-	logs, err := ioutil.ReadAll(r.Body)
+	body, err := requestBody(r)
+	if err != nil {
+		log.Errorf("error when decompressing logs: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logs, err := ioutil.ReadAll(body)
 	if err != nil {
 		log.Errorf("error when receiving logs: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -299,7 +387,10 @@ func (cts *ClientTestServer) statusReq(w http.ResponseWriter, r *http.Request, i
 		return
 	}
 
+	cts.Status.ID = id
 	cts.Status.Status = report.Status
+	cts.Status.PreviousArtifactName = report.PreviousArtifactName
+	cts.Status.Source = report.Source
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -338,6 +429,10 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 	case cts.Update.Has == false:
 		w.WriteHeader(http.StatusNoContent)
+	case cts.Update.Raw == true:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(cts.Update.Body)
 	case cts.Update.Has == true:
 		w.WriteHeader(http.StatusOK)
 
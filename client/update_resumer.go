@@ -26,6 +26,50 @@ import (
 	"time"
 )
 
+// DownloadRetryPolicy controls how many times and how often an interrupted
+// update download is resumed. The downloads are long running, hence these are
+// retried independently of the other requests.
+type DownloadRetryPolicy struct {
+	// maximum number of attempts to resume the download; zero limits the
+	// attempts by the backoff only
+	MaxAttempts int
+	// maximum number of times the download is resumed after the connection
+	// broke, e.g. on flaky cellular links; if set, MaxAttempts and the
+	// backoff apply to every reconnect separately. Zero for no limit
+	MaxReconnects int
+	// wait before the first attempt, doubled with every following one up
+	// to MaxWait; if zero the attempts are made three times per interval,
+	// starting with a minute
+	InitialWait time.Duration
+	MaxWait     time.Duration
+}
+
+// backoff returns the wait before the next attempt to resume the download,
+// or an error if the download should not be resumed any more.
+func (p DownloadRetryPolicy) backoff(tried int) (time.Duration, error) {
+	if p.MaxAttempts > 0 && tried >= p.MaxAttempts {
+		return 0, errors.Errorf("Tried maximum amount of times (%d)", p.MaxAttempts)
+	}
+	if p.InitialWait <= 0 {
+		return GetExponentialBackoffTime(tried, p.MaxWait)
+	}
+	wait := p.InitialWait
+	for i := 0; i < tried; i++ {
+		if p.MaxWait > 0 && wait >= p.MaxWait {
+			break
+		}
+		wait *= 2
+	}
+	if p.MaxWait > 0 && wait > p.MaxWait {
+		wait = p.MaxWait
+	}
+	return wait, nil
+}
+
+// ErrReconnectsExhausted is returned if the connection broke more times than
+// the download may be resumed.
+var ErrReconnectsExhausted = errors.New("download connection broke too many times")
+
 type UpdateResumer struct {
 	stream        io.ReadCloser
 	apiReq        ApiRequester
@@ -33,13 +77,14 @@ type UpdateResumer struct {
 	offset        int64
 	contentLength int64
 	retryAttempts int
-	maxWait       time.Duration
+	reconnects    int
+	retry         DownloadRetryPolicy
 }
 
 // Note: It is important that nothing has been read from the stream yet.
 func NewUpdateResumer(stream io.ReadCloser,
 	contentLength int64,
-	maxWait time.Duration,
+	retry DownloadRetryPolicy,
 	apiReq ApiRequester,
 	req *http.Request) *UpdateResumer {
 
@@ -48,7 +93,7 @@ func NewUpdateResumer(stream io.ReadCloser,
 		apiReq:        apiReq,
 		req:           req,
 		contentLength: contentLength,
-		maxWait:       maxWait,
+		retry:         retry,
 	}
 }
 
@@ -72,11 +117,22 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 
 		h.req.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
 
+		// download was aborted on purpose; do not try to resume
+		if cerr := h.req.Context().Err(); cerr != nil {
+			return int(h.offset - origOffset), cerr
+		}
+
+		if h.retry.MaxReconnects > 0 && h.reconnects >= h.retry.MaxReconnects {
+			log.Errorf("Download connection broken: %s", err.Error())
+			return int(h.offset - origOffset), errors.Wrapf(ErrReconnectsExhausted,
+				"Cannot resume download after %d reconnects", h.reconnects)
+		}
+
 		var res *http.Response
 		for {
 			log.Errorf("Download connection broken: %s", err.Error())
 
-			waitTime, err := GetExponentialBackoffTime(h.retryAttempts, h.maxWait)
+			waitTime, err := h.retry.backoff(h.retryAttempts)
 			if err != nil {
 				return int(h.offset - origOffset),
 					errors.Wrapf(err, "Cannot resume download")
@@ -85,7 +141,13 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 			log.Infof("Resuming download in %s", waitTime.String())
 			h.retryAttempts += 1
 
-			time.Sleep(waitTime)
+			timer := time.NewTimer(waitTime)
+			select {
+			case <-timer.C:
+			case <-h.req.Context().Done():
+				timer.Stop()
+				return int(h.offset - origOffset), h.req.Context().Err()
+			}
 
 			log.Infof("Attempting to resume artifact download from offset %d", h.offset)
 
@@ -96,11 +158,24 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 			}
 
 			stream, err := h.getStreamFromPartialContent(res)
-			if err != nil {
+			if errors.Cause(err) == ErrUpdateGone {
+				res.Body.Close()
+				return int(h.offset - origOffset), err
+			} else if err != nil {
 				continue
 			}
 
 			h.stream = stream
+			h.reconnects++
+			if h.retry.MaxReconnects > 0 {
+				h.retryAttempts = 0
+			}
+			if h.contentLength > 0 {
+				log.Infof("Download resumed at %d of %d bytes (%d%%)", h.offset,
+					h.contentLength, h.offset*100/h.contentLength)
+			} else {
+				log.Infof("Download resumed at %d bytes", h.offset)
+			}
 			break
 		}
 
@@ -111,6 +186,11 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.ReadCloser, error) {
 	var err error
 
+	if updateGone(res.StatusCode) {
+		return nil, errors.Wrapf(ErrUpdateGone,
+			"Could not resume download from offset %d. HTTP status code: %s",
+			h.offset, res.Status)
+	}
 	if h.offset > 0 && res.StatusCode != http.StatusPartialContent {
 		return nil, fmt.Errorf("Could not resume download from offset %d. HTTP status code: %s",
 			h.offset, res.Status)
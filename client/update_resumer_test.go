@@ -157,7 +157,8 @@ func testBrokenReadAndPartialDownload_oneCase(t *testing.T, h *testHandler) {
 	contentLength, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
 	assert.NoError(t, err)
 
-	updateResumer := NewUpdateResumer(res.Body, contentLength, 3*time.Second, &client, req)
+	updateResumer := NewUpdateResumer(res.Body, contentLength,
+		DownloadRetryPolicy{MaxWait: 3 * time.Second}, &client, req)
 	defer updateResumer.Close()
 
 	if h.serverDownAfter > 0 {
@@ -0,0 +1,167 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// maximum amount of the output of an external command kept to tell why the
+// command failed
+const maxCommandOutput = 1024
+
+// commandOutput collects the output of an external command, keeping only the
+// beginning of it if it is longer than maxCommandOutput. Writes never fail, so
+// that the command is not disturbed by the output being dropped.
+type commandOutput struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (o *commandOutput) Write(p []byte) (int, error) {
+	if room := maxCommandOutput - o.buf.Len(); len(p) > room {
+		o.buf.Write(p[:room])
+		o.truncated = true
+	} else {
+		o.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (o *commandOutput) String() string {
+	out := strings.TrimSpace(o.buf.String())
+	if o.truncated {
+		out += " [...]"
+	}
+	return out
+}
+
+// commandError wraps the error of the failed command name with the output of
+// the command, which usually tells why it failed.
+func commandError(err error, name string, output *commandOutput) error {
+	if out := output.String(); out != "" {
+		return errors.Wrapf(err, "%s failed: %s", name, out)
+	}
+	return errors.Wrapf(err, "%s failed", name)
+}
+
+// errCommandTimeout is returned by runCommand if the command did not complete
+// in time.
+var errCommandTimeout = errors.New("command did not complete in time")
+
+// runCommand runs the command, killing it along with its children unless it
+// completes within timeout, and returns its output. An error other than
+// *exec.ExitError tells that the command did not run to completion.
+func runCommand(command []string, timeout time.Duration) (string, error) {
+	return runCommandEnv(command, nil, timeout)
+}
+
+// runCommandEnv is runCommand with env added to the environment of the
+// command.
+func runCommandEnv(command []string, env []string,
+	timeout time.Duration) (string, error) {
+	return runCommandContext(context.Background(), command, env, timeout)
+}
+
+// runCommandContext is runCommandEnv also killing the command once ctx is
+// done, in which case the error of ctx is returned.
+func runCommandContext(ctx context.Context, command []string, env []string,
+	timeout time.Duration) (string, error) {
+	var out commandOutput
+	cmd := exec.Command(command[0], command[1:]...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := waitCommand(ctx, cmd, timeout)
+	return out.String(), err
+}
+
+// waitCommand runs cmd, killing it along with its children unless it completes
+// within timeout, in which case errCommandTimeout is returned, or before ctx
+// is done, in which case the error of ctx is returned.
+func waitCommand(ctx context.Context, cmd *exec.Cmd,
+	timeout time.Duration) error {
+	// run the command in its own process group, so that it can be killed
+	// along with its children once the time is up
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err := cmd.Wait()
+	if atomic.LoadInt32(&timedOut) != 0 {
+		return errCommandTimeout
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// runCheckCommand runs the command checking whether the device is ready for
+// what the client is about to do. Returns false along with the reason given
+// by the command if it is not. A command which does not run to completion is
+// only logged: a broken command must not stop the updates for good.
+func runCheckCommand(name string, command []string,
+	timeout time.Duration) (bool, string) {
+	out, err := runCommand(command, timeout)
+	if err == nil {
+		return true, ""
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		log.Errorf("%s command failed: %v", name, err)
+		return true, ""
+	}
+	if out == "" {
+		out = err.Error()
+	}
+	return false, out
+}
+
+// truncateReason shortens the description of a failure sent to the server.
+func truncateReason(reason string) string {
+	if len(reason) <= maxCommandOutput {
+		return reason
+	}
+	return reason[:maxCommandOutput] + " [...]"
+}
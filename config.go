@@ -14,19 +14,52 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/pkg/errors"
 )
 
+// signaturePolicy applies to the artifacts installed from ServerURL on devices
+// of DeviceType; empty fields match anything. Artifacts installed with
+// -rootfs match only the policies without ServerURL.
+type signaturePolicy struct {
+	ServerURL        string
+	DeviceType       string
+	RequireSignature bool
+}
+
+// downloadRateWindow limits the download rate of artifacts during the daily
+// time window from Start to End, local time formatted as "15:04"; the window
+// may span midnight.
+type downloadRateWindow struct {
+	Start          string
+	End            string
+	BytesPerSecond int64
+}
+
 type menderConfig struct {
 	ClientProtocol    string
 	ArtifactVerifyKey string
-	HttpsClient       struct {
+	// additional artifact verification keys; artifact is accepted if its
+	// signature can be verified with any of the keys
+	ArtifactVerifyKeys []string
+	// whether artifacts must be signed, by the server they are installed
+	// from or by the device type, e.g. to accept unsigned artifacts from a
+	// development server; the first matching policy applies. If none
+	// matches, artifacts must be signed if verification keys are configured
+	SignaturePolicies []signaturePolicy
+	// accept the state scripts embedded in the artifacts only if the
+	// artifact signature is verified
+	ArtifactScriptsRequireSignature bool
+	HttpsClient                     struct {
 		Certificate string
 		Key         string
 		SkipVerify  bool
@@ -43,8 +76,257 @@ type menderConfig struct {
 	ServerCertificate               string
 	UpdateLogPath                   string
 	TenantToken                     string
+	// partition the updates are installed to instead of the inactive one of
+	// RootfsPartA and RootfsPartB, e.g. a recovery partition; installing to
+	// the partition the system is running from is refused
+	InstallTargetPartition string
+	// notify systemd about the service status and send watchdog keep-alive
+	// messages
+	SystemdNotify bool
+	// bounds of the poll interval the server may request for the duration
+	// of a deployment; by default the interval can be lowered down to 10
+	// seconds, but not raised above UpdatePollIntervalSeconds
+	PollIntervalOverrideMinSeconds int
+	PollIntervalOverrideMaxSeconds int
+	// lowest accepted UpdatePollIntervalSeconds and
+	// InventoryPollIntervalSeconds, protecting the server from a
+	// misconfigured device polling in a tight loop; defaults to 5 seconds
+	PollIntervalMinSeconds int
+	// time after which a state that is not waiting is considered stuck and
+	// is aborted with an error; zero disables stuck state detection
+	StuckStateTimeoutSeconds int
+	// age after which deployment logs, and entries of the data store no
+	// longer used by the client, are removed; zero keeps them
+	StaleDataExpireSeconds int
+	// upper bound of the random delay of the first update check after
+	// start-up; zero disables the delay
+	StartupDelayMaxSeconds int
+	// upper bound of a random delay added to every update poll interval, so
+	// that devices started together do not keep checking at the same time;
+	// zero disables it
+	UpdatePollJitterSeconds int
+	// log level, e.g. "debug" or "warning", unless one is given on the
+	// command line; defaults to info
+	LogLevel string
+	// directory the artifact is downloaded to before it is installed, e.g. on
+	// a persistent partition with enough space; created with 0700
+	// permissions if missing. If not set, the artifact is installed while
+	// being downloaded and nothing is written to a temporary location
+	ArtifactStagingDir string
+	// maximum size in bytes of the artifact to download; larger artifacts
+	// are rejected without retrying, protecting devices with small storage
+	// from deployments of oversized images. 0 disables the check
+	MaxArtifactSizeBytes int64
+	// keep the artifact in the staging directory if its download breaks, and
+	// continue the download where it stopped on the next attempt
+	ResumeStagedDownloads bool
+	// if the artifact is installed while being downloaded (ArtifactStagingDir
+	// is not set), download it ahead of the installation into a buffer in
+	// memory, so that the download goes on while the data is written to the
+	// partition. The updated partition is still enabled only once the whole
+	// artifact is downloaded and verified
+	PipelinedInstall bool
+	// download rate limits by the time of day, e.g. to download quickly at
+	// night, but save the bandwidth during business hours; the first window
+	// containing the current time applies, also to a download in progress.
+	// Downloads are not limited outside of the windows or if BytesPerSecond
+	// is 0
+	DownloadRateSchedule []downloadRateWindow
+	// an interrupted artifact download is resumed where it stopped at most
+	// DownloadRetryAttempts times (limited by the backoff only if 0). The
+	// wait before the first attempt is DownloadRetryIntervalSeconds, doubled
+	// with every following one up to DownloadRetryMaxIntervalSeconds
+	// (RetryPollIntervalSeconds by default); if not set, the attempts are
+	// made three times per interval starting with a minute
+	DownloadRetryAttempts           int
+	DownloadRetryIntervalSeconds    int
+	DownloadRetryMaxIntervalSeconds int
+	// number of times the download is resumed after the connection broke
+	// before the update fails; DownloadRetryAttempts and the backoff then
+	// apply to every reconnect. 0 for no limit
+	DownloadMaxReconnects int
+	// ask the server again whether the deployment is still offered to the
+	// device right before its artifact is downloaded, skipping the download
+	// of deployments aborted or retargeted in the meantime
+	PreDownloadCheck bool
+	// only authorize and submit the inventory; the daemon never checks for
+	// or installs updates and does not need to run as root
+	InventoryOnly bool
+	// check for and install updates, but never submit the inventory; can
+	// not be combined with InventoryOnly
+	UpdatesOnly bool
+	// daily time window updates are installed in; local time formatted as
+	// "15:04", e.g. "02:00" to "04:00". The window may span midnight. Updates
+	// found outside of the window are installed once it opens; if not set,
+	// updates are installed at any time
+	MaintenanceWindowStart string
+	MaintenanceWindowEnd   string
+	// command executed when an update is available, but is not installed
+	// until the maintenance window opens, e.g. to announce the update in a
+	// local UI; the artifact name and the time the window opens (RFC 3339)
+	// are appended to the arguments
+	UpdateDeferredCommand []string
+	// command telling whether updates may be checked for and downloaded
+	// now, e.g. not while the device runs on battery or is connected over a
+	// metered link; updates are deferred while it exits with a non-zero
+	// status, and its output is logged as the reason. The conditions are
+	// checked again every RetryPollIntervalSeconds
+	UpdateConditionsCommand []string
+	// scripts executed in order once an update is committed, e.g. to remove
+	// data left over by the update or to notify an application; the
+	// artifact name is passed as the argument. Failures are logged, but do
+	// not fail the update
+	PostCommitScripts []string
+	// path of the unix socket the daemon accepts control commands on
+	ControlSocket string
+	// load the device key even if it is accessible by users other than the
+	// owner
+	AllowInsecureKeyPermissions bool
+	// where the device key is kept; one of "file" (default), "memory" or
+	// "external". A key kept in memory is generated on every start, e.g. for
+	// ephemeral devices; an external key is used through SignCommand. If not
+	// set, the external key is used if SignCommand is set
+	KeyStoreBackend string
+	// command signing the authorization requests instead of the device key
+	// kept by the client, e.g. with a key stored in a TPM; it reads the data
+	// from stdin and writes the raw signature to stdout, and is killed if it
+	// does not complete within StateScriptTimeoutSeconds.
+	// DevicePublicKeyFile is the PEM file with the matching public key
+	SignCommand         []string
+	DevicePublicKeyFile string
+	// command printing the identity of the device as key=value lines, e.g.
+	// its MAC address, serial number or IMEI; all the attributes are sent
+	// to the server when authorizing. Defaults to mender-device-identity in
+	// the identity directory of the data directory. The command is killed if
+	// it does not complete within StateScriptTimeoutSeconds
+	IdentityCommand string
+	// file locked while the client runs, so that a second instance using
+	// the same data store refuses to start; defaults to mender.lock in the
+	// data store directory
+	InstanceLockFile string
+	// fetch the configuration delivered by the server after every update
+	// check, e.g. to change the poll intervals of a fleet centrally. It
+	// takes precedence over this file, except for the fields listed in
+	// LocalOverrides, and is kept across restarts
+	ServerConfig bool
+	// fields kept as configured here even if delivered by the server; any
+	// of UpdatePollIntervalSeconds, InventoryPollIntervalSeconds,
+	// RetryPollIntervalSeconds, StartupDelayMaxSeconds and LogLevel. The
+	// log level given on the command line is always kept
+	LocalOverrides []string
+	// headers added to every request sent to the server, e.g. API gateway
+	// keys; headers set by the client itself can not be overridden
+	ExtraHeaders map[string]string
+	// maximum size in bytes of JSON responses from the server, such as the
+	// update check and authorization responses; 0 selects the default of 1MB
+	MaxResponseSize int64
+	// connections to the server are kept open between the polls and reused;
+	// period of TCP keep-alive probes (0 selects the default of 10 seconds,
+	// negative disables them), maximum number of idle connections and how
+	// long an idle connection is kept (0 for no limit)
+	ConnectionKeepAliveSeconds   int
+	MaxIdleConnections           int
+	IdleConnectionTimeoutSeconds int
+	// how long establishing a connection to the server may take, so that an
+	// unreachable server is given up on quickly; 0 selects the default of 30
+	// seconds, negative leaves it to the system
+	ConnectTimeoutSeconds int
+	// lowest TLS version accepted from the server; one of "1.0", "1.1",
+	// "1.2" (default) or "1.3"
+	TLSMinVersion string
+	// talk to the server over HTTP/1.1 only, even if it supports HTTP/2
+	DisableHTTP2 bool
+	// version of the device API of the server; "v1" (default) or "v2"
+	APIVersion string
+	// how the update is activated after it is installed; one of "system"
+	// (default), "command", "none" or "manual"
+	RebootStrategy string
+	// command executed instead of the system reboot if RebootStrategy is
+	// "command"
+	RebootCommand []string
+	// time given to the applications to finish their work before the device
+	// is rebooted into the update; 0 reboots right away
+	RebootGracePeriodSeconds int
+	// command asked at the end of the grace period whether the device may be
+	// rebooted now, e.g. not while a transaction is in progress; while it
+	// exits with a non-zero status the reboot is postponed by another grace
+	// period, up to MaxRebootDelaySeconds in total (1 hour by default)
+	RebootVetoCommand     []string
+	MaxRebootDelaySeconds int
+	// what is done if the success of a committed update can not be reported
+	// to the server; one of "retry" (default), keeping the report and sending
+	// it again with the following update checks until the server accepts it,
+	// "ignore", dropping the report, or "rollback", rolling the update back
+	CommitReportFailure string
+	// directory with executables verifying the health of the device after
+	// rebooting into the update; the update is rolled back if any of them
+	// fails. If not set, the update is committed without further checks
+	HealthCheckScriptsPath string
+	// time all the health checks must complete in; defaults to 5 minutes
+	HealthCheckTimeoutSeconds int
+	// time the updated system has to confirm itself, i.e. pass the health
+	// checks and commit the update, after it is booted; the update is rolled
+	// back if it does not. 0 disables the limit
+	UpdateControlTimeoutSeconds int
+	// static inventory attributes, e.g. site or customer; they take
+	// precedence over the attributes reported by the inventory scripts
+	InventoryAttributes map[string]string
+	// directories with the inventory scripts, run in the given order; the
+	// attributes reported by the scripts of a later directory override the
+	// ones of an earlier directory. Defaults to the inventory directory in
+	// the data directory
+	InventoryScriptsDirs []string
+	// fail the whole inventory submission if any of the inventory scripts
+	// fails; by default the output of failing scripts is skipped and the
+	// output of the others is submitted
+	InventoryScriptsStrict bool
 }
 
+const (
+	// reboot the system
+	rebootStrategySystem = "system"
+	// run RebootCommand, e.g. to restart a container or an application
+	rebootStrategyCommand = "command"
+	// the update takes effect without a reboot
+	rebootStrategyNone = "none"
+	// install the update and enable the updated partition, then stop
+	// without rebooting or committing; the device is rebooted by hand,
+	// e.g. when re-validating the update
+	rebootStrategyManual = "manual"
+
+	// longest the reboot is postponed by RebootVetoCommand by default
+	defaultMaxRebootDelay = time.Hour
+)
+
+// the state scripts, and the commands integrating the client with the device,
+// are killed if they run longer than this, unless configured otherwise
+const defaultStateScriptTimeout = 60 * time.Second
+
+const (
+	// update and inventory poll interval used if none is configured
+	defaultPollInterval = 30 * time.Minute
+	// lowest update and inventory poll interval accepted by default
+	defaultPollIntervalMin = 5 * time.Second
+)
+
+const (
+	// keep the success report and send it again later
+	commitReportRetry = "retry"
+	// drop the success report
+	commitReportIgnore = "ignore"
+	// roll the committed update back
+	commitReportRollback = "rollback"
+)
+
+const (
+	// device key kept in the data directory
+	keyStoreFile = "file"
+	// device key kept only in memory, generated on every start
+	keyStoreMemory = "memory"
+	// device key kept outside of the client, used through SignCommand
+	keyStoreExternal = "external"
+)
+
 func LoadConfig(configFile string) (*menderConfig, error) {
 	var confFromFile menderConfig
 
@@ -55,6 +337,45 @@ func LoadConfig(configFile string) (*menderConfig, error) {
 		return nil, err
 	}
 
+	if confFromFile.InventoryOnly && confFromFile.UpdatesOnly {
+		return nil, errors.New("InventoryOnly and UpdatesOnly can not be both set")
+	}
+
+	if err := client.CheckAPIVersion(confFromFile.APIVersion); err != nil {
+		return nil, err
+	}
+
+	if err := checkTLSMinVersion(confFromFile.TLSMinVersion); err != nil {
+		return nil, err
+	}
+
+	if confFromFile.LogLevel != "" {
+		if _, err := log.ParseLevel(confFromFile.LogLevel); err != nil {
+			return nil, errors.Wrapf(err, "invalid LogLevel")
+		}
+	}
+
+	for _, f := range confFromFile.LocalOverrides {
+		if !isRemoteConfigField(f) {
+			return nil, errors.Errorf("%s in LocalOverrides can not be "+
+				"delivered by the server", f)
+		}
+	}
+
+	for _, w := range confFromFile.DownloadRateSchedule {
+		if _, _, err := w.parse(); err != nil {
+			return nil, errors.Wrapf(err, "invalid download rate window %q - %q",
+				w.Start, w.End)
+		}
+	}
+
+	if confFromFile.DownloadRetryAttempts < 0 ||
+		confFromFile.DownloadMaxReconnects < 0 ||
+		confFromFile.DownloadRetryIntervalSeconds < 0 ||
+		confFromFile.DownloadRetryMaxIntervalSeconds < 0 {
+		return nil, errors.New("download retry settings can not be negative")
+	}
+
 	if strings.HasSuffix(confFromFile.ServerURL, "/") {
 		confFromFile.ServerURL = strings.TrimSuffix(confFromFile.ServerURL, "/")
 	}
@@ -84,13 +405,55 @@ func (c menderConfig) GetHttpConfig() client.Config {
 		ServerCert: c.ServerCertificate,
 		IsHttps:    c.ClientProtocol == "https",
 		NoVerify:   c.HttpsClient.SkipVerify,
+
+		MinTLSVersion: c.GetTLSMinVersion(),
+		DisableHTTP2:  c.DisableHTTP2,
 	}
 }
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// checkTLSMinVersion returns an error if the TLS version is not known. Empty
+// version selects the default one.
+func checkTLSMinVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	if _, ok := tlsVersions[version]; ok {
+		return nil
+	}
+	versions := make([]string, 0, len(tlsVersions))
+	for v := range tlsVersions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return errors.Errorf("unsupported TLS version %q; supported versions: %s",
+		version, strings.Join(versions, ", "))
+}
+
+func (c menderConfig) GetTLSMinVersion() uint16 {
+	if c.TLSMinVersion == "" {
+		return tls.VersionTLS12
+	}
+	version, ok := tlsVersions[c.TLSMinVersion]
+	if !ok {
+		log.Warnf("config: unknown TLS version %q; using 1.2", c.TLSMinVersion)
+		return tls.VersionTLS12
+	}
+	return version
+}
+
 func (c menderConfig) GetDeviceConfig() deviceConfig {
 	return deviceConfig{
 		rootfsPartA: c.RootfsPartA,
 		rootfsPartB: c.RootfsPartB,
+
+		installTarget: c.InstallTargetPartition,
 	}
 }
 
@@ -104,14 +467,244 @@ func (c menderConfig) GetTenantToken() []byte {
 	return []byte(c.TenantToken)
 }
 
-func (c menderConfig) GetVerificationKey() []byte {
-	if c.ArtifactVerifyKey == "" {
-		return nil
+func (c menderConfig) GetControlSocket() string {
+	if c.ControlSocket == "" {
+		return defaultControlSocket
+	}
+	return c.ControlSocket
+}
+
+// GetUpdateControlTimeout returns the time the updated system has to confirm
+// itself after it is booted; zero if it is not limited.
+func (c menderConfig) GetUpdateControlTimeout() time.Duration {
+	return time.Duration(c.UpdateControlTimeoutSeconds) * time.Second
+}
+
+// GetStateScriptTimeout returns the time a state script, or a command run by
+// the client on an update event, may run for.
+func (c menderConfig) GetStateScriptTimeout() time.Duration {
+	if c.StateScriptTimeoutSeconds <= 0 {
+		return defaultStateScriptTimeout
 	}
-	key, err := ioutil.ReadFile(c.ArtifactVerifyKey)
+	return time.Duration(c.StateScriptTimeoutSeconds) * time.Second
+}
+
+// GetHealthCheckTimeout returns the time all the health checks must complete
+// in.
+func (c menderConfig) GetHealthCheckTimeout() time.Duration {
+	if c.HealthCheckTimeoutSeconds <= 0 {
+		return defaultHealthCheckTimeout
+	}
+	return time.Duration(c.HealthCheckTimeoutSeconds) * time.Second
+}
+
+// GetMaintenanceWindowWait returns how long from now on the maintenance window
+// opens; zero if it is open or not configured.
+func (c menderConfig) GetMaintenanceWindowWait(now time.Time) time.Duration {
+	if c.MaintenanceWindowStart == "" && c.MaintenanceWindowEnd == "" {
+		return 0
+	}
+	start, err := time.Parse("15:04", c.MaintenanceWindowStart)
+	if err == nil {
+		var end time.Time
+		if end, err = time.Parse("15:04", c.MaintenanceWindowEnd); err == nil {
+			return maintenanceWindowWait(now, start, end)
+		}
+	}
+	log.Warnf("config: invalid maintenance window %q - %q; installing updates at any time",
+		c.MaintenanceWindowStart, c.MaintenanceWindowEnd)
+	return 0
+}
+
+func maintenanceWindowWait(now, start, end time.Time) time.Duration {
+	opens := time.Date(now.Year(), now.Month(), now.Day(),
+		start.Hour(), start.Minute(), 0, 0, now.Location())
+	closes := time.Date(now.Year(), now.Month(), now.Day(),
+		end.Hour(), end.Minute(), 0, 0, now.Location())
+
+	if !closes.After(opens) {
+		// window spans midnight
+		if now.Before(closes) || !now.Before(opens) {
+			return 0
+		}
+		return opens.Sub(now)
+	}
+	switch {
+	case now.Before(opens):
+		return opens.Sub(now)
+	case now.Before(closes):
+		return 0
+	default:
+		return opens.AddDate(0, 0, 1).Sub(now)
+	}
+}
+
+func (w downloadRateWindow) parse() (time.Time, time.Time, error) {
+	start, err := time.Parse("15:04", w.Start)
 	if err != nil {
-		log.Info("config: error reading artifact verify key")
-		return nil
+		return start, start, err
+	}
+	end, err := time.Parse("15:04", w.End)
+	return start, end, err
+}
+
+// GetDownloadRateLimit returns the highest download rate of artifacts in bytes
+// per second at the time; zero if the rate is not limited.
+func (c menderConfig) GetDownloadRateLimit(now time.Time) int64 {
+	for _, w := range c.DownloadRateSchedule {
+		start, end, err := w.parse()
+		if err != nil {
+			continue
+		}
+		if maintenanceWindowWait(now, start, end) == 0 {
+			return w.BytesPerSecond
+		}
+	}
+	return 0
+}
+
+func (c menderConfig) GetKeyStoreBackend() string {
+	switch c.KeyStoreBackend {
+	case "":
+		if len(c.SignCommand) != 0 {
+			return keyStoreExternal
+		}
+		return keyStoreFile
+	case keyStoreFile, keyStoreMemory, keyStoreExternal:
+		return c.KeyStoreBackend
+	default:
+		log.Warnf("config: unknown key store backend %q; using file",
+			c.KeyStoreBackend)
+		return keyStoreFile
+	}
+}
+
+// GetRebootStrategy returns how the update is activated after installation.
+func (c menderConfig) GetRebootStrategy() string {
+	switch c.RebootStrategy {
+	case "":
+		return rebootStrategySystem
+	case rebootStrategySystem, rebootStrategyNone, rebootStrategyManual:
+		return c.RebootStrategy
+	case rebootStrategyCommand:
+		if len(c.RebootCommand) == 0 {
+			log.Warnf("config: reboot command is not set; using system reboot")
+			return rebootStrategySystem
+		}
+		return c.RebootStrategy
+	default:
+		log.Warnf("config: unknown reboot strategy %q; using system reboot",
+			c.RebootStrategy)
+		return rebootStrategySystem
+	}
+}
+
+// GetRebootDelay returns the grace period before the reboot into the update,
+// and how long the reboot may be postponed in total.
+func (c menderConfig) GetRebootDelay() (grace, max time.Duration) {
+	grace = time.Duration(c.RebootGracePeriodSeconds) * time.Second
+	max = time.Duration(c.MaxRebootDelaySeconds) * time.Second
+	if max <= 0 {
+		max = defaultMaxRebootDelay
+	}
+	if max < grace {
+		max = grace
+	}
+	return grace, max
+}
+
+func (c menderConfig) GetCommitReportFailure() string {
+	switch c.CommitReportFailure {
+	case "":
+		return commitReportRetry
+	case commitReportRetry, commitReportIgnore, commitReportRollback:
+		return c.CommitReportFailure
+	default:
+		log.Warnf("config: unknown commit report failure handling %q; using retry",
+			c.CommitReportFailure)
+		return commitReportRetry
+	}
+}
+
+// GetPollIntervalMin returns the lowest accepted update and inventory poll
+// interval.
+func (c menderConfig) GetPollIntervalMin() time.Duration {
+	if c.PollIntervalMinSeconds <= 0 {
+		return defaultPollIntervalMin
+	}
+	return time.Duration(c.PollIntervalMinSeconds) * time.Second
+}
+
+func (c menderConfig) GetIdentityCommand() string {
+	if c.IdentityCommand == "" {
+		return identityDataHelper
+	}
+	return c.IdentityCommand
+}
+
+// GetInstanceLockFile returns the lock file of the client using the data store
+// in the given directory.
+func (c menderConfig) GetInstanceLockFile(dataStore string) string {
+	if c.InstanceLockFile == "" {
+		return path.Join(dataStore, defaultInstanceLockFile)
+	}
+	return c.InstanceLockFile
+}
+
+func (c menderConfig) GetInventoryScriptsDirs() []string {
+	if len(c.InventoryScriptsDirs) == 0 {
+		return []string{path.Join(getDataDirPath(), "inventory")}
+	}
+	return c.InventoryScriptsDirs
+}
+
+// GetArtifactVerifyKeys returns the keys the artifacts installed from the server
+// on the device type are verified with, according to SignaturePolicies; nil if
+// the artifacts need not be signed.
+func (c menderConfig) GetArtifactVerifyKeys(serverURL,
+	deviceType string) ([][]byte, error) {
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	for _, p := range c.SignaturePolicies {
+		if p.ServerURL != "" && strings.TrimSuffix(p.ServerURL, "/") != serverURL {
+			continue
+		}
+		if p.DeviceType != "" && p.DeviceType != deviceType {
+			continue
+		}
+		if !p.RequireSignature {
+			// signed artifacts are installed without verification, as
+			// if no keys were configured
+			return nil, nil
+		}
+		keys, err := c.GetVerificationKeys()
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, errors.New("config: artifacts must be signed, " +
+				"but no verification keys are configured")
+		}
+		return keys, nil
+	}
+	return c.GetVerificationKeys()
+}
+
+// GetVerificationKeys returns all the configured artifact verification keys.
+// A key that can not be read is an error rather than skipped, as without any
+// keys unsigned artifacts would be accepted.
+func (c menderConfig) GetVerificationKeys() ([][]byte, error) {
+	paths := c.ArtifactVerifyKeys
+	if c.ArtifactVerifyKey != "" {
+		paths = append([]string{c.ArtifactVerifyKey}, paths...)
+	}
+
+	var keys [][]byte
+	for _, p := range paths {
+		key, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "config: error reading artifact verify key")
+		}
+		keys = append(keys, key)
 	}
-	return key
+	return keys, nil
 }
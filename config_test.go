@@ -14,9 +14,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -116,3 +120,211 @@ func TestServerURLConfig(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "https://mender.io", config.ServerURL)
 }
+
+func TestVerificationKeysConfig(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-config-")
+	defer os.RemoveAll(td)
+
+	ioutil.WriteFile(path.Join(td, "key1.pem"), []byte("key1"), 0600)
+	ioutil.WriteFile(path.Join(td, "key2.pem"), []byte("key2"), 0600)
+	ioutil.WriteFile(path.Join(td, "key3.pem"), []byte("key3"), 0600)
+
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+
+	configFile.WriteString(`{
+  "ArtifactVerifyKey": "` + path.Join(td, "key1.pem") + `",
+  "ArtifactVerifyKeys": [
+    "` + path.Join(td, "key2.pem") + `",
+    "` + path.Join(td, "key3.pem") + `"
+  ]
+}`)
+
+	config, err := LoadConfig("mender.config")
+	assert.NoError(t, err)
+	keys, err := config.GetVerificationKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("key1"), []byte("key2"), []byte("key3")}, keys)
+
+	keys, err = menderConfig{}.GetVerificationKeys()
+	assert.NoError(t, err)
+	assert.Nil(t, keys)
+
+	// a key which can not be read is not skipped, as unsigned artifacts
+	// would be accepted if none of the keys could be read
+	config.ArtifactVerifyKeys = append(config.ArtifactVerifyKeys,
+		path.Join(td, "missing.pem"))
+	_, err = config.GetVerificationKeys()
+	assert.Error(t, err)
+	_, err = config.GetArtifactVerifyKeys("", "vexpress-qemu")
+	assert.Error(t, err)
+}
+
+func TestDisabledPhasesConfig(t *testing.T) {
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+
+	configFile.WriteString(`{"InventoryOnly": true, "UpdatesOnly": true}`)
+
+	config, err := LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestAPIVersionConfig(t *testing.T) {
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+
+	configFile.WriteString(`{"APIVersion": "v2"}`)
+	config, err := LoadConfig("mender.config")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", config.APIVersion)
+
+	configFile.Truncate(0)
+	configFile.Seek(0, 0)
+	configFile.WriteString(`{"APIVersion": "v9"}`)
+	config, err = LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported API version")
+	assert.Nil(t, config)
+}
+
+func TestDownloadRateScheduleConfig(t *testing.T) {
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+
+	configFile.WriteString(`{"DownloadRateSchedule": [
+  {"Start": "18:00", "End": "8am", "BytesPerSecond": 1000}
+]}`)
+
+	config, err := LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestDownloadRetryConfig(t *testing.T) {
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+
+	configFile.WriteString(`{"DownloadRetryAttempts": -1}`)
+
+	config, err := LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+
+	ioutil.WriteFile("mender.config", []byte(`{"DownloadMaxReconnects": -1}`), 0600)
+	config, err = LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestLocalOverridesConfig(t *testing.T) {
+	defer os.Remove("mender.config")
+
+	ioutil.WriteFile("mender.config",
+		[]byte(`{"LocalOverrides": ["UpdatePollIntervalSeconds", "LogLevel"]}`), 0600)
+	config, err := LoadConfig("mender.config")
+	assert.NoError(t, err)
+	assert.True(t, config.isLocalOverride("LogLevel"))
+
+	// only the fields the server may change can be overridden
+	ioutil.WriteFile("mender.config",
+		[]byte(`{"LocalOverrides": ["ServerURL"]}`), 0600)
+	config, err = LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestLogLevelConfig(t *testing.T) {
+	defer os.Remove("mender.config")
+
+	ioutil.WriteFile("mender.config", []byte(`{"LogLevel": "debug"}`), 0600)
+	config, err := LoadConfig("mender.config")
+	assert.NoError(t, err)
+	assert.Equal(t, "debug", config.LogLevel)
+
+	ioutil.WriteFile("mender.config", []byte(`{"LogLevel": "chatty"}`), 0600)
+	config, err = LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestRebootStrategyConfig(t *testing.T) {
+	assert.Equal(t, rebootStrategySystem, menderConfig{}.GetRebootStrategy())
+	assert.Equal(t, rebootStrategyNone,
+		menderConfig{RebootStrategy: "none"}.GetRebootStrategy())
+	assert.Equal(t, rebootStrategyManual,
+		menderConfig{RebootStrategy: "manual"}.GetRebootStrategy())
+	assert.Equal(t, rebootStrategyCommand,
+		menderConfig{
+			RebootStrategy: "command",
+			RebootCommand:  []string{"systemctl", "restart", "app"},
+		}.GetRebootStrategy())
+	// command strategy without the command
+	assert.Equal(t, rebootStrategySystem,
+		menderConfig{RebootStrategy: "command"}.GetRebootStrategy())
+	assert.Equal(t, rebootStrategySystem,
+		menderConfig{RebootStrategy: "bogus"}.GetRebootStrategy())
+}
+
+func TestTLSMinVersionConfig(t *testing.T) {
+	assert.EqualValues(t, tls.VersionTLS12, menderConfig{}.GetTLSMinVersion())
+	assert.EqualValues(t, tls.VersionTLS13,
+		menderConfig{TLSMinVersion: "1.3"}.GetTLSMinVersion())
+	assert.EqualValues(t, tls.VersionTLS11,
+		menderConfig{TLSMinVersion: "1.1"}.GetTLSMinVersion())
+	assert.EqualValues(t, tls.VersionTLS12,
+		menderConfig{TLSMinVersion: "SSLv3"}.GetTLSMinVersion())
+
+	conf := menderConfig{TLSMinVersion: "1.3", DisableHTTP2: true}.GetHttpConfig()
+	assert.EqualValues(t, tls.VersionTLS13, conf.MinTLSVersion)
+	assert.True(t, conf.DisableHTTP2)
+
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+
+	configFile.WriteString(`{"TLSMinVersion": "1.3"}`)
+	config, err := LoadConfig("mender.config")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.3", config.TLSMinVersion)
+
+	configFile.Truncate(0)
+	configFile.Seek(0, 0)
+	configFile.WriteString(`{"TLSMinVersion": "SSLv3"}`)
+	config, err = LoadConfig("mender.config")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported TLS version")
+	assert.Nil(t, config)
+}
+
+func TestMaintenanceWindowWait(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2018, 5, 10, hour, min, 0, 0, time.Local)
+	}
+
+	// not configured
+	assert.Equal(t, time.Duration(0), menderConfig{}.GetMaintenanceWindowWait(at(12, 0)))
+	// invalid
+	assert.Equal(t, time.Duration(0), menderConfig{
+		MaintenanceWindowStart: "2am",
+		MaintenanceWindowEnd:   "04:00",
+	}.GetMaintenanceWindowWait(at(12, 0)))
+
+	c := menderConfig{
+		MaintenanceWindowStart: "02:00",
+		MaintenanceWindowEnd:   "04:00",
+	}
+	assert.Equal(t, 90*time.Minute, c.GetMaintenanceWindowWait(at(0, 30)))
+	assert.Equal(t, time.Duration(0), c.GetMaintenanceWindowWait(at(2, 0)))
+	assert.Equal(t, time.Duration(0), c.GetMaintenanceWindowWait(at(3, 59)))
+	assert.Equal(t, 22*time.Hour, c.GetMaintenanceWindowWait(at(4, 0)))
+
+	// spanning midnight
+	c = menderConfig{
+		MaintenanceWindowStart: "23:00",
+		MaintenanceWindowEnd:   "01:00",
+	}
+	assert.Equal(t, time.Duration(0), c.GetMaintenanceWindowWait(at(23, 30)))
+	assert.Equal(t, time.Duration(0), c.GetMaintenanceWindowWait(at(0, 30)))
+	assert.Equal(t, 22*time.Hour, c.GetMaintenanceWindowWait(at(1, 0)))
+}
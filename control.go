@@ -0,0 +1,174 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// The daemon accepts commands from the local operator on a unix socket. Each
+// command is a single line of text and is answered with a single line; either
+// the output of the command, "ok" if the command has no output, or
+// "error: <reason>".
+const (
+	controlCommandPause  = "pause"
+	controlCommandResume = "resume"
+	controlCommandStatus = "status"
+	// drop the authorization token and authorize again right away, e.g. if
+	// the token is known to be rejected by the server
+	controlCommandReauthorize = "reauthorize"
+	// clear the record of an unrecoverable failure, allowing updates again
+	// once the device is repaired
+	controlCommandClearFatal = "clear-fatal"
+	// the output is the PEM encoded public key of the device as a JSON
+	// string, as the PEM data spans multiple lines
+	controlCommandPublicKey = "public-key"
+
+	controlResponseOK    = "ok"
+	controlResponseError = "error: "
+)
+
+// deviceStatus is the output of the status command. It must never include any
+// secrets, such as the private key or the authorization token.
+type deviceStatus struct {
+	KeyFingerprint  string     `json:"key_fingerprint"`
+	Authorized      bool       `json:"authorized"`
+	ServerURL       string     `json:"server_url"`
+	LastUpdateCheck *time.Time `json:"last_update_check,omitempty"`
+	Boot            *bootState `json:"boot,omitempty"`
+	// reason of the unrecoverable failure updates were given up after
+	FatalFailure string `json:"fatal_failure,omitempty"`
+}
+
+// ServeControl starts accepting control commands on the given socket. The
+// socket is closed by Cleanup().
+func (d *menderDaemon) ServeControl(socket string) error {
+	// remove stale socket left behind by the previous instance
+	os.Remove(socket)
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on control socket %s", socket)
+	}
+	// only the owner may control the daemon
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return errors.Wrapf(err, "failed to set control socket permissions")
+	}
+
+	d.control = l
+	go d.acceptControl(l)
+	return nil
+}
+
+func (d *menderDaemon) acceptControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// listener was closed
+			return
+		}
+		go d.handleControl(conn)
+	}
+}
+
+func (d *menderDaemon) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		resp, err := d.runControlCommand(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			resp = controlResponseError + err.Error()
+		} else if resp == "" {
+			resp = controlResponseOK
+		}
+		if _, err := fmt.Fprintln(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// runControlCommand executes the command and returns its output, if any.
+func (d *menderDaemon) runControlCommand(cmd string) (string, error) {
+	log.Infof("control: received command: %s", cmd)
+
+	switch cmd {
+	case controlCommandPause:
+		return "", d.mender.SetUpdatesPaused(true)
+	case controlCommandResume:
+		return "", d.mender.SetUpdatesPaused(false)
+	case controlCommandStatus:
+		data, err := json.Marshal(d.mender.GetDeviceStatus())
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to encode status")
+		}
+		return string(data), nil
+	case controlCommandReauthorize:
+		d.Reauthorize()
+		return "", nil
+	case controlCommandClearFatal:
+		return "", d.mender.SetFatalFailure("")
+	case controlCommandPublicKey:
+		key, err := d.mender.ExportPublicKey()
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(key)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to encode public key")
+		}
+		return string(data), nil
+	default:
+		return "", errors.Errorf("unknown command: %s", cmd)
+	}
+}
+
+// sendControlCommand sends the command to the daemon listening on the given
+// socket and waits for the response. Returns the output of the command, if
+// any.
+func sendControlCommand(socket string, cmd string) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to connect to mender daemon")
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return "", errors.Wrapf(err, "failed to send command to mender daemon")
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read response from mender daemon")
+	}
+	resp = strings.TrimSpace(resp)
+	switch {
+	case resp == controlResponseOK:
+		return "", nil
+	case strings.HasPrefix(resp, controlResponseError):
+		return "", errors.New(strings.TrimPrefix(resp, controlResponseError))
+	default:
+		return resp, nil
+	}
+}
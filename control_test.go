@@ -0,0 +1,251 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemonControl(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-control-")
+	defer os.RemoveAll(td)
+	socket := path.Join(td, "control.sock")
+
+	// daemon is not running
+	_, err := sendControlCommand(socket, controlCommandPause)
+	assert.Error(t, err)
+
+	ctrl := &stateTestController{}
+	d := NewDaemon(ctrl, nil)
+	assert.NoError(t, d.ServeControl(socket))
+
+	fi, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	out, err := sendControlCommand(socket, controlCommandPause)
+	assert.NoError(t, err)
+	assert.Equal(t, "", out)
+	assert.True(t, ctrl.updatesPaused)
+
+	_, err = sendControlCommand(socket, controlCommandResume)
+	assert.NoError(t, err)
+	assert.False(t, ctrl.updatesPaused)
+
+	ctrl.fatalFailure = "rollback failed"
+	_, err = sendControlCommand(socket, controlCommandClearFatal)
+	assert.NoError(t, err)
+	assert.Empty(t, ctrl.fatalFailure)
+
+	_, err = sendControlCommand(socket, "bogus")
+	assert.EqualError(t, err, "unknown command: bogus")
+
+	d.Cleanup()
+	_, err = sendControlCommand(socket, controlCommandPause)
+	assert.Error(t, err)
+
+	// stale socket of the previous instance is replaced
+	d = NewDaemon(ctrl, nil)
+	assert.NoError(t, d.ServeControl(socket))
+	_, err = sendControlCommand(socket, controlCommandPause)
+	assert.NoError(t, err)
+	d.Cleanup()
+}
+
+func TestDaemonControlStatus(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-control-")
+	defer os.RemoveAll(td)
+	socket := path.Join(td, "control.sock")
+
+	ms := store.NewMemStore()
+	ks := store.NewKeystore(ms, defaultKeyFile)
+	assert.NoError(t, ks.Generate())
+	assert.NoError(t, ks.Save())
+	assert.NoError(t, ms.WriteAll(authTokenName, []byte("secret-token")))
+
+	mender := newTestMender(nil, menderConfig{ServerURL: "https://mender.io"},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+	d := NewDaemon(mender, ms)
+	assert.NoError(t, d.ServeControl(socket))
+	defer d.Cleanup()
+
+	out, err := sendControlCommand(socket, controlCommandStatus)
+	assert.NoError(t, err)
+
+	var status map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(out), &status))
+	fp, _ := ks.Fingerprint()
+	assert.Equal(t, map[string]interface{}{
+		"key_fingerprint": fp,
+		"authorized":      true,
+		"server_url":      "https://mender.io",
+	}, status)
+
+	// neither the token nor the private key are exposed
+	assert.NotContains(t, out, "secret-token")
+	keyData, _ := ms.ReadAll(defaultKeyFile)
+	block, _ := pem.Decode(keyData)
+	assert.NotContains(t, out, string(block.Bytes))
+	assert.NotContains(t, out, base64.StdEncoding.EncodeToString(block.Bytes))
+
+	// last successful update check is reported
+	now := time.Now()
+	mender.lastUpdateCheck = now.UnixNano()
+	out, err = sendControlCommand(socket, controlCommandStatus)
+	assert.NoError(t, err)
+	var reported deviceStatus
+	assert.NoError(t, json.Unmarshal([]byte(out), &reported))
+	assert.NotNil(t, reported.LastUpdateCheck)
+	assert.True(t, now.Equal(*reported.LastUpdateCheck))
+
+	// boot flags of the device are reported
+	mender.UInstallCommitRebooter = &fakeDevice{
+		retBootState: &bootState{
+			ActivePartition:   "/dev/mmcblk0p3",
+			NextBootPartition: "/dev/mmcblk0p3",
+			UpgradeAvailable:  true,
+			BootCount:         1,
+		},
+	}
+	out, err = sendControlCommand(socket, controlCommandStatus)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal([]byte(out), &status))
+	assert.Equal(t, map[string]interface{}{
+		"active_partition":    "/dev/mmcblk0p3",
+		"next_boot_partition": "/dev/mmcblk0p3",
+		"upgrade_available":   true,
+		"bootcount":           float64(1),
+	}, status["boot"])
+
+	// public key, but not the private one, can be exported
+	out, err = sendControlCommand(socket, controlCommandPublicKey)
+	assert.NoError(t, err)
+	var pubKey string
+	assert.NoError(t, json.Unmarshal([]byte(out), &pubKey))
+	expected, _ := ks.PublicPEM()
+	assert.Equal(t, expected, pubKey)
+	assert.NotContains(t, out, base64.StdEncoding.EncodeToString(block.Bytes))
+}
+
+func TestDaemonControlConcurrent(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-control-")
+	defer os.RemoveAll(td)
+	socket := path.Join(td, "control.sock")
+
+	ms := store.NewMemStore()
+	config := menderConfig{ServerURL: "https://mender.io"}
+	mender := newTestMender(nil, config, testMenderPieces{
+		MenderPieces: MenderPieces{
+			store: ms,
+		},
+	})
+	d := NewDaemon(mender, ms)
+	assert.NoError(t, d.ServeControl(socket))
+	defer d.Cleanup()
+
+	// the control socket is served while the daemon loop bootstraps and
+	// replaces the configuration
+	keys := make(chan string, 1)
+	go func() {
+		out, err := sendControlCommand(socket, controlCommandPublicKey)
+		assert.NoError(t, err)
+		keys <- out
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			_, err := sendControlCommand(socket, controlCommandStatus)
+			assert.NoError(t, err)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, mender.Bootstrap())
+		config.ServerURL = fmt.Sprintf("https://%d.mender.io", i)
+		mender.ReloadConfig(config)
+		mender.applyRemoteConfig(nil)
+	}
+	<-done
+
+	// the key is generated only once
+	var pubKey string
+	assert.NoError(t, json.Unmarshal([]byte(<-keys), &pubKey))
+	expected, err := mender.authMgr.PublicKeyPEM()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, pubKey)
+}
+
+func TestDaemonControlReauthorize(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-control-")
+	defer os.RemoveAll(td)
+	socket := path.Join(td, "control.sock")
+	DeploymentLogger = NewDeploymentLogManager(td)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Auth.Authorize = true
+	srv.Auth.Token = []byte("fresh-token")
+
+	ms := store.NewMemStore()
+	assert.NoError(t, ms.WriteAll(authTokenName, []byte("rejected-token")))
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+	assert.True(t, mender.IsAuthorized())
+	mender.state = checkWaitState
+
+	d := NewDaemon(mender, ms)
+	assert.NoError(t, d.ServeControl(socket))
+	defer d.Cleanup()
+
+	_, err := sendControlCommand(socket, controlCommandReauthorize)
+	assert.NoError(t, err)
+
+	// update in progress is not interrupted
+	fetch := NewUpdateFetchState(client.UpdateResponse{ID: "foo"})
+	assert.Equal(t, fetch, d.applyReauthorize(fetch))
+	assert.False(t, srv.Auth.Called)
+
+	// the daemon authorizes again before checking for updates
+	d.StopDaemon()
+	assert.NoError(t, d.Run())
+	assert.True(t, srv.Auth.Called)
+	assert.Equal(t, client.AuthToken("fresh-token"), mender.getAuthToken())
+	token, err := ms.ReadAll(authTokenName)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fresh-token"), token)
+
+	// the request is handled only once
+	assert.Equal(t, checkWaitState, d.applyReauthorize(checkWaitState))
+}
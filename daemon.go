@@ -14,6 +14,10 @@
 package main
 
 import (
+	"net"
+	"sync"
+	"time"
+
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/store"
 	"github.com/pkg/errors"
@@ -26,6 +30,33 @@ type menderDaemon struct {
 	stop   bool
 	sctx   StateContext
 	store  store.Store
+	reload chan menderConfig
+	// pending request to authorize again with a fresh token
+	reauthorize chan struct{}
+	// listener accepting control commands; nil if not enabled
+	control net.Listener
+	// held as long as the daemon uses the store; nil if not locked
+	instanceLock *instanceLock
+
+	notifier *systemdNotifier
+	// time after which a state that is not waiting is considered stuck; zero
+	// disables the check
+	stuckStateTimeout time.Duration
+	// age after which stale store entries and deployment logs are removed;
+	// zero disables the cleanup
+	staleDataTTL time.Duration
+	lastCleanup  time.Time
+
+	// run only until the outcome of a single update check is known, see
+	// oneShotResult
+	oneShot bool
+	// status of the deployment reported during the single run
+	oneShotStatus string
+
+	// state being handled and the time its handling started
+	lock         sync.Mutex
+	current      State
+	currentSince time.Time
 }
 
 func NewDaemon(mender Controller, store store.Store) *menderDaemon {
@@ -35,7 +66,9 @@ func NewDaemon(mender Controller, store store.Store) *menderDaemon {
 		sctx: StateContext{
 			store: store,
 		},
-		store: store,
+		store:       store,
+		reload:      make(chan menderConfig, 1),
+		reauthorize: make(chan struct{}, 1),
 	}
 	return &daemon
 }
@@ -44,25 +77,233 @@ func (d *menderDaemon) StopDaemon() {
 	d.stop = true
 }
 
+// ReloadConfig schedules the new configuration to be applied before the next
+// state transition, so that the state being handled (for instance an ongoing
+// download) is not interrupted. Only the most recent configuration is kept.
+func (d *menderDaemon) ReloadConfig(config *menderConfig) {
+	select {
+	case <-d.reload:
+	default:
+	}
+	d.reload <- *config
+}
+
+// Reauthorize schedules a fresh authorization, e.g. if the token is known to be
+// rejected by the server. The token is dropped and the device authorizes again
+// before the next check for updates or inventory submission; an update in
+// progress is not interrupted. Waiting for the next check is cut short.
+func (d *menderDaemon) Reauthorize() {
+	select {
+	case d.reauthorize <- struct{}{}:
+	default:
+		// already requested
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	switch s := d.current.(type) {
+	case *CheckWaitState, *AuthorizeWaitState:
+		// if the state is not waiting yet, the request is picked up
+		// once it is done
+		s.(WaitState).Wake()
+	}
+}
+
+// applyReauthorize returns the authorize state instead of the given one if a
+// fresh authorization was requested and the client is not busy with an update.
+func (d *menderDaemon) applyReauthorize(to State) State {
+	switch to.(type) {
+	case *IdleState, *CheckWaitState, *AuthorizeWaitState,
+		*InventoryUpdateState, *UpdateCheckState:
+	default:
+		return to
+	}
+
+	select {
+	case <-d.reauthorize:
+		log.Info("authorizing again on request")
+		d.mender.ClearAuthToken()
+		return authorizeState
+	default:
+		return to
+	}
+}
+
 func (d *menderDaemon) Cleanup() {
+	if d.control != nil {
+		d.control.Close()
+		d.control = nil
+	}
 	if d.store != nil {
 		if err := d.store.Close(); err != nil {
 			log.Errorf("failed to close data store: %v", err)
 		}
 		d.store = nil
 	}
+	if err := d.instanceLock.Release(); err != nil {
+		log.Errorf("%v", err)
+	}
+	d.instanceLock = nil
 }
 
 func (d *menderDaemon) shouldStop() bool {
 	return d.stop
 }
 
+func (d *menderDaemon) setCurrentState(s State) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.current = s
+	d.currentSince = time.Now()
+}
+
+// isStuck returns true if the state being handled is not a wait state and its
+// handling did not finish within stuckStateTimeout.
+func (d *menderDaemon) isStuck(now time.Time) bool {
+	if d.stuckStateTimeout == 0 {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.current == nil {
+		return false
+	}
+	if _, ok := d.current.(WaitState); ok {
+		return false
+	}
+	return now.Sub(d.currentSince) > d.stuckStateTimeout
+}
+
+func (d *menderDaemon) notify(state string) {
+	if err := d.notifier.Notify(state); err != nil {
+		log.Warnf("systemd notification failed: %v", err)
+	}
+}
+
+// runWatchdog sends keep-alive messages to systemd as long as the state machine
+// is not stuck. Once it is, keep-alive messages are no longer sent and systemd
+// restarts the service.
+func (d *menderDaemon) runWatchdog(done chan struct{}) {
+	intvl := d.notifier.WatchdogInterval()
+	if intvl == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(intvl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if d.isStuck(now) {
+				log.Errorf("state machine is stuck; not sending watchdog keep-alive")
+				continue
+			}
+			d.notify(sdNotifyWatchdog)
+		}
+	}
+}
+
+// cleanup removes stale store entries and deployment logs, at most once every
+// storeCleanupInterval.
+func (d *menderDaemon) cleanup(now time.Time) {
+	if d.staleDataTTL == 0 || now.Sub(d.lastCleanup) < storeCleanupInterval {
+		return
+	}
+	d.lastCleanup = now
+
+	if d.store != nil {
+		if err := cleanupStore(d.store, d.staleDataTTL, now); err != nil {
+			log.Warnf("failed to clean up the store: %v", err)
+		}
+	}
+	if DeploymentLogger != nil {
+		DeploymentLogger.RemoveLogsOlderThan(now.Add(-d.staleDataTTL))
+	}
+}
+
+type transitionResult struct {
+	state     State
+	cancelled bool
+}
+
+// transitionState transitions to the given state. If handling of the state is
+// stuck, it is cancelled and an error state is returned instead so that the
+// device can recover. The next state is not entered before the cancelled
+// handler has returned; if it does not return within another
+// stuckStateTimeout, a fatal error is returned so that the client exits and
+// is restarted.
+func (d *menderDaemon) transitionState(to State) (State, bool) {
+	if _, ok := to.(WaitState); ok || d.stuckStateTimeout == 0 {
+		return d.mender.TransitionState(to, &d.sctx)
+	}
+
+	res := make(chan transitionResult, 1)
+	go func() {
+		s, c := d.mender.TransitionState(to, &d.sctx)
+		res <- transitionResult{s, c}
+	}()
+
+	timer := time.NewTimer(d.stuckStateTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-res:
+		return r.state, r.cancelled
+	case <-timer.C:
+		err := NewTransientError(errors.Errorf(
+			"state %s did not finish within %v", to.Id(), d.stuckStateTimeout))
+		log.Errorf("state machine is stuck: %v", err)
+		to.Cancel()
+		timer.Reset(d.stuckStateTimeout)
+		select {
+		case <-res:
+		case <-timer.C:
+			return NewErrorState(NewFatalError(errors.Errorf(
+				"state %s did not return after being cancelled", to.Id()))), false
+		}
+		if upd, uerr := getUpdateFromState(to); uerr == nil {
+			return NewUpdateErrorState(err, upd), false
+		}
+		return NewErrorState(err), false
+	}
+}
+
 func (d *menderDaemon) Run() error {
 	// set the first state transition
 	var toState State = d.mender.GetCurrentState()
 	cancelled := false
+
+	if d.oneShot {
+		// check for updates right away instead of after the start-up delay
+		d.sctx.firstUpdateCheck = time.Now()
+	}
+
+	d.notify(sdNotifyReady)
+	done := make(chan struct{})
+	defer close(done)
+	go d.runWatchdog(done)
+
 	for {
-		toState, cancelled = d.mender.TransitionState(toState, &d.sctx)
+		select {
+		case config := <-d.reload:
+			d.mender.ReloadConfig(config)
+		default:
+		}
+		toState = d.applyReauthorize(toState)
+		// clean up only while no update is in progress
+		if _, ok := toState.(*CheckWaitState); ok {
+			d.cleanup(time.Now())
+		}
+
+		d.setCurrentState(toState)
+		d.notify(sdNotifyWatchdog + "\n" + sdNotifyStatus + toState.Id().String())
+
+		from := toState
+		authorizeFailures := d.sctx.authorizeFailures
+		toState, cancelled = d.transitionState(toState)
 
 		if toState.Id() == MenderStateError {
 			es, ok := toState.(*ErrorState)
@@ -74,6 +315,11 @@ func (d *menderDaemon) Run() error {
 				return errors.New("failed")
 			}
 		}
+		if d.oneShot {
+			if code, ok := d.oneShotResult(from, toState, authorizeFailures); ok {
+				return exitWithCode(code)
+			}
+		}
 		if cancelled || toState.Id() == MenderStateDone {
 			break
 		}
@@ -14,14 +14,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/store"
 	"github.com/stretchr/testify/assert"
@@ -36,6 +40,8 @@ type fakeDevice struct {
 	retHasUpdate      bool
 	retHasUpdateError error
 	consumeUpdate     bool
+	retBootState      *bootState
+	retBootStateError error
 }
 
 func (f fakeDevice) Reboot() error {
@@ -66,12 +72,19 @@ func (f fakeDevice) HasUpdate() (bool, error) {
 	return f.retHasUpdate, f.retHasUpdateError
 }
 
+func (f fakeDevice) GetBootState() (*bootState, error) {
+	return f.retBootState, f.retBootStateError
+}
+
 type fakeUpdater struct {
 	GetScheduledUpdateReturnIface interface{}
 	GetScheduledUpdateReturnError error
 	fetchUpdateReturnReadCloser   io.ReadCloser
 	fetchUpdateReturnSize         int64
 	fetchUpdateReturnError        error
+	resumeUpdateReturnReadCloser  io.ReadCloser
+	resumeUpdateReturnSize        int64
+	resumeUpdateReturnError       error
 }
 
 func (f fakeUpdater) GetScheduledUpdate(api client.ApiRequester, url string) (interface{}, error) {
@@ -80,6 +93,9 @@ func (f fakeUpdater) GetScheduledUpdate(api client.ApiRequester, url string) (in
 func (f fakeUpdater) FetchUpdate(api client.ApiRequester, url string) (io.ReadCloser, int64, error) {
 	return f.fetchUpdateReturnReadCloser, f.fetchUpdateReturnSize, f.fetchUpdateReturnError
 }
+func (f fakeUpdater) FetchUpdateFrom(api client.ApiRequester, url string, offset int64) (io.ReadCloser, int64, error) {
+	return f.resumeUpdateReturnReadCloser, f.resumeUpdateReturnSize, f.resumeUpdateReturnError
+}
 
 func fakeProcessUpdate(response *http.Response) (interface{}, error) {
 	return nil, nil
@@ -134,9 +150,9 @@ type daemonTestController struct {
 	updateCheckCount int
 }
 
-func (d *daemonTestController) CheckUpdate() (*client.UpdateResponse, menderError) {
+func (d *daemonTestController) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
 	d.updateCheckCount++
-	return d.stateTestController.CheckUpdate()
+	return d.stateTestController.CheckUpdate(ctx)
 }
 
 func (d *daemonTestController) TransitionState(next State, ctx *StateContext) (State, bool) {
@@ -178,3 +194,263 @@ func TestDaemonRun(t *testing.T) {
 	t.Logf("poke count: %v", dtc.updateCheckCount)
 	assert.False(t, dtc.updateCheckCount < (timespolled-1))
 }
+
+type reloadCheckState struct {
+	baseState
+	pollIntvl  time.Duration
+	pollJitter time.Duration
+}
+
+func (r *reloadCheckState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	r.pollIntvl = c.GetUpdatePollInterval()
+	r.pollJitter = c.GetUpdatePollJitter()
+	return doneState, false
+}
+
+func TestDaemonReloadConfig(t *testing.T) {
+	oldLevel, oldFromCommandLine := log.Log.Level, logLevelFromCommandLine
+	defer func() {
+		log.SetLevel(oldLevel)
+		logLevelFromCommandLine = oldFromCommandLine
+	}()
+	logLevelFromCommandLine = false
+	log.SetLevel(log.InfoLevel)
+
+	store := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{
+		UpdatePollIntervalSeconds: 20,
+		RootfsPartA:               "/dev/mmcblk0p2",
+	}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			store: store,
+		},
+	})
+	mender.authToken = client.AuthToken("authorized")
+
+	check := &reloadCheckState{
+		baseState: baseState{id: MenderStateCheckWait},
+	}
+	mender.state = check
+
+	d := NewDaemon(mender, store)
+	d.ReloadConfig(&menderConfig{
+		UpdatePollIntervalSeconds: 30,
+		RootfsPartA:               "/dev/mmcblk0p2",
+	})
+	// only the last configuration is applied
+	d.ReloadConfig(&menderConfig{
+		UpdatePollIntervalSeconds: 5,
+		UpdatePollJitterSeconds:   2,
+		LogLevel:                  "debug",
+		RootfsPartA:               "/dev/mmcblk0p3",
+	})
+
+	assert.NoError(t, d.Run())
+
+	// the subsequent state sees the new interval and jitter
+	assert.Equal(t, 5*time.Second, check.pollIntvl)
+	assert.True(t, check.pollJitter <= 2*time.Second)
+	assert.Equal(t, 2, mender.config.UpdatePollJitterSeconds)
+	// and the new log level is in effect
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+	// fields that can not be changed live are ignored
+	assert.Equal(t, "/dev/mmcblk0p2", mender.config.RootfsPartA)
+	// reloading must not drop the authorization
+	assert.Equal(t, client.AuthToken("authorized"), mender.authToken)
+}
+
+// stuckState blocks until it is cancelled.
+type stuckState struct {
+	cancellableState
+	returned bool
+}
+
+func (s *stuckState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	<-s.begin().Done()
+	s.end()
+	s.returned = true
+	return doneState, false
+}
+
+// hangingState blocks until released, even if cancelled.
+type hangingState struct {
+	baseState
+	release chan struct{}
+}
+
+func (s *hangingState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	<-s.release
+	return doneState, false
+}
+
+type stuckUpdateState struct {
+	stuckState
+	update client.UpdateResponse
+}
+
+func (s *stuckUpdateState) Update() client.UpdateResponse {
+	return s.update
+}
+
+func TestDaemonStuckState(t *testing.T) {
+	store := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: store,
+			},
+		})
+
+	d := NewDaemon(mender, store)
+	d.stuckStateTimeout = 100 * time.Millisecond
+
+	update := client.UpdateResponse{ID: "foo"}
+	stuck := &stuckUpdateState{
+		stuckState: stuckState{cancellableState: cancellableState{
+			baseState: baseState{id: MenderStateUpdateInstall},
+		}},
+		update: update,
+	}
+	next, cancelled := d.transitionState(stuck)
+	assert.False(t, cancelled)
+	assert.IsType(t, &UpdateErrorState{}, next)
+	assert.Equal(t, update, next.(*UpdateErrorState).Update())
+	// the stuck handler is cancelled before the error state is entered
+	assert.True(t, stuck.returned)
+
+	// not handling an update
+	stuckInventory := &stuckState{cancellableState: cancellableState{
+		baseState: baseState{id: MenderStateInventoryUpdate},
+	}}
+	next, cancelled = d.transitionState(stuckInventory)
+	assert.False(t, cancelled)
+	assert.IsType(t, &ErrorState{}, next)
+	assert.False(t, next.(*ErrorState).IsFatal())
+	assert.True(t, stuckInventory.returned)
+
+	// detection disabled
+	d.stuckStateTimeout = 0
+	next, _ = d.transitionState(&fakePreDoneState{baseState{id: MenderStateInit}})
+	assert.Equal(t, doneState, next)
+
+	// handler ignoring the cancellation; the client exits and is restarted
+	d.stuckStateTimeout = 100 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	hanging := &hangingState{baseState{id: MenderStateInventoryUpdate}, release}
+	start := time.Now()
+	next, cancelled = d.transitionState(hanging)
+	assert.False(t, cancelled)
+	assert.IsType(t, &ErrorState{}, next)
+	assert.True(t, next.(*ErrorState).IsFatal())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestDaemonOneShot(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	// error returned for a server that can not be reached
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	api, _ := client.New(client.Config{})
+	unreachable := client.NewStatus().Report(api, srv.URL,
+		client.StatusReport{DeploymentID: "1", Status: client.StatusSuccess})
+
+	update := &client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.ArtifactName = "bar"
+
+	tc := map[string]struct {
+		sc    stateTestController
+		state State
+		code  int
+	}{
+		"no update": {
+			sc:   stateTestController{},
+			code: exitNoUpdate,
+		},
+		"update applied": {
+			sc:    stateTestController{},
+			state: NewUpdateStatusReportState(*update, client.StatusSuccess),
+			code:  exitUpdateApplied,
+		},
+		"update activated with manual reboot": {
+			sc: stateTestController{
+				updateResp:     update,
+				rebootStrategy: rebootStrategyManual,
+				updater: fakeUpdater{
+					fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewReader(nil)),
+				},
+			},
+			code: exitUpdateApplied,
+		},
+		"update failed": {
+			sc:    stateTestController{},
+			state: NewUpdateStatusReportState(*update, client.StatusFailure),
+			code:  exitUpdateFailed,
+		},
+		"update installed already": {
+			sc:    stateTestController{},
+			state: NewUpdateStatusReportState(*update, client.StatusAlreadyInstalled),
+			code:  exitNoUpdate,
+		},
+		"authorization failed": {
+			sc: stateTestController{
+				authorizeErr: NewTransientError(errors.New("device rejected")),
+			},
+			code: exitAuthFailed,
+		},
+		"server unreachable when authorizing": {
+			sc: stateTestController{
+				authorizeErr: NewTransientError(unreachable),
+			},
+			code: exitServerUnreachable,
+		},
+		"server unreachable when checking for updates": {
+			sc: stateTestController{
+				updateRespErr: NewTransientError(unreachable),
+			},
+			code: exitServerUnreachable,
+		},
+	}
+
+	for name, c := range tc {
+		t.Run(name, func(t *testing.T) {
+			sc := c.sc
+			sc.state = c.state
+			if sc.state == nil {
+				sc.state = initState
+			}
+			sc.pollIntvl = time.Hour
+			sc.retryIntvl = time.Hour
+			// the daemon would otherwise wait for the start-up delay
+			sc.startupDelay = time.Hour
+
+			d := NewDaemon(&sc, store.NewMemStore())
+			d.oneShot = true
+
+			res := make(chan error, 1)
+			go func() {
+				res <- d.Run()
+			}()
+			var err error
+			select {
+			case err = <-res:
+			case <-time.After(5 * time.Second):
+				d.StopDaemon()
+				t.Fatalf("single run did not finish; state %s", sc.state.Id())
+			}
+
+			if c.code == exitNoUpdate {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.IsType(t, &exitCodeError{}, err) {
+				assert.Equal(t, c.code, err.(*exitCodeError).code)
+			}
+		})
+	}
+}
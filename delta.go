@@ -0,0 +1,183 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// Delta image format
+//
+// A delta image is stored in the artifact in place of the full rootfs image.
+// It starts with deltaMagic, followed by a single line holding the JSON encoded
+// deltaHeader. The rest of the image is a sequence of operations
+// reconstructing the target image:
+//
+//	'C' <offset uint64> <length uint64>  copy length bytes of the base image
+//	                                     starting at offset
+//	'I' <length uint64> <data>           insert length bytes of data
+//
+// All the integers are big endian.
+const (
+	deltaMagic = "MENDER-DELTA-1\n"
+
+	deltaOpCopy   = 'C'
+	deltaOpInsert = 'I'
+)
+
+var (
+	errDeltaBaseMismatch = errors.New("delta update base does not match the installed artifact")
+)
+
+type deltaHeader struct {
+	// name of the artifact the delta must be applied to
+	BaseArtifactName string
+	// size and hex encoded SHA256 checksum of the reconstructed image
+	TargetSize     int64
+	TargetChecksum string
+}
+
+// baseImageOpener is implemented by devices able to provide the currently
+// installed image delta updates are applied to.
+type baseImageOpener interface {
+	OpenActiveImage() (*os.File, error)
+}
+
+// deltaInstaller reconstructs the image from the delta and the currently
+// installed image before passing it to the device. Full images are passed to
+// the device unchanged.
+type deltaInstaller struct {
+	installer.UInstaller
+	// name of the currently installed artifact
+	artifactName string
+}
+
+func (d *deltaInstaller) InstallUpdate(image io.ReadCloser, size int64) error {
+	defer image.Close()
+
+	r := bufio.NewReader(image)
+	magic, _ := r.Peek(len(deltaMagic))
+	if !bytes.Equal(magic, []byte(deltaMagic)) {
+		return d.UInstaller.InstallUpdate(ioutil.NopCloser(r), size)
+	}
+
+	r.Discard(len(deltaMagic))
+	hdrData, err := r.ReadBytes('\n')
+	if err != nil {
+		return errors.Wrapf(err, "failed to read delta update header")
+	}
+	var hdr deltaHeader
+	if err := json.Unmarshal(hdrData, &hdr); err != nil {
+		return errors.Wrapf(err, "failed to parse delta update header")
+	}
+
+	if hdr.BaseArtifactName != d.artifactName {
+		return errors.Wrapf(errDeltaBaseMismatch, "delta base: %s, installed: %s",
+			hdr.BaseArtifactName, d.artifactName)
+	}
+
+	opener, ok := d.UInstaller.(baseImageOpener)
+	if !ok {
+		return errors.New("delta updates are not supported by the device")
+	}
+	base, err := opener.OpenActiveImage()
+	if err != nil {
+		return errors.Wrapf(err, "failed to open base image of delta update")
+	}
+	defer base.Close()
+
+	log.Infof("applying delta update to artifact %s", hdr.BaseArtifactName)
+	target := applyDelta(base, r, hdr)
+	// makes sure the delta is not applied any further if the device bails out
+	defer target.Close()
+	return d.UInstaller.InstallUpdate(target, hdr.TargetSize)
+}
+
+// applyDelta returns the image reconstructed from the base image and the delta
+// operations. Reading the image fails if it does not match the size or the
+// checksum given in the header.
+func applyDelta(base io.ReaderAt, ops io.Reader, hdr deltaHeader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		h := sha256.New()
+		w := io.MultiWriter(pw, h)
+
+		n, err := applyDeltaOps(base, ops, w)
+		if err == nil && n != hdr.TargetSize {
+			err = errors.Errorf("delta update size mismatch; expected %d, got %d",
+				hdr.TargetSize, n)
+		}
+		if err == nil {
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != hdr.TargetChecksum {
+				err = errors.Errorf("delta update checksum mismatch; "+
+					"expected %s, got %s", hdr.TargetChecksum, sum)
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func applyDeltaOps(base io.ReaderAt, ops io.Reader, w io.Writer) (int64, error) {
+	var written int64
+	var op [1]byte
+	for {
+		if _, err := io.ReadFull(ops, op[:]); err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, errors.Wrapf(err, "failed to read delta update")
+		}
+
+		var n int64
+		var err error
+		switch op[0] {
+		case deltaOpCopy:
+			var args [2]uint64
+			if err = binary.Read(ops, binary.BigEndian, &args); err != nil {
+				break
+			}
+			n, err = io.Copy(w, io.NewSectionReader(base,
+				int64(args[0]), int64(args[1])))
+			if err == nil && n != int64(args[1]) {
+				err = errors.New("copy beyond the end of the base image")
+			}
+		case deltaOpInsert:
+			var length uint64
+			if err = binary.Read(ops, binary.BigEndian, &length); err != nil {
+				break
+			}
+			n, err = io.CopyN(w, ops, int64(length))
+		default:
+			err = errors.Errorf("unknown operation: %q", op[0])
+		}
+		written += n
+		if err != nil {
+			return written, errors.Wrapf(err, "failed to apply delta update")
+		}
+	}
+}
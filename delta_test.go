@@ -0,0 +1,177 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type deltaTestDevice struct {
+	base      string
+	installed bytes.Buffer
+}
+
+func (d *deltaTestDevice) InstallUpdate(r io.ReadCloser, size int64) error {
+	d.installed.Reset()
+	_, err := io.Copy(&d.installed, r)
+	return err
+}
+
+func (d *deltaTestDevice) EnableUpdatedPartition() error {
+	return nil
+}
+
+func (d *deltaTestDevice) OpenActiveImage() (*os.File, error) {
+	return os.Open(d.base)
+}
+
+func makeDelta(hdr deltaHeader, ops ...interface{}) io.ReadCloser {
+	buf := bytes.NewBufferString(deltaMagic)
+	data, _ := json.Marshal(hdr)
+	buf.Write(data)
+	buf.WriteByte('\n')
+
+	for _, op := range ops {
+		switch op := op.(type) {
+		case [2]uint64:
+			buf.WriteByte(deltaOpCopy)
+			binary.Write(buf, binary.BigEndian, op)
+		case string:
+			buf.WriteByte(deltaOpInsert)
+			binary.Write(buf, binary.BigEndian, uint64(len(op)))
+			buf.WriteString(op)
+		}
+	}
+	return ioutil.NopCloser(buf)
+}
+
+func TestDeltaInstall(t *testing.T) {
+	base, _ := ioutil.TempFile("", "mender-delta-base-")
+	defer os.Remove(base.Name())
+	base.WriteString("hello world, this is release-1")
+	base.Close()
+
+	target := "hello mender, this is release-2"
+	sum := sha256.Sum256([]byte(target))
+	hdr := deltaHeader{
+		BaseArtifactName: "release-1",
+		TargetSize:       int64(len(target)),
+		TargetChecksum:   hex.EncodeToString(sum[:]),
+	}
+	ops := []interface{}{
+		[2]uint64{0, 6},
+		"mender",
+		[2]uint64{11, 18},
+		"2",
+	}
+
+	dev := &deltaTestDevice{base: base.Name()}
+	di := &deltaInstaller{UInstaller: dev, artifactName: "release-1"}
+
+	// full image is installed as is
+	err := di.InstallUpdate(ioutil.NopCloser(bytes.NewBufferString(target)),
+		int64(len(target)))
+	assert.NoError(t, err)
+	assert.Equal(t, target, dev.installed.String())
+
+	err = di.InstallUpdate(makeDelta(hdr, ops...), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, target, dev.installed.String())
+
+	// reconstructed image does not match
+	bad := hdr
+	bad.TargetChecksum = hex.EncodeToString(make([]byte, sha256.Size))
+	err = di.InstallUpdate(makeDelta(bad, ops...), 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+
+	bad = hdr
+	bad.TargetSize++
+	err = di.InstallUpdate(makeDelta(bad, ops...), 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "size mismatch")
+
+	// copy beyond the end of the base image
+	err = di.InstallUpdate(makeDelta(hdr, [2]uint64{20, 100}), 0)
+	assert.Error(t, err)
+
+	// delta for different base
+	di.artifactName = "release-0"
+	err = di.InstallUpdate(makeDelta(hdr, ops...), 0)
+	assert.Error(t, err)
+	assert.Equal(t, errDeltaBaseMismatch, errors.Cause(err))
+}
+
+// makeDeltaArtifact returns an artifact with the delta as its rootfs image.
+func makeDeltaArtifact(t *testing.T, hdr deltaHeader, ops ...interface{}) io.ReadCloser {
+	delta, err := ioutil.ReadAll(makeDelta(hdr, ops...))
+	require.NoError(t, err)
+	upd, err := MakeFakeUpdate(string(delta))
+	require.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = awriter.NewWriter(art).WriteArtifact("mender", 2,
+		[]string{"vexpress-qemu"}, "release-2", updates, nil)
+	require.NoError(t, err)
+	return ioutil.NopCloser(art)
+}
+
+func TestMenderInstallDeltaBaseMismatch(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-install-delta-")
+	defer os.RemoveAll(td)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-0\n"), 0644)
+
+	// the device is not written to
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			device: &fakeDevice{retInstallUpdate: errors.New("installed")},
+		},
+	})
+	mender.deviceTypeFile = deviceType
+	mender.artifactInfoFile = artifactInfo
+
+	// the delta applies to a different artifact than the installed one
+	art := makeDeltaArtifact(t, deltaHeader{BaseArtifactName: "release-1"}, "release-2")
+	err := mender.InstallArtifact(context.Background(), art, 0, "release-2")
+	require.Error(t, err)
+	assert.True(t, errorIs(err, errDeltaBaseMismatch), err.Error())
+}
+
+func TestDeltaInstallNotSupported(t *testing.T) {
+	di := &deltaInstaller{UInstaller: fakeDevice{}, artifactName: "release-1"}
+	err := di.InstallUpdate(makeDelta(deltaHeader{BaseArtifactName: "release-1"}), 0)
+	assert.EqualError(t, err, "delta updates are not supported by the device")
+}
@@ -32,7 +32,7 @@ type DeploymentJSONFormatter struct {
 }
 
 func (f *DeploymentJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
-	data := make(logrus.Fields, 3)
+	data := make(logrus.Fields, 4)
 
 	timestampFormat := f.TimestampFormat
 	if timestampFormat == "" {
@@ -42,6 +42,9 @@ func (f *DeploymentJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	data["timestamp"] = entry.Time.Format(timestampFormat)
 	data["message"] = entry.Message
 	data["level"] = entry.Level.String()
+	if state, ok := entry.Data["state"]; ok {
+		data["state"] = state
+	}
 
 	serialized, err := json.Marshal(data)
 	if err != nil {
@@ -73,11 +76,15 @@ func (dh DeploymentHook) Fire(entry *logrus.Entry) error {
 		return nil
 	}
 
-	// customize log message to contain only message, level and time
+	// customize log message to contain only message, level, time and the
+	// state of the client
 	dLog := logrus.NewEntry(entry.Logger)
 	dLog.Message = entry.Message
 	dLog.Level = entry.Level
 	dLog.Time = entry.Time
+	if dh.logManager.state != "" {
+		dLog.Data = logrus.Fields{"state": dh.logManager.state}
+	}
 
 	message, err := dh.formater.Format(dLog)
 	if err != nil {
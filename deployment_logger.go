@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // error messages
@@ -74,6 +75,9 @@ type DeploymentLogManager struct {
 	// it is easy to add logging hook, but not so much remove it;
 	// we need a mechanism for emabling and disabling logging
 	loggingEnabled bool
+	// state the client is in; logged along with every message, so that the
+	// phase of the deployment a message comes from can be told from the log
+	state string
 }
 
 const baseLogFileName = "deployments"
@@ -140,6 +144,14 @@ func (dlm *DeploymentLogManager) Enable(deploymentID string) error {
 	return nil
 }
 
+// SetState sets the state the following messages are logged in.
+func (dlm *DeploymentLogManager) SetState(state MenderState) {
+	if dlm == nil {
+		return
+	}
+	dlm.state = state.String()
+}
+
 func (dlm *DeploymentLogManager) Disable() error {
 	if !dlm.loggingEnabled {
 		return nil
@@ -166,7 +178,7 @@ func (dlm DeploymentLogManager) getSortedLogFiles() ([]string, error) {
 	return logFiles, nil
 }
 
-//log naming convention: <base_name>.%04d.<deployment_id>.log
+// log naming convention: <base_name>.%04d.<deployment_id>.log
 func (dlm DeploymentLogManager) rotateLogFileName(name string) string {
 	logFileName := filepath.Base(name)
 	nameChunks := strings.Split(logFileName, ".")
@@ -221,6 +233,24 @@ func (dlm DeploymentLogManager) Rotate() {
 	}
 }
 
+// RemoveLogsOlderThan removes the logs of the deployments which were last
+// written to before t; the log of the deployment being logged is kept.
+func (dlm DeploymentLogManager) RemoveLogsOlderThan(t time.Time) {
+	logFiles, err := dlm.getSortedLogFiles()
+	if err != nil {
+		return
+	}
+
+	for _, file := range logFiles {
+		if dlm.loggingEnabled && strings.Contains(file, dlm.deploymentID) {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil && info.ModTime().Before(t) {
+			os.Remove(file)
+		}
+	}
+}
+
 func (dlm DeploymentLogManager) findLogsForSpecificID(deploymentID string) (string, error) {
 	logFiles, err := dlm.getSortedLogFiles()
 	if err != nil {
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -278,6 +279,48 @@ func TestDeploymentLoggingHook(t *testing.T) {
 	}
 }
 
+type loggingTestState struct {
+	baseState
+}
+
+func (s *loggingTestState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Infof("handling %s", s.Id())
+	return doneState, false
+}
+
+func TestDeploymentLoggingState(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	log.AddHook(NewDeploymentLogHook(DeploymentLogger))
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	DeploymentLogger.Enable("1111-2222")
+	for _, id := range []MenderState{MenderStateUpdateFetch, MenderStateUpdateInstall} {
+		mender.TransitionState(&loggingTestState{baseState{id: id}}, nil)
+	}
+	DeploymentLogger.Disable()
+
+	// the uploaded logs tell which state each message comes from
+	data, err := DeploymentLogger.GetLogs("1111-2222")
+	assert.NoError(t, err)
+	var logs struct {
+		Messages []struct {
+			Message string `json:"message"`
+			State   string `json:"state"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &logs))
+
+	states := map[string]string{}
+	for _, m := range logs.Messages {
+		states[m.Message] = m.State
+	}
+	assert.Equal(t, "update-fetch", states["handling update-fetch"])
+	assert.Equal(t, "update-install", states["handling update-install"])
+}
+
 func TestGetLogs(t *testing.T) {
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
@@ -16,6 +16,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -28,16 +29,32 @@ import (
 type deviceConfig struct {
 	rootfsPartA string
 	rootfsPartB string
+	// partition the update is installed to instead of the inactive one
+	installTarget string
 }
 
 type device struct {
 	BootEnvReadWriter
 	Commander
 	*partitions
+	// partition the update is installed to; the inactive one if not set
+	installTarget string
+}
+
+// bootState describes the boot flags of the device, for diagnostics.
+type bootState struct {
+	// partition the system is running from; empty if it can not be detected
+	ActivePartition string `json:"active_partition,omitempty"`
+	// partition the bootloader boots next
+	NextBootPartition string `json:"next_boot_partition,omitempty"`
+	UpgradeAvailable  bool   `json:"upgrade_available"`
+	BootCount         int    `json:"bootcount"`
 }
 
 var (
 	errorNoUpgradeMounted = errors.New("There is nothing to commit")
+
+	errInstallTargetActive = errors.New("can not install the update to the active partition")
 )
 
 func NewDevice(env BootEnvReadWriter, sc StatCommander, config deviceConfig) *device {
@@ -49,17 +66,28 @@ func NewDevice(env BootEnvReadWriter, sc StatCommander, config deviceConfig) *de
 		active:            "",
 		inactive:          "",
 	}
-	device := device{env, sc, &partitions}
+	device := device{env, sc, &partitions, config.installTarget}
 	return &device
 }
 
 func (d *device) Reboot() error {
-	return d.Command("reboot").Run()
+	cmd := d.Command("reboot")
+	output := &commandOutput{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return commandError(err, "reboot", output)
+	}
+	return nil
 }
 
 func (d *device) SwapPartitions() error {
 	// first get inactive partition
-	inactivePartition, inactivePartitionHex, err := d.getInactivePartition()
+	inactive, err := d.GetInactive()
+	if err != nil {
+		return errors.New("Error obtaining inactive partition: " + err.Error())
+	}
+	inactivePartition, inactivePartitionHex, err := partitionNumber(inactive)
 	if err != nil {
 		return err
 	}
@@ -80,7 +108,7 @@ func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 		return errors.New("Have invalid update. Aborting.")
 	}
 
-	inactivePartition, err := d.GetInactive()
+	inactivePartition, err := d.getInstallTarget()
 	if err != nil {
 		return err
 	}
@@ -139,18 +167,42 @@ func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 	return err
 }
 
-func (d *device) getInactivePartition() (string, string, error) {
-	inactivePartition, err := d.GetInactive()
+// OpenActiveImage opens the partition the running system was booted from.
+func (d *device) OpenActiveImage() (*os.File, error) {
+	activePartition, err := d.GetActive()
 	if err != nil {
-		return "", "", errors.New("Error obtaining inactive partition: " + err.Error())
+		return nil, err
+	}
+	if isUbiBlockDevice(activePartition) {
+		activePartition = filepath.Join("/dev", activePartition)
+	}
+	return os.Open(activePartition)
+}
+
+// getInstallTarget returns the partition the update is installed to; the
+// inactive one, unless the target is set explicitly, e.g. for recovery. The
+// partition the system is running from is never a valid target.
+func (d *device) getInstallTarget() (string, error) {
+	if d.installTarget == "" {
+		return d.GetInactive()
 	}
 
-	log.Debugf("Marking inactive partition (%s) as the new boot candidate.", inactivePartition)
+	active, err := d.GetActive()
+	if err != nil {
+		return "", err
+	}
+	if filepath.Clean(d.installTarget) == filepath.Clean(active) {
+		return "", errors.Wrapf(errInstallTargetActive, "target %s", d.installTarget)
+	}
+	return d.installTarget, nil
+}
 
-	partitionNumberDecStr := inactivePartition[len(strings.TrimRight(inactivePartition, "0123456789")):]
+// partitionNumber returns the decimal and hexadecimal number of the partition.
+func partitionNumber(partition string) (string, string, error) {
+	partitionNumberDecStr := partition[len(strings.TrimRight(partition, "0123456789")):]
 	partitionNumberDec, err := strconv.Atoi(partitionNumberDecStr)
 	if err != nil {
-		return "", "", errors.New("Invalid inactive partition: " + inactivePartition)
+		return "", "", errors.New("Invalid inactive partition: " + partition)
 	}
 
 	partitionNumberHexStr := fmt.Sprintf("%X", partitionNumberDec)
@@ -160,7 +212,13 @@ func (d *device) getInactivePartition() (string, string, error) {
 
 func (d *device) EnableUpdatedPartition() error {
 
-	inactivePartition, inactivePartitionHex, err := d.getInactivePartition()
+	target, err := d.getInstallTarget()
+	if err != nil {
+		return errors.Wrap(err, "Error obtaining inactive partition")
+	}
+	log.Debugf("Marking partition (%s) as the new boot candidate.", target)
+
+	inactivePartition, inactivePartitionHex, err := partitionNumber(target)
 	if err != nil {
 		return err
 	}
@@ -203,3 +261,38 @@ func (d *device) HasUpdate() (bool, error) {
 	}
 	return false, nil
 }
+
+// GetBootState returns the boot flags read from the bootloader environment.
+func (d *device) GetBootState() (*bootState, error) {
+	env, err := d.ReadEnv("mender_boot_part", "upgrade_available", "bootcount")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read environment variable")
+	}
+
+	state := &bootState{
+		UpgradeAvailable:  env["upgrade_available"] == "1",
+		NextBootPartition: d.partitionWithNumber(env["mender_boot_part"]),
+	}
+	if count := env["bootcount"]; count != "" {
+		if state.BootCount, err = strconv.Atoi(count); err != nil {
+			return nil, errors.Errorf("invalid bootcount: %q", count)
+		}
+	}
+	if active, err := d.GetActive(); err == nil {
+		state.ActivePartition = active
+	} else {
+		log.Warnf("failed to detect active partition: %v", err)
+	}
+	return state, nil
+}
+
+// partitionWithNumber returns the root filesystem partition with the given
+// number, or the number itself if it is neither of the configured ones.
+func (d *device) partitionWithNumber(number string) string {
+	for _, part := range []string{d.rootfsPartA, d.rootfsPartB} {
+		if num, _, err := partitionNumber(part); err == nil && num == number {
+			return part
+		}
+	}
+	return number
+}
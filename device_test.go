@@ -15,7 +15,9 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -150,6 +152,89 @@ func Test_installUpdate_existingAndNonInactivePartition(t *testing.T) {
 	BlockDeviceGetSectorSizeOf = oldSectorSizeOf
 }
 
+func TestDeviceInstallTarget(t *testing.T) {
+	env := &fakeBootEnv{}
+	testDevice := device{
+		BootEnvReadWriter: env,
+		partitions: &partitions{
+			active:   "/dev/mmcblk0p2",
+			inactive: "/dev/mmcblk0p3",
+		},
+		installTarget: "/dev/mmcblk0p4",
+	}
+
+	target, err := testDevice.getInstallTarget()
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmcblk0p4", target)
+
+	assert.NoError(t, testDevice.EnableUpdatedPartition())
+	assert.Equal(t, "4", env.writeVars["mender_boot_part"])
+	assert.Equal(t, "1", env.writeVars["upgrade_available"])
+
+	// installing to the running system is refused
+	env.writeVars = nil
+	testDevice.installTarget = "/dev/mmcblk0p2/"
+	err = testDevice.EnableUpdatedPartition()
+	assert.True(t, errorIs(err, errInstallTargetActive))
+	assert.Nil(t, env.writeVars)
+
+	err = testDevice.InstallUpdate(ioutil.NopCloser(strings.NewReader("update")), 6)
+	assert.True(t, errorIs(err, errInstallTargetActive))
+
+	// the inactive partition is used if no target is set
+	testDevice.installTarget = ""
+	target, err = testDevice.getInstallTarget()
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmcblk0p3", target)
+}
+
+func TestDeviceGetBootState(t *testing.T) {
+	env := &fakeBootEnv{
+		readVars: BootVars{
+			"mender_boot_part":  "3",
+			"upgrade_available": "1",
+			"bootcount":         "1",
+		},
+	}
+	testDevice := device{
+		BootEnvReadWriter: env,
+		partitions: &partitions{
+			rootfsPartA: "/dev/mmcblk0p2",
+			rootfsPartB: "/dev/mmcblk0p3",
+			active:      "/dev/mmcblk0p2",
+		},
+	}
+
+	state, err := testDevice.GetBootState()
+	assert.NoError(t, err)
+	assert.Equal(t, &bootState{
+		ActivePartition:   "/dev/mmcblk0p2",
+		NextBootPartition: "/dev/mmcblk0p3",
+		UpgradeAvailable:  true,
+		BootCount:         1,
+	}, state)
+
+	// committed update, booting from the active partition
+	env.readVars = BootVars{
+		"mender_boot_part":  "2",
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	}
+	state, err = testDevice.GetBootState()
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmcblk0p2", state.NextBootPartition)
+	assert.False(t, state.UpgradeAvailable)
+	assert.Equal(t, 0, state.BootCount)
+
+	env.readVars["bootcount"] = "x"
+	_, err = testDevice.GetBootState()
+	assert.Error(t, err)
+
+	env.readErr = errors.New("IO error")
+	_, err = testDevice.GetBootState()
+	assert.Error(t, err)
+}
+
 func Test_FetchUpdate_existingAndNonExistingUpdateFile(t *testing.T) {
 	image, _ := os.Create("imageFile")
 	imageContent := "test content"
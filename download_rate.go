@@ -0,0 +1,60 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// rateLimitedReader limits the rate data is read at to the rate returned by
+// rate for the current time; zero rate means no limit.
+type rateLimitedReader struct {
+	io.ReadCloser
+	rate  func(now time.Time) int64
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRateLimitedReader(r io.ReadCloser, rate func(time.Time) int64,
+	now func() time.Time) io.ReadCloser {
+	return &rateLimitedReader{
+		ReadCloser: r,
+		rate:       rate,
+		now:        now,
+		sleep:      time.Sleep,
+	}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	start := l.now()
+	rate := l.rate(start)
+	if rate <= 0 {
+		return l.ReadCloser.Read(p)
+	}
+
+	// read at most a tenth of a second worth of data at once, so that a
+	// change of the rate applies soon
+	if max := rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := l.ReadCloser.Read(p)
+
+	// wait until reading the data took as long as it should at the rate
+	took := time.Duration(n) * time.Second / time.Duration(rate)
+	if wait := took - l.now().Sub(start); wait > 0 {
+		l.sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadRateSchedule(t *testing.T) {
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(2018, 5, 10, hour, min, sec, 0, time.Local)
+	}
+	config := menderConfig{
+		DownloadRateSchedule: []downloadRateWindow{
+			{Start: "18:00", End: "08:00", BytesPerSecond: 10000},
+			{Start: "08:00", End: "12:00", BytesPerSecond: 1000},
+		},
+	}
+	assert.EqualValues(t, 10000, config.GetDownloadRateLimit(at(23, 0, 0)))
+	assert.EqualValues(t, 10000, config.GetDownloadRateLimit(at(7, 59, 59)))
+	assert.EqualValues(t, 1000, config.GetDownloadRateLimit(at(8, 0, 0)))
+	// not limited outside of the windows
+	assert.EqualValues(t, 0, config.GetDownloadRateLimit(at(12, 0, 0)))
+
+	// the download slows down once the clock reaches the business hours
+	clock := &mockClock{now: at(7, 59, 59)}
+	var reads []int
+	data := make([]byte, 12000)
+	r := &rateLimitedReader{
+		ReadCloser: ioutil.NopCloser(&readRecorder{bytes.NewReader(data), &reads}),
+		rate:       config.GetDownloadRateLimit,
+		now:        clock.Now,
+		sleep: func(d time.Duration) {
+			clock.now = clock.now.Add(d)
+		},
+	}
+	var read []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		read = append(read, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, data, read)
+
+	// a second at the night rate, then two seconds at the day rate
+	assert.Equal(t, at(8, 0, 2), clock.now)
+	require.Len(t, reads, 30)
+	for i, n := range reads {
+		if i < 10 {
+			assert.Equal(t, 1000, n)
+		} else {
+			assert.Equal(t, 100, n)
+		}
+	}
+}
+
+// readRecorder records the size of the reads of the data.
+type readRecorder struct {
+	*bytes.Reader
+	reads *[]int
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		*r.reads = append(*r.reads, n)
+	}
+	return n, err
+}
@@ -14,9 +14,21 @@
 package main
 
 import (
+	"os"
+	"syscall"
+
 	"github.com/pkg/errors"
 )
 
+var (
+	// ErrDownloadTooLarge is returned if the artifact is larger than
+	// MaxArtifactSizeBytes
+	ErrDownloadTooLarge = errors.New("artifact exceeds the maximum size")
+	// ErrNoSpace is returned if the update does not fit the storage it is
+	// written to
+	ErrNoSpace = errors.New("not enough space for the update")
+)
+
 // mender specific error
 type menderError interface {
 	// cause of the error
@@ -36,6 +48,10 @@ func (m *MenderError) Cause() error {
 	return m.cause
 }
 
+func (m *MenderError) Unwrap() error {
+	return m.cause
+}
+
 func (m *MenderError) IsFatal() bool {
 	return m.fatal
 }
@@ -68,3 +84,39 @@ func NewTransientError(err error) menderError {
 		fatal: false,
 	}
 }
+
+// errorIs reports whether target is in the chain of errors wrapping err. Both
+// errors wrapped with github.com/pkg/errors, and ones implementing Unwrap are
+// followed, so that sentinel errors can be matched regardless of how they
+// were wrapped.
+func errorIs(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// noSpaceError returns ErrNoSpace wrapping the description of err if err was
+// caused by the storage running out of space, otherwise err.
+func noSpaceError(err error) error {
+	cause := errors.Cause(err)
+	if pe, ok := cause.(*os.PathError); ok {
+		cause = pe.Err
+	} else if se, ok := cause.(*os.SyscallError); ok {
+		cause = se.Err
+	}
+	if cause == syscall.ENOSPC {
+		return errors.Wrap(ErrNoSpace, err.Error())
+	}
+	return err
+}
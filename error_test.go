@@ -14,10 +14,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMenderError(t *testing.T) {
@@ -33,3 +47,85 @@ func TestMenderError(t *testing.T) {
 	assert.False(t, tt.IsFatal())
 	assert.Equal(t, err, tt.Cause())
 }
+
+func TestErrorIs(t *testing.T) {
+	wrapped := pkgerrors.Wrapf(ErrNoSpace, "writing update")
+
+	assert.True(t, errorIs(ErrNoSpace, ErrNoSpace))
+	assert.True(t, errorIs(wrapped, ErrNoSpace))
+	assert.False(t, errorIs(wrapped, ErrDownloadTooLarge))
+	assert.False(t, errorIs(nil, ErrNoSpace))
+
+	// fatal and transient errors keep their semantics
+	merr := NewFatalError(pkgerrors.Wrap(wrapped, "install failed"))
+	assert.True(t, merr.IsFatal())
+	assert.True(t, errorIs(merr, ErrNoSpace))
+	assert.True(t, errorIs(NewTransientError(wrapped), ErrNoSpace))
+	// matched by errors.Is when not wrapped further
+	assert.True(t, errors.Is(NewTransientError(ErrNoSpace), ErrNoSpace))
+
+	// errors wrapped with Unwrap are followed too
+	assert.True(t, errorIs(fmt.Errorf("update: %w", wrapped), ErrNoSpace))
+}
+
+func TestNoSpaceError(t *testing.T) {
+	for _, err := range []error{
+		syscall.ENOSPC,
+		&os.PathError{Op: "write", Path: "/dev/mmcblk0p3", Err: syscall.ENOSPC},
+		pkgerrors.Wrap(&os.SyscallError{Syscall: "write", Err: syscall.ENOSPC},
+			"failed to write"),
+	} {
+		nerr := noSpaceError(err)
+		assert.True(t, errorIs(nerr, ErrNoSpace), err.Error())
+		assert.Contains(t, nerr.Error(), err.Error())
+	}
+
+	err := errors.New("foo")
+	assert.Equal(t, err, noSpaceError(err))
+}
+
+func TestErrorsIsReturnedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(make([]byte, 8192)))
+	}))
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "mender-errors-is-")
+	defer os.RemoveAll(td)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=beaglebone\n"), 0644)
+
+	mender := newTestMender(nil,
+		menderConfig{
+			MaxArtifactSizeBytes: 100,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				device: &fakeDevice{retInstallUpdate: syscall.ENOSPC},
+			},
+		})
+	mender.deviceTypeFile = deviceType
+
+	// the sentinel errors are matched by errors.Is, not only by errorIs
+	_, _, err := mender.FetchUpdate(context.Background(), srv.URL)
+	assert.True(t, errors.Is(err, ErrDownloadTooLarge), err.Error())
+	_, _, err = mender.ResumeUpdate(context.Background(), srv.URL, 10)
+	assert.True(t, errors.Is(err, ErrDownloadTooLarge), err.Error())
+	_, _, err = mender.FetchUpdate(context.Background(), srv.URL+"/gone")
+	assert.True(t, errors.Is(err, client.ErrUpdateGone), err.Error())
+
+	upd, err := MakeRootfsImageArtifact(2, false)
+	require.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "")
+	assert.True(t, errors.Is(err, installer.ErrDeviceTypeMismatch), err.Error())
+
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	upd, err = MakeRootfsImageArtifact(2, false)
+	require.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "")
+	assert.True(t, errors.Is(err, ErrNoSpace), err.Error())
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHealthCheckTimeout = 5 * time.Minute
+)
+
+var (
+	errHealthCheckTimeout = errors.New("health checks did not complete in time")
+)
+
+// runHealthChecks runs all the executable files found in dir in lexical
+// order, stopping at the first failing one, with env added to their
+// environment. All the checks must complete before the timeout expires, and
+// are stopped once ctx is done. A missing directory means there is nothing to
+// check.
+func runHealthChecks(ctx context.Context, dir string, env []string,
+	timeout time.Duration) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "can not read health check scripts directory")
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || file.Mode().Perm()&0111 == 0 {
+			log.Debugf("skipping %s; not an executable file", file.Name())
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "health checks stopped")
+		}
+		log.Infof("running health check %s", file.Name())
+		if err := runHealthCheck(ctx, filepath.Join(dir, file.Name()), env,
+			time.Until(deadline)); err != nil {
+			return errors.Wrapf(err, "health check %s failed", file.Name())
+		}
+	}
+	return nil
+}
+
+func runHealthCheck(ctx context.Context, name string, env []string,
+	timeout time.Duration) error {
+	if timeout <= 0 {
+		return errHealthCheckTimeout
+	}
+
+	out, err := runCommandContext(ctx, []string{name}, env, timeout)
+	if err == errCommandTimeout {
+		return errHealthCheckTimeout
+	} else if err == ctx.Err() {
+		return err
+	} else if err != nil {
+		log.Errorf("output of failed health check %s: %s", name, out)
+		return err
+	}
+	return nil
+}
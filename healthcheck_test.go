@@ -0,0 +1,95 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-health-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	ctx := context.Background()
+
+	check := func(name, script string) {
+		require.NoError(t, ioutil.WriteFile(path.Join(td, name),
+			[]byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+
+	// missing directory; nothing to check
+	assert.NoError(t, runHealthChecks(ctx, path.Join(td, "missing"), nil,
+		time.Second))
+
+	check("10_network", "exit 0")
+	// not executable; ignored
+	require.NoError(t, ioutil.WriteFile(path.Join(td, "README"),
+		[]byte("exit 1"), 0644))
+	assert.NoError(t, runHealthChecks(ctx, td, nil, time.Second))
+
+	// deployment details are passed to the checks
+	check("15_env", `[ "$MENDER_DEPLOYMENT_ID" = "foo" ]`)
+	assert.NoError(t, runHealthChecks(ctx, td,
+		[]string{"MENDER_DEPLOYMENT_ID=foo"}, time.Second))
+	assert.Error(t, runHealthChecks(ctx, td, nil, time.Second))
+	require.NoError(t, os.Remove(path.Join(td, "15_env")))
+
+	check("20_app", "exit 1")
+	err = runHealthChecks(ctx, td, nil, time.Second)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "20_app")
+
+	check("20_app", "sleep 10")
+	start := time.Now()
+	err = runHealthChecks(ctx, td, nil, 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, errHealthCheckTimeout, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// the checks are stopped once the context is done
+	cctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	err = runHealthChecks(cctx, td, nil, time.Minute)
+	assert.Error(t, err)
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestMenderVerifyUpdate(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-health-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(td, "10_app"),
+		[]byte("#!/bin/sh\nexit 1\n"), 0755))
+
+	// health checks are not configured
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	assert.NoError(t, mender.VerifyUpdate(context.Background()))
+
+	mender = newTestMender(nil, menderConfig{
+		HealthCheckScriptsPath: td,
+	}, testMenderPieces{})
+	assert.Error(t, mender.VerifyUpdate(context.Background()))
+}
@@ -14,8 +14,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"path"
+	"time"
 
 	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
@@ -36,17 +39,25 @@ type IdentityDataGetter interface {
 
 type IdentityDataRunner struct {
 	Helper string
-	cmdr   Commander
+	// the helper is killed if it does not complete in time;
+	// defaultStateScriptTimeout if not set
+	Timeout time.Duration
+	cmdr    Commander
 }
 
-func NewIdentityDataGetter() IdentityDataGetter {
+// NewIdentityDataGetter returns the getter running the given helper, killing
+// it unless it completes within timeout; the default helper is used if it is
+// empty.
+func NewIdentityDataGetter(helper string, timeout time.Duration) IdentityDataGetter {
 	return &IdentityDataRunner{
-		identityDataHelper,
-		&osCalls{},
+		Helper:  helper,
+		Timeout: timeout,
+		cmdr:    &osCalls{},
 	}
 }
 
-// Obtain identity data by calling a suitable helper tool
+// Obtain identity data by calling a suitable helper tool; every key=value line
+// it prints is an identity attribute
 func (id IdentityDataRunner) Get() (string, error) {
 	helper := identityDataHelper
 
@@ -54,26 +65,23 @@ func (id IdentityDataRunner) Get() (string, error) {
 		helper = id.Helper
 	}
 
-	cmd := id.cmdr.Command(helper)
-
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to open pipe for reading")
+	timeout := id.Timeout
+	if timeout <= 0 {
+		timeout = defaultStateScriptTimeout
 	}
 
-	if err := cmd.Start(); err != nil {
+	var out bytes.Buffer
+	cmd := id.cmdr.Command(helper)
+	cmd.Stdout = &out
+	if err := waitCommand(context.Background(), cmd, timeout); err != nil {
 		return "", errors.Wrapf(err, "failed to call %s", helper)
 	}
 
 	p := utils.KeyValParser{}
-	if err := p.Parse(out); err != nil {
+	if err := p.Parse(&out); err != nil {
 		return "", errors.Wrapf(err, "failed to parse identity data")
 	}
 
-	if err := cmd.Wait(); err != nil {
-		return "", errors.Wrapf(err, "wait for helper failed")
-	}
-
 	collected := p.Collect()
 	if len(collected) == 0 {
 		return "", errors.New("no identity data colleted")
@@ -15,9 +15,15 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeviceIdentityGet(t *testing.T) {
@@ -108,3 +114,25 @@ keyvalue
 		}
 	}
 }
+
+func TestDeviceIdentityGetTimeout(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-identity-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	helper := path.Join(td, "mender-device-identity")
+	require.NoError(t, ioutil.WriteFile(helper,
+		[]byte("#!/bin/sh\necho mac=de:ad:be:ef:00:01\nsleep 10\n"), 0755))
+
+	// the hanging helper is killed once the time is up
+	ir := IdentityDataRunner{
+		Helper:  helper,
+		Timeout: 100 * time.Millisecond,
+		cmdr:    &osCalls{},
+	}
+	start := time.Now()
+	_, err = ir.Get()
+	assert.Error(t, err)
+	assert.Equal(t, errCommandTimeout, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"os"
+
+	"github.com/mendersoftware/mender-artifact/areader"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// ArtifactInfo describes an artifact as declared in its header.
+type ArtifactInfo struct {
+	Name              string
+	Version           int
+	CompatibleDevices []string
+	// types of the updates contained in the artifact
+	UpdateTypes []string
+	// meta-data of the rootfs image update
+	Metadata map[string]interface{}
+	// what the device must provide for the artifact to be installed, and
+	// what it provides once installed, as declared in the meta-data
+	Depends  map[string]string
+	Provides map[string]string
+	// names of the state scripts
+	Scripts []string
+	// true if the artifact carries a signature; the signature is not
+	// verified
+	Signed bool
+}
+
+const (
+	metadataDepends  = "depends"
+	metadataProvides = "provides"
+)
+
+// used for stopping reading the artifact once the header is parsed
+var errHeaderRead = errors.New("installer: artifact header read")
+
+// metadataRecorder stores the meta-data of the update being read
+type metadataRecorder struct {
+	UInstaller
+	meta map[string]interface{}
+}
+
+func (m *metadataRecorder) ReceiveArtifactMetadata(meta map[string]interface{}) error {
+	// meta-data may be read multiple times; keep all the values
+	for k, v := range meta {
+		m.meta[k] = v
+	}
+	return nil
+}
+
+// ReadArtifactHeader parses the header of the artifact without installing the
+// update. Artifact format versions 1 and 2 are supported. Reading stops at the
+// update data, hence the data checksums are not verified.
+func ReadArtifactHeader(r io.Reader) (*ArtifactInfo, error) {
+	info := &ArtifactInfo{}
+
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		return errHeaderRead
+	}
+	recorder := &metadataRecorder{
+		meta: map[string]interface{}{},
+	}
+
+	ar := areader.NewReader(r)
+	if err := ar.RegisterHandler(&rootfsHandler{rootfs, recorder}); err != nil {
+		return nil, errors.Wrap(err, "installer: failed to register handler")
+	}
+	ar.VerifySignatureCallback = func(message, sig []byte) error {
+		info.Signed = true
+		return nil
+	}
+	ar.ScriptsReadCallback = func(r io.Reader, fi os.FileInfo) error {
+		info.Scripts = append(info.Scripts, fi.Name())
+		return nil
+	}
+
+	if err := ar.ReadArtifact(); err != nil && errors.Cause(err) != errHeaderRead {
+		return nil, errors.Wrap(err, "installer: failed to read artifact header")
+	}
+
+	info.Name = ar.GetArtifactName()
+	info.Version = ar.GetInfo().Version
+	info.CompatibleDevices = ar.GetCompatibleDevices()
+	updates := ar.GetHandlers()
+	for i := 0; i < len(updates); i++ {
+		info.UpdateTypes = append(info.UpdateTypes, updates[i].GetType())
+	}
+	if err := info.SetMetadata(recorder.meta); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// SetMetadata sets the meta-data of the rootfs image update, along with the
+// dependencies and provides declared in it.
+func (a *ArtifactInfo) SetMetadata(meta map[string]interface{}) error {
+	depends, err := metadataStrings(meta, metadataDepends)
+	if err != nil {
+		return err
+	}
+	provides, err := metadataStrings(meta, metadataProvides)
+	if err != nil {
+		return err
+	}
+	a.Metadata, a.Depends, a.Provides = meta, depends, provides
+	return nil
+}
+
+// metadataStrings returns the meta-data object with string values under key,
+// if any.
+func metadataStrings(meta map[string]interface{}, key string) (map[string]string, error) {
+	v, ok := meta[key]
+	if !ok {
+		return nil, nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("invalid value of %s meta-data: %v", key, v)
+	}
+	strs := make(map[string]string, len(obj))
+	for k, v := range obj {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.Errorf("invalid value of %s meta-data %s: %v",
+				key, k, v)
+		}
+		strs[k] = s
+	}
+	return strs, nil
+}
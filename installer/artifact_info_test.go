@@ -0,0 +1,125 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadArtifactHeader(t *testing.T) {
+	tc := []struct {
+		version    int
+		signed     bool
+		hasScripts bool
+	}{
+		{1, false, false},
+		{2, false, false},
+		{2, true, false},
+		{2, false, true},
+		{2, true, true},
+	}
+
+	for _, c := range tc {
+		art, err := MakeRootfsImageArtifact(c.version, c.signed, c.hasScripts)
+		assert.NoError(t, err)
+
+		info, err := ReadArtifactHeader(art)
+		assert.NoError(t, err)
+		assert.Equal(t, "mender-1.1", info.Name)
+		assert.Equal(t, c.version, info.Version)
+		assert.Equal(t, []string{"vexpress-qemu"}, info.CompatibleDevices)
+		assert.Equal(t, []string{"rootfs-image"}, info.UpdateTypes)
+		assert.Equal(t, map[string]interface{}{}, info.Metadata)
+		assert.Equal(t, c.signed, info.Signed)
+		if c.hasScripts {
+			assert.Len(t, info.Scripts, 1)
+			assert.True(t, strings.HasPrefix(info.Scripts[0], "ArtifactInstall_Enter_10_"))
+		} else {
+			assert.Empty(t, info.Scripts)
+		}
+	}
+
+	_, err := ReadArtifactHeader(bytes.NewBufferString("not an artifact"))
+	assert.Error(t, err)
+}
+
+// metadataComposer adds meta-data to the update header.
+type metadataComposer struct {
+	handlers.Composer
+	metadata []byte
+}
+
+func (m *metadataComposer) ComposeHeader(tw *tar.Writer, no int) error {
+	if err := m.Composer.ComposeHeader(tw, no); err != nil {
+		return err
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	return sw.Write(m.metadata,
+		filepath.Join(artifact.UpdateHeaderPath(no), "meta-data"))
+}
+
+func makeArtifactWithMetadata(t *testing.T, metadata string) io.Reader {
+	upd, err := MakeFakeUpdate("test update")
+	require.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	u := &metadataComposer{handlers.NewRootfsV2(upd), []byte(metadata)}
+	err = awriter.NewWriter(art).WriteArtifact("mender", 2,
+		[]string{"vexpress-qemu"}, "mender-1.1",
+		&awriter.Updates{U: []handlers.Composer{u}}, nil)
+	require.NoError(t, err)
+	return art
+}
+
+func TestReadArtifactHeaderDependsProvides(t *testing.T) {
+	art := makeArtifactWithMetadata(t, `{
+		"depends": {"rootfs-image.version": "1.0"},
+		"provides": {"rootfs-image.version": "1.1", "bootloader": "u-boot"}
+	}`)
+	info, err := ReadArtifactHeader(art)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"rootfs-image.version": "1.0"}, info.Depends)
+	assert.Equal(t, map[string]string{
+		"rootfs-image.version": "1.1",
+		"bootloader":           "u-boot",
+	}, info.Provides)
+
+	// neither is declared
+	art = makeArtifactWithMetadata(t, `{"foo": "bar"}`)
+	info, err = ReadArtifactHeader(art)
+	require.NoError(t, err)
+	assert.Nil(t, info.Depends)
+	assert.Nil(t, info.Provides)
+
+	// values must be strings
+	art = makeArtifactWithMetadata(t, `{"provides": {"rootfs-image.version": 1}}`)
+	_, err = ReadArtifactHeader(art)
+	assert.Error(t, err)
+	art = makeArtifactWithMetadata(t, `{"depends": ["rootfs-image.version"]}`)
+	_, err = ReadArtifactHeader(art)
+	assert.Error(t, err)
+}
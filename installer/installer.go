@@ -15,15 +15,27 @@
 package installer
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender-artifact/areader"
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/handlers"
-	"github.com/mendersoftware/mender/statescript"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -32,7 +44,226 @@ type UInstaller interface {
 	EnableUpdatedPartition() error
 }
 
-func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
+// ArtifactNameVerifier can be implemented by the UInstaller to reject an
+// artifact based on its name before any of the update data is installed.
+type ArtifactNameVerifier interface {
+	VerifyArtifactName(name string) error
+}
+
+// ArtifactMetadataReceiver can be implemented by the UInstaller to receive the
+// meta-data of the update before the update data is installed.
+type ArtifactMetadataReceiver interface {
+	ReceiveArtifactMetadata(meta map[string]interface{}) error
+}
+
+// CustomUpdatesReceiver can be implemented by the UInstaller to receive the
+// handlers of the installed updates of custom types, which activate the
+// updates instead of EnableUpdatedPartition.
+type CustomUpdatesReceiver interface {
+	ReceiveCustomUpdates(handlers []UpdateHandler)
+}
+
+// rootfsHandler extends the rootfs image handler with parsing of the update
+// meta-data.
+type rootfsHandler struct {
+	*handlers.Rootfs
+	device UInstaller
+}
+
+func (r *rootfsHandler) ReadHeader(in io.Reader, path string) error {
+	recv, ok := r.device.(ArtifactMetadataReceiver)
+	if !ok || filepath.Base(path) != "meta-data" {
+		return r.Rootfs.ReadHeader(in, path)
+	}
+
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return errors.Wrap(err, "installer: failed to read meta-data")
+	}
+	meta := map[string]interface{}{}
+	// meta-data is optional
+	if len(bytes.TrimSpace(data)) != 0 {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return errors.Wrap(err, "installer: failed to parse meta-data")
+		}
+	}
+	return recv.ReceiveArtifactMetadata(meta)
+}
+
+func (r *rootfsHandler) Copy() handlers.Installer {
+	return &rootfsHandler{
+		Rootfs: r.Rootfs.Copy().(*handlers.Rootfs),
+		device: r.device,
+	}
+}
+
+// UpdateHandler installs updates of a type other than the built-in
+// rootfs-image, e.g. application updates or files copied to the device. The
+// data files are verified against their checksums while being installed, as
+// the rootfs images are; the installation fails if they do not match, hence
+// the handler must not apply the update before all of them are installed.
+type UpdateHandler interface {
+	// InstallFile installs a single data file of the update
+	InstallFile(r io.Reader, name string, size int64) error
+	// Activate applies the update once all of its data files are
+	// installed. The update takes effect right away: the updated
+	// partition is not enabled, the device is not rebooted and the boot
+	// flags are not committed.
+	Activate() error
+}
+
+var (
+	updateHandlersLock sync.Mutex
+	updateHandlers     = map[string]UpdateHandler{}
+)
+
+// RegisterUpdateHandler registers the handler installing the updates of the
+// given type; a nil handler removes the registered one. The rootfs-image
+// updates are always installed with the UInstaller passed to Install.
+//
+// The client itself registers no handlers. Integrators adding update types to
+// their build of the client register the handlers from an init function, e.g.
+// in a file added to package main, so that they are in place before any
+// artifact is installed, both by the daemon and with -rootfs.
+func RegisterUpdateHandler(updateType string, h UpdateHandler) error {
+	if updateType == handlers.NewRootfsInstaller().GetType() {
+		return errors.Errorf("installer: %s updates can not have a custom handler",
+			updateType)
+	}
+
+	updateHandlersLock.Lock()
+	defer updateHandlersLock.Unlock()
+	if h == nil {
+		delete(updateHandlers, updateType)
+		return nil
+	}
+	if _, ok := updateHandlers[updateType]; ok {
+		return errors.Errorf("installer: handler of %s updates already registered",
+			updateType)
+	}
+	updateHandlers[updateType] = h
+	return nil
+}
+
+// customHandler installs the updates with a registered UpdateHandler; the
+// header is parsed as by the generic handler of the artifact reader.
+type customHandler struct {
+	*handlers.Generic
+	handler UpdateHandler
+}
+
+func (c *customHandler) Install(r io.Reader, info *os.FileInfo) error {
+	if err := c.handler.InstallFile(r, (*info).Name(), (*info).Size()); err != nil {
+		log.Errorf("%s update installation failed: %v", c.GetType(), err)
+		return err
+	}
+	return nil
+}
+
+func (c *customHandler) Copy() handlers.Installer {
+	return &customHandler{
+		Generic: handlers.NewGeneric(c.GetType()),
+		handler: c.handler,
+	}
+}
+
+// customUpdates returns the handlers of the custom updates read from the
+// artifact; an artifact can not carry both a rootfs-image and a custom update,
+// as these are activated differently.
+func customUpdates(ar *areader.Reader) ([]UpdateHandler, error) {
+	installers := ar.GetHandlers()
+	custom := []UpdateHandler{}
+	for i := 0; i < len(installers); i++ {
+		if c, ok := installers[i].(*customHandler); ok {
+			custom = append(custom, c.handler)
+		}
+	}
+	if len(custom) != 0 && len(custom) != len(installers) {
+		return nil, errors.New("installer: custom updates can not be installed " +
+			"along with a rootfs-image update")
+	}
+	return custom, nil
+}
+
+// registerUpdateHandlers registers the custom update handlers with the artifact
+// reader.
+func registerUpdateHandlers(ar *areader.Reader) error {
+	updateHandlersLock.Lock()
+	defer updateHandlersLock.Unlock()
+	for t, h := range updateHandlers {
+		if err := ar.RegisterHandler(&customHandler{handlers.NewGeneric(t), h}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	ErrArtifactNameMismatch = errors.New("installer: unexpected artifact name")
+	// returned by ArtifactNameVerifier if the artifact is installed already
+	ErrArtifactAlreadyInstalled = errors.New("installer: artifact already installed")
+	// returned by ArtifactMetadataReceiver if the device does not provide
+	// what the artifact depends on
+	ErrArtifactDependsNotSatisfied = errors.New("installer: artifact dependencies not satisfied")
+	// the artifact is not compatible with the device type
+	ErrDeviceTypeMismatch = errors.New("installer: artifact not compatible with device")
+	// the artifact signature can not be verified with any of the keys
+	ErrSignatureInvalid = errors.New("installer: invalid artifact signature")
+	// the artifact carries state scripts, but these are not accepted
+	ErrStateScriptsNotAccepted = errors.New("installer: artifact state scripts not accepted")
+	// the update data does not match its checksum, or can not be
+	// decompressed
+	ErrArtifactCorrupted = errors.New("installer: artifact data corrupted")
+)
+
+// corruptionError returns ErrArtifactCorrupted wrapping the description of err
+// if err was caused by corrupted update data, otherwise err.
+func corruptionError(err error) error {
+	cause := errors.Cause(err)
+	_, flateErr := cause.(flate.CorruptInputError)
+	_, checksumErr := cause.(*artifact.ChecksumError)
+	if flateErr || checksumErr || cause == gzip.ErrChecksum ||
+		cause == gzip.ErrHeader || cause == tar.ErrHeader {
+		return errors.Wrap(ErrArtifactCorrupted, err.Error())
+	}
+	return err
+}
+
+// checkVerificationKey makes sure artifact signatures can be verified with the
+// key. The artifact does not declare the signature algorithm; it is derived
+// from the key type, hence keys of unsupported types are rejected up front.
+func checkVerificationKey(key []byte) error {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("installer: failed to parse verification key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "installer: failed to parse verification key")
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return nil
+	case *ecdsa.PublicKey:
+		// only 256 bit ECDSA signatures are supported
+		if pub.Curve != elliptic.P256() {
+			return errors.Errorf("installer: unsupported ECDSA curve: %s",
+				pub.Curve.Params().Name)
+		}
+		return nil
+	default:
+		return errors.Errorf("installer: unsupported verification key type: %T", pub)
+	}
+}
+
+// Install installs the artifact using the device. The update data is verified
+// against the checksums from the artifact manifest while being streamed to the
+// device. The artifact format holds a single checksum per update file, not per
+// block, hence corrupted data is detected only once the whole file is read;
+// the device must not activate an update unless InstallUpdate succeeded.
+func Install(art io.ReadCloser, dt string, keys [][]byte, scrDir string,
 	device UInstaller, acceptStateScripts bool) error {
 
 	rootfs := handlers.NewRootfsInstaller()
@@ -49,17 +280,32 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 
 	var ar *areader.Reader
 	// if there is a verification key artifact must be signed
-	if key != nil {
+	if len(keys) != 0 {
+		for _, key := range keys {
+			if err := checkVerificationKey(key); err != nil {
+				return err
+			}
+		}
 		ar = areader.NewReaderSigned(art)
 	} else {
 		ar = areader.NewReader(art)
 	}
 
-	if err := ar.RegisterHandler(rootfs); err != nil {
+	if err := ar.RegisterHandler(&rootfsHandler{rootfs, device}); err != nil {
+		return errors.Wrap(err, "failed to register install handler")
+	}
+	if err := registerUpdateHandlers(ar); err != nil {
 		return errors.Wrap(err, "failed to register install handler")
 	}
 
 	ar.CompatibleDevicesCallback = func(devices []string) error {
+		// header info is available at this point
+		if v, ok := device.(ArtifactNameVerifier); ok {
+			if err := v.VerifyArtifactName(ar.GetArtifactName()); err != nil {
+				return err
+			}
+		}
+
 		log.Debugf("checking if device [%s] is on compatibile device list: %v\n",
 			dt, devices)
 		if dt == "" {
@@ -71,7 +317,8 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 				return nil
 			}
 		}
-		return errors.Errorf("installer: image (device types %v) not compatible with device %v",
+		return errors.Wrapf(ErrDeviceTypeMismatch,
+			"installer: image (device types %v) not compatible with device %v",
 			devices, dt)
 	}
 
@@ -82,47 +329,68 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 		// MEN-1196 skip verification of the signature if there is no key
 		// provided. This means signed artifact will be installed on all
 		// devices having no key specified.
-		if key == nil {
+		if len(keys) == 0 {
 			log.Warn("installer: installing signed artifact without verification " +
 				"as verification key is missing")
 			return nil
 		}
 
-		// Do the verification only if the key is provided.
-		s := artifact.NewVerifier(key)
-		return s.Verify(message, sig)
+		// Do the verification only if the key is provided. The signature
+		// algorithm (RSA or ECDSA) is determined by the type of the key.
+		// Artifact signed with any of the trusted keys is accepted, so that
+		// the signing key can be rotated.
+		var err error
+		for _, key := range keys {
+			s := artifact.NewVerifier(key)
+			if err = s.Verify(message, sig); err == nil {
+				return nil
+			}
+		}
+		return errors.Wrapf(ErrSignatureInvalid, "installer: artifact signature "+
+			"does not match any of the verification keys: %v", err)
 	}
 
-	scr := statescript.NewStore(scrDir)
-	// we need to wipe out the scripts directory first
-	if err := scr.Clear(); err != nil {
+	scripts, err := newScriptsStaging(scrDir)
+	if err != nil {
 		log.Errorf("installer: error initializing directory for scripts [%s]: %v",
 			scrDir, err)
 		return errors.Wrap(err, "installer: error initializing directory for scripts")
 	}
+	defer scripts.discard()
 
 	if acceptStateScripts {
 		// All the scripts that are part of the artifact will be processed here.
 		ar.ScriptsReadCallback = func(r io.Reader, fi os.FileInfo) error {
 			log.Debugf("installer: processing script: %s", fi.Name())
-			return scr.StoreScript(r, fi.Name())
+			return scripts.store(r, fi.Name())
 		}
 	} else {
 		ar.ScriptsReadCallback = func(r io.Reader, fi os.FileInfo) error {
-			errMsg := "will not install artifact with state-scripts when installing from cmd-line. Use -f to override"
-			return errors.New(errMsg)
+			return ErrStateScriptsNotAccepted
 		}
 	}
 
 	// read the artifact
 	if err := ar.ReadArtifact(); err != nil {
-		return errors.Wrap(err, "installer: failed to read and install update")
+		return utils.WithCause(errors.Wrap(corruptionError(err),
+			"installer: failed to read and install update"))
+	}
+
+	custom, err := customUpdates(ar)
+	if err != nil {
+		return err
 	}
 
-	if err := scr.Finalize(ar.GetInfo().Version); err != nil {
+	// the scripts are made available to the state script executor only
+	// once the whole artifact, including its signature, is verified
+	if err := scripts.commit(ar.GetInfo().Version); err != nil {
 		return errors.Wrap(err, "installer: error finalizing writing scripts")
 	}
 
+	if recv, ok := device.(CustomUpdatesReceiver); ok && len(custom) != 0 {
+		recv.ReceiveCustomUpdates(custom)
+	}
+
 	log.Debugf(
 		"installer: successfully read artifact [name: %v; version: %v; compatible devices: %v]",
 		ar.GetArtifactName(), ar.GetInfo().Version, ar.GetCompatibleDevices())
@@ -16,16 +16,25 @@ package installer
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/mendersoftware/mender-artifact/handlers"
-	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInstall(t *testing.T) {
@@ -35,9 +44,8 @@ func TestInstall(t *testing.T) {
 
 	// image not compatible with device
 	err = Install(art, "fake-device", nil, "", nil, true)
-	assert.Error(t, err)
-	assert.Contains(t, errors.Cause(err).Error(),
-		"not compatible with device fake-device")
+	assert.True(t, errors.Is(err, ErrDeviceTypeMismatch), err.Error())
+	assert.Contains(t, err.Error(), "not compatible with device fake-device")
 
 	art, err = MakeRootfsImageArtifact(1, false, false)
 	assert.NoError(t, err)
@@ -59,27 +67,149 @@ func TestInstallSigned(t *testing.T) {
 	// image not compatible with device
 	art, err = MakeRootfsImageArtifact(2, true, false)
 	assert.NoError(t, err)
-	err = Install(art, "fake-device", []byte(PublicRSAKey), "", new(fDevice), true)
-	assert.Error(t, err)
-	assert.Contains(t, errors.Cause(err).Error(),
-		"not compatible with device fake-device")
+	err = Install(art, "fake-device", [][]byte{[]byte(PublicRSAKey)}, "", new(fDevice), true)
+	assert.True(t, errors.Is(err, ErrDeviceTypeMismatch), err.Error())
+	assert.Contains(t, err.Error(), "not compatible with device fake-device")
 
 	// installation successful
 	art, err = MakeRootfsImageArtifact(2, true, false)
 	assert.NoError(t, err)
-	err = Install(art, "vexpress-qemu", []byte(PublicRSAKey), "", new(fDevice), true)
+	err = Install(art, "vexpress-qemu", [][]byte{[]byte(PublicRSAKey)}, "", new(fDevice), true)
 	assert.NoError(t, err)
 
 	// have a key but artifact is unsigned
 	art, err = MakeRootfsImageArtifact(2, false, false)
 	assert.NoError(t, err)
-	err = Install(art, "vexpress-qemu", []byte(PublicRSAKey), "", new(fDevice), true)
+	err = Install(art, "vexpress-qemu", [][]byte{[]byte(PublicRSAKey)}, "", new(fDevice), true)
 	assert.Error(t, err)
 
 	// have a key but artifact is v1
 	art, err = MakeRootfsImageArtifact(1, false, false)
 	assert.NoError(t, err)
-	err = Install(art, "vexpress-qemu", []byte(PublicRSAKey), "", new(fDevice), true)
+	err = Install(art, "vexpress-qemu", [][]byte{[]byte(PublicRSAKey)}, "", new(fDevice), true)
+	assert.Error(t, err)
+}
+
+// makeECDSAKeys returns PEM encoded private and public ECDSA keys.
+func makeECDSAKeys(t *testing.T, curve elliptic.Curve) ([]byte, []byte) {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	assert.NoError(t, err)
+
+	privDER, err := x509.MarshalECPrivateKey(priv)
+	assert.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
+
+// ecdsaSigner signs with an ECDSA key, left-padding r and s to the curve size.
+// The vendored signer drops their leading zero bytes, so some of its
+// signatures do not verify.
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (e *ecdsaSigner) Sign(message []byte) ([]byte, error) {
+	h := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, e.key, h[:])
+	if err != nil {
+		return nil, err
+	}
+	size := (e.key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// makeECDSASignedArtifact returns an artifact signed with the PEM encoded
+// ECDSA key.
+func makeECDSASignedArtifact(t *testing.T, priv []byte) io.ReadCloser {
+	block, _ := pem.Decode(priv)
+	require.NotNil(t, block)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	art, err := makeSignedRootfsImageArtifact(2, &ecdsaSigner{key}, false)
+	require.NoError(t, err)
+	return art
+}
+
+func TestInstallSignedECDSA(t *testing.T) {
+	privECDSA, pubECDSA := makeECDSAKeys(t, elliptic.P256())
+
+	// ECDSA signed artifact verified with matching key
+	art := makeECDSASignedArtifact(t, privECDSA)
+	err := Install(art, "vexpress-qemu", [][]byte{pubECDSA}, "", new(fDevice), true)
+	assert.NoError(t, err)
+
+	// ECDSA signed artifact, RSA key
+	art, err = makeRootfsImageArtifact(2, privECDSA, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", [][]byte{[]byte(PublicRSAKey)}, "", new(fDevice), true)
+	assert.Error(t, err)
+
+	// RSA signed artifact, ECDSA key
+	art, err = makeRootfsImageArtifact(2, []byte(PrivateRSAKey), false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", [][]byte{pubECDSA}, "", new(fDevice), true)
+	assert.Error(t, err)
+
+	// ECDSA signed artifact, ECDSA key of someone else
+	_, pubOther := makeECDSAKeys(t, elliptic.P256())
+	art, err = makeRootfsImageArtifact(2, privECDSA, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", [][]byte{pubOther}, "", new(fDevice), true)
+	assert.True(t, errors.Is(err, ErrSignatureInvalid), err.Error())
+}
+
+func TestInstallUnsupportedKey(t *testing.T) {
+	// only 256 bit ECDSA is supported
+	_, pubP384 := makeECDSAKeys(t, elliptic.P384())
+	art, err := makeRootfsImageArtifact(2, []byte(PrivateRSAKey), false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", [][]byte{pubP384}, "", new(fDevice), true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported ECDSA curve")
+
+	art, err = makeRootfsImageArtifact(2, []byte(PrivateRSAKey), false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", [][]byte{[]byte("not a key")}, "", new(fDevice), true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse verification key")
+}
+
+func TestInstallMultipleKeys(t *testing.T) {
+	privECDSA, pubECDSA := makeECDSAKeys(t, elliptic.P256())
+	keys := [][]byte{[]byte(PublicRSAKey), pubECDSA}
+
+	// signed with the first key
+	art, err := makeRootfsImageArtifact(2, []byte(PrivateRSAKey), false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", keys, "", new(fDevice), true)
+	assert.NoError(t, err)
+
+	// signed with the second key
+	art = makeECDSASignedArtifact(t, privECDSA)
+	err = Install(art, "vexpress-qemu", keys, "", new(fDevice), true)
+	assert.NoError(t, err)
+
+	// signed with untrusted key
+	privOther, _ := makeECDSAKeys(t, elliptic.P256())
+	art, err = makeRootfsImageArtifact(2, privOther, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", keys, "", new(fDevice), true)
+	assert.True(t, errors.Is(err, ErrSignatureInvalid), err.Error())
+	assert.Contains(t, err.Error(), "does not match any of the verification keys")
+
+	// one of the keys is not valid
+	art, err = makeRootfsImageArtifact(2, privECDSA, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", append(keys, []byte("not a key")), "",
+		new(fDevice), true)
 	assert.Error(t, err)
 }
 
@@ -89,9 +219,9 @@ func TestInstallNoSignature(t *testing.T) {
 	assert.NotNil(t, art)
 
 	// image does not contain signature
-	err = Install(art, "vexpress-qemu", []byte(PublicRSAKey), "", new(fDevice), true)
+	err = Install(art, "vexpress-qemu", [][]byte{[]byte(PublicRSAKey)}, "", new(fDevice), true)
 	assert.Error(t, err)
-	assert.Contains(t, errors.Cause(err).Error(),
+	assert.Contains(t, err.Error(),
 		"expecting signed artifact, but no signature file found")
 }
 
@@ -106,13 +236,177 @@ func TestInstallWithScripts(t *testing.T) {
 
 	err = Install(art, "vexpress-qemu", nil, scrDir, new(fDevice), true)
 	assert.NoError(t, err)
+	scripts, err := filepath.Glob(filepath.Join(scrDir, "ArtifactInstall_Enter_10_*"))
+	assert.NoError(t, err)
+	assert.Len(t, scripts, 1)
+	_, err = os.Stat(filepath.Join(scrDir, "version"))
+	assert.NoError(t, err)
+
+	// scripts of an artifact failing the verification are not installed
+	// and the scripts of the previous artifact are gone
+	priv, _ := makeECDSAKeys(t, elliptic.P256())
+	_, pubOther := makeECDSAKeys(t, elliptic.P256())
+	art, err = makeRootfsImageArtifact(2, priv, true)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", [][]byte{pubOther}, scrDir, new(fDevice), true)
+	assert.True(t, errors.Is(err, ErrSignatureInvalid), err.Error())
+	files, err := ioutil.ReadDir(scrDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	staged, err := filepath.Glob(filepath.Join(filepath.Dir(scrDir),
+		"."+filepath.Base(scrDir)+"-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, staged)
+
+	art, err = MakeRootfsImageArtifact(2, false, true)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", nil, scrDir, new(fDevice), false)
+	assert.True(t, errors.Is(err, ErrStateScriptsNotAccepted), err.Error())
+}
+
+func TestInstallCorrupted(t *testing.T) {
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(art)
+	assert.NoError(t, err)
+
+	install := func(data []byte) {
+		dev := new(fDevice)
+		err := Install(&rc{bytes.NewBuffer(data)}, "vexpress-qemu", nil, "",
+			dev, true)
+		assert.Error(t, err)
+		assert.True(t, errors.Is(err, ErrArtifactCorrupted), err.Error())
+		// the device never completes writing the update
+		assert.False(t, dev.installed)
+	}
+
+	// corrupt the compressed update data, which follows the tar header of
+	// the data file
+	corrupted := append([]byte(nil), data...)
+	hdr := bytes.Index(corrupted, []byte("data/0000.tar.gz"))
+	require.True(t, hdr > 0)
+	corrupted[hdr+512+20] ^= 0xff
+	install(corrupted)
+
+	// data decompresses fine, but does not match the checksum from the
+	// manifest, which is only known once all of it is read
+	corrupted = append([]byte(nil), data...)
+	sum := bytes.Index(corrupted, []byte("  data/0000/"))
+	require.True(t, sum > 0)
+	if corrupted[sum-1] == '0' {
+		corrupted[sum-1] = '1'
+	} else {
+		corrupted[sum-1] = '0'
+	}
+	install(corrupted)
+}
+
+// customUpdate composes updates of a custom type out of a rootfs image
+type customUpdate struct {
+	*handlers.Rootfs
 }
 
-type fDevice struct{}
+func (u customUpdate) GetType() string {
+	return "custom-update"
+}
+
+// fUpdateHandler records the installed data files
+type fUpdateHandler struct {
+	files     map[string]string
+	activated bool
+}
+
+func (h *fUpdateHandler) InstallFile(r io.Reader, name string, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return errors.New("size mismatch")
+	}
+	h.files[name] = string(data)
+	return nil
+}
+
+func (h *fUpdateHandler) Activate() error {
+	h.activated = true
+	return nil
+}
+
+// fCustomDevice records the handlers of the installed custom updates
+type fCustomDevice struct {
+	fDevice
+	custom []UpdateHandler
+}
+
+func (d *fCustomDevice) ReceiveCustomUpdates(handlers []UpdateHandler) {
+	d.custom = handlers
+}
+
+func TestInstallCustomUpdateType(t *testing.T) {
+	upd, err := MakeFakeUpdate("custom update data")
+	require.NoError(t, err)
+	defer os.Remove(upd)
+
+	makeArtifact := func(u ...handlers.Composer) io.ReadCloser {
+		art := bytes.NewBuffer(nil)
+		updates := &awriter.Updates{U: u}
+		err := awriter.NewWriter(art).WriteArtifact("mender", 2,
+			[]string{"vexpress-qemu"}, "custom-1", updates, &artifact.Scripts{})
+		require.NoError(t, err)
+		return &rc{art}
+	}
+
+	h := &fUpdateHandler{files: map[string]string{}}
+	require.NoError(t, RegisterUpdateHandler("custom-update", h))
+	defer RegisterUpdateHandler("custom-update", nil)
+
+	assert.Error(t, RegisterUpdateHandler("custom-update", h))
+	assert.Error(t, RegisterUpdateHandler("rootfs-image", h))
+
+	// installed by the registered handler instead of the device, and
+	// activated by the handler too
+	dev := &fCustomDevice{fDevice: fDevice{fail: true}}
+	err = Install(makeArtifact(customUpdate{handlers.NewRootfsV2(upd)}),
+		"vexpress-qemu", nil, "", dev, true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		filepath.Base(upd): "custom update data",
+	}, h.files)
+	assert.Equal(t, []UpdateHandler{h}, dev.custom)
+	assert.False(t, h.activated)
+
+	// activated differently, hence not installed together
+	dev = &fCustomDevice{}
+	err = Install(makeArtifact(handlers.NewRootfsV2(upd),
+		customUpdate{handlers.NewRootfsV2(upd)}), "vexpress-qemu", nil, "", dev, true)
+	assert.EqualError(t, err, "installer: custom updates can not be installed "+
+		"along with a rootfs-image update")
+	assert.Empty(t, dev.custom)
+
+	// rootfs images are still installed with the device
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	require.NoError(t, err)
+	err = Install(art, "vexpress-qemu", nil, "", &fDevice{fail: true}, true)
+	assert.Error(t, err)
+}
+
+type fDevice struct {
+	fail bool
+	// set once the whole update is written successfully
+	installed bool
+}
 
 func (d *fDevice) InstallUpdate(r io.ReadCloser, l int64) error {
-	_, err := io.Copy(ioutil.Discard, r)
-	return err
+	if d.fail {
+		return errors.New("install failed")
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	d.installed = true
+	return nil
 }
 
 func (d *fDevice) EnableUpdatedPartition() error { return nil }
@@ -142,6 +436,26 @@ r3rtT0ysHWd7l+Kx/SUCQGlitd5RDfdHl+gKrCwhNnRG7FzRLv5YOQV81+kh7SkU
 )
 
 func MakeRootfsImageArtifact(version int, signed bool,
+	hasScripts bool) (io.ReadCloser, error) {
+	var key []byte
+	if signed {
+		key = []byte(PrivateRSAKey)
+	}
+	return makeRootfsImageArtifact(version, key, hasScripts)
+}
+
+// makeRootfsImageArtifact creates an artifact; signed with signKey unless it is
+// nil.
+func makeRootfsImageArtifact(version int, signKey []byte,
+	hasScripts bool) (io.ReadCloser, error) {
+	var s artifact.Signer
+	if signKey != nil {
+		s = artifact.NewSigner(signKey)
+	}
+	return makeSignedRootfsImageArtifact(version, s, hasScripts)
+}
+
+func makeSignedRootfsImageArtifact(version int, signer artifact.Signer,
 	hasScripts bool) (io.ReadCloser, error) {
 	upd, err := MakeFakeUpdate("test update")
 	if err != nil {
@@ -151,11 +465,10 @@ func MakeRootfsImageArtifact(version int, signed bool,
 
 	art := bytes.NewBuffer(nil)
 	var aw *awriter.Writer
-	if !signed {
+	if signer == nil {
 		aw = awriter.NewWriter(art)
 	} else {
-		s := artifact.NewSigner([]byte(PrivateRSAKey))
-		aw = awriter.NewWriterSigned(art, s)
+		aw = awriter.NewWriterSigned(art, signer)
 	}
 	var u handlers.Composer
 	switch version {
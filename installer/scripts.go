@@ -0,0 +1,95 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package installer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/mender/statescript"
+	"github.com/pkg/errors"
+)
+
+// scriptsStaging keeps the state scripts embedded in the artifact in a private
+// directory until the artifact is verified; only then the scripts replace the
+// ones in the scripts directory, so that the scripts of an artifact failing the
+// signature or checksum verification are never executed.
+type scriptsStaging struct {
+	dir     string
+	staging string
+}
+
+// newScriptsStaging wipes out the scripts of the previous artifact from dir
+// and creates the staging directory next to it, so that the scripts can be
+// moved in place atomically. If dir is empty the scripts are read and dropped.
+func newScriptsStaging(dir string) (*scriptsStaging, error) {
+	s := &scriptsStaging{dir: dir}
+	if dir == "" {
+		return s, nil
+	}
+	if err := statescript.NewStore(dir).Clear(); err != nil {
+		return nil, err
+	}
+
+	staging, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+"-")
+	if err != nil {
+		return nil, err
+	}
+	s.staging = staging
+	return s, nil
+}
+
+func (s *scriptsStaging) store(r io.Reader, name string) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return errors.Errorf("installer: invalid state script name: %q", name)
+	}
+	if s.staging == "" {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	return statescript.NewStore(s.staging).StoreScript(r, name)
+}
+
+// commit moves the staged scripts to the scripts directory.
+func (s *scriptsStaging) commit(version int) error {
+	if s.staging == "" {
+		return nil
+	}
+	if err := statescript.NewStore(s.staging).Finalize(version); err != nil {
+		return err
+	}
+	// same permissions as the directory created by the script store
+	if err := os.Chmod(s.staging, 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	if err := os.Rename(s.staging, s.dir); err != nil {
+		return err
+	}
+	s.staging = ""
+	return nil
+}
+
+// discard removes the staged scripts unless these were committed.
+func (s *scriptsStaging) discard() {
+	if s.staging != "" {
+		os.RemoveAll(s.staging)
+		s.staging = ""
+	}
+}
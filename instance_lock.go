@@ -0,0 +1,82 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// name of the lock file in the data store directory
+const defaultInstanceLockFile = "mender.lock"
+
+var errInstanceLocked = errors.New("another instance of the client is running")
+
+// instanceLock keeps other instances of the client from using the same data
+// store. It is an flock(2) lock, which the kernel releases when the process
+// exits, so a lock file left behind by a crashed instance does not keep the
+// client from starting.
+type instanceLock struct {
+	file *os.File
+}
+
+// acquireInstanceLock locks the given file, or returns errInstanceLocked if
+// another process holds the lock already.
+func acquireInstanceLock(path string) (*instanceLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file %s", path)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			owner := "unknown process"
+			if pid, rerr := ioutil.ReadFile(path); rerr == nil &&
+				len(strings.TrimSpace(string(pid))) != 0 {
+				owner = "process " + strings.TrimSpace(string(pid))
+			}
+			return nil, errors.Wrapf(errInstanceLocked,
+				"data store is locked by %s (%s)", owner, path)
+		}
+		return nil, errors.Wrapf(err, "failed to lock %s", path)
+	}
+
+	// the owner is recorded for the error message of other instances only
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	return &instanceLock{file: f}, nil
+}
+
+// Release unlocks the file. The file itself is kept; removing it would let
+// an instance waiting for the lock and one starting afterwards lock different
+// files.
+func (l *instanceLock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return errors.Wrap(err, "failed to release the instance lock")
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceLock(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	lockFile := path.Join(tdir, defaultInstanceLockFile)
+
+	// lock file left behind by a crashed instance
+	require.NoError(t, ioutil.WriteFile(lockFile, []byte("99999\n"), 0600))
+
+	first, err := acquireInstanceLock(lockFile)
+	require.NoError(t, err)
+
+	// the second instance refuses to start while the first one runs
+	second, err := acquireInstanceLock(lockFile)
+	assert.Nil(t, second)
+	assert.Equal(t, errInstanceLocked, errors.Cause(err))
+	assert.Contains(t, err.Error(), "process")
+
+	// and starts once it is gone
+	assert.NoError(t, first.Release())
+	second, err = acquireInstanceLock(lockFile)
+	assert.NoError(t, err)
+	assert.NoError(t, second.Release())
+	// releasing twice is harmless
+	assert.NoError(t, second.Release())
+
+	_, err = acquireInstanceLock(path.Join(tdir, "missing", defaultInstanceLockFile))
+	assert.Error(t, err)
+
+	assert.Equal(t, path.Join(tdir, defaultInstanceLockFile),
+		menderConfig{}.GetInstanceLockFile(tdir))
+	assert.Equal(t, "/run/mender.lock",
+		menderConfig{InstanceLockFile: "/run/mender.lock"}.GetInstanceLockFile(tdir))
+}
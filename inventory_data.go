@@ -14,32 +14,47 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
 	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
 const (
 	inventoryToolPrefix = "mender-inventory-"
+	// name of key holding the version of the inventory acknowledged by the
+	// server
+	inventoryVersionName = "inventory-version"
 )
 
-func NewInventoryDataRunner(scriptsDir string) InventoryDataRunner {
+// NewInventoryDataRunner returns a runner of the inventory scripts found in the
+// given directories. Attributes reported by the scripts of a later directory
+// override the same attributes reported by an earlier one, so that e.g. a
+// vendor overlay can replace the scripts of the base image.
+func NewInventoryDataRunner(scriptsDirs ...string) InventoryDataRunner {
 	return InventoryDataRunner{
-		scriptsDir,
-		&osCalls{},
+		dirs: scriptsDirs,
+		cmd:  &osCalls{},
 	}
 }
 
 type InventoryDataRunner struct {
-	dir string
-	cmd Commander
+	dirs []string
+	cmd  Commander
+	// fail if any of the tools fails, instead of skipping its output
+	strict bool
 }
 
 func listRunnable(dpath string) ([]string, error) {
@@ -67,38 +82,72 @@ func listRunnable(dpath string) ([]string, error) {
 }
 
 func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
-	tools, err := listRunnable(id.dir)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to list tools for inventory data")
+	var idata client.InventoryData
+	var lastErr error
+	listed := 0
+	for _, dir := range id.dirs {
+		tools, err := listRunnable(dir)
+		if err != nil {
+			log.Debugf("no inventory tools in %s: %v", dir, err)
+			lastErr = err
+			continue
+		}
+		listed++
+		data, err := id.run(tools)
+		if err != nil {
+			return nil, err
+		}
+		idata.ReplaceAttributes(data)
+	}
+	if listed == 0 && lastErr != nil {
+		return nil, errors.Wrapf(lastErr, "failed to list tools for inventory data")
 	}
+	if len(idata) == 0 {
+		return nil, nil
+	}
+	return idata, nil
+}
 
+// run runs the inventory tools, merging the values they report for the same
+// attribute. The output of a failing tool is skipped, unless the runner is
+// strict, in which case the first failure is returned.
+func (id *InventoryDataRunner) run(tools []string) (client.InventoryData, error) {
 	idec := NewInventoryDataDecoder()
 	for _, t := range tools {
-		cmd := id.cmd.Command(t)
-		out, err := cmd.StdoutPipe()
+		data, err := id.runTool(t)
 		if err != nil {
-			log.Errorf("failed to open stdout for inventory tool %s: %v", t, err)
+			if id.strict {
+				return nil, err
+			}
+			log.Errorf("skipping output of inventory tool: %v", err)
 			continue
 		}
+		idec.AppendFromRaw(data)
+	}
+	return idec.GetInventoryData(), nil
+}
 
-		if err := cmd.Start(); err != nil {
-			log.Errorf("inventory tool %s failed with status: %v", t, err)
-			continue
-		}
+func (id *InventoryDataRunner) runTool(t string) (map[string][]string, error) {
+	cmd := id.cmd.Command(t)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open stdout for inventory tool %s", t)
+	}
 
-		p := utils.KeyValParser{}
-		if err := p.Parse(out); err != nil {
-			log.Warnf("inventory tool %s returned unparsable output: %v", t, err)
-			continue
-		}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "inventory tool %s failed to start", t)
+	}
 
-		if err := cmd.Wait(); err != nil {
-			log.Warnf("inventory tool %s wait failed: %v", t, err)
-		}
+	p := utils.KeyValParser{}
+	if err := p.Parse(out); err != nil {
+		cmd.Wait()
+		return nil, errors.Wrapf(err, "inventory tool %s returned unparsable output", t)
+	}
 
-		idec.AppendFromRaw(p.Collect())
+	if err := cmd.Wait(); err != nil {
+		return nil, errors.Wrapf(err, "inventory tool %s failed", t)
 	}
-	return idec.GetInventoryData(), nil
+	return p.Collect(), nil
 }
 
 type InventoryDataDecoder struct {
@@ -152,3 +201,102 @@ func (id *InventoryDataDecoder) AppendFromRaw(raw map[string][]string) {
 		}
 	}
 }
+
+// canonicalizeInventory returns the attributes sorted by name, with values
+// trimmed and multiple values sorted, so that the same inventory always looks
+// the same regardless of the order the inventory scripts were run in.
+func canonicalizeInventory(attrs []client.InventoryAttribute) []client.InventoryAttribute {
+	canonical := make([]client.InventoryAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case string:
+			a.Value = strings.TrimSpace(v)
+		case []string:
+			vals := make([]string, len(v))
+			for i := range v {
+				vals[i] = strings.TrimSpace(v[i])
+			}
+			sort.Strings(vals)
+			if len(vals) == 1 {
+				a.Value = vals[0]
+			} else {
+				a.Value = vals
+			}
+		}
+		canonical = append(canonical, a)
+	}
+	sort.SliceStable(canonical, func(i, j int) bool {
+		return canonical[i].Name < canonical[j].Name
+	})
+	return canonical
+}
+
+// inventoryHash returns a hex encoded SHA256 checksum of the canonical form of
+// the inventory.
+func inventoryHash(attrs []client.InventoryAttribute) (string, error) {
+	data, err := json.Marshal(canonicalizeInventory(attrs))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode inventory data")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// inventoryVersion is the version the server acknowledged the inventory with
+// the given hash as.
+type inventoryVersion struct {
+	Hash    string
+	Version string
+}
+
+func storeInventoryVersion(s store.Store, v inventoryVersion) {
+	storeJSON(s, inventoryVersionName, "inventory version", v)
+}
+
+func loadInventoryVersion(s store.Store) (inventoryVersion, bool) {
+	var v inventoryVersion
+	if !loadJSON(s, inventoryVersionName, "inventory version", &v) {
+		return v, false
+	}
+	return v, v.Version != ""
+}
+
+func clearInventoryVersion(s store.Store) {
+	clearJSON(s, inventoryVersionName, "inventory version")
+}
+
+// ST_RDONLY flag of statfs(2); not defined by the syscall package
+const statfsReadOnly = 0x1
+
+// storageInventory returns the free space on the data and root partitions,
+// and whether the root partition is mounted read-only; a full or read-only
+// partition is a frequent cause of failed updates. Attributes of file systems
+// that can not be inspected are left out.
+func storageInventory(dataDir, rootDir string) []client.InventoryAttribute {
+	var attrs []client.InventoryAttribute
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dataDir, &stat); err != nil {
+		log.Warnf("failed to get free space of %s: %v", dataDir, err)
+	} else {
+		attrs = append(attrs, client.InventoryAttribute{
+			Name:  "data_partition_free_bytes",
+			Value: strconv.FormatUint(stat.Bavail*uint64(stat.Bsize), 10),
+		})
+	}
+
+	if err := syscall.Statfs(rootDir, &stat); err != nil {
+		log.Warnf("failed to get free space of %s: %v", rootDir, err)
+	} else {
+		attrs = append(attrs,
+			client.InventoryAttribute{
+				Name:  "rootfs_free_bytes",
+				Value: strconv.FormatUint(stat.Bavail*uint64(stat.Bsize), 10),
+			},
+			client.InventoryAttribute{
+				Name:  "rootfs_read_only",
+				Value: strconv.FormatBool(stat.Flags&statfsReadOnly != 0),
+			})
+	}
+	return attrs
+}
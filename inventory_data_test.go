@@ -14,10 +14,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
 	"testing"
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInventoryDataDecoder(t *testing.T) {
@@ -50,3 +55,110 @@ func TestInventoryDataDecoder(t *testing.T) {
 	assert.Contains(t, idata, client.InventoryAttribute{"foo", []string{"bar", "baz"}})
 	assert.Contains(t, idata, client.InventoryAttribute{"bar", "zen"})
 }
+
+func TestInventoryDataRunnerDirs(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-inventory-")
+	defer os.RemoveAll(td)
+
+	base := path.Join(td, "base")
+	vendor := path.Join(td, "vendor")
+	require.NoError(t, os.MkdirAll(base, 0755))
+	require.NoError(t, os.MkdirAll(vendor, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(base, "mender-inventory-os"),
+		[]byte("#!/bin/sh\necho os=base\necho kernel=4.14\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(base, "mender-inventory-net"),
+		[]byte("#!/bin/sh\necho mac=aa\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(vendor, "mender-inventory-os"),
+		[]byte("#!/bin/sh\necho os=vendor\n"), 0755))
+
+	// attributes of the later directory override the earlier ones; the
+	// missing directory is skipped
+	idr := NewInventoryDataRunner(base, path.Join(td, "missing"), vendor)
+	idata, err := idr.Get()
+	assert.NoError(t, err)
+	assert.Len(t, idata, 3)
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "os", Value: "vendor"})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "kernel", Value: "4.14"})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "mac", Value: "aa"})
+
+	idr = NewInventoryDataRunner(path.Join(td, "missing"))
+	_, err = idr.Get()
+	assert.Error(t, err)
+}
+
+func TestInventoryDataRunnerFailingTool(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-inventory-")
+	defer os.RemoveAll(td)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(td, "mender-inventory-broken"),
+		[]byte("#!/bin/sh\necho partial=yes\nexit 1\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(td, "mender-inventory-net"),
+		[]byte("#!/bin/sh\necho mac=aa\n"), 0755))
+
+	// output of the failing tool is skipped
+	idr := NewInventoryDataRunner(td)
+	idata, err := idr.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, client.InventoryData{{Name: "mac", Value: "aa"}}, idata)
+
+	idr.strict = true
+	idata, err = idr.Get()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mender-inventory-broken")
+	assert.Nil(t, idata)
+}
+
+func TestCanonicalizeInventory(t *testing.T) {
+	a := []client.InventoryAttribute{
+		{Name: "mac", Value: []string{"de:ad:be:ef:00:02", "de:ad:be:ef:00:01"}},
+		{Name: "kernel", Value: "4.14 "},
+		{Name: "device_type", Value: "foo-bar"},
+		{Name: "ip", Value: []string{"10.0.0.1"}},
+	}
+	b := []client.InventoryAttribute{
+		{Name: "device_type", Value: "foo-bar"},
+		{Name: "ip", Value: "10.0.0.1"},
+		{Name: "kernel", Value: "4.14"},
+		{Name: "mac", Value: []string{"de:ad:be:ef:00:01", "de:ad:be:ef:00:02"}},
+	}
+
+	assert.Equal(t, b, canonicalizeInventory(a))
+	assert.Equal(t, b, canonicalizeInventory(b))
+
+	ha, err := inventoryHash(a)
+	assert.NoError(t, err)
+	hb, err := inventoryHash(b)
+	assert.NoError(t, err)
+	assert.Equal(t, ha, hb)
+
+	b[0].Value = "foo-baz"
+	hb, err = inventoryHash(b)
+	assert.NoError(t, err)
+	assert.NotEqual(t, ha, hb)
+}
+
+func TestStorageInventory(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-storage-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	attrs := storageInventory(td, td)
+	values := map[string]string{}
+	for _, a := range attrs {
+		values[a.Name] = a.Value.(string)
+	}
+
+	for _, name := range []string{"data_partition_free_bytes", "rootfs_free_bytes"} {
+		require.Contains(t, values, name)
+		free, err := strconv.ParseUint(values[name], 10, 64)
+		assert.NoError(t, err)
+		assert.True(t, free > 0)
+	}
+	// temporary directory is writable
+	assert.Equal(t, "false", values["rootfs_read_only"])
+
+	// file system that can not be inspected is left out
+	attrs = storageInventory(td, path.Join(td, "missing"))
+	require.Len(t, attrs, 1)
+	assert.Equal(t, "data_partition_free_bytes", attrs[0].Name)
+}
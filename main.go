@@ -16,15 +16,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -47,12 +52,25 @@ type runOptionsType struct {
 	config          *string
 	dataStore       *string
 	imageFile       *string
+	installTarget   *string
 	runStateScripts *bool
 	commit          *bool
 	bootstrap       *bool
 	daemon          *bool
+	once            *bool
 	bootstrapForce  *bool
 	showArtifact    *bool
+	exportPubKey    *bool
+	showInventory   *bool
+	selfCheck       *bool
+	decommission    *bool
+	removeKey       *bool
+	pause           *bool
+	resume          *bool
+	status          *bool
+	reauthorize     *bool
+	clearFatal      *bool
+	reinstall       *bool
 	client.Config
 }
 
@@ -63,8 +81,12 @@ var (
 		"- must give exactly one from: -rootfs, -commit, -bootstrap, -authorize or -daemon")
 	errMsgIncompatibleLogOptions = errors.New("One or more " +
 		"incompatible log log options specified.")
+	errMsgNotRoot = errors.New("must run as root to install updates")
 )
 
+// effective user ID of the process; replaced in tests
+var getEUID = os.Geteuid
+
 var defaultConfFile string = path.Join(getConfDirPath(), "mender.conf")
 
 var DeploymentLogger *DeploymentLogManager
@@ -110,13 +132,51 @@ func argsParse(args []string) (runOptionsType, error) {
 
 	showArtifact := parsing.Bool("show-artifact", false, "print the current artifact name to the command line and exit")
 
+	exportPubKey := parsing.Bool("export-pubkey", false,
+		"Print the public key of the device in PEM format, generating the key if needed, and exit.")
+
+	showInventory := parsing.Bool("show-inventory", false,
+		"Print the inventory data the device would submit to the server as JSON, "+
+			"without submitting it, and exit.")
+
+	selfCheck := parsing.Bool("self-check", false,
+		"Check that the data store, the device key and the authorization token "+
+			"are usable, print the results and exit.")
+
+	decommission := parsing.Bool("decommission", false,
+		"Retire the device: remove the authorization token and stop contacting "+
+			"the server for good, and exit.")
+	removeKey := parsing.Bool("remove-key", false,
+		"Also remove the device key when decommissioning the device.")
+
 	imageFile := parsing.String("rootfs", "",
 		"Root filesystem URI to use for update. Can be either a local "+
-			"file or a URL.")
+			"file or a URL. Use - to read the artifact from standard input.")
+
+	installTarget := parsing.String("install-target", "",
+		"Partition to install the artifact given with -rootfs to instead of the inactive one.")
 
 	forceStateScripts := parsing.Bool("f", false, "force installation of artifacts with state-scripts")
 
+	reinstall := parsing.Bool("reinstall", false,
+		"Install the artifact given with -rootfs even if it is installed already.")
+
 	daemon := parsing.Bool("daemon", false, "Run as a daemon.")
+	once := parsing.Bool("once", false,
+		"Check for an update once, install it if there is one and exit with a code "+
+			"telling the outcome: 0 no update, 3 update applied, 4 update failed, "+
+			"5 authorization failed, 6 server unreachable.")
+
+	pause := parsing.Bool("pause", false,
+		"Pause checking for updates in the running daemon.")
+	resume := parsing.Bool("resume", false,
+		"Resume checking for updates in the running daemon.")
+	status := parsing.Bool("status", false,
+		"Show authorization status of the running daemon.")
+	reauthorize := parsing.Bool("reauthorize", false,
+		"Make the running daemon drop its authorization token and authorize again.")
+	clearFatal := parsing.Bool("clear-fatal", false,
+		"Allow updates again in the running daemon after an unrecoverable failure was repaired.")
 
 	// add bootstrap related command line options
 	serverCert := parsing.String("trusted-certs", "", "Trusted server certificates")
@@ -137,12 +197,25 @@ func argsParse(args []string) (runOptionsType, error) {
 		config:          config,
 		dataStore:       data,
 		imageFile:       imageFile,
+		installTarget:   installTarget,
 		runStateScripts: forceStateScripts,
 		commit:          commit,
 		bootstrap:       bootstrap,
 		daemon:          daemon,
+		once:            once,
 		bootstrapForce:  forcebootstrap,
 		showArtifact:    showArtifact,
+		exportPubKey:    exportPubKey,
+		showInventory:   showInventory,
+		selfCheck:       selfCheck,
+		decommission:    decommission,
+		removeKey:       removeKey,
+		pause:           pause,
+		resume:          resume,
+		status:          status,
+		reauthorize:     reauthorize,
+		clearFatal:      clearFatal,
+		reinstall:       reinstall,
 		Config: client.Config{
 			ServerCert: *serverCert,
 			NoVerify:   *skipVerify,
@@ -183,6 +256,36 @@ func moreThanOneRunOptionSelected(runOptions runOptionsType) bool {
 	if *runOptions.daemon {
 		runOptionsCount++
 	}
+	if *runOptions.once {
+		runOptionsCount++
+	}
+	if *runOptions.pause {
+		runOptionsCount++
+	}
+	if *runOptions.resume {
+		runOptionsCount++
+	}
+	if *runOptions.status {
+		runOptionsCount++
+	}
+	if *runOptions.reauthorize {
+		runOptionsCount++
+	}
+	if *runOptions.clearFatal {
+		runOptionsCount++
+	}
+	if *runOptions.exportPubKey {
+		runOptionsCount++
+	}
+	if *runOptions.showInventory {
+		runOptionsCount++
+	}
+	if *runOptions.selfCheck {
+		runOptionsCount++
+	}
+	if *runOptions.decommission {
+		runOptionsCount++
+	}
 
 	if runOptionsCount > 1 {
 		return true
@@ -243,6 +346,7 @@ func parseLogFlags(args logOptionsType) error {
 		logOptCount++
 	}
 
+	logLevelFromCommandLine = logOptCount != 0
 	if logOptCount > 1 {
 		return errMsgIncompatibleLogOptions
 	} else if logOptCount == 0 {
@@ -309,6 +413,12 @@ func PrintArtifactName(fpath string) error {
 }
 
 func doBootstrapAuthorize(config *menderConfig, opts *runOptionsType) error {
+	lock, err := acquireInstanceLock(config.GetInstanceLockFile(*opts.dataStore))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	mp, err := commonInit(config, opts)
 	if err != nil {
 		return err
@@ -338,39 +448,165 @@ func doBootstrapAuthorize(config *menderConfig, opts *runOptionsType) error {
 	return nil
 }
 
+// doExportPublicKey prints the public key of the device, e.g. to preauthorize
+// the device during provisioning.
+func doExportPublicKey(config *menderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+
+	key, err := controller.ExportPublicKey()
+	if err != nil {
+		return err
+	}
+	fmt.Print(key)
+	return nil
+}
+
+// doShowInventory prints the inventory the device would submit, e.g. while
+// developing inventory scripts; nothing is sent to the server.
+func doShowInventory(config *menderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+	return printInventory(os.Stdout, controller)
+}
+
+func printInventory(out io.Writer, m *mender) error {
+	attrs, err := m.CollectInventory()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(attrs, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode inventory")
+	}
+	fmt.Fprintln(out, string(data))
+	return nil
+}
+
+// doSelfCheck checks the data kept by the client, e.g. while diagnosing a
+// device in the field, before a corruption causes failures at run time.
+func doSelfCheck(config *menderConfig, opts *runOptionsType) error {
+	dbstore := store.NewDBStore(*opts.dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	var ks *store.Keystore
+	if config.GetKeyStoreBackend() == keyStoreFile {
+		ks = getKeyStore(*opts.dataStore, defaultKeyFile)
+		ks.SetAllowInsecurePermissions(config.AllowInsecureKeyPermissions)
+	}
+	return printSelfCheck(os.Stdout, runSelfCheck(dbstore, ks))
+}
+
+// doDecommission retires the device when it is taken out of service; the
+// daemon stops once it notices, and does not start over after a restart.
+func doDecommission(config *menderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+	return controller.Decommission(*opts.removeKey)
+}
+
 func getKeyStore(datastore string, keyName string) *store.Keystore {
 	dirstore := store.NewDirStore(datastore)
 	return store.NewKeystore(dirstore, keyName)
 }
 
-func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, error) {
-
-	tentok := config.GetTenantToken()
+// newAuthManager sets up the authorization manager with the device key kept in
+// the configured key store backend.
+func newAuthManager(config *menderConfig, dataStore string,
+	authStore store.Store, idSrc IdentityDataGetter) (AuthManager, error) {
+
+	var ks *store.Keystore
+	var signCommand []string
+	var pubKey []byte
+
+	switch config.GetKeyStoreBackend() {
+	case keyStoreMemory:
+		ks = store.NewKeystore(store.NewMemStore(), defaultKeyFile)
+	case keyStoreExternal:
+		if len(config.SignCommand) == 0 {
+			return nil, errors.New("SignCommand must be set to use the external key store")
+		}
+		var err error
+		if pubKey, err = ioutil.ReadFile(config.DevicePublicKeyFile); err != nil {
+			return nil, errors.Wrapf(err, "failed to read device public key")
+		}
+		signCommand = config.SignCommand
+		// never used, the key is kept by the signer
+		ks = store.NewKeystore(store.NewMemStore(), defaultKeyFile)
+	default:
+		ks = getKeyStore(dataStore, defaultKeyFile)
+		if ks == nil {
+			return nil, errors.New("failed to setup key storage")
+		}
+		ks.SetAllowInsecurePermissions(config.AllowInsecureKeyPermissions)
+	}
 
-	ks := getKeyStore(*opts.dataStore, defaultKeyFile)
-	if ks == nil {
-		return nil, errors.New("failed to setup key storage")
+	authmgr := NewAuthManager(AuthManagerConfig{
+		AuthDataStore:      authStore,
+		KeyStore:           ks,
+		IdentitySource:     idSrc,
+		TenantToken:        config.GetTenantToken(),
+		SignCommand:        signCommand,
+		SignCommandTimeout: config.GetStateScriptTimeout(),
+		PublicKey:          string(pubKey),
+	})
+	if authmgr == nil {
+		return nil, errors.New("error initializing authentication manager")
 	}
+	return authmgr, nil
+}
+
+func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, error) {
 
 	dbstore := store.NewDBStore(*opts.dataStore)
 	if dbstore == nil {
 		return nil, errors.New("failed to initialize DB store")
 	}
 
-	authmgr := NewAuthManager(AuthManagerConfig{
-		AuthDataStore:  dbstore,
-		KeyStore:       ks,
-		IdentitySource: NewIdentityDataGetter(),
-		TenantToken:    tentok,
+	// the state data and the authorization token are written even if the
+	// data partition fills up
+	s := newSpaceRecoveringStore(dbstore, func() {
+		freeStoreSpace(dbstore, time.Now())
 	})
-	if authmgr == nil {
+
+	authmgr, err := newAuthManager(config, *opts.dataStore, s,
+		NewIdentityDataGetter(config.GetIdentityCommand(),
+			config.GetStateScriptTimeout()))
+	if err != nil {
 		// close DB store explicitly
 		dbstore.Close()
-		return nil, errors.New("error initializing authentication manager")
+		return nil, err
 	}
 
 	mp := MenderPieces{
-		store:   dbstore,
+		store:   s,
 		authMgr: authmgr,
 	}
 	return &mp, nil
@@ -379,8 +615,16 @@ func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, erro
 func initDaemon(config *menderConfig, dev *device, env BootEnvReadWriter,
 	opts *runOptionsType) (*menderDaemon, error) {
 
+	// the lock is taken before the store is opened, and released by
+	// Cleanup
+	lock, err := acquireInstanceLock(config.GetInstanceLockFile(*opts.dataStore))
+	if err != nil {
+		return nil, err
+	}
+
 	mp, err := commonInit(config, opts)
 	if err != nil {
+		lock.Release()
 		return nil, err
 	}
 	mp.device = dev
@@ -388,6 +632,7 @@ func initDaemon(config *menderConfig, dev *device, env BootEnvReadWriter,
 	controller, err := NewMender(*config, *mp)
 	if controller == nil {
 		mp.store.Close()
+		lock.Release()
 		return nil, errors.Wrap(err, "error initializing mender controller")
 	}
 
@@ -396,6 +641,14 @@ func initDaemon(config *menderConfig, dev *device, env BootEnvReadWriter,
 	}
 
 	daemon := NewDaemon(controller, mp.store)
+	daemon.instanceLock = lock
+	if config.SystemdNotify {
+		daemon.notifier = NewSystemdNotifier()
+	}
+	daemon.stuckStateTimeout =
+		time.Duration(config.StuckStateTimeoutSeconds) * time.Second
+	daemon.staleDataTTL =
+		time.Duration(config.StaleDataExpireSeconds) * time.Second
 
 	// add logging hook; only daemon needs this
 	log.AddHook(NewDeploymentLogHook(DeploymentLogger))
@@ -403,6 +656,28 @@ func initDaemon(config *menderConfig, dev *device, env BootEnvReadWriter,
 	return daemon, nil
 }
 
+// reloadConfigOnSignal makes the daemon re-read the configuration file each
+// time SIGHUP is received.
+func reloadConfigOnSignal(d *menderDaemon, configFile string, noVerify bool) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for range sigs {
+			log.Infof("got SIGHUP, reloading configuration from %s", configFile)
+			config, err := LoadConfig(configFile)
+			if err != nil {
+				log.Errorf("failed to reload configuration: %v", err)
+				continue
+			}
+			if noVerify {
+				config.HttpsClient.SkipVerify = true
+			}
+			d.ReloadConfig(config)
+		}
+	}()
+}
+
 func doMain(args []string) error {
 	runOptions, err := argsParse(args)
 	if err != nil {
@@ -426,7 +701,22 @@ func doMain(args []string) error {
 	return handleCLIOptions(runOptions, env, device, config)
 }
 
+// checkPrivileges fails early if the selected operation writes the partitions,
+// the boot environment or reboots the device, and the process is not run as
+// root; otherwise it would fail in the middle of the deployment.
+func checkPrivileges(runOptions runOptionsType, config *menderConfig) error {
+	needsRoot := *runOptions.imageFile != "" || *runOptions.commit ||
+		((*runOptions.daemon || *runOptions.once) && !config.InventoryOnly)
+	if needsRoot && getEUID() != 0 {
+		return errMsgNotRoot
+	}
+	return nil
+}
+
 func handleCLIOptions(runOptions runOptionsType, env *uBootEnv, device *device, config *menderConfig) error {
+	if err := checkPrivileges(runOptions, config); err != nil {
+		return err
+	}
 
 	switch {
 
@@ -441,13 +731,52 @@ func handleCLIOptions(runOptions runOptionsType, env *uBootEnv, device *device,
 		if err != nil {
 			log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
 		}
-		vKey := config.GetVerificationKey()
-		return doRootfs(device, runOptions, dt, vKey)
+		installed, err := GetCurrentArtifactName(defaultArtifactInfoFile)
+		if err != nil {
+			log.Errorf("Unable to read the name of the installed artifact: %v", err)
+		}
+		vKeys, err := config.GetArtifactVerifyKeys("", dt)
+		if err != nil {
+			return err
+		}
+		if *runOptions.installTarget != "" {
+			device.installTarget = *runOptions.installTarget
+		}
+		runOptions.Config.MinTLSVersion = config.GetTLSMinVersion()
+		runOptions.Config.DisableHTTP2 = config.DisableHTTP2
+		return doRootfs(device, runOptions, dt, installed, vKeys)
 
 	case *runOptions.commit:
 		return device.CommitUpdate()
 	case *runOptions.bootstrap:
 		return doBootstrapAuthorize(config, &runOptions)
+	case *runOptions.exportPubKey:
+		return doExportPublicKey(config, &runOptions)
+	case *runOptions.showInventory:
+		return doShowInventory(config, &runOptions)
+	case *runOptions.selfCheck:
+		return doSelfCheck(config, &runOptions)
+	case *runOptions.decommission:
+		return doDecommission(config, &runOptions)
+	case *runOptions.pause:
+		_, err := sendControlCommand(config.GetControlSocket(), controlCommandPause)
+		return err
+	case *runOptions.resume:
+		_, err := sendControlCommand(config.GetControlSocket(), controlCommandResume)
+		return err
+	case *runOptions.status:
+		status, err := sendControlCommand(config.GetControlSocket(), controlCommandStatus)
+		if err != nil {
+			return err
+		}
+		fmt.Println(status)
+		return nil
+	case *runOptions.reauthorize:
+		_, err := sendControlCommand(config.GetControlSocket(), controlCommandReauthorize)
+		return err
+	case *runOptions.clearFatal:
+		_, err := sendControlCommand(config.GetControlSocket(), controlCommandClearFatal)
+		return err
 
 	case *runOptions.daemon:
 		d, err := initDaemon(config, device, env, &runOptions)
@@ -455,6 +784,19 @@ func handleCLIOptions(runOptions runOptionsType, env *uBootEnv, device *device,
 			return err
 		}
 		defer d.Cleanup()
+		reloadConfigOnSignal(d, *runOptions.config, runOptions.Config.NoVerify)
+		if err := d.ServeControl(config.GetControlSocket()); err != nil {
+			log.Warnf("control commands are not available: %v", err)
+		}
+		return d.Run()
+
+	case *runOptions.once:
+		d, err := initDaemon(config, device, env, &runOptions)
+		if err != nil {
+			return err
+		}
+		defer d.Cleanup()
+		d.oneShot = true
 		return d.Run()
 
 	case *runOptions.imageFile == "" && !*runOptions.commit &&
@@ -468,7 +810,10 @@ func handleCLIOptions(runOptions runOptionsType, env *uBootEnv, device *device,
 func main() {
 	if err := doMain(os.Args[1:]); err != nil && err != flag.ErrHelp {
 		var returnCode int
-		if err == errorNoUpgradeMounted {
+		if e, ok := err.(*exitCodeError); ok {
+			log.Infoln(err.Error())
+			returnCode = e.code
+		} else if err == errorNoUpgradeMounted {
 			log.Warnln(err.Error())
 			returnCode = 2
 		} else {
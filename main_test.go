@@ -15,7 +15,12 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -30,7 +35,9 @@ import (
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -47,6 +54,9 @@ func TestAmbiguousArgumentsArgs(t *testing.T) {
 	err := doMain([]string{"-daemon", "-commit"})
 	assert.Error(t, err)
 	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+
+	err = doMain([]string{"-daemon", "-once"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
 }
 
 func TestArgsParseRootfsForce(t *testing.T) {
@@ -129,7 +139,7 @@ func TestBinarySize(t *testing.T) {
 	// so.
 	//
 	// When increasing, use current binary size on amd64 + 1M.
-	const maxSize int64 = 9525080
+	const maxSize int64 = 13769312
 	programName := "mender"
 	built := false
 
@@ -307,6 +317,18 @@ echo mac=00:11:22:33:44:55
 	assert.Error(t, err)
 	assert.True(t, os.IsNotExist(err))
 
+	// no second instance is started while the client is running
+	responder.httpStatus = http.StatusOK
+	lock, err := acquireInstanceLock(path.Join(tdir, defaultInstanceLockFile))
+	require.NoError(t, err)
+	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap"})
+	assert.Equal(t, errInstanceLocked, errors.Cause(err))
+	_, err = db.ReadAll(authTokenName)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, lock.Release())
+	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap"})
+	assert.NoError(t, err)
 }
 
 func TestPrintArtifactName(t *testing.T) {
@@ -339,3 +361,157 @@ func TestPrintArtifactName(t *testing.T) {
 	assert.EqualError(t, PrintArtifactName(tfile.Name()), "Wrong formatting of the artifact_info file")
 
 }
+
+func TestCheckPrivileges(t *testing.T) {
+	oldEUID := getEUID
+	defer func() { getEUID = oldEUID }()
+	getEUID = func() int { return 1000 }
+
+	for _, args := range [][]string{
+		{"-rootfs", "newImage"},
+		{"-commit"},
+		{"-daemon"},
+		{"-once"},
+	} {
+		runOpts, err := argsParse(args)
+		require.NoError(t, err)
+		assert.Equal(t, errMsgNotRoot,
+			checkPrivileges(runOpts, &menderConfig{}), "%v", args)
+	}
+
+	// inventory only mode runs unprivileged
+	runOpts, err := argsParse([]string{"-daemon"})
+	require.NoError(t, err)
+	assert.NoError(t, checkPrivileges(runOpts, &menderConfig{InventoryOnly: true}))
+
+	// so do the commands not touching the device
+	runOpts, err = argsParse([]string{"-show-artifact"})
+	require.NoError(t, err)
+	assert.NoError(t, checkPrivileges(runOpts, &menderConfig{}))
+
+	// the error is returned before the update is attempted
+	err = doMain([]string{"-config", "mender.conf.example", "-commit"})
+	assert.Equal(t, errMsgNotRoot, err)
+
+	getEUID = func() int { return 0 }
+	runOpts, err = argsParse([]string{"-rootfs", "newImage"})
+	require.NoError(t, err)
+	assert.NoError(t, checkPrivileges(runOpts, &menderConfig{}))
+}
+
+func TestMainExportPublicKey(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	cpath := path.Join(tdir, "mender.config")
+	writeConfig(t, cpath, menderConfig{
+		ServerURL: "https://mender.io",
+	})
+
+	export := func() string {
+		oldstdout := os.Stdout
+		defer func() { os.Stdout = oldstdout }()
+		tfile, err := ioutil.TempFile(tdir, "stdout")
+		require.NoError(t, err)
+		defer tfile.Close()
+		os.Stdout = tfile
+
+		err = doMain([]string{"-data", tdir, "-config", cpath, "-export-pubkey"})
+		assert.NoError(t, err)
+
+		tfile.Seek(0, 0)
+		data, _ := ioutil.ReadAll(tfile)
+		return string(data)
+	}
+
+	// key is generated on the first export
+	out := export()
+	block, _ := pem.Decode([]byte(out))
+	require.NotNil(t, block)
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+
+	ks := getKeyStore(tdir, defaultKeyFile)
+	require.NoError(t, ks.Load())
+	assert.Equal(t, &ks.Private().PublicKey, pub)
+
+	// and is not replaced by the following ones
+	assert.Equal(t, out, export())
+}
+
+func TestKeyStoreBackends(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	// external key store is selected if the sign command is set
+	assert.Equal(t, keyStoreExternal,
+		menderConfig{SignCommand: []string{"sign"}}.GetKeyStoreBackend())
+	assert.Equal(t, keyStoreFile, menderConfig{}.GetKeyStoreBackend())
+	assert.Equal(t, keyStoreFile,
+		menderConfig{KeyStoreBackend: "bogus"}.GetKeyStoreBackend())
+
+	cmdr := newTestOSCalls("mac=foobar", 0)
+	idSrc := IdentityDataRunner{cmdr: &cmdr}
+
+	// signature of the auth request must verify with the device public key
+	verify := func(am AuthManager) {
+		req, err := am.MakeAuthRequest()
+		require.NoError(t, err)
+		pubPEM, err := am.PublicKeyPEM()
+		require.NoError(t, err)
+		block, _ := pem.Decode([]byte(pubPEM))
+		require.NotNil(t, block)
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		sum := sha256.Sum256(req.Data)
+		assert.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256,
+			sum[:], req.Signature))
+	}
+
+	// file and memory backends generate the key on demand
+	for _, backend := range []string{keyStoreFile, keyStoreMemory} {
+		config := &menderConfig{KeyStoreBackend: backend}
+		am, err := newAuthManager(config, tdir, store.NewMemStore(), idSrc)
+		require.NoError(t, err, backend)
+		assert.False(t, am.HasKey(), backend)
+		require.NoError(t, am.GenerateKey(), backend)
+		assert.True(t, am.HasKey(), backend)
+		verify(am)
+
+		// only the file backend keeps the key across restarts
+		am, err = newAuthManager(config, tdir, store.NewMemStore(), idSrc)
+		require.NoError(t, err, backend)
+		assert.Equal(t, backend == keyStoreFile, am.HasKey(), backend)
+		os.Remove(path.Join(tdir, defaultKeyFile))
+	}
+
+	// external backend signs with the key it keeps; the signer is faked with
+	// a key in a file
+	ks := store.NewKeystore(store.NewDirStore(tdir), "signer.key")
+	require.NoError(t, ks.Generate())
+	require.NoError(t, ks.Save())
+	pub, _ := ks.PublicPEM()
+	require.NoError(t, ioutil.WriteFile(path.Join(tdir, "signer.pub"), []byte(pub), 0644))
+
+	config := &menderConfig{
+		KeyStoreBackend:     keyStoreExternal,
+		DevicePublicKeyFile: path.Join(tdir, "signer.pub"),
+	}
+	_, err = newAuthManager(config, tdir, store.NewMemStore(), idSrc)
+	assert.Error(t, err)
+
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+	config.SignCommand = []string{"openssl", "dgst", "-sha256", "-sign",
+		path.Join(tdir, "signer.key")}
+	am, err := newAuthManager(config, tdir, store.NewMemStore(), idSrc)
+	require.NoError(t, err)
+	assert.True(t, am.HasKey())
+	assert.Error(t, am.GenerateKey())
+	verify(am)
+	_, err = os.Stat(path.Join(tdir, defaultKeyFile))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -15,12 +15,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mendersoftware/log"
@@ -29,6 +36,7 @@ import (
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/statescript"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -45,6 +53,7 @@ type UInstallCommitRebooter interface {
 	Reboot() error
 	SwapPartitions() error
 	HasUpdate() (bool, error)
+	GetBootState() (*bootState, error)
 }
 
 type Controller interface {
@@ -54,13 +63,47 @@ type Controller interface {
 	GetUpdatePollInterval() time.Duration
 	GetInventoryPollInterval() time.Duration
 	GetRetryPollInterval() time.Duration
-	HasUpgrade() (bool, menderError)
-	CheckUpdate() (*client.UpdateResponse, menderError)
-	FetchUpdate(url string) (io.ReadCloser, int64, error)
+	GetStartupDelay() time.Duration
+	GetUpdatePollJitter() time.Duration
+	GetArtifactStagingDir() string
+	ResumeStagedDownloads() bool
+	PipelinedInstall() bool
+	DownloadRateLimited() bool
+	GetDownloadRateLimit(now time.Time) int64
+	GetRebootStrategy() string
+	GetRebootDelay() (grace, max time.Duration)
+	RebootVetoed() bool
+	GetCommitReportFailure() string
+	RebootRequired() bool
+	ActivateCustomUpdate() (bool, error)
+	HasUpgrade() (bool, *client.UpdateResponse, menderError)
+	VerifyUpdate(ctx context.Context) error
+	GetUpdateControlTimeout() time.Duration
+	CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError)
+	FetchUpdate(ctx context.Context, url string) (io.ReadCloser, int64, error)
+	ResumeUpdate(ctx context.Context, url string, offset int64) (io.ReadCloser, int64, error)
+	InstallArtifact(ctx context.Context, from io.ReadCloser, size int64, name string) error
 	ReportUpdateStatus(update client.UpdateResponse, status string) menderError
+	ReportUpdateSubState(update client.UpdateResponse, status, substate string) menderError
 	UploadLog(update client.UpdateResponse, logs []byte) menderError
-	InventoryRefresh() error
+	InventoryRefresh(ctx context.Context) error
 	CheckScriptsCompatibility() error
+	ReloadConfig(config menderConfig)
+	UpdatesPaused() bool
+	ClearAuthToken()
+	UpdatesEnabled() bool
+	InventoryEnabled() bool
+	SetUpdatesPaused(paused bool) error
+	FatalFailure() string
+	Decommissioned() bool
+	SetFatalFailure(reason string) error
+	MaintenanceWindowWait() time.Duration
+	DeploymentEligible(ctx context.Context, update client.UpdateResponse) (bool, menderError)
+	NotifyUpdateDeferred(update client.UpdateResponse, until time.Time)
+	RunPostCommitScripts(update client.UpdateResponse)
+	UpdateConditionsMet() (bool, string)
+	GetDeviceStatus() deviceStatus
+	ExportPublicKey() (string, error)
 
 	UInstallCommitRebooter
 	StateRunner
@@ -68,6 +111,30 @@ type Controller interface {
 
 const (
 	defaultKeyFile = "mender-agent.pem"
+
+	// name of key that is present in the store while updates are paused
+	updatesPausedName = "updates-paused"
+	// name of key holding the reason of an unrecoverable failure of the
+	// device; updates are not attempted anymore until the operator clears it
+	fatalFailureName = "fatal-failure"
+	// name of key that is present in the store once the device is
+	// decommissioned; the client does not contact the server anymore
+	decommissionedName = "decommissioned"
+	// name of key holding the name of the artifact that was installed before
+	// the most recent update
+	previousArtifactName = "previous-artifact-name"
+
+	// artifact meta-data declaring whether the update needs a reboot to
+	// take effect
+	metadataRebootRequired = "reboot_required"
+	// name of key holding what the installed artifact provides
+	artifactProvidesName = "artifact-provides"
+	// name of key holding what the artifact installed, but not yet
+	// committed, provides
+	artifactProvidesPendingName = "artifact-provides-pending"
+	// name of key holding the cache validators of the last update check
+	// response
+	updateCheckValidatorsName = "update-check-validators"
 )
 
 var (
@@ -76,8 +143,13 @@ var (
 	defaultDataStore         = getStateDirPath()
 	defaultArtScriptsPath    = path.Join(getStateDirPath(), "scripts")
 	defaultRootfsScriptsPath = path.Join(getConfDirPath(), "scripts")
+	defaultControlSocket     = path.Join(getStateDirPath(), "control.sock")
 
 	errNoArtifactName = errors.New("cannot determine current artifact name")
+
+	// used for spreading requests of devices over time; accessed from the
+	// state machine only
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
 
 type MenderState int
@@ -130,8 +202,13 @@ const (
 	MenderStateError
 	// update error
 	MenderStateUpdateError
+	// unrecoverable failure; updates are given up
+	MenderStateFatal
 	// exit state
 	MenderStateDone
+	// state loaded from the state data, but unknown to this version of the
+	// client; never stored
+	MenderStateUnknown
 )
 
 var (
@@ -159,6 +236,7 @@ var (
 		MenderStateAfterRollbackReboot: "after-rollback-reboot",
 		MenderStateError:               "error",
 		MenderStateUpdateError:         "update-error",
+		MenderStateFatal:               "fatal",
 		MenderStateDone:                "finished",
 	}
 
@@ -190,6 +268,7 @@ var (
 		MenderStateAfterRollbackReboot: client.StatusRebooting,
 		MenderStateError:               "",
 		MenderStateUpdateError:         client.StatusFailure,
+		MenderStateFatal:               "",
 		MenderStateDone:                "",
 	}
 )
@@ -222,7 +301,12 @@ func (m *MenderState) UnmarshalJSON(data []byte) error {
 			return nil
 		}
 	}
-	return fmt.Errorf("unmarshal error; unknown state %s", s)
+	// state data may be written by a newer version of the client, which is
+	// then downgraded; the unknown state is left for the caller to handle
+	// instead of failing to load the data
+	log.Warnf("unknown state %q", s)
+	*m = MenderStateUnknown
+	return nil
 }
 
 type mender struct {
@@ -231,14 +315,45 @@ type mender struct {
 	state               State
 	stateScriptExecutor statescript.Executor
 	stateScriptPath     string
-	config              menderConfig
-	artifactInfoFile    string
-	deviceTypeFile      string
-	forceBootstrap      bool
-	authReq             client.AuthRequester
-	authMgr             AuthManager
-	api                 *client.ApiClient
-	authToken           client.AuthToken
+	// replaced only by the daemon loop, while holding configLock; other
+	// goroutines, such as the control socket, read it with getConfig()
+	config           menderConfig
+	configLock       sync.RWMutex
+	artifactInfoFile string
+	deviceTypeFile   string
+	forceBootstrap   bool
+	// held while bootstrapping, so that the device key is not generated
+	// twice when it is exported from the control socket
+	bootstrapLock sync.Mutex
+	authReq       client.AuthRequester
+	authMgr       AuthManager
+	api           *client.ApiClient
+	// cached authorization token; use getAuthToken() and setAuthToken()
+	authToken client.AuthToken
+	authLock  sync.Mutex
+	store     store.Store
+	// time of the last successful update check in nanoseconds since the
+	// epoch; accessed atomically as it is read by the control socket
+	lastUpdateCheck int64
+	// false if the installed update takes effect without a reboot
+	rebootRequired bool
+	// handlers activating the installed update if it is of a custom type
+	customUpdates []installer.UpdateHandler
+	// poll interval requested by the server for the deployment in
+	// progress; zero if not requested
+	pollIntervalOverride time.Duration
+	// cache validators of the last update check response offering an
+	// update, stored once the update is started
+	offeredValidators client.CacheValidators
+	// deployment the update deferred command was run for
+	deferredUpdateID string
+	// configuration as loaded from the file; config is the same with the
+	// configuration delivered by the server applied
+	localConfig menderConfig
+	// configuration delivered by the server; nil if there is none
+	remoteConfig *client.RemoteConfig
+	// log level applied from the configuration; empty if none was
+	logLevel string
 }
 
 type MenderPieces struct {
@@ -252,6 +367,15 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating HTTP client")
 	}
+	if err := api.SetAPIVersion(config.APIVersion); err != nil {
+		return nil, err
+	}
+	api.SetExtraHeaders(config.ExtraHeaders)
+	api.SetMaxResponseSize(config.MaxResponseSize)
+	api.SetKeepAlive(time.Duration(config.ConnectionKeepAliveSeconds) * time.Second)
+	api.SetConnectTimeout(time.Duration(config.ConnectTimeoutSeconds) * time.Second)
+	api.SetIdleConnections(config.MaxIdleConnections,
+		time.Duration(config.IdleConnectionTimeoutSeconds)*time.Second)
 
 	stateScrExec := statescript.Launcher{
 		ArtScriptsPath:          defaultArtScriptsPath,
@@ -269,13 +393,24 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 		deviceTypeFile:         defaultDeviceTypeFile,
 		state:                  initState,
 		config:                 config,
+		localConfig:            config,
 		authMgr:                pieces.authMgr,
 		authReq:                client.NewAuth(),
 		api:                    api,
 		authToken:              noAuthToken,
-		stateScriptExecutor:    stateScrExec,
+		rebootRequired:         true,
 		stateScriptPath:        defaultArtScriptsPath,
+		store:                  pieces.store,
+	}
+	stateScrExec.Environment = m.deploymentEnvironment
+	m.stateScriptExecutor = stateScrExec
+
+	if config.ServerConfig {
+		if rc, ok := loadRemoteConfig(m.store); ok {
+			m.applyRemoteConfig(rc)
+		}
 	}
+	m.applyLogLevel()
 
 	if m.authMgr != nil {
 		if err := m.loadAuth(); err != nil {
@@ -323,8 +458,10 @@ func (m *mender) GetDeviceType() (string, error) {
 	return getManifestData("device_type", m.deviceTypeFile)
 }
 
-func (m *mender) GetArtifactVerifyKey() []byte {
-	return m.config.GetVerificationKey()
+// GetArtifactVerifyKeys returns the keys the artifacts installed from the server
+// are verified with; nil if they need not be signed.
+func (m *mender) GetArtifactVerifyKeys(deviceType string) ([][]byte, error) {
+	return m.config.GetArtifactVerifyKeys(m.config.ServerURL, deviceType)
 }
 
 func GetCurrentArtifactName(artifactInfoFile string) (string, error) {
@@ -335,12 +472,16 @@ func GetDeviceType(deviceTypeFile string) (string, error) {
 	return getManifestData("device_type", deviceTypeFile)
 }
 
-func (m *mender) HasUpgrade() (bool, menderError) {
+func (m *mender) HasUpgrade() (bool, *client.UpdateResponse, menderError) {
 	has, err := m.UInstallCommitRebooter.HasUpdate()
 	if err != nil {
-		return false, NewFatalError(err)
+		return false, nil, NewFatalError(err)
+	}
+	if !has {
+		return false, nil, nil
 	}
-	return has, nil
+	update, _ := loadUpgradeUpdate(m.store)
+	return true, update, nil
 }
 
 func (m *mender) ForceBootstrap() {
@@ -361,6 +502,12 @@ func (m *mender) needsBootstrap() bool {
 }
 
 func (m *mender) Bootstrap() menderError {
+	m.bootstrapLock.Lock()
+	defer m.bootstrapLock.Unlock()
+	return m.bootstrap()
+}
+
+func (m *mender) bootstrap() menderError {
 	if !m.needsBootstrap() {
 		return nil
 	}
@@ -368,8 +515,48 @@ func (m *mender) Bootstrap() menderError {
 	return m.doBootstrap()
 }
 
+// ExportPublicKey returns the PEM encoded public key of the device, e.g. to
+// preauthorize the device. The key is generated first if needed.
+func (m *mender) ExportPublicKey() (string, error) {
+	m.bootstrapLock.Lock()
+	defer m.bootstrapLock.Unlock()
+	if merr := m.bootstrap(); merr != nil {
+		return "", merr.Cause()
+	}
+	return m.authMgr.PublicKeyPEM()
+}
+
+func (m *mender) getAuthToken() client.AuthToken {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	return m.authToken
+}
+
+func (m *mender) setAuthToken(token client.AuthToken) {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	m.authToken = token
+}
+
+// ClearAuthToken drops the authorization token, both the cached and the
+// stored copy, once the server rejects it or a fresh authorization is
+// requested. Both are removed under the lock, so
+// that a concurrent loadAuth() can not cache the token being removed.
+func (m *mender) ClearAuthToken() {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
+	m.authToken = noAuthToken
+	if err := m.authMgr.RemoveAuthToken(); err != nil {
+		log.Warn("can not remove rejected authentication token")
+	}
+}
+
 // cache authorization code
 func (m *mender) loadAuth() menderError {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
 	if m.authToken != noAuthToken {
 		return nil
 	}
@@ -405,15 +592,13 @@ func (m *mender) Authorize() menderError {
 		return err
 	}
 
-	m.authToken = noAuthToken
+	m.setAuthToken(noAuthToken)
 
 	rsp, err := m.authReq.Request(m.api, m.config.ServerURL, m.authMgr)
 	if err != nil {
-		if err == client.AuthErrorUnauthorized {
+		if errorIs(err, client.AuthErrorUnauthorized) {
 			// make sure to remove auth token once device is rejected
-			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
-				log.Warn("can not remove rejected authentication token")
-			}
+			m.ClearAuthToken()
 		}
 		return NewTransientError(errors.Wrap(err, "authorization request failed"))
 	}
@@ -442,14 +627,80 @@ func (m *mender) doBootstrap() menderError {
 	return nil
 }
 
-func (m *mender) FetchUpdate(url string) (io.ReadCloser, int64, error) {
-	return m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+// FetchUpdate starts the download of the update. The download is aborted
+// once ctx is done.
+func (m *mender) FetchUpdate(ctx context.Context, url string) (io.ReadCloser, int64, error) {
+	m.storeOfferedValidators()
+	in, size, err := m.updater.FetchUpdate(ctx, m.api, url, m.downloadRetryPolicy())
+	if err != nil {
+		return nil, -1, utils.WithCause(err)
+	}
+	return m.limitArtifactSize(in, size, 0)
+}
+
+// downloadRetryPolicy returns how the interrupted downloads are resumed.
+func (m *mender) downloadRetryPolicy() client.DownloadRetryPolicy {
+	retry := client.DownloadRetryPolicy{
+		MaxAttempts:   m.config.DownloadRetryAttempts,
+		MaxReconnects: m.config.DownloadMaxReconnects,
+		InitialWait:   time.Duration(m.config.DownloadRetryIntervalSeconds) * time.Second,
+		MaxWait:       time.Duration(m.config.DownloadRetryMaxIntervalSeconds) * time.Second,
+	}
+	if retry.MaxWait <= 0 {
+		retry.MaxWait = m.GetRetryPollInterval()
+	}
+	return retry
+}
+
+// ResumeUpdate continues the download interrupted at offset.
+func (m *mender) ResumeUpdate(ctx context.Context, url string,
+	offset int64) (io.ReadCloser, int64, error) {
+	in, size, err := m.updater.FetchUpdateFrom(ctx, m.api, url, offset)
+	if err != nil {
+		return nil, -1, utils.WithCause(err)
+	}
+	return m.limitArtifactSize(in, size, offset)
+}
+
+// limitArtifactSize rejects the artifact download if the declared size is
+// over the configured maximum, and makes reading it fail once more than the
+// maximum is downloaded, so that a wrongly declared size is caught as well.
+// Offset is the number of bytes that were downloaded already.
+func (m *mender) limitArtifactSize(in io.ReadCloser, size,
+	offset int64) (io.ReadCloser, int64, error) {
+	max := m.config.MaxArtifactSizeBytes
+	if max <= 0 {
+		return in, size, nil
+	}
+	if size > max {
+		in.Close()
+		return nil, -1, utils.WithCause(errors.Wrapf(ErrDownloadTooLarge,
+			"artifact size %d is over the limit of %d bytes", size, max))
+	}
+	return &artifactSizeLimiter{ReadCloser: in, max: max, read: offset}, size, nil
+}
+
+// artifactSizeLimiter fails reading the artifact once it is larger than max.
+type artifactSizeLimiter struct {
+	io.ReadCloser
+	max  int64
+	read int64
+}
+
+func (a *artifactSizeLimiter) Read(p []byte) (int, error) {
+	n, err := a.ReadCloser.Read(p)
+	a.read += int64(n)
+	if a.read > a.max {
+		return n, utils.WithCause(errors.Wrapf(ErrDownloadTooLarge,
+			"artifact download is over the limit of %d bytes", a.max))
+	}
+	return n, err
 }
 
 // Check if new update is available. In case of errors, returns nil and error
 // that occurred. If no update is available *UpdateResponse is nil, otherwise it
 // contains update information.
-func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
+func (m *mender) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
 	currentArtifactName, err := m.GetCurrentArtifactName()
 	if err != nil || currentArtifactName == "" {
 		log.Error("could not get the current artifact name")
@@ -463,107 +714,574 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 	if err != nil {
 		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
 	}
-	haveUpdate, err := m.updater.GetScheduledUpdate(m.api.Request(m.authToken),
+	validators := m.getUpdateCheckValidators()
+	haveUpdate, newValidators, err := m.updater.GetScheduledUpdate(ctx,
+		m.api.Request(m.getAuthToken()),
 		m.config.ServerURL, client.CurrentUpdate{
 			Artifact:   currentArtifactName,
 			DeviceType: deviceType,
+			Validators: validators,
 		})
 
 	if err != nil {
 		// remove authentication token if device is not authorized
-		if err == client.ErrNotAuthorized {
-			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
-				log.Warn("can not remove rejected authentication token")
-			}
+		if errorIs(err, client.ErrNotAuthorized) {
+			m.ClearAuthToken()
 		}
 		log.Error("Error receiving scheduled update data: ", err)
 		return nil, NewTransientError(err)
 	}
+	atomic.StoreInt64(&m.lastUpdateCheck, time.Now().UnixNano())
+	// the validators of a response offering an update are stored only once
+	// the update is started, so that an update which is deferred or
+	// declined is offered again by the next update check
+	m.offeredValidators = client.CacheValidators{}
+	if newValidators != validators {
+		m.offeredValidators = newValidators
+	}
+	m.refreshRemoteConfig(ctx)
 
 	if haveUpdate == nil {
 		log.Debug("no updates available")
+		m.pollIntervalOverride = 0
+		m.storeOfferedValidators()
 		return nil, nil
 	}
 	update, ok := haveUpdate.(client.UpdateResponse)
 	if !ok {
 		return nil, NewTransientError(errors.Errorf("not an update response?"))
 	}
+	m.setPollIntervalOverride(update)
 
 	log.Debugf("received update response: %v", update)
 
 	if update.ArtifactName() == currentArtifactName {
 		log.Info("Attempting to upgrade to currently installed artifact name, not performing upgrade.")
+		// the update is finished as soon as it is reported
+		m.storeOfferedValidators()
 		return &update, NewTransientError(os.ErrExist)
 	}
 	return &update, nil
 }
 
+// DeploymentEligible confirms with the server that the update is still offered
+// to the device, if enabled with PreDownloadCheck. The update check is sent
+// again without the cache validators, so that the full response is received.
+func (m *mender) DeploymentEligible(ctx context.Context,
+	update client.UpdateResponse) (bool, menderError) {
+	if !m.config.PreDownloadCheck {
+		return true, nil
+	}
+	currentArtifactName, err := m.GetCurrentArtifactName()
+	if err != nil {
+		return false, NewTransientError(err)
+	}
+	deviceType, err := m.GetDeviceType()
+	if err != nil {
+		log.Errorf("Unable to verify the existing hardware: %v", err)
+	}
+	data, _, err := m.updater.GetScheduledUpdate(ctx,
+		m.api.Request(m.getAuthToken()),
+		m.config.ServerURL, client.CurrentUpdate{
+			Artifact:   currentArtifactName,
+			DeviceType: deviceType,
+		})
+	if err != nil {
+		return false, NewTransientError(err)
+	}
+	offered, ok := data.(client.UpdateResponse)
+	return ok && offered.ID == update.ID, nil
+}
+
 func (m *mender) ReportUpdateStatus(update client.UpdateResponse, status string) menderError {
+	return m.ReportUpdateSubState(update, status, "")
+}
+
+// ReportUpdateSubState reports the status of the update along with additional
+// details.
+func (m *mender) ReportUpdateSubState(update client.UpdateResponse,
+	status, substate string) menderError {
+	report := client.StatusReport{
+		DeploymentID: update.ID,
+		Status:       status,
+		SubState:     substate,
+		Source:       artifactSource(update.URI()),
+	}
+	if status == client.StatusSuccess {
+		report.PreviousArtifactName = m.getPreviousArtifactName()
+	}
 	s := client.NewStatus()
-	err := s.Report(m.api.Request(m.authToken), m.config.ServerURL,
-		client.StatusReport{
-			DeploymentID: update.ID,
-			Status:       status,
-		})
+	err := s.Report(m.api.Request(m.getAuthToken()), m.config.ServerURL, report)
 	if err != nil {
 		log.Error("error reporting update status: ", err)
 
 		// remove authentication token if device is not authorized
-		if err == client.ErrNotAuthorized {
-			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
-				log.Warn("can not remove rejected authentication token")
-			}
+		if errorIs(err, client.ErrNotAuthorized) {
+			m.ClearAuthToken()
 		}
 
-		if err == client.ErrDeploymentAborted {
+		if errorIs(err, client.ErrDeploymentAborted) {
+			m.pollIntervalOverride = 0
 			return NewFatalError(err)
 		}
 		return NewTransientError(err)
 	}
+
+	switch status {
+	case client.StatusSuccess, client.StatusFailure, client.StatusAlreadyInstalled:
+		// deployment is over
+		m.pollIntervalOverride = 0
+	}
 	return nil
 }
 
+// setPollIntervalOverride applies the poll interval requested for the
+// deployment, clamped to the configured bounds.
+func (m *mender) setPollIntervalOverride(update client.UpdateResponse) {
+	if update.PollIntervalSeconds <= 0 {
+		m.pollIntervalOverride = 0
+		return
+	}
+
+	min := time.Duration(m.config.PollIntervalOverrideMinSeconds) * time.Second
+	if min <= 0 {
+		min = 10 * time.Second
+	}
+	max := time.Duration(m.config.PollIntervalOverrideMaxSeconds) * time.Second
+	if max <= 0 {
+		max = m.configuredUpdatePollInterval()
+	}
+
+	intvl := time.Duration(update.PollIntervalSeconds) * time.Second
+	if intvl < min {
+		intvl = min
+	}
+	if intvl > max {
+		intvl = max
+	}
+	log.Infof("using poll interval %v for deployment %s", intvl, update.ID)
+	m.pollIntervalOverride = intvl
+}
+
 func (m *mender) UploadLog(update client.UpdateResponse, logs []byte) menderError {
 	s := client.NewLog()
-	err := s.Upload(m.api.Request(m.authToken), m.config.ServerURL,
+	err := s.Upload(m.api.Request(m.getAuthToken()), m.config.ServerURL,
 		client.LogData{
 			DeploymentID: update.ID,
 			Messages:     logs,
 		})
 	if err != nil {
 		log.Error("error uploading logs: ", err)
+
+		// remove authentication token if device is not authorized
+		if errorIs(err, client.ErrNotAuthorized) {
+			m.ClearAuthToken()
+		}
 		return NewTransientError(err)
 	}
 	return nil
 }
 
-func (m mender) GetUpdatePollInterval() time.Duration {
-	t := time.Duration(m.config.UpdatePollIntervalSeconds) * time.Second
-	if t == 0 {
-		log.Warn("UpdatePollIntervalSeconds is not defined")
-		t = 30 * time.Minute
+// GetUpdatePollInterval returns the poll interval requested for the deployment
+// in progress, if any, or the configured one.
+func (m *mender) GetUpdatePollInterval() time.Duration {
+	if m.pollIntervalOverride > 0 {
+		return m.pollIntervalOverride
 	}
-	return t
+	return m.configuredUpdatePollInterval()
 }
 
-func (m mender) GetInventoryPollInterval() time.Duration {
-	t := time.Duration(m.config.InventoryPollIntervalSeconds) * time.Second
-	if t == 0 {
-		log.Warn("InventoryPollIntervalSeconds is not defined")
-		t = 30 * time.Minute
+func (m *mender) configuredUpdatePollInterval() time.Duration {
+	return m.pollInterval("UpdatePollIntervalSeconds",
+		m.config.UpdatePollIntervalSeconds)
+}
+
+func (m *mender) GetInventoryPollInterval() time.Duration {
+	return m.pollInterval("InventoryPollIntervalSeconds",
+		m.config.InventoryPollIntervalSeconds)
+}
+
+// pollInterval returns the configured poll interval, or the default one if it
+// is not set, raised to the configured minimum.
+func (m *mender) pollInterval(name string, seconds int) time.Duration {
+	if seconds <= 0 {
+		log.Warnf("%s is not defined", name)
+		return defaultPollInterval
+	}
+	t := time.Duration(seconds) * time.Second
+	if min := m.config.GetPollIntervalMin(); t < min {
+		log.Warnf("%s of %v is below the minimum of %v; using the minimum",
+			name, t, min)
+		return min
 	}
 	return t
 }
 
-func (m mender) GetRetryPollInterval() time.Duration {
+func (m *mender) GetRetryPollInterval() time.Duration {
 	t := time.Duration(m.config.RetryPollIntervalSeconds) * time.Second
 	if t == 0 {
 		log.Warn("RetryPollIntervalSeconds is not defined")
 		t = 5 * time.Minute
 	}
+	// status reports are retried at least as often as the server polls
+	// during the deployment
+	if o := m.pollIntervalOverride; o > 0 && o < t {
+		t = o
+	}
 	return t
 }
 
+// GetStartupDelay returns a random delay of the first update check after
+// start-up, so that devices booted at the same time do not all check for
+// updates at once.
+func (m *mender) GetStartupDelay() time.Duration {
+	max := time.Duration(m.config.StartupDelayMaxSeconds) * time.Second
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(random.Int63n(int64(max) + 1))
+}
+
+// GetUpdatePollJitter returns a random delay added to the update poll
+// interval, so that devices started together spread their update checks.
+func (m *mender) GetUpdatePollJitter() time.Duration {
+	max := time.Duration(m.config.UpdatePollJitterSeconds) * time.Second
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(random.Int63n(int64(max) + 1))
+}
+
+// GetArtifactStagingDir returns the directory artifacts are downloaded to
+// before being installed. If empty, artifacts are installed while being
+// downloaded.
+func (m *mender) GetArtifactStagingDir() string {
+	return m.config.ArtifactStagingDir
+}
+
+func (m *mender) ResumeStagedDownloads() bool {
+	return m.config.ResumeStagedDownloads
+}
+
+func (m *mender) PipelinedInstall() bool {
+	return m.config.PipelinedInstall
+}
+
+func (m *mender) DownloadRateLimited() bool {
+	return len(m.config.DownloadRateSchedule) != 0
+}
+
+func (m *mender) GetDownloadRateLimit(now time.Time) int64 {
+	return m.config.GetDownloadRateLimit(now)
+}
+
+func (m *mender) GetUpdateControlTimeout() time.Duration {
+	return m.config.GetUpdateControlTimeout()
+}
+
+// VerifyUpdate runs the health checks after booting into the updated system,
+// stopping them once ctx is done.
+func (m *mender) VerifyUpdate(ctx context.Context) error {
+	if m.config.HealthCheckScriptsPath == "" {
+		return nil
+	}
+	return runHealthChecks(ctx, m.config.HealthCheckScriptsPath,
+		m.deploymentEnvironment(), m.config.GetHealthCheckTimeout())
+}
+
+func (m *mender) GetRebootStrategy() string {
+	return m.config.GetRebootStrategy()
+}
+
+func (m *mender) GetRebootDelay() (grace, max time.Duration) {
+	return m.config.GetRebootDelay()
+}
+
+// RebootVetoed runs the configured command asking whether the device may be
+// rebooted into the update now.
+func (m *mender) RebootVetoed() bool {
+	if len(m.config.RebootVetoCommand) == 0 {
+		return false
+	}
+	ok, reason := runCheckCommand("reboot veto", m.config.RebootVetoCommand,
+		m.config.GetStateScriptTimeout())
+	if !ok {
+		log.Infof("reboot vetoed: %s", reason)
+	}
+	return !ok
+}
+
+func (m *mender) GetCommitReportFailure() string {
+	return m.config.GetCommitReportFailure()
+}
+
+// Reboot activates the installed update according to the configured reboot
+// strategy.
+func (m *mender) Reboot() error {
+	if m.config.GetRebootStrategy() != rebootStrategyCommand {
+		return m.UInstallCommitRebooter.Reboot()
+	}
+
+	log.Infof("running reboot command: %v", m.config.RebootCommand)
+	if out, err := runCommand(m.config.RebootCommand,
+		m.config.GetStateScriptTimeout()); err != nil {
+		return errors.Wrapf(err, "reboot command failed: %s", out)
+	}
+	return nil
+}
+
+// MaintenanceWindowWait returns how long the installation of updates is
+// deferred until the maintenance window opens.
+func (m *mender) MaintenanceWindowWait() time.Duration {
+	return m.config.GetMaintenanceWindowWait(time.Now())
+}
+
+// NotifyUpdateDeferred runs the configured command announcing that the update
+// is available, and is installed once the maintenance window opens. The
+// command is run once for a deployment, however many times the update is
+// deferred.
+func (m *mender) NotifyUpdateDeferred(update client.UpdateResponse, until time.Time) {
+	if len(m.config.UpdateDeferredCommand) == 0 || update.ID == m.deferredUpdateID {
+		return
+	}
+	m.deferredUpdateID = update.ID
+	command := m.config.UpdateDeferredCommand
+	command = append(append([]string{}, command...),
+		update.ArtifactName(), until.Format(time.RFC3339))
+	if out, err := runCommand(command, m.config.GetStateScriptTimeout()); err != nil {
+		log.Errorf("update deferred command failed: %v: %s", err, out)
+	}
+}
+
+// RunPostCommitScripts runs the configured cleanup scripts after the update
+// was committed. The update has succeeded already, so failing scripts are only
+// logged; each script is killed once the state script timeout is up.
+func (m *mender) RunPostCommitScripts(update client.UpdateResponse) {
+	for _, script := range m.config.PostCommitScripts {
+		log.Infof("running post-commit script %s", script)
+		out, err := runCommand([]string{script, update.ArtifactName()},
+			m.config.GetStateScriptTimeout())
+		if err != nil {
+			log.Errorf("post-commit script %s failed: %v: %s", script, err, out)
+		}
+	}
+}
+
+// UpdateConditionsMet runs the configured command checking whether the
+// conditions of the device allow updates now; if not, the reason reported by
+// the command is returned.
+func (m *mender) UpdateConditionsMet() (bool, string) {
+	if len(m.config.UpdateConditionsCommand) == 0 {
+		return true, ""
+	}
+	return runCheckCommand("update conditions", m.config.UpdateConditionsCommand,
+		m.config.GetStateScriptTimeout())
+}
+
+// ReloadConfig applies the configuration fields that are safe to change while
+// the daemon is running. Fields that require the client to be re-initialized
+// (keys, certificates, partitions, etc.) are ignored and a warning is logged.
+func (m *mender) ReloadConfig(config menderConfig) {
+	reloaded := m.localConfig
+	reloaded.UpdatePollIntervalSeconds = config.UpdatePollIntervalSeconds
+	reloaded.InventoryPollIntervalSeconds = config.InventoryPollIntervalSeconds
+	reloaded.RetryPollIntervalSeconds = config.RetryPollIntervalSeconds
+	reloaded.StartupDelayMaxSeconds = config.StartupDelayMaxSeconds
+	reloaded.UpdatePollJitterSeconds = config.UpdatePollJitterSeconds
+	reloaded.LogLevel = config.LogLevel
+	reloaded.ServerURL = config.ServerURL
+
+	rv := reflect.ValueOf(reloaded)
+	cv := reflect.ValueOf(config)
+	for i := 0; i < rv.NumField(); i++ {
+		if !reflect.DeepEqual(rv.Field(i).Interface(), cv.Field(i).Interface()) {
+			log.Warnf("config: %s can not be changed without restarting; ignoring",
+				rv.Type().Field(i).Name)
+		}
+	}
+
+	log.Infof("config: reloaded; update poll interval: %v, inventory poll interval: %v, "+
+		"retry poll interval: %v, poll jitter: %v, log level: %q, server: %s",
+		reloaded.UpdatePollIntervalSeconds, reloaded.InventoryPollIntervalSeconds,
+		reloaded.RetryPollIntervalSeconds, reloaded.UpdatePollJitterSeconds,
+		reloaded.LogLevel, reloaded.ServerURL)
+	m.localConfig = reloaded
+	// the configuration delivered by the server still takes precedence
+	m.setConfig(reloaded.withRemoteConfig(m.remoteConfig))
+	m.applyLogLevel()
+}
+
+// applyLogLevel sets the log level delivered by the server or, if there is
+// none, the configured one. The level given on the command line is kept.
+func (m *mender) applyLogLevel() {
+	if logLevelFromCommandLine {
+		return
+	}
+	level := m.localConfig.LogLevel
+	if rc := m.remoteConfig; rc != nil && rc.LogLevel != "" &&
+		!m.localConfig.isLocalOverride("LogLevel") {
+		level = rc.LogLevel
+	}
+	if level == m.logLevel {
+		return
+	}
+	m.logLevel = level
+
+	l := log.InfoLevel
+	if level != "" {
+		var err error
+		if l, err = log.ParseLevel(level); err != nil {
+			log.Warnf("config: ignoring invalid log level %q", level)
+			return
+		}
+	}
+	log.SetLevel(l)
+}
+
+// getConfig returns a copy of the configuration in use, for goroutines other
+// than the daemon loop.
+func (m *mender) getConfig() menderConfig {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	return m.config
+}
+
+// setConfig replaces the configuration in use; called from the daemon loop.
+func (m *mender) setConfig(config menderConfig) {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	m.config = config
+}
+
+// UpdatesPaused returns true if checking for updates has been paused by the
+// operator, or the client is configured to only submit the inventory.
+func (m *mender) UpdatesPaused() bool {
+	if m.getConfig().InventoryOnly {
+		return true
+	}
+	_, err := m.store.ReadAll(updatesPausedName)
+	return err == nil
+}
+
+// UpdatesEnabled returns false if the client never checks for updates, either
+// as configured or after an unrecoverable failure.
+func (m *mender) UpdatesEnabled() bool {
+	return !m.getConfig().InventoryOnly && m.FatalFailure() == ""
+}
+
+// InventoryEnabled returns false if the client never submits the inventory.
+func (m *mender) InventoryEnabled() bool {
+	return !m.getConfig().UpdatesOnly
+}
+
+// SetUpdatesPaused pauses or resumes checking for updates. The setting is kept
+// in the store so that it survives restarts.
+func (m *mender) SetUpdatesPaused(paused bool) error {
+	if paused {
+		if err := m.store.WriteAll(updatesPausedName, []byte("paused")); err != nil {
+			return errors.Wrapf(err, "failed to pause updates")
+		}
+		return nil
+	}
+
+	if !m.UpdatesPaused() {
+		return nil
+	}
+	if err := m.store.Remove(updatesPausedName); err != nil {
+		return errors.Wrapf(err, "failed to resume updates")
+	}
+	return nil
+}
+
+// Decommissioned returns true once the device is retired by the operator.
+func (m *mender) Decommissioned() bool {
+	_, err := m.store.ReadAll(decommissionedName)
+	return err == nil
+}
+
+// Decommission retires the device: the client stops contacting the server,
+// and the authorization token, along with the device key if requested, is
+// removed. The marker is written first, so that a running daemon does not
+// authorize again in the meantime.
+func (m *mender) Decommission(removeKey bool) error {
+	if err := m.store.WriteAll(decommissionedName, []byte("decommissioned")); err != nil {
+		return errors.Wrapf(err, "failed to mark device as decommissioned")
+	}
+
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
+	m.authToken = noAuthToken
+	if err := m.authMgr.RemoveAuthToken(); err != nil {
+		return errors.Wrapf(err, "failed to remove authentication token")
+	}
+	if removeKey {
+		if err := m.authMgr.RemoveKey(); err != nil {
+			return err
+		}
+	}
+	log.Infof("device decommissioned (device key removed: %v)", removeKey)
+	return nil
+}
+
+// FatalFailure returns the reason of the unrecoverable failure the updates
+// were given up after, or an empty string.
+func (m *mender) FatalFailure() string {
+	reason, err := m.store.ReadAll(fatalFailureName)
+	if err != nil {
+		return ""
+	}
+	return string(reason)
+}
+
+// SetFatalFailure records the unrecoverable failure of the device, after which
+// no updates are attempted. The record is kept in the store until it is
+// cleared by the operator with an empty reason.
+func (m *mender) SetFatalFailure(reason string) error {
+	if reason != "" {
+		if err := m.store.WriteAll(fatalFailureName, []byte(reason)); err != nil {
+			return errors.Wrapf(err, "failed to store fatal failure")
+		}
+		return nil
+	}
+
+	if m.FatalFailure() == "" {
+		return nil
+	}
+	if err := m.store.Remove(fatalFailureName); err != nil {
+		return errors.Wrapf(err, "failed to clear fatal failure")
+	}
+	return nil
+}
+
+// GetDeviceStatus returns information useful for diagnosing problems with
+// connecting the device to the server.
+func (m *mender) GetDeviceStatus() deviceStatus {
+	status := deviceStatus{
+		Authorized: m.authMgr.IsAuthorized(),
+		ServerURL:  m.getConfig().ServerURL,
+	}
+	m.bootstrapLock.Lock()
+	fp, err := m.authMgr.KeyFingerprint()
+	m.bootstrapLock.Unlock()
+	if err == nil {
+		status.KeyFingerprint = fp
+	} else {
+		log.Warnf("failed to get device key fingerprint: %v", err)
+	}
+	if last := atomic.LoadInt64(&m.lastUpdateCheck); last != 0 {
+		t := time.Unix(0, last)
+		status.LastUpdateCheck = &t
+	}
+	status.FatalFailure = m.FatalFailure()
+	if boot, err := m.UInstallCommitRebooter.GetBootState(); err == nil {
+		status.Boot = boot
+	} else {
+		log.Warnf("failed to get boot state: %v", err)
+	}
+	return status
+}
+
 func (m *mender) SetNextState(s State) {
 	m.state = s
 }
@@ -619,6 +1337,55 @@ func shouldReportUpdateStatus(state MenderState) bool {
 	return state.Status() != ""
 }
 
+// deploymentEnvironment returns the environment variables describing the
+// deployment in progress, which are passed to the state scripts and the health
+// checks. The deployment meta-data is passed as MENDER_META_<KEY> variables.
+func (m *mender) deploymentEnvironment() []string {
+	state := m.GetCurrentState()
+	upd, err := getUpdateFromState(state)
+	if err != nil {
+		// no deployment in progress
+		return nil
+	}
+
+	rollback := "0"
+	switch state.Transition() {
+	case ToArtifactRollback, ToArtifactRollbackReboot_Enter,
+		ToArtifactRollbackReboot_Leave:
+		rollback = "1"
+	}
+
+	env := []string{
+		"MENDER_DEPLOYMENT_ID=" + upd.ID,
+		"MENDER_ARTIFACT_NAME=" + upd.ArtifactName(),
+		"MENDER_ROLLBACK=" + rollback,
+	}
+
+	keys := make([]string, 0, len(upd.Metadata))
+	for k := range upd.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, "MENDER_META_"+envVariableName(k)+"="+upd.Metadata[k])
+	}
+	return env
+}
+
+// envVariableName converts the key to a valid environment variable name;
+// letters are upper-cased and other characters replaced with underscores.
+func envVariableName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
 func getUpdateFromState(state State) (client.UpdateResponse, error) {
 	upd, ok := state.(UpdateState)
 	if ok {
@@ -646,7 +1413,7 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 			log.Error(err)
 		} else {
 			report = &client.StatusReportWrapper{
-				API: m.api.Request(m.authToken),
+				API: m.api.Request(m.getAuthToken()),
 				URL: m.config.ServerURL,
 				Report: client.StatusReport{
 					DeploymentID: upd.ID,
@@ -677,6 +1444,7 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 		}
 
 		m.SetNextState(to)
+		DeploymentLogger.SetState(to.Id())
 
 		if err := to.Transition().Enter(m.stateScriptExecutor, report); err != nil {
 			log.Errorf("error calling enter script for (error) %s state: %v", to.Id(), err)
@@ -686,14 +1454,83 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 	}
 
 	m.SetNextState(to)
+	DeploymentLogger.SetState(to.Id())
 
 	// execute current state action
-	return to.Handle(ctx, m)
+	if ctx == nil {
+		return to.Handle(ctx, m)
+	}
+	start := ctx.now()
+	next, cancelled := to.Handle(ctx, m)
+	recordUpdateTiming(ctx.store, to.Id(), ctx.now().Sub(start))
+	return next, cancelled
+}
+
+func (m *mender) InventoryRefresh(ctx context.Context) error {
+	idata, err := m.CollectInventory()
+	if err != nil {
+		return err
+	}
+
+	if idata == nil {
+		log.Infof("no inventory data to submit")
+		return nil
+	}
+
+	return m.submitInventory(ctx, idata)
 }
 
-func (m *mender) InventoryRefresh() error {
+// submitInventory sends the inventory to the server, unless the server
+// confirms it holds the same inventory already.
+func (m *mender) submitInventory(ctx context.Context, idata client.InventoryData) error {
 	ic := client.NewInventory()
-	idg := NewInventoryDataRunner(path.Join(getDataDirPath(), "inventory"))
+	api := m.api.Request(m.getAuthToken())
+	hash, herr := inventoryHash(idata)
+	if herr != nil {
+		log.Warnf("can not tell if the inventory changed: %v", herr)
+	}
+
+	// the unchanged inventory is not sent again, as long as the server
+	// confirms it holds the version it acknowledged
+	if v, ok := loadInventoryVersion(m.store); ok && herr == nil && v.Hash == hash {
+		err := ic.Confirm(ctx, api, m.config.ServerURL, v.Version)
+		if err == nil {
+			log.Debugf("inventory unchanged since version %s", v.Version)
+			return nil
+		}
+		if errors.Cause(err) != client.ErrInventoryResync {
+			if errorIs(err, client.ErrNotAuthorized) {
+				m.ClearAuthToken()
+			}
+			return errors.Wrapf(err, "failed to confirm inventory version")
+		}
+		log.Infof("server requested the complete inventory; submitting")
+	}
+
+	version, err := ic.SubmitVersioned(ctx, api, m.config.ServerURL, idata)
+	if err != nil {
+		// remove authentication token if device is not authorized
+		if errorIs(err, client.ErrNotAuthorized) {
+			m.ClearAuthToken()
+		}
+		clearInventoryVersion(m.store)
+		return errors.Wrapf(err, "failed to submit inventory data")
+	}
+
+	if version != "" && herr == nil {
+		storeInventoryVersion(m.store, inventoryVersion{Hash: hash, Version: version})
+	} else {
+		clearInventoryVersion(m.store)
+	}
+	return nil
+}
+
+// CollectInventory returns the inventory submitted to the server: the output of
+// the inventory scripts, the attributes from the configuration and the ones
+// reported by the client itself, canonicalized.
+func (m *mender) CollectInventory() ([]client.InventoryAttribute, error) {
+	idg := NewInventoryDataRunner(m.config.GetInventoryScriptsDirs()...)
+	idg.strict = m.config.InventoryScriptsStrict
 
 	artifactName, err := m.GetCurrentArtifactName()
 	if err != nil || artifactName == "" {
@@ -701,11 +1538,13 @@ func (m *mender) InventoryRefresh() error {
 			err = errors.New("artifact name is empty")
 		}
 		errstr := fmt.Sprintf("could not read the artifact name. This is a necessary condition in order for a mender update to finish safely. Please give the current artifact a name (This can be done by adding a name to the file /etc/mender/artifact_info) err: %v", err)
-		return errors.Wrap(errNoArtifactName, errstr)
+		return nil, errors.Wrap(errNoArtifactName, errstr)
 	}
 
 	idata, err := idg.Get()
-	if err != nil {
+	if err != nil && idg.strict {
+		return nil, errors.Wrap(err, "failed to obtain inventory data")
+	} else if err != nil {
 		// at least report device type
 		log.Errorf("failed to obtain inventory data: %s", err.Error())
 	}
@@ -718,35 +1557,309 @@ func (m *mender) InventoryRefresh() error {
 		{Name: "device_type", Value: deviceType},
 		{Name: "artifact_name", Value: artifactName},
 		{Name: "mender_client_version", Value: VersionString()},
+		{Name: "clock_synced", Value: strconv.FormatBool(client.ClockSynced(time.Now()))},
+	}
+	// not reported after a rollback, when the artifact is installed again
+	if prev := m.getPreviousArtifactName(); prev != "" && prev != artifactName {
+		reqAttr = append(reqAttr,
+			client.InventoryAttribute{Name: "previous_artifact_name", Value: prev})
+	}
+	if reason := m.FatalFailure(); reason != "" {
+		reqAttr = append(reqAttr,
+			client.InventoryAttribute{Name: "fatal_failure", Value: reason})
 	}
+	reqAttr = append(reqAttr, storageInventory(getDataDirPath(), "/")...)
 
 	if idata == nil {
 		idata = make(client.InventoryData, 0, len(reqAttr))
 	}
+	if len(m.config.InventoryAttributes) != 0 {
+		cfgAttr := make([]client.InventoryAttribute, 0,
+			len(m.config.InventoryAttributes))
+		for name, value := range m.config.InventoryAttributes {
+			cfgAttr = append(cfgAttr, client.InventoryAttribute{Name: name, Value: value})
+		}
+		idata.ReplaceAttributes(cfgAttr)
+	}
 	idata.ReplaceAttributes(reqAttr)
+	return canonicalizeInventory(idata), nil
+}
 
-	if idata == nil {
-		log.Infof("no inventory data to submit")
-		return nil
-	}
+func (m *mender) CheckScriptsCompatibility() error {
+	return m.stateScriptExecutor.CheckRootfsScriptsVersion()
+}
 
-	err = ic.Submit(m.api.Request(m.authToken), m.config.ServerURL, idata)
+func (m *mender) InstallUpdate(from io.ReadCloser, size int64) error {
+	return m.InstallArtifact(context.Background(), from, size, "")
+}
+
+// InstallArtifact installs the artifact, provided it is named as expected. The
+// name is checked before any of the update data is written, so that a payload
+// swapped for a different artifact is never installed. Empty name matches any
+// artifact. Installation is aborted once ctx is done.
+func (m *mender) InstallArtifact(ctx context.Context, from io.ReadCloser,
+	size int64, name string) error {
+	deviceType, err := m.GetDeviceType()
 	if err != nil {
-		return errors.Wrapf(err, "failed to submit inventory data")
+		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+	}
+	// delta updates are applied to the installed artifact
+	artifactName, err := m.GetCurrentArtifactName()
+	if err != nil {
+		log.Errorf("could not get the current artifact name: %v", err)
+	}
+	dev := &artifactInstaller{
+		UInstaller: &deltaInstaller{
+			UInstaller:   m.UInstallCommitRebooter,
+			artifactName: artifactName,
+		},
+		name:           name,
+		installed:      artifactName,
+		provides:       m.getArtifactProvides(artifactName),
+		rebootRequired: true,
+	}
+	keys, err := m.GetArtifactVerifyKeys(deviceType)
+	if err != nil {
+		return err
 	}
+	// artifacts are verified only if there are keys configured
+	acceptScripts := len(keys) != 0 || !m.config.ArtifactScriptsRequireSignature
+	err = installer.Install(&contextReader{ctx: ctx, r: from}, deviceType,
+		keys, m.stateScriptPath, dev, acceptScripts)
+	m.rebootRequired = dev.rebootRequired
+	m.customUpdates = dev.customUpdates
+	if err != nil {
+		return utils.WithCause(noSpaceError(err))
+	}
+	if artifactName != "" {
+		// remember what the device is updated from
+		if werr := m.store.WriteAll(previousArtifactName,
+			[]byte(artifactName)); werr != nil {
+			log.Errorf("failed to store the previous artifact name: %v", werr)
+		}
+	}
+	// kept aside until the update is committed, so that the provides of
+	// the running artifact still apply if the update is rolled back
+	m.storeArtifactProvides(artifactProvidesPendingName, dev.artifactName,
+		dev.newProvides)
+	return nil
+}
 
+// CommitUpdate commits the update on the device and makes what the new
+// artifact provides the provides of the device.
+func (m *mender) CommitUpdate() error {
+	if err := m.UInstallCommitRebooter.CommitUpdate(); err != nil {
+		return err
+	}
+	m.commitArtifactProvides()
 	return nil
 }
 
-func (m *mender) CheckScriptsCompatibility() error {
-	return m.stateScriptExecutor.CheckRootfsScriptsVersion()
+// artifactProvides is what an artifact declared to provide in its meta-data.
+type artifactProvides struct {
+	ArtifactName string
+	Provides     map[string]string
 }
 
-func (m *mender) InstallUpdate(from io.ReadCloser, size int64) error {
-	deviceType, err := m.GetDeviceType()
+// getArtifactProvides returns what the installed artifact provides. The
+// artifact name is always provided. What was stored for a different artifact,
+// for instance one that was rolled back, is ignored.
+func (m *mender) getArtifactProvides(installed string) map[string]string {
+	provides := map[string]string{}
+	if data, err := m.store.ReadAll(artifactProvidesName); err == nil {
+		var ap artifactProvides
+		if err := json.Unmarshal(data, &ap); err != nil {
+			log.Errorf("failed to parse the provides of the installed artifact: %v", err)
+		} else if ap.ArtifactName == installed {
+			for k, v := range ap.Provides {
+				provides[k] = v
+			}
+		}
+	}
+	if installed != "" {
+		provides["artifact_name"] = installed
+	}
+	return provides
+}
+
+func (m *mender) storeArtifactProvides(key, name string, provides map[string]string) {
+	data, err := json.Marshal(artifactProvides{
+		ArtifactName: name,
+		Provides:     provides,
+	})
+	if err == nil {
+		err = m.store.WriteAll(key, data)
+	}
 	if err != nil {
-		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+		log.Errorf("failed to store the provides of the artifact: %v", err)
+	}
+}
+
+// commitArtifactProvides replaces the provides of the previous artifact with
+// the ones stored when the update was installed.
+func (m *mender) commitArtifactProvides() {
+	data, err := m.store.ReadAll(artifactProvidesPendingName)
+	if os.IsNotExist(err) {
+		return
+	} else if err == nil {
+		err = m.store.WriteAll(artifactProvidesName, data)
+	}
+	if err != nil {
+		log.Errorf("failed to store the provides of the committed artifact: %v", err)
+		return
 	}
-	return installer.Install(from, deviceType,
-		m.GetArtifactVerifyKey(), m.stateScriptPath, m.UInstallCommitRebooter, true)
+	if err := m.store.Remove(artifactProvidesPendingName); err != nil {
+		log.Errorf("failed to remove the provides of the installed artifact: %v", err)
+	}
+}
+
+// getUpdateCheckValidators returns the cache validators of the last update
+// check response, sent along with the next update check.
+func (m *mender) getUpdateCheckValidators() client.CacheValidators {
+	var validators client.CacheValidators
+	data, err := m.store.ReadAll(updateCheckValidatorsName)
+	if err != nil {
+		return validators
+	}
+	if err := json.Unmarshal(data, &validators); err != nil {
+		log.Errorf("failed to parse the update check cache validators: %v", err)
+		return client.CacheValidators{}
+	}
+	return validators
+}
+
+// storeOfferedValidators stores the cache validators of the last update check
+// response, if they changed.
+func (m *mender) storeOfferedValidators() {
+	if m.offeredValidators == (client.CacheValidators{}) {
+		return
+	}
+	data, err := json.Marshal(m.offeredValidators)
+	if err == nil {
+		err = m.store.WriteAll(updateCheckValidatorsName, data)
+	}
+	if err != nil {
+		log.Errorf("failed to store the update check cache validators: %v", err)
+	}
+	m.offeredValidators = client.CacheValidators{}
+}
+
+// getPreviousArtifactName returns the name of the artifact installed before
+// the most recent update, or empty string if not known.
+func (m *mender) getPreviousArtifactName() string {
+	name, err := m.store.ReadAll(previousArtifactName)
+	if err != nil {
+		return ""
+	}
+	return string(name)
+}
+
+// contextReader fails reading once the context is done, so that consumers of
+// the stream stop promptly.
+type contextReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (c *contextReader) Close() error {
+	return c.r.Close()
+}
+
+// RebootRequired returns false if the most recently installed artifact
+// declares that the update takes effect without a reboot.
+func (m *mender) RebootRequired() bool {
+	return m.rebootRequired
+}
+
+// ActivateCustomUpdate activates the most recently installed update with the
+// handlers of its custom type, and makes what the artifact provides the
+// provides of the device. Returns false if the update is a rootfs-image, which
+// is activated by enabling the updated partition instead.
+func (m *mender) ActivateCustomUpdate() (bool, error) {
+	if len(m.customUpdates) == 0 {
+		return false, nil
+	}
+	for _, h := range m.customUpdates {
+		if err := h.Activate(); err != nil {
+			return true, errors.Wrap(err, "failed to activate update")
+		}
+	}
+	m.customUpdates = nil
+	m.commitArtifactProvides()
+	return true, nil
+}
+
+// artifactInstaller checks the artifact before the update data is installed.
+// Artifacts that are named differently than expected, or are installed
+// already, are rejected.
+type artifactInstaller struct {
+	installer.UInstaller
+	name string
+	// name of the installed artifact; installing it again is refused. Empty
+	// if the artifact may be reinstalled
+	installed string
+	// what the device provides; the artifact dependencies must match
+	provides map[string]string
+	// set from the artifact header and meta-data
+	artifactName   string
+	newProvides    map[string]string
+	rebootRequired bool
+	customUpdates  []installer.UpdateHandler
+}
+
+func (a *artifactInstaller) ReceiveCustomUpdates(handlers []installer.UpdateHandler) {
+	a.customUpdates = handlers
+}
+
+func (a *artifactInstaller) VerifyArtifactName(name string) error {
+	a.artifactName = name
+	if a.name != "" && a.name != name {
+		return errors.Wrapf(installer.ErrArtifactNameMismatch,
+			"expected artifact %q, got %q", a.name, name)
+	}
+	if a.installed != "" && a.installed == name {
+		return errors.Wrapf(installer.ErrArtifactAlreadyInstalled,
+			"artifact %q", name)
+	}
+	return nil
+}
+
+func (a *artifactInstaller) ReceiveArtifactMetadata(meta map[string]interface{}) error {
+	if v, ok := meta[metadataRebootRequired]; ok {
+		required, ok := v.(bool)
+		if !ok {
+			return errors.Errorf("invalid value of %s meta-data: %v",
+				metadataRebootRequired, v)
+		}
+		a.rebootRequired = required
+	}
+
+	var info installer.ArtifactInfo
+	if err := info.SetMetadata(meta); err != nil {
+		return err
+	}
+	depends := info.Depends
+	// checked in order, so that the same error is reported every time
+	keys := make([]string, 0, len(depends))
+	for k := range depends {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := a.provides[k]; !ok || v != depends[k] {
+			return errors.Wrapf(installer.ErrArtifactDependsNotSatisfied,
+				"artifact depends on %s %q, device provides %q",
+				k, depends[k], v)
+		}
+	}
+
+	a.newProvides = info.Provides
+	return nil
 }
@@ -14,26 +14,42 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/mendersoftware/mender/client"
 	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/statescript"
 	"github.com/mendersoftware/mender/store"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type testMenderPieces struct {
@@ -248,7 +264,7 @@ func Test_CheckUpdateSimple(t *testing.T) {
 		ServerURL: "bogusurl",
 	}, testMenderPieces{})
 
-	up, err := mender.CheckUpdate()
+	up, err := mender.CheckUpdate(context.Background())
 	assert.Error(t, err)
 	assert.Nil(t, up)
 
@@ -271,7 +287,7 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	}
 
 	// test server expects current update information, request should fail
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.Error(t, err)
 	assert.Nil(t, nil)
 
@@ -286,23 +302,163 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	// make artifact name same as current, will result in no updates being available
 	srv.Update.Data.Artifact.ArtifactName = currID
 
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.Equal(t, err, NewTransientError(os.ErrExist))
 	assert.NotNil(t, up)
 
 	// make artifact name different from current
 	srv.Update.Data.Artifact.ArtifactName = currID + "-fake"
 	srv.Update.Has = true
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.NoError(t, err)
 	assert.NotNil(t, up)
 	assert.Equal(t, *up, srv.Update.Data)
 
 	// pretend that we got 204 No Content from the server, i.e empty response body
 	srv.Update.Has = false
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.NoError(t, err)
 	assert.Nil(t, up)
+
+	// 200 OK with empty body is not the same as no update
+	srv.Update.Has = true
+	srv.Update.Raw = true
+	srv.Update.Body = []byte{}
+	up, err = mender.CheckUpdate(context.Background())
+	assert.Error(t, err)
+	assert.False(t, err.IsFatal())
+	assert.Contains(t, err.Error(), "empty update response")
+	assert.Nil(t, up)
+
+	// 200 OK with malformed body
+	srv.Update.Body = []byte(`{"id": "foo", "artifact": `)
+	up, err = mender.CheckUpdate(context.Background())
+	assert.Error(t, err)
+	assert.False(t, err.IsFatal())
+	assert.Nil(t, up)
+}
+
+func TestMenderUpdatesPaused(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-updates-paused-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Current = client.CurrentUpdate{
+		Artifact:   "fake-id",
+		DeviceType: "hammer",
+	}
+
+	ms := store.NewMemStore()
+	pieces := testMenderPieces{
+		MenderPieces: MenderPieces{
+			store: ms,
+		},
+	}
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL}, pieces)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	assert.False(t, mender.UpdatesPaused())
+	assert.NoError(t, mender.SetUpdatesPaused(true))
+	assert.True(t, mender.UpdatesPaused())
+
+	// paused flag survives restarts
+	mender = newTestMender(nil, menderConfig{ServerURL: srv.URL}, pieces)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+	assert.True(t, mender.UpdatesPaused())
+
+	// server is not contacted while paused
+	next, _ := updateCheckState.Handle(&StateContext{}, mender)
+	assert.Equal(t, checkWaitState, next)
+	assert.False(t, srv.Update.Called)
+
+	assert.NoError(t, mender.SetUpdatesPaused(false))
+	assert.False(t, mender.UpdatesPaused())
+	// resuming twice is fine
+	assert.NoError(t, mender.SetUpdatesPaused(false))
+
+	next, _ = updateCheckState.Handle(&StateContext{}, mender)
+	assert.Equal(t, checkWaitState, next)
+	assert.True(t, srv.Update.Called)
+
+	ms.ReadOnly(true)
+	assert.Error(t, mender.SetUpdatesPaused(true))
+
+	// updates are never checked for in inventory only mode
+	mender = newTestMender(nil, menderConfig{InventoryOnly: true}, pieces)
+	assert.True(t, mender.UpdatesPaused())
+	assert.False(t, mender.UpdatesEnabled())
+	assert.True(t, mender.InventoryEnabled())
+
+	mender = newTestMender(nil, menderConfig{UpdatesOnly: true}, pieces)
+	assert.True(t, mender.UpdatesEnabled())
+	assert.False(t, mender.InventoryEnabled())
+}
+
+func TestMenderDeploymentEligible(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-eligible-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Current = client.CurrentUpdate{
+		Artifact:   "fake-id",
+		DeviceType: "hammer",
+	}
+
+	pieces := testMenderPieces{
+		MenderPieces: MenderPieces{
+			store: store.NewMemStore(),
+		},
+	}
+	update := client.UpdateResponse{ID: "foo"}
+
+	// the server is not asked unless enabled
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL}, pieces)
+	ok, err := mender.DeploymentEligible(context.Background(), update)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, srv.Update.Called)
+
+	mender = newTestMender(nil, menderConfig{
+		ServerURL:        srv.URL,
+		PreDownloadCheck: true,
+	}, pieces)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	srv.Update.Has = true
+	srv.Update.Data.ID = "foo"
+	ok, err = mender.DeploymentEligible(context.Background(), update)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, srv.Update.Called)
+
+	// deployment aborted, or replaced with another one
+	srv.Update.Has = false
+	ok, err = mender.DeploymentEligible(context.Background(), update)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	srv.Update.Has = true
+	srv.Update.Data.ID = "bar"
+	ok, err = mender.DeploymentEligible(context.Background(), update)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.False(t, srv.UpdateDownload.Called)
 }
 
 func TestMenderHasUpgrade(t *testing.T) {
@@ -314,7 +470,7 @@ func TestMenderHasUpgrade(t *testing.T) {
 		},
 	})
 
-	h, err := mender.HasUpgrade()
+	h, _, err := mender.HasUpgrade()
 	assert.NoError(t, err)
 	assert.True(t, h)
 
@@ -326,7 +482,7 @@ func TestMenderHasUpgrade(t *testing.T) {
 		},
 	})
 
-	h, err = mender.HasUpgrade()
+	h, _, err = mender.HasUpgrade()
 	assert.NoError(t, err)
 	assert.False(t, h)
 
@@ -337,8 +493,33 @@ func TestMenderHasUpgrade(t *testing.T) {
 			},
 		},
 	})
-	h, err = mender.HasUpgrade()
+	h, _, err = mender.HasUpgrade()
 	assert.Error(t, err)
+
+	// the update enabled before the reboot is known
+	ms := store.NewMemStore()
+	update := client.UpdateResponse{ID: "foo"}
+	storeUpgradeUpdate(ms, update)
+	dev := &fakeDevice{retHasUpdate: true}
+	mender = newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			store:  ms,
+			device: dev,
+		},
+	})
+	h, upd, err := mender.HasUpgrade()
+	assert.NoError(t, err)
+	assert.True(t, h)
+	require.NotNil(t, upd)
+	assert.Equal(t, update, *upd)
+
+	// once the update is committed it is not reported; the state machine
+	// forgets it
+	dev.retHasUpdate = false
+	h, upd, err = mender.HasUpgrade()
+	assert.NoError(t, err)
+	assert.False(t, h)
+	assert.Nil(t, upd)
 }
 
 func TestMenderGetUpdatePollInterval(t *testing.T) {
@@ -348,6 +529,88 @@ func TestMenderGetUpdatePollInterval(t *testing.T) {
 
 	intvl := mender.GetUpdatePollInterval()
 	assert.Equal(t, time.Duration(20)*time.Second, intvl)
+
+	// not configured
+	mender.config.UpdatePollIntervalSeconds = 0
+	assert.Equal(t, defaultPollInterval, mender.GetUpdatePollInterval())
+	assert.Equal(t, defaultPollInterval, mender.GetInventoryPollInterval())
+
+	// below the minimum
+	mender.config.UpdatePollIntervalSeconds = 1
+	mender.config.InventoryPollIntervalSeconds = 2
+	assert.Equal(t, defaultPollIntervalMin, mender.GetUpdatePollInterval())
+	assert.Equal(t, defaultPollIntervalMin, mender.GetInventoryPollInterval())
+
+	mender.config.PollIntervalMinSeconds = 60
+	mender.config.UpdatePollIntervalSeconds = 30
+	mender.config.InventoryPollIntervalSeconds = 120
+	assert.Equal(t, time.Minute, mender.GetUpdatePollInterval())
+	assert.Equal(t, 2*time.Minute, mender.GetInventoryPollInterval())
+}
+
+func TestMenderPollIntervalOverride(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-poll-override-")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Current = client.CurrentUpdate{
+		Artifact:   "fake-id",
+		DeviceType: "hammer",
+	}
+	srv.Update.Has = true
+	srv.Update.Data.ID = "urgent"
+	srv.Update.Data.Artifact.ArtifactName = "fake-id-2"
+	srv.Update.Data.PollIntervalSeconds = 15
+
+	mender := newTestMender(nil, menderConfig{
+		ServerURL:                    srv.URL,
+		UpdatePollIntervalSeconds:    3600,
+		InventoryPollIntervalSeconds: 3600,
+		RetryPollIntervalSeconds:     300,
+	}, testMenderPieces{})
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	up, merr := mender.CheckUpdate(context.Background())
+	require.Nil(t, merr)
+	assert.Equal(t, 15*time.Second, mender.GetUpdatePollInterval())
+	assert.Equal(t, 15*time.Second, mender.GetRetryPollInterval())
+
+	// next wait uses the requested interval
+	now := time.Now()
+	ctx := StateContext{
+		lastUpdateCheck:     now.Add(-15*time.Second + 50*time.Millisecond),
+		lastInventoryUpdate: now,
+	}
+	next, _ := NewCheckWaitState().Handle(&ctx, mender)
+	assert.Equal(t, updateCheckState, next)
+	assert.WithinDuration(t, now.Add(50*time.Millisecond), time.Now(), time.Second)
+
+	// configured interval is used once the deployment is over
+	assert.Nil(t, mender.ReportUpdateStatus(*up, client.StatusSuccess))
+	assert.Equal(t, time.Hour, mender.GetUpdatePollInterval())
+	assert.Equal(t, 5*time.Minute, mender.GetRetryPollInterval())
+
+	// clamped to the configured bounds
+	srv.Update.Data.PollIntervalSeconds = 1
+	_, merr = mender.CheckUpdate(context.Background())
+	require.Nil(t, merr)
+	assert.Equal(t, 10*time.Second, mender.GetUpdatePollInterval())
+	srv.Update.Data.PollIntervalSeconds = 7200
+	_, merr = mender.CheckUpdate(context.Background())
+	require.Nil(t, merr)
+	assert.Equal(t, time.Hour, mender.GetUpdatePollInterval())
+
+	// deployment is gone
+	srv.Update.Has = false
+	_, merr = mender.CheckUpdate(context.Background())
+	require.Nil(t, merr)
+	assert.Equal(t, time.Hour, mender.GetUpdatePollInterval())
 }
 
 func TestMenderGetInventoryPollInterval(t *testing.T) {
@@ -359,6 +622,34 @@ func TestMenderGetInventoryPollInterval(t *testing.T) {
 	assert.Equal(t, time.Duration(10)*time.Second, intvl)
 }
 
+func TestMenderGetStartupDelay(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	assert.Equal(t, time.Duration(0), mender.GetStartupDelay())
+
+	mender = newTestMender(nil, menderConfig{
+		StartupDelayMaxSeconds: 2,
+	}, testMenderPieces{})
+	for i := 0; i < 100; i++ {
+		delay := mender.GetStartupDelay()
+		assert.True(t, delay >= 0)
+		assert.True(t, delay <= 2*time.Second)
+	}
+}
+
+func TestMenderGetUpdatePollJitter(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	assert.Equal(t, time.Duration(0), mender.GetUpdatePollJitter())
+
+	mender = newTestMender(nil, menderConfig{
+		UpdatePollJitterSeconds: 2,
+	}, testMenderPieces{})
+	for i := 0; i < 100; i++ {
+		jitter := mender.GetUpdatePollJitter()
+		assert.True(t, jitter >= 0)
+		assert.True(t, jitter <= 2*time.Second)
+	}
+}
+
 type testAuthDataMessenger struct {
 	reqData  []byte
 	sigData  []byte
@@ -387,6 +678,7 @@ type testAuthManager struct {
 	authtokenErr   error
 	haskey         bool
 	generatekeyErr error
+	fingerprint    string
 	testAuthDataMessenger
 }
 
@@ -406,10 +698,66 @@ func (a *testAuthManager) GenerateKey() error {
 	return a.generatekeyErr
 }
 
+func (a *testAuthManager) KeyFingerprint() (string, error) {
+	return a.fingerprint, nil
+}
+
+func (a *testAuthManager) PublicKeyPEM() (string, error) {
+	return "", errors.New("not implemented")
+}
+
 func (a *testAuthManager) RemoveAuthToken() error {
 	return nil
 }
 
+func (a *testAuthManager) RemoveKey() error {
+	return nil
+}
+
+func TestMenderDecommission(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	for _, removeKey := range []bool{false, true} {
+		ms := store.NewMemStore()
+		mender := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+			testMenderPieces{
+				MenderPieces: MenderPieces{
+					store: ms,
+				},
+			})
+		assert.NoError(t, mender.Bootstrap())
+		ms.WriteAll(authTokenName, []byte("tokendata"))
+		assert.True(t, mender.IsAuthorized())
+		assert.False(t, mender.Decommissioned())
+
+		assert.NoError(t, mender.Decommission(removeKey))
+		assert.True(t, mender.Decommissioned())
+		assert.False(t, mender.IsAuthorized())
+		assert.Equal(t, noAuthToken, mender.getAuthToken())
+		_, err := ms.ReadAll(authTokenName)
+		assert.True(t, os.IsNotExist(err))
+		_, err = ms.ReadAll(defaultKeyFile)
+		assert.Equal(t, removeKey, os.IsNotExist(err))
+
+		// the marker survives restarts, and the server is not contacted
+		// anymore
+		mender = newTestMender(nil, menderConfig{ServerURL: srv.URL},
+			testMenderPieces{
+				MenderPieces: MenderPieces{
+					store: ms,
+				},
+			})
+		assert.True(t, mender.Decommissioned())
+		for _, s := range []State{idleState, authorizeState, checkWaitState} {
+			next, cancel := s.Handle(&StateContext{store: ms}, mender)
+			assert.Equal(t, doneState, next)
+			assert.False(t, cancel)
+		}
+		assert.False(t, srv.Auth.Called)
+	}
+}
+
 func TestMenderAuthorize(t *testing.T) {
 	runner := newTestOSCalls("", -1)
 
@@ -534,9 +882,13 @@ func TestMenderReportStatus(t *testing.T) {
 	)
 	assert.NotNil(t, err)
 	assert.False(t, err.IsFatal())
+	// rejected token is dropped
+	assert.Equal(t, noAuthToken, mender.getAuthToken())
 
 	// 3. pretend that deployment was aborted
 	srv.Reset()
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	assert.NoError(t, mender.Authorize())
 	srv.Auth.Token = []byte("tokendata")
 	srv.Auth.Verify = true
 	srv.Status.Aborted = true
@@ -550,6 +902,189 @@ func TestMenderReportStatus(t *testing.T) {
 	assert.True(t, err.IsFatal())
 }
 
+// concurrentAuthManager is a testAuthManager which is safe to use from
+// multiple goroutines
+type concurrentAuthManager struct {
+	testAuthManager
+}
+
+func (a *concurrentAuthManager) RecvAuthResponse(data []byte) error {
+	return nil
+}
+
+func TestMenderAuthTokenConcurrent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/auth_requests") {
+			w.Write([]byte("tokendata"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				authMgr: &concurrentAuthManager{
+					testAuthManager{
+						haskey:    true,
+						authtoken: client.AuthToken("tokendata"),
+					},
+				},
+			},
+		},
+	)
+
+	// run with -race to detect unguarded access to the cached token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, mender.Authorize())
+		}()
+		go func() {
+			defer wg.Done()
+			mender.ReportUpdateStatus(client.UpdateResponse{ID: "foobar"},
+				client.StatusDownloading)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, client.AuthToken("tokendata"), mender.getAuthToken())
+}
+
+func TestMenderCheckUpdateNotModified(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-check-update-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	var checks, notModified, downloads int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" {
+			downloads++
+			w.Header().Set("Content-Length", "8192")
+			w.Write(make([]byte, 8192))
+			return
+		}
+		checks++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"id": "foo",
+			"artifact": {
+				"artifact_name": "fake-id-2",
+				"device_types_compatible": ["hammer"],
+				"source": {"uri": "%s/download"}
+			}
+		}`, srv.URL)
+	}))
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	newMender := func() *mender {
+		m := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+			testMenderPieces{
+				MenderPieces: MenderPieces{
+					store: ms,
+				},
+			})
+		m.artifactInfoFile = artifactInfo
+		m.deviceTypeFile = deviceType
+		return m
+	}
+	mender := newMender()
+
+	// update is deferred until the maintenance window opens
+	now := time.Now()
+	mender.config.MaintenanceWindowStart = now.Add(2 * time.Hour).Format("15:04")
+	mender.config.MaintenanceWindowEnd = now.Add(3 * time.Hour).Format("15:04")
+	next, _ := updateCheckState.Handle(&StateContext{}, mender)
+	assert.Equal(t, checkWaitState, next)
+	assert.Equal(t, 0, notModified)
+
+	// validators of a deferred update are not stored, so the update is
+	// offered again once the window opens
+	mender = newMender()
+	next, _ = updateCheckState.Handle(&StateContext{}, mender)
+	require.IsType(t, &UpdateFetchState{}, next)
+	assert.Equal(t, 0, notModified)
+	up := next.(*UpdateFetchState).update
+	assert.Equal(t, "fake-id-2", up.ArtifactName())
+
+	in, _, err := mender.FetchUpdate(context.Background(), up.URI())
+	require.NoError(t, err)
+	in.Close()
+	assert.Equal(t, 1, downloads)
+
+	// validators are kept in the store between cycles once the update is
+	// started
+	mender = newMender()
+	up2, merr := mender.CheckUpdate(context.Background())
+	assert.Nil(t, merr)
+	assert.Nil(t, up2)
+	assert.Equal(t, 1, notModified)
+
+	// update is not fetched nor installed
+	next, _ = updateCheckState.Handle(&StateContext{}, mender)
+	assert.Equal(t, checkWaitState, next)
+	assert.Equal(t, 2, notModified)
+	assert.Equal(t, 4, checks)
+	assert.Equal(t, 1, downloads)
+}
+
+func TestMenderExtraHeaders(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+			ExtraHeaders: map[string]string{
+				"X-Gateway-Key": "gatewaykey",
+				"authorization": "Bearer bogus",
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	assert.NoError(t, mender.Authorize())
+
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+
+	err := mender.ReportUpdateStatus(
+		client.UpdateResponse{
+			ID: "foobar",
+		},
+		client.StatusSuccess,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, client.StatusSuccess, srv.Status.Status)
+	assert.Equal(t, "gatewaykey", srv.Header.Get("X-Gateway-Key"))
+	assert.Equal(t, "Bearer tokendata", srv.Header.Get("Authorization"))
+
+}
+
 func TestMenderLogUpload(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -627,6 +1162,22 @@ func TestMenderState(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, MenderStateInit, s)
+
+	err = json.Unmarshal([]byte(`"update-commit"`), &s)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateCommit, s)
+
+	// states of newer versions of the client are loaded as unknown, and
+	// can not be stored
+	err = json.Unmarshal([]byte(`"some-future-state"`), &s)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUnknown, s)
+	_, err = json.Marshal(MenderStateUnknown)
+	assert.Error(t, err)
+
+	// not a state name at all
+	err = json.Unmarshal([]byte(`3`), &s)
+	assert.Error(t, err)
 }
 
 func TestAuthToken(t *testing.T) {
@@ -651,8 +1202,8 @@ func TestAuthToken(t *testing.T) {
 
 	ts.Update.Unauthorized = true
 	ts.Update.Current = client.CurrentUpdate{
-		"fake-id",
-		"foo-bar",
+		Artifact:   "fake-id",
+		DeviceType: "foo-bar",
 	}
 
 	td, _ := ioutil.TempDir("", "mender-install-update-")
@@ -665,44 +1216,261 @@ func TestAuthToken(t *testing.T) {
 	mender.artifactInfoFile = artifactInfo
 	mender.deviceTypeFile = deviceType
 
-	_, updErr := mender.CheckUpdate()
-	assert.EqualError(t, updErr.Cause(), client.ErrNotAuthorized.Error())
+	_, updErr := mender.CheckUpdate(context.Background())
+	assert.True(t, errorIs(updErr, client.ErrNotAuthorized), updErr.Error())
 
 	token, err = ms.ReadAll(authTokenName)
 	assert.Equal(t, os.ErrNotExist, err)
 	assert.Empty(t, token)
 }
 
-func TestMenderInventoryRefresh(t *testing.T) {
-	// create temp dir
-	td, _ := ioutil.TempDir("", "mender-install-update-")
+func TestMenderStateScriptEnvironment(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-scripts-")
+	assert.NoError(t, err)
 	defer os.RemoveAll(td)
 
-	// prepare fake artifactInfo file, it is read when submitting inventory to
-	// fill some default fields (device_type, artifact_name)
-	artifactInfo := path.Join(td, "artifact_info")
-	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	DeploymentLogger = NewDeploymentLogManager(td)
+
+	envFile := path.Join(td, "env")
+	ioutil.WriteFile(path.Join(td, "version"), []byte("2"), 0644)
+	ioutil.WriteFile(path.Join(td, "ArtifactRollback_Enter_01"),
+		[]byte("#!/bin/sh\nenv | grep ^MENDER_ | sort > "+envFile+"\n"), 0755)
+
+	mender := newDefaultTestMender()
+	mender.stateScriptExecutor = statescript.Launcher{
+		ArtScriptsPath:          td,
+		RootfsScriptsPath:       td,
+		SupportedScriptVersions: []int{2},
+		Environment:             mender.deploymentEnvironment,
+	}
+
+	update := client.UpdateResponse{
+		ID: "deployment-1",
+		Metadata: map[string]string{
+			"service":   "app",
+			"stop-with": "SIGTERM",
+		},
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	mender.SetNextState(NewUpdateVerifyState(update))
+	mender.TransitionState(NewRollbackState(update, false, false), nil)
+
+	env, err := ioutil.ReadFile(envFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "MENDER_ARTIFACT_NAME=release-2\n"+
+		"MENDER_DEPLOYMENT_ID=deployment-1\n"+
+		"MENDER_META_SERVICE=app\n"+
+		"MENDER_META_STOP_WITH=SIGTERM\n"+
+		"MENDER_ROLLBACK=1\n", string(env))
+}
+
+func TestMenderArtifactStateScripts(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-artifact-scripts-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	DeploymentLogger = NewDeploymentLogManager(td)
+
 	deviceType := path.Join(td, "device_type")
-	ioutil.WriteFile(deviceType, []byte("device_type=foo-bar"), 0600)
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	key := path.Join(td, "key.pem")
+	ioutil.WriteFile(key, []byte(PublicRSAKey), 0644)
 
-	srv := cltest.NewClientTestServer()
-	defer srv.Close()
+	marker := path.Join(td, "marker")
+	script := path.Join(td, "ArtifactInstall_Enter_00")
+	ioutil.WriteFile(script,
+		[]byte("#!/bin/sh\necho installed >> "+marker+"\n"), 0755)
+	scripts := &artifact.Scripts{}
+	require.NoError(t, scripts.Add(script))
 
-	ms := store.NewMemStore()
+	scriptsDir := path.Join(td, "scripts")
 	mender := newTestMender(nil,
-		menderConfig{
-			ServerURL: srv.URL,
-		},
+		menderConfig{ArtifactScriptsRequireSignature: true},
 		testMenderPieces{
 			MenderPieces: MenderPieces{
-				store: ms,
+				device: &fakeDevice{consumeUpdate: true},
 			},
 		},
 	)
-	mender.artifactInfoFile = artifactInfo
 	mender.deviceTypeFile = deviceType
+	mender.stateScriptPath = scriptsDir
+	mender.stateScriptExecutor = statescript.Launcher{
+		ArtScriptsPath:          scriptsDir,
+		RootfsScriptsPath:       td,
+		SupportedScriptVersions: []int{2},
+	}
 
-	ms.WriteAll(authTokenName, []byte("tokendata"))
+	// the scripts of unsigned artifacts are rejected
+	upd, err := makeRootfsImageArtifactWithScripts(2, false, nil, scripts)
+	require.NoError(t, err)
+	err = mender.InstallUpdate(upd, 0)
+	assert.Equal(t, installer.ErrStateScriptsNotAccepted, errors.Cause(err))
+	_, err = os.Stat(path.Join(scriptsDir, "ArtifactInstall_Enter_00"))
+	assert.True(t, os.IsNotExist(err))
+
+	mender.config.ArtifactVerifyKey = key
+	upd, err = makeRootfsImageArtifactWithScripts(2, true, nil, scripts)
+	require.NoError(t, err)
+	require.NoError(t, mender.InstallUpdate(upd, 0))
+
+	// the embedded script runs when entering the install state only
+	require.NoError(t, ToDownload.Leave(mender.stateScriptExecutor, nil))
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ToArtifactInstall.Enter(mender.stateScriptExecutor, nil))
+	data, err := ioutil.ReadFile(marker)
+	assert.NoError(t, err)
+	assert.Equal(t, "installed\n", string(data))
+}
+
+func TestAuthTokenInventoryRefresh(t *testing.T) {
+	ts := cltest.NewClientTestServer()
+	defer ts.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: ts.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+
+	td, _ := ioutil.TempDir("", "mender-install-update-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=foo-bar"), 0600)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	assert.NoError(t, mender.Authorize())
+	assert.Equal(t, client.AuthToken("tokendata"), mender.getAuthToken())
+
+	// server no longer accepts the token
+	ts.Auth.Verify = true
+	ts.Auth.Token = []byte("newtokendata")
+
+	err := mender.InventoryRefresh(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, client.ErrNotAuthorized, errors.Cause(err))
+
+	assert.Equal(t, noAuthToken, mender.getAuthToken())
+	token, err := ms.ReadAll(authTokenName)
+	assert.Equal(t, os.ErrNotExist, err)
+	assert.Empty(t, token)
+}
+
+func TestMenderPreviousArtifactName(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-install-update-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu"), 0600)
+
+	// inventory scripts are looked up in the data directory
+	oldDefaultPathDataDir := defaultPathDataDir
+	defaultPathDataDir = td
+	defer func() { defaultPathDataDir = oldDefaultPathDataDir }()
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:  ms,
+				device: &fakeDevice{consumeUpdate: true},
+			},
+		},
+	)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	assert.NoError(t, mender.Authorize())
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+
+	// nothing installed yet
+	assert.NoError(t, mender.ReportUpdateStatus(client.UpdateResponse{ID: "foo"},
+		client.StatusSuccess))
+	assert.Empty(t, srv.Status.PreviousArtifactName)
+
+	upd, err := MakeRootfsImageArtifact(1, false)
+	require.NoError(t, err)
+	assert.NoError(t, mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1"))
+
+	// pretend the device rebooted into the update
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.1"), 0600)
+
+	// only the success report carries the previous artifact
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	assert.NoError(t, mender.ReportUpdateStatus(client.UpdateResponse{ID: "foo"},
+		client.StatusRebooting))
+	assert.Empty(t, srv.Status.PreviousArtifactName)
+	assert.NoError(t, mender.ReportUpdateStatus(client.UpdateResponse{ID: "foo"},
+		client.StatusSuccess))
+	assert.Equal(t, "mender-1.0", srv.Status.PreviousArtifactName)
+
+	assert.NoError(t, mender.InventoryRefresh(context.Background()))
+	assert.Contains(t, srv.Inventory.Attrs, client.InventoryAttribute{
+		Name: "previous_artifact_name", Value: "mender-1.0"})
+
+	// after a rollback the previous artifact is the installed one
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0"), 0600)
+	assert.NoError(t, mender.InventoryRefresh(context.Background()))
+	for _, attr := range srv.Inventory.Attrs {
+		assert.NotEqual(t, "previous_artifact_name", attr.Name)
+	}
+}
+
+func TestMenderInventoryRefresh(t *testing.T) {
+	// create temp dir
+	td, _ := ioutil.TempDir("", "mender-install-update-")
+	defer os.RemoveAll(td)
+
+	// prepare fake artifactInfo file, it is read when submitting inventory to
+	// fill some default fields (device_type, artifact_name)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=foo-bar"), 0600)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	ms.WriteAll(authTokenName, []byte("tokendata"))
 
 	merr := mender.Authorize()
 	assert.NoError(t, merr)
@@ -724,7 +1492,7 @@ func TestMenderInventoryRefresh(t *testing.T) {
 	// called with default inventory attributes only
 	srv.Auth.Verify = true
 	srv.Auth.Token = []byte("tokendata")
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.Nil(t, err)
 
 	assert.True(t, srv.Inventory.Called)
@@ -732,6 +1500,7 @@ func TestMenderInventoryRefresh(t *testing.T) {
 		{Name: "device_type", Value: "foo-bar"},
 		{Name: "artifact_name", Value: "fake-id"},
 		{Name: "mender_client_version", Value: "unknown"},
+		{Name: "clock_synced", Value: "true"},
 	}
 	for _, a := range exp {
 		assert.Contains(t, srv.Inventory.Attrs, a)
@@ -747,7 +1516,7 @@ echo foo=bar`),
 	srv.Reset()
 	srv.Auth.Verify = true
 	srv.Auth.Token = []byte("tokendata")
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.Nil(t, err)
 	exp = []client.InventoryAttribute{
 		{Name: "device_type", Value: "foo-bar"},
@@ -759,21 +1528,269 @@ echo foo=bar`),
 		assert.Contains(t, srv.Inventory.Attrs, a)
 	}
 
+	// 2a. attributes from the config override the ones from the scripts
+	mender.config.InventoryAttributes = map[string]string{
+		"foo":  "baz",
+		"site": "lab",
+	}
+	err = mender.InventoryRefresh(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, srv.Inventory.Attrs, client.InventoryAttribute{Name: "foo", Value: "baz"})
+	assert.Contains(t, srv.Inventory.Attrs, client.InventoryAttribute{Name: "site", Value: "lab"})
+	assert.NotContains(t, srv.Inventory.Attrs, client.InventoryAttribute{Name: "foo", Value: "bar"})
+	mender.config.InventoryAttributes = nil
+
+	// 2b. failing script is skipped, output of the others is submitted
+	err = ioutil.WriteFile(path.Join(invpath, "mender-inventory-broken"),
+		[]byte("#!/bin/sh\necho broken=yes\nexit 1\n"),
+		os.FileMode(syscall.S_IRWXU))
+	assert.NoError(t, err)
+	err = mender.InventoryRefresh(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, srv.Inventory.Attrs, client.InventoryAttribute{Name: "foo", Value: "bar"})
+	assert.NotContains(t, srv.Inventory.Attrs, client.InventoryAttribute{Name: "broken", Value: "yes"})
+
+	// nothing is submitted in strict mode
+	srv.Inventory.Called = false
+	mender.config.InventoryScriptsStrict = true
+	err = mender.InventoryRefresh(context.Background())
+	assert.Error(t, err)
+	assert.False(t, srv.Inventory.Called)
+	mender.config.InventoryScriptsStrict = false
+	os.Remove(path.Join(invpath, "mender-inventory-broken"))
+
 	// no artifact name should error
 	ioutil.WriteFile(artifactInfo, []byte(""), 0600)
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.Error(t, err)
 	assert.EqualError(t, errors.Cause(err), errNoArtifactName.Error())
 
 	// 3. pretend client is no longer authorized
 	srv.Auth.Token = []byte("footoken")
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.NotNil(t, err)
 
 	// restore old datadir path
 	defaultPathDataDir = oldDefaultPathDataDir
 }
 
+func TestMenderServerConfig(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-server-config-")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	oldLevel, oldFromCommandLine := log.Log.Level, logLevelFromCommandLine
+	defer func() {
+		log.SetLevel(oldLevel)
+		logLevelFromCommandLine = oldFromCommandLine
+	}()
+	logLevelFromCommandLine = false
+	log.SetLevel(log.InfoLevel)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Current = client.CurrentUpdate{
+		Artifact:   "fake-id",
+		DeviceType: "hammer",
+	}
+
+	ms := store.NewMemStore()
+	config := menderConfig{
+		ServerURL:                 srv.URL,
+		UpdatePollIntervalSeconds: 1800,
+		RetryPollIntervalSeconds:  300,
+		LogLevel:                  "warning",
+		ServerConfig:              true,
+		LocalOverrides:            []string{"RetryPollIntervalSeconds"},
+	}
+	newMender := func() *mender {
+		m := newTestMender(nil, config, testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+		m.artifactInfoFile = artifactInfo
+		m.deviceTypeFile = deviceType
+		return m
+	}
+	mender := newMender()
+	assert.Equal(t, 30*time.Minute, mender.GetUpdatePollInterval())
+	assert.Equal(t, log.WarnLevel, log.Log.Level)
+
+	// the server delivers a new poll interval along with the next check
+	srv.Config.Data = &client.RemoteConfig{
+		UpdatePollIntervalSeconds: 60,
+		RetryPollIntervalSeconds:  10,
+		LogLevel:                  "debug",
+	}
+	_, merr := mender.CheckUpdate(context.Background())
+	require.NoError(t, merr)
+	assert.True(t, srv.Config.Called)
+
+	// which takes effect on the next cycle, except for the fields
+	// overridden locally
+	assert.Equal(t, time.Minute, mender.GetUpdatePollInterval())
+	assert.Equal(t, 5*time.Minute, mender.GetRetryPollInterval())
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+
+	// the configuration survives restarts and reloads of the local one
+	log.SetLevel(log.InfoLevel)
+	mender = newMender()
+	assert.Equal(t, time.Minute, mender.GetUpdatePollInterval())
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+	mender.ReloadConfig(config)
+	assert.Equal(t, time.Minute, mender.GetUpdatePollInterval())
+
+	// the local configuration applies again once the server stops
+	// delivering it
+	srv.Config.Data = nil
+	_, merr = mender.CheckUpdate(context.Background())
+	require.NoError(t, merr)
+	assert.Equal(t, 30*time.Minute, mender.GetUpdatePollInterval())
+	assert.Equal(t, log.WarnLevel, log.Log.Level)
+	_, err := ms.ReadAll(remoteConfigName)
+	assert.True(t, os.IsNotExist(err))
+
+	// nothing is fetched unless enabled
+	srv.Config.Called = false
+	config.ServerConfig = false
+	mender = newMender()
+	_, merr = mender.CheckUpdate(context.Background())
+	require.NoError(t, merr)
+	assert.False(t, srv.Config.Called)
+}
+
+func TestRemoteConfigPollIntervalMin(t *testing.T) {
+	config := menderConfig{
+		UpdatePollIntervalSeconds: 1800,
+		PollIntervalMinSeconds:    60,
+	}
+
+	// the poll intervals delivered by the server are raised to the minimum
+	c := config.withRemoteConfig(&client.RemoteConfig{
+		UpdatePollIntervalSeconds:    1,
+		InventoryPollIntervalSeconds: 120,
+		RetryPollIntervalSeconds:     10,
+		StartupDelayMaxSeconds:       5,
+	})
+	assert.Equal(t, 60, c.UpdatePollIntervalSeconds)
+	assert.Equal(t, 120, c.InventoryPollIntervalSeconds)
+	assert.Equal(t, 10, c.RetryPollIntervalSeconds)
+	assert.Equal(t, 5, c.StartupDelayMaxSeconds)
+}
+
+func TestMenderInventoryResync(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	merr := mender.Authorize()
+	require.NoError(t, merr)
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	srv.Inventory.Version = "v1"
+
+	idata := client.InventoryData{
+		{Name: "device_type", Value: "foo-bar"},
+		{Name: "artifact_name", Value: "fake-id"},
+	}
+	require.NoError(t, mender.submitInventory(context.Background(), idata))
+	assert.Equal(t, []client.InventoryAttribute(idata), srv.Inventory.Attrs)
+
+	// the server confirms it holds the unchanged inventory
+	srv.Inventory.Attrs = nil
+	require.NoError(t, mender.submitInventory(context.Background(), idata))
+	assert.Equal(t, "v1", srv.Header.Get("If-Match"))
+	assert.Nil(t, srv.Inventory.Attrs)
+
+	// the server lost the inventory, e.g. it was restored from a backup
+	srv.Inventory.Version = "v2"
+	require.NoError(t, mender.submitInventory(context.Background(), idata))
+	assert.Equal(t, []client.InventoryAttribute(idata), srv.Inventory.Attrs)
+	v, ok := loadInventoryVersion(ms)
+	assert.True(t, ok)
+	assert.Equal(t, "v2", v.Version)
+
+	// changed inventory is submitted without asking
+	idata = append(idata, client.InventoryAttribute{Name: "foo", Value: "bar"})
+	require.NoError(t, mender.submitInventory(context.Background(), idata))
+	assert.Empty(t, srv.Header.Get("If-Match"))
+	assert.Equal(t, []client.InventoryAttribute(idata), srv.Inventory.Attrs)
+}
+
+func TestMenderShowInventory(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-show-inventory-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=foo-bar"), 0600)
+	invpath := path.Join(td, "inventory")
+	require.NoError(t, os.MkdirAll(invpath, 0700))
+	require.NoError(t, ioutil.WriteFile(path.Join(invpath, "mender-inventory-net"),
+		[]byte("#!/bin/sh\necho mac=de:ad:be:ef:00:02\necho mac=de:ad:be:ef:00:01\n"),
+		0700))
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL:            srv.URL,
+			InventoryScriptsDirs: []string{invpath},
+			InventoryAttributes:  map[string]string{"site": "lab"},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	// free space may change between the two collections
+	withoutStorage := func(attrs []client.InventoryAttribute) []client.InventoryAttribute {
+		var res []client.InventoryAttribute
+		for _, a := range attrs {
+			if !strings.HasSuffix(a.Name, "_free_bytes") {
+				res = append(res, a)
+			}
+		}
+		return res
+	}
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, printInventory(buf, mender))
+	var shown []client.InventoryAttribute
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &shown))
+	assert.False(t, srv.Inventory.Called)
+
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	require.NoError(t, mender.Authorize())
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	require.NoError(t, mender.InventoryRefresh(context.Background()))
+	assert.Equal(t, withoutStorage(srv.Inventory.Attrs), withoutStorage(shown))
+	assert.Contains(t, shown, client.InventoryAttribute{Name: "site", Value: "lab"})
+}
+
 func MakeFakeUpdate(data string) (string, error) {
 	f, err := ioutil.TempFile("", "test_update")
 	if err != nil {
@@ -821,6 +1838,32 @@ r3rtT0ysHWd7l+Kx/SUCQGlitd5RDfdHl+gKrCwhNnRG7FzRLv5YOQV81+kh7SkU
 )
 
 func MakeRootfsImageArtifact(version int, signed bool) (io.ReadCloser, error) {
+	return makeRootfsImageArtifact(version, signed, nil)
+}
+
+// metadataComposer adds meta-data to the update header; the rootfs image
+// handler itself always stores empty meta-data.
+type metadataComposer struct {
+	handlers.Composer
+	metadata []byte
+}
+
+func (m *metadataComposer) ComposeHeader(tw *tar.Writer, no int) error {
+	if err := m.Composer.ComposeHeader(tw, no); err != nil {
+		return err
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	return sw.Write(m.metadata,
+		filepath.Join(artifact.UpdateHeaderPath(no), "meta-data"))
+}
+
+func makeRootfsImageArtifact(version int, signed bool,
+	metadata []byte) (io.ReadCloser, error) {
+	return makeRootfsImageArtifactWithScripts(version, signed, metadata, nil)
+}
+
+func makeRootfsImageArtifactWithScripts(version int, signed bool,
+	metadata []byte, scripts *artifact.Scripts) (io.ReadCloser, error) {
 	upd, err := MakeFakeUpdate("test update")
 	if err != nil {
 		return nil, err
@@ -842,10 +1885,13 @@ func MakeRootfsImageArtifact(version int, signed bool) (io.ReadCloser, error) {
 	case 2:
 		u = handlers.NewRootfsV2(upd)
 	}
+	if metadata != nil {
+		u = &metadataComposer{u, metadata}
+	}
 
 	updates := &awriter.Updates{U: []handlers.Composer{u}}
 	err = aw.WriteArtifact("mender", version, []string{"vexpress-qemu"},
-		"mender-1.1", updates, nil)
+		"mender-1.1", updates, scripts)
 	if err != nil {
 		return nil, err
 	}
@@ -861,6 +1907,61 @@ func (m *mockReader) Read(p []byte) (int, error) {
 	return ret.Get(0).(int), ret.Error(1)
 }
 
+func TestMenderSignaturePolicy(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-signature-policy-")
+	defer os.RemoveAll(td)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	key := path.Join(td, "key.pem")
+	ioutil.WriteFile(key, []byte(PublicRSAKey), 0644)
+
+	install := func(config menderConfig, signed bool) error {
+		mender := newTestMender(nil, config,
+			testMenderPieces{
+				MenderPieces: MenderPieces{
+					device: &fakeDevice{consumeUpdate: true},
+				},
+			},
+		)
+		mender.deviceTypeFile = deviceType
+		upd, err := MakeRootfsImageArtifact(2, signed)
+		require.NoError(t, err)
+		return mender.InstallUpdate(upd, 0)
+	}
+
+	policies := []signaturePolicy{
+		{ServerURL: "https://dev.example.com/", RequireSignature: false},
+		{DeviceType: "devboard", RequireSignature: false},
+	}
+	dev := menderConfig{
+		ServerURL:         "https://dev.example.com",
+		ArtifactVerifyKey: key,
+		SignaturePolicies: policies,
+	}
+	prod := menderConfig{
+		ServerURL:         "https://prod.example.com",
+		ArtifactVerifyKey: key,
+		SignaturePolicies: policies,
+	}
+
+	// unsigned artifacts are accepted from the development server only
+	assert.NoError(t, install(dev, false))
+	assert.Error(t, install(prod, false))
+	assert.NoError(t, install(prod, true))
+
+	// dev boards accept unsigned artifacts from any server
+	keys, err := prod.GetArtifactVerifyKeys(prod.ServerURL, "devboard")
+	assert.NoError(t, err)
+	assert.Nil(t, keys)
+
+	// signatures can not be required without the keys
+	prod.ArtifactVerifyKey = ""
+	prod.SignaturePolicies = []signaturePolicy{{RequireSignature: true}}
+	_, err = prod.GetArtifactVerifyKeys(prod.ServerURL, "vexpress-qemu")
+	assert.Error(t, err)
+}
+
 func TestMenderInstallUpdate(t *testing.T) {
 	// create temp dir
 	td, _ := ioutil.TempDir("", "mender-install-update-")
@@ -929,6 +2030,459 @@ func TestMenderInstallUpdate(t *testing.T) {
 
 }
 
+func TestMenderInstallArtifactName(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-install-update-")
+	defer os.RemoveAll(td)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	// device would fail the installation if it was reached
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				device: &fakeDevice{retInstallUpdate: errors.New("installed")},
+			},
+		},
+	)
+	mender.deviceTypeFile = deviceType
+
+	// served artifact is named differently than advertised
+	upd, err := MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.2")
+	assert.Error(t, err)
+	assert.Equal(t, installer.ErrArtifactNameMismatch, errors.Cause(err))
+
+	// advertised name matches, device is asked to install the update
+	upd, err = MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "installed")
+
+	// the artifact is installed already; the device is not touched
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.1\n"), 0644)
+	mender.artifactInfoFile = artifactInfo
+
+	upd, err = MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1")
+	assert.Error(t, err)
+	assert.Equal(t, installer.ErrArtifactAlreadyInstalled, errors.Cause(err))
+
+	// typed errors for artifacts that can not be installed
+	mender.artifactInfoFile = ""
+	upd, err = MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	ioutil.WriteFile(deviceType, []byte("device_type=beaglebone\n"), 0644)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1")
+	assert.True(t, errorIs(err, installer.ErrDeviceTypeMismatch), err.Error())
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	mender.UInstallCommitRebooter = &fakeDevice{retInstallUpdate: syscall.ENOSPC}
+	upd, err = MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1")
+	assert.True(t, errorIs(err, ErrNoSpace), err.Error())
+
+	// signed with a key that is not trusted
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherDER, err := x509.MarshalPKIXPublicKey(&other.PublicKey)
+	require.NoError(t, err)
+	otherKey := path.Join(td, "other.pem")
+	ioutil.WriteFile(otherKey, pem.EncodeToMemory(
+		&pem.Block{Type: "PUBLIC KEY", Bytes: otherDER}), 0644)
+	mender.config.ArtifactVerifyKey = otherKey
+	upd, err = MakeRootfsImageArtifact(2, true)
+	assert.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1")
+	assert.True(t, errorIs(err, installer.ErrSignatureInvalid), err.Error())
+}
+
+func TestMenderInstallDepends(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-install-update-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	ms := store.NewMemStore()
+	device := &fakeDevice{consumeUpdate: true}
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:  ms,
+				device: device,
+			},
+		},
+	)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	// installed artifact provides rootfs version 1
+	mender.storeArtifactProvides(artifactProvidesName, "mender-1.0",
+		map[string]string{"rootfs_version": "1"})
+
+	// dependencies satisfied
+	upd, err := makeRootfsImageArtifact(2, false, []byte(`{
+		"depends": {"artifact_name": "mender-1.0", "rootfs_version": "1"},
+		"provides": {"rootfs_version": "2"}
+	}`))
+	require.NoError(t, err)
+	assert.NoError(t, mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1"))
+	// the previous artifact keeps its provides until the update is
+	// committed, so that they still apply if it is rolled back
+	assert.Equal(t, map[string]string{
+		"artifact_name":  "mender-1.0",
+		"rootfs_version": "1",
+	}, mender.getArtifactProvides("mender-1.0"))
+	assert.Equal(t, map[string]string{
+		"artifact_name": "mender-1.1",
+	}, mender.getArtifactProvides("mender-1.1"))
+	// provides of the new artifact apply once it is committed
+	assert.NoError(t, mender.CommitUpdate())
+	assert.Equal(t, map[string]string{
+		"artifact_name":  "mender-1.1",
+		"rootfs_version": "2",
+	}, mender.getArtifactProvides("mender-1.1"))
+	assert.Equal(t, map[string]string{
+		"artifact_name": "mender-1.0",
+	}, mender.getArtifactProvides("mender-1.0"))
+	_, err = ms.ReadAll(artifactProvidesPendingName)
+	assert.True(t, os.IsNotExist(err))
+
+	// device does not provide what the artifact depends on; the update is
+	// refused before it is written
+	mender.UInstallCommitRebooter = &fakeDevice{retInstallUpdate: errors.New("written")}
+	for _, meta := range []string{
+		`{"depends": {"rootfs_version": "2"}}`,
+		`{"depends": {"artifact_name": "mender-0.9"}}`,
+		`{"depends": {"bootloader": "u-boot"}}`,
+	} {
+		upd, err = makeRootfsImageArtifact(2, false, []byte(meta))
+		require.NoError(t, err)
+		err = mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1")
+		assert.Equal(t, installer.ErrArtifactDependsNotSatisfied, errors.Cause(err), meta)
+	}
+
+	// malformed dependencies
+	upd, err = makeRootfsImageArtifact(2, false, []byte(`{"depends": {"rootfs_version": 1}}`))
+	require.NoError(t, err)
+	assert.Error(t, mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1"))
+}
+
+func TestMenderInstallRebootRequired(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-install-update-")
+	defer os.RemoveAll(td)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				device: &fakeDevice{consumeUpdate: true},
+			},
+		},
+	)
+	mender.deviceTypeFile = deviceType
+	assert.True(t, mender.RebootRequired())
+
+	for _, version := range []int{1, 2} {
+		upd, err := makeRootfsImageArtifact(version, false,
+			[]byte(`{"reboot_required": false}`))
+		assert.NoError(t, err)
+		assert.NoError(t, mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1"))
+		assert.False(t, mender.RebootRequired())
+
+		// no meta-data, reboot is needed
+		upd, err = MakeRootfsImageArtifact(version, false)
+		assert.NoError(t, err)
+		assert.NoError(t, mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1"))
+		assert.True(t, mender.RebootRequired())
+	}
+
+	upd, err := makeRootfsImageArtifact(2, false,
+		[]byte(`{"reboot_required": "maybe"}`))
+	assert.NoError(t, err)
+	assert.Error(t, mender.InstallArtifact(context.Background(), upd, 0, "mender-1.1"))
+}
+
+func TestMenderReboot(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-reboot-")
+	defer os.RemoveAll(td)
+	marker := path.Join(td, "rebooted")
+
+	device := &fakeDevice{retReboot: errors.New("system reboot")}
+
+	// system reboot
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{MenderPieces: MenderPieces{device: device}})
+	assert.EqualError(t, mender.Reboot(), "system reboot")
+
+	// custom command is run instead of the system reboot
+	mender = newTestMender(nil, menderConfig{
+		RebootStrategy: rebootStrategyCommand,
+		RebootCommand:  []string{"touch", marker},
+	}, testMenderPieces{MenderPieces: MenderPieces{device: device}})
+	assert.NoError(t, mender.Reboot())
+	_, err := os.Stat(marker)
+	assert.NoError(t, err)
+
+	mender = newTestMender(nil, menderConfig{
+		RebootStrategy: rebootStrategyCommand,
+		RebootCommand:  []string{"false"},
+	}, testMenderPieces{MenderPieces: MenderPieces{device: device}})
+	assert.Error(t, mender.Reboot())
+
+	// hanging command is killed once the state script timeout is up
+	mender = newTestMender(nil, menderConfig{
+		RebootStrategy:            rebootStrategyCommand,
+		RebootCommand:             []string{"sleep", "10"},
+		StateScriptTimeoutSeconds: 1,
+	}, testMenderPieces{MenderPieces: MenderPieces{device: device}})
+	start := time.Now()
+	assert.Error(t, mender.Reboot())
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestMenderNotifyUpdateDeferred(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-deferred-")
+	defer os.RemoveAll(td)
+	out := path.Join(td, "deferred")
+
+	update := client.UpdateResponse{ID: "deployment-1"}
+	update.Artifact.ArtifactName = "release-2"
+	until := time.Date(2018, 5, 10, 2, 0, 0, 0, time.UTC)
+
+	mender := newTestMender(nil, menderConfig{
+		UpdateDeferredCommand: []string{"sh", "-c", `echo "$0 $1" >> ` + out},
+	}, testMenderPieces{})
+	mender.NotifyUpdateDeferred(update, until)
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "release-2 2018-05-10T02:00:00Z\n", string(data))
+
+	// run once for a deployment deferred again
+	mender.NotifyUpdateDeferred(update, until.Add(24*time.Hour))
+	data, err = ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "release-2 2018-05-10T02:00:00Z\n", string(data))
+
+	next := client.UpdateResponse{ID: "deployment-2"}
+	next.Artifact.ArtifactName = "release-3"
+	mender.NotifyUpdateDeferred(next, until)
+	data, err = ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "release-2 2018-05-10T02:00:00Z\n"+
+		"release-3 2018-05-10T02:00:00Z\n", string(data))
+
+	// hanging command is killed along with its children once the state
+	// script timeout is up
+	mender = newTestMender(nil, menderConfig{
+		UpdateDeferredCommand:     []string{"sh", "-c", "sleep 10"},
+		StateScriptTimeoutSeconds: 1,
+	}, testMenderPieces{})
+	start := time.Now()
+	mender.NotifyUpdateDeferred(update, until)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// not configured
+	mender = newTestMender(nil, menderConfig{}, testMenderPieces{})
+	mender.NotifyUpdateDeferred(update, until)
+}
+
+func TestMenderUpdateConditionsMet(t *testing.T) {
+	// not configured
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	ok, _ := mender.UpdateConditionsMet()
+	assert.True(t, ok)
+
+	mender = newTestMender(nil, menderConfig{
+		UpdateConditionsCommand: []string{"sh", "-c", "echo metered link; exit 1"},
+	}, testMenderPieces{})
+	ok, reason := mender.UpdateConditionsMet()
+	assert.False(t, ok)
+	assert.Equal(t, "metered link", reason)
+
+	mender = newTestMender(nil, menderConfig{
+		UpdateConditionsCommand: []string{"true"},
+	}, testMenderPieces{})
+	ok, _ = mender.UpdateConditionsMet()
+	assert.True(t, ok)
+
+	// broken command does not block the updates
+	mender = newTestMender(nil, menderConfig{
+		UpdateConditionsCommand: []string{"/non/existing/command"},
+	}, testMenderPieces{})
+	ok, _ = mender.UpdateConditionsMet()
+	assert.True(t, ok)
+
+	// neither does a hanging one, which is killed once the state script
+	// timeout is up
+	mender = newTestMender(nil, menderConfig{
+		UpdateConditionsCommand:   []string{"sh", "-c", "sleep 10; exit 1"},
+		StateScriptTimeoutSeconds: 1,
+	}, testMenderPieces{})
+	start := time.Now()
+	ok, _ = mender.UpdateConditionsMet()
+	assert.True(t, ok)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestMenderDownloadRetryPolicy(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{RetryPollIntervalSeconds: 60},
+		testMenderPieces{})
+	assert.Equal(t, client.DownloadRetryPolicy{MaxWait: time.Minute},
+		mender.downloadRetryPolicy())
+
+	mender = newTestMender(nil, menderConfig{
+		RetryPollIntervalSeconds:        60,
+		DownloadRetryAttempts:           10,
+		DownloadRetryIntervalSeconds:    5,
+		DownloadRetryMaxIntervalSeconds: 600,
+		DownloadMaxReconnects:           20,
+	}, testMenderPieces{})
+	assert.Equal(t, client.DownloadRetryPolicy{
+		MaxAttempts:   10,
+		MaxReconnects: 20,
+		InitialWait:   5 * time.Second,
+		MaxWait:       10 * time.Minute,
+	}, mender.downloadRetryPolicy())
+}
+
+func TestMenderRebootDelay(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	grace, _ := mender.GetRebootDelay()
+	assert.Zero(t, grace)
+	assert.False(t, mender.RebootVetoed())
+
+	mender = newTestMender(nil, menderConfig{
+		RebootGracePeriodSeconds: 30,
+		RebootVetoCommand:        []string{"sh", "-c", "echo transaction in progress; exit 1"},
+	}, testMenderPieces{})
+	grace, max := mender.GetRebootDelay()
+	assert.Equal(t, 30*time.Second, grace)
+	assert.Equal(t, defaultMaxRebootDelay, max)
+	assert.True(t, mender.RebootVetoed())
+
+	// the maximum is never shorter than the grace period
+	mender = newTestMender(nil, menderConfig{
+		RebootGracePeriodSeconds: 30,
+		MaxRebootDelaySeconds:    10,
+		RebootVetoCommand:        []string{"/non/existing/command"},
+	}, testMenderPieces{})
+	grace, max = mender.GetRebootDelay()
+	assert.Equal(t, 30*time.Second, grace)
+	assert.Equal(t, 30*time.Second, max)
+	// broken command does not block the reboot
+	assert.False(t, mender.RebootVetoed())
+
+	// neither does a hanging one, which is killed once the state script
+	// timeout is up
+	mender = newTestMender(nil, menderConfig{
+		RebootVetoCommand:         []string{"sh", "-c", "sleep 10; exit 1"},
+		StateScriptTimeoutSeconds: 1,
+	}, testMenderPieces{})
+	start := time.Now()
+	assert.False(t, mender.RebootVetoed())
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestMenderRunPostCommitScripts(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-post-commit-")
+	defer os.RemoveAll(td)
+
+	failing := path.Join(td, "failing")
+	ioutil.WriteFile(failing, []byte("#!/bin/sh\necho cleanup failed\nexit 1\n"), 0755)
+	cleanup := path.Join(td, "cleanup")
+	ioutil.WriteFile(cleanup, []byte("#!/bin/sh\necho \"$1\" >> "+
+		path.Join(td, "cleaned")+"\n"), 0755)
+
+	hanging := path.Join(td, "hanging")
+	ioutil.WriteFile(hanging, []byte("#!/bin/sh\nsleep 10\n"), 0755)
+
+	// failing scripts do not stop the following ones, and hanging ones are
+	// killed once the state script timeout is up
+	mender := newTestMender(nil, menderConfig{
+		PostCommitScripts: []string{failing, path.Join(td, "missing"), hanging,
+			cleanup},
+		StateScriptTimeoutSeconds: 1,
+	}, testMenderPieces{})
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+	start := time.Now()
+	mender.RunPostCommitScripts(update)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	data, err := ioutil.ReadFile(path.Join(td, "cleaned"))
+	assert.NoError(t, err)
+	assert.Equal(t, "release-2\n", string(data))
+}
+
+func TestMenderMaxArtifactSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8192")
+		w.Write(make([]byte, 8192))
+	}))
+	defer srv.Close()
+
+	mender := newTestMender(nil,
+		menderConfig{
+			MaxArtifactSizeBytes: 8192,
+		},
+		testMenderPieces{})
+
+	// artifact within the limit
+	in, size, err := mender.FetchUpdate(context.Background(), srv.URL)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8192, size)
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	assert.NoError(t, err)
+	assert.Len(t, data, 8192)
+
+	// declared size is over the limit
+	mender.config.MaxArtifactSizeBytes = 8191
+	_, _, err = mender.FetchUpdate(context.Background(), srv.URL)
+	assert.Equal(t, ErrDownloadTooLarge, errors.Cause(err))
+
+	// no limit
+	mender.config.MaxArtifactSizeBytes = 0
+	in, _, err = mender.FetchUpdate(context.Background(), srv.URL)
+	require.NoError(t, err)
+	in.Close()
+
+	// stream is larger than declared
+	mender.config.MaxArtifactSizeBytes = 100
+	in, _, err = mender.limitArtifactSize(
+		ioutil.NopCloser(bytes.NewReader(make([]byte, 200))), 0, 0)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(in)
+	assert.Equal(t, ErrDownloadTooLarge, errors.Cause(err))
+	assert.True(t, len(data) <= 200)
+
+	// already downloaded data counts when resuming
+	in, _, err = mender.limitArtifactSize(
+		ioutil.NopCloser(bytes.NewReader(make([]byte, 60))), 100, 60)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(in)
+	assert.Equal(t, ErrDownloadTooLarge, errors.Cause(err))
+
+	// installation of an artifact over the limit is aborted
+	upd, err := MakeRootfsImageArtifact(1, false)
+	require.NoError(t, err)
+	in, _, err = mender.limitArtifactSize(upd, 0, 0)
+	require.NoError(t, err)
+	err = mender.InstallArtifact(context.Background(), in, 0, "")
+	assert.Equal(t, ErrDownloadTooLarge, errors.Cause(err))
+}
+
 func TestMenderFetchUpdate(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -962,7 +2516,7 @@ func TestMenderFetchUpdate(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, rcount, len(rbytes))
 
-	img, sz, err := mender.FetchUpdate(srv.URL + "/api/devices/v1/download")
+	img, sz, err := mender.FetchUpdate(context.Background(), srv.URL+"/api/devices/v1/download")
 	assert.NoError(t, err)
 	assert.NotNil(t, img)
 	assert.EqualValues(t, len(rbytes), sz)
@@ -974,3 +2528,111 @@ func TestMenderFetchUpdate(t *testing.T) {
 
 	assert.True(t, bytes.Equal(rbytes, dl.Bytes()))
 }
+
+func TestMenderReportInstallSource(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-install-source-")
+	defer os.RemoveAll(td)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	assert.NoError(t, mender.Authorize())
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+
+	// local files offered by the server are never read
+	artifact := path.Join(td, "update.mender")
+	require.NoError(t, ioutil.WriteFile(artifact, []byte("artifact data"), 0600))
+
+	local := client.UpdateResponse{ID: "foo"}
+	local.Artifact.Source.URI = "file://" + artifact
+	_, _, err := mender.FetchUpdate(context.Background(), local.URI())
+	assert.Error(t, err)
+	_, _, err = mender.ResumeUpdate(context.Background(), artifact, 9)
+	assert.Error(t, err)
+
+	// the source is reported as given by the server
+	assert.NoError(t, mender.ReportUpdateStatus(local, client.StatusInstalling))
+	assert.Equal(t, client.SourceLocal, srv.Status.Source)
+	remote := client.UpdateResponse{ID: "foo"}
+	remote.Artifact.Source.URI = srv.URL + "/api/devices/v1/download"
+	assert.NoError(t, mender.ReportUpdateStatus(remote, client.StatusInstalling))
+	assert.Equal(t, client.SourceRemote, srv.Status.Source)
+}
+
+func TestMenderUpdateAcrossReboot(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-update-reboot-")
+	defer os.RemoveAll(td)
+	DeploymentLogger = NewDeploymentLogManager(td)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0\n"), 0644)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	// the store survives the reboot
+	ms := store.NewMemStore()
+	newMender := func(dev *fakeDevice) *mender {
+		m := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+			testMenderPieces{
+				MenderPieces: MenderPieces{
+					store:  ms,
+					device: dev,
+				},
+			})
+		m.artifactInfoFile = artifactInfo
+		m.deviceTypeFile = deviceType
+		require.NoError(t, m.Authorize())
+		return m
+	}
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+
+	upd, err := MakeRootfsImageArtifact(2, false)
+	require.NoError(t, err)
+	_, err = io.Copy(&srv.UpdateDownload.Data, upd)
+	require.NoError(t, err)
+
+	update := client.UpdateResponse{ID: "deployment-1"}
+	update.Artifact.ArtifactName = "mender-1.1"
+	update.Artifact.Source.URI = srv.URL + "/api/devices/v1/download"
+
+	// download, install and reboot
+	mender := newMender(&fakeDevice{consumeUpdate: true})
+	ctx := StateContext{store: ms}
+	var s State = NewUpdateFetchState(update)
+	for i := 0; i < 10 && s != doneState; i++ {
+		s, _ = s.Handle(&ctx, mender)
+	}
+	require.Equal(t, doneState, s)
+	assert.Equal(t, client.StatusRebooting, srv.Status.Status)
+
+	// the device comes up running the update
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.1\n"), 0644)
+	mender = newMender(&fakeDevice{retHasUpdate: true})
+	ctx = StateContext{store: ms}
+	s = initState
+	for i := 0; i < 10; i++ {
+		if _, ok := s.(*IdleState); ok {
+			break
+		}
+		s, _ = s.Handle(&ctx, mender)
+	}
+	assert.IsType(t, &IdleState{}, s)
+	assert.Equal(t, client.StatusSuccess, srv.Status.Status)
+	assert.Equal(t, update.ID, srv.Status.ID)
+}
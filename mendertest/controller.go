@@ -0,0 +1,274 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package mendertest provides a scriptable server and device for driving the
+// state machine of the client in tests, without a server or a device.
+package mendertest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNothingToCommit is returned by CommitUpdate if no update is
+	// enabled.
+	ErrNothingToCommit = errors.New("mendertest: there is nothing to commit")
+	// ErrNoUpdateInstalled is returned by EnableUpdatedPartition if no update
+	// is installed.
+	ErrNoUpdateInstalled = errors.New("mendertest: no update installed")
+)
+
+// CheckUpdateResult is the outcome of a single update check of the
+// Controller; nil Update means no update is offered.
+type CheckUpdateResult struct {
+	Update *client.UpdateResponse
+	Err    error
+}
+
+// FetchUpdateResult is the outcome of a single artifact download of the
+// Controller.
+type FetchUpdateResult struct {
+	Data []byte
+	Err  error
+}
+
+// StatusReport is an update status reported through the Controller.
+type StatusReport struct {
+	Update   client.UpdateResponse
+	Status   string
+	SubState string
+}
+
+// Controller implements the server and device facing methods of the client
+// controller with scripted results. The device is simulated as far as the
+// state machine can tell: the installed artifact runs once the device is
+// rebooted, and is committed or rolled back. Use NewController to create one.
+type Controller struct {
+	// name of the artifact the device is running
+	ArtifactName string
+	Authorized   bool
+	// results of the successive update checks; no update is offered once
+	// they are used up
+	CheckUpdateResults []CheckUpdateResult
+	// results of the successive downloads; the downloads fail once they
+	// are used up
+	FetchUpdateResults []FetchUpdateResult
+	// errors returned by the successive installations; the installations
+	// succeed once they are used up
+	InstallErrors []error
+	// error returned by the verification of the running update
+	VerifyErr error
+
+	// update statuses reported so far
+	Reports []StatusReport
+	// number of times the device was rebooted
+	Reboots int
+
+	// artifact installed to the inactive partition, and the one the device
+	// is updated from
+	installed        string
+	previous         string
+	upgradeAvailable bool
+	fetched          []byte
+}
+
+// NewController returns an authorized Controller of the device running the
+// given artifact.
+func NewController(artifactName string) *Controller {
+	return &Controller{
+		ArtifactName: artifactName,
+		Authorized:   true,
+	}
+}
+
+// NewUpdate returns the update of the given deployment installing the
+// artifact.
+func NewUpdate(id, artifactName string) client.UpdateResponse {
+	update := client.UpdateResponse{ID: id}
+	update.Artifact.ArtifactName = artifactName
+	update.Artifact.Source.URI = "https://mendertest/" + artifactName
+	return update
+}
+
+// OfferUpdate makes the next update check offer the update, and the next
+// download return the artifact.
+func (c *Controller) OfferUpdate(update client.UpdateResponse,
+	artifact []byte) *Controller {
+	c.CheckUpdateResults = append(c.CheckUpdateResults,
+		CheckUpdateResult{Update: &update})
+	c.FetchUpdateResults = append(c.FetchUpdateResults,
+		FetchUpdateResult{Data: artifact})
+	return c
+}
+
+// FailInstall makes the next installation fail with err.
+func (c *Controller) FailInstall(err error) *Controller {
+	c.InstallErrors = append(c.InstallErrors, err)
+	return c
+}
+
+// Statuses returns the statuses reported so far, in order.
+func (c *Controller) Statuses() []string {
+	var statuses []string
+	for _, r := range c.Reports {
+		statuses = append(statuses, r.Status)
+	}
+	return statuses
+}
+
+func (c *Controller) IsAuthorized() bool {
+	return c.Authorized
+}
+
+func (c *Controller) Authorize() error {
+	c.Authorized = true
+	return nil
+}
+
+func (c *Controller) ClearAuthToken() {
+	c.Authorized = false
+}
+
+func (c *Controller) GetCurrentArtifactName() (string, error) {
+	if c.ArtifactName == "" {
+		return "", errors.New("mendertest: no artifact name")
+	}
+	return c.ArtifactName, nil
+}
+
+// CheckUpdate returns the next of CheckUpdateResults.
+func (c *Controller) CheckUpdate(ctx context.Context) (*client.UpdateResponse, error) {
+	if len(c.CheckUpdateResults) == 0 {
+		return nil, nil
+	}
+	res := c.CheckUpdateResults[0]
+	c.CheckUpdateResults = c.CheckUpdateResults[1:]
+	return res.Update, res.Err
+}
+
+// FetchUpdate returns the next of FetchUpdateResults.
+func (c *Controller) FetchUpdate(ctx context.Context,
+	url string) (io.ReadCloser, int64, error) {
+	if len(c.FetchUpdateResults) == 0 {
+		return nil, 0, errors.Errorf("mendertest: no artifact at %s", url)
+	}
+	res := c.FetchUpdateResults[0]
+	c.FetchUpdateResults = c.FetchUpdateResults[1:]
+	if res.Err != nil {
+		return nil, 0, res.Err
+	}
+	c.fetched = res.Data
+	return ioutil.NopCloser(bytes.NewReader(res.Data)), int64(len(res.Data)), nil
+}
+
+// ResumeUpdate returns the rest of the artifact fetched last.
+func (c *Controller) ResumeUpdate(ctx context.Context, url string,
+	offset int64) (io.ReadCloser, int64, error) {
+	if offset > int64(len(c.fetched)) {
+		return nil, 0, errors.Errorf("mendertest: no artifact at %s", url)
+	}
+	data := c.fetched[offset:]
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// InstallArtifact installs the artifact to the inactive partition, unless the
+// next of InstallErrors is set.
+func (c *Controller) InstallArtifact(ctx context.Context, from io.ReadCloser,
+	size int64, name string) error {
+	if len(c.InstallErrors) != 0 {
+		err := c.InstallErrors[0]
+		c.InstallErrors = c.InstallErrors[1:]
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.InstallUpdate(from, size); err != nil {
+		return err
+	}
+	c.installed = name
+	return nil
+}
+
+func (c *Controller) ReportUpdateStatus(update client.UpdateResponse,
+	status string) error {
+	return c.ReportUpdateSubState(update, status, "")
+}
+
+func (c *Controller) ReportUpdateSubState(update client.UpdateResponse,
+	status, substate string) error {
+	c.Reports = append(c.Reports, StatusReport{
+		Update:   update,
+		Status:   status,
+		SubState: substate,
+	})
+	return nil
+}
+
+func (c *Controller) VerifyUpdate(ctx context.Context) error {
+	return c.VerifyErr
+}
+
+func (c *Controller) InstallUpdate(from io.ReadCloser, size int64) error {
+	_, err := io.Copy(ioutil.Discard, from)
+	return err
+}
+
+func (c *Controller) EnableUpdatedPartition() error {
+	if c.installed == "" {
+		return ErrNoUpdateInstalled
+	}
+	c.upgradeAvailable = true
+	return nil
+}
+
+func (c *Controller) CommitUpdate() error {
+	if !c.upgradeAvailable {
+		return ErrNothingToCommit
+	}
+	c.upgradeAvailable = false
+	c.installed = ""
+	return nil
+}
+
+// Reboot boots the device into the update enabled for the next boot, if any.
+func (c *Controller) Reboot() error {
+	c.Reboots++
+	if c.upgradeAvailable && c.installed != "" && c.installed != c.ArtifactName {
+		c.previous = c.ArtifactName
+		c.ArtifactName = c.installed
+	}
+	return nil
+}
+
+// SwapPartitions rolls back to the artifact the device was updated from.
+func (c *Controller) SwapPartitions() error {
+	if c.previous != "" {
+		c.ArtifactName = c.previous
+		c.previous = ""
+	}
+	c.upgradeAvailable = false
+	c.installed = ""
+	return nil
+}
+
+// HasUpdate returns true if an update is enabled and not committed yet.
+func (c *Controller) HasUpdate() (bool, error) {
+	return c.upgradeAvailable, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mendertest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControllerScriptedResults(t *testing.T) {
+	failed := errors.New("check failed")
+	update := NewUpdate("deployment-1", "release-2")
+	c := NewController("release-1")
+	c.CheckUpdateResults = append(c.CheckUpdateResults,
+		CheckUpdateResult{Err: failed})
+	c.OfferUpdate(update, []byte("artifact"))
+
+	_, err := c.CheckUpdate(context.Background())
+	assert.Equal(t, failed, err)
+	offered, err := c.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &update, offered)
+	// used up
+	offered, err = c.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, offered)
+
+	r, size, err := c.FetchUpdate(context.Background(), update.URI())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("artifact")), size)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "artifact", string(data))
+
+	r, _, err = c.ResumeUpdate(context.Background(), update.URI(), 3)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(r)
+	assert.Equal(t, "ifact", string(data))
+
+	_, _, err = c.FetchUpdate(context.Background(), update.URI())
+	assert.Error(t, err)
+}
+
+func TestControllerUpdateAndRollback(t *testing.T) {
+	c := NewController("release-1").FailInstall(errors.New("broken"))
+	update := NewUpdate("deployment-1", "release-2")
+	c.OfferUpdate(update, []byte("artifact"))
+	r, size, err := c.FetchUpdate(context.Background(), update.URI())
+	assert.NoError(t, err)
+
+	// nothing is installed if the installation fails
+	assert.Error(t, c.InstallArtifact(context.Background(), r, size, "release-2"))
+	assert.Equal(t, ErrNoUpdateInstalled, c.EnableUpdatedPartition())
+
+	r, size, _ = c.ResumeUpdate(context.Background(), update.URI(), 0)
+	assert.NoError(t, c.InstallArtifact(context.Background(), r, size, "release-2"))
+	assert.NoError(t, c.EnableUpdatedPartition())
+
+	// the update runs after the reboot
+	assert.NoError(t, c.Reboot())
+	assert.Equal(t, 1, c.Reboots)
+	assert.Equal(t, "release-2", c.ArtifactName)
+	ok, _ := c.HasUpdate()
+	assert.True(t, ok)
+
+	// and is gone once rolled back
+	assert.NoError(t, c.SwapPartitions())
+	assert.Equal(t, "release-1", c.ArtifactName)
+	assert.Equal(t, ErrNothingToCommit, c.CommitUpdate())
+
+	assert.NoError(t, c.ReportUpdateStatus(update, "failure"))
+	assert.Equal(t, []string{"failure"}, c.Statuses())
+}
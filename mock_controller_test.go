@@ -0,0 +1,200 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/mendertest"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockController is the Controller of the scripted server and device of
+// mendertest; the rest of the Controller is the one of stateTestController.
+type mockController struct {
+	stateTestController
+	*mendertest.Controller
+}
+
+func newMockController(c *mendertest.Controller) *mockController {
+	return &mockController{
+		stateTestController: stateTestController{state: initState},
+		Controller:          c,
+	}
+}
+
+// runMockStates handles the states starting with from, until stop returns
+// true for the state entered or the state machine finishes, e.g. as the
+// device is rebooted. Returns the last state entered.
+func runMockStates(ctx *StateContext, c *mockController, from State,
+	stop func(State) bool) State {
+	s := from
+	for {
+		if _, ok := s.(*FinalState); ok || stop(s) {
+			return s
+		}
+		s, _ = c.TransitionState(s, ctx)
+	}
+}
+
+func (m *mockController) IsAuthorized() bool {
+	return m.Controller.IsAuthorized()
+}
+
+func (m *mockController) Authorize() menderError {
+	if err := m.Controller.Authorize(); err != nil {
+		return NewTransientError(err)
+	}
+	return nil
+}
+
+func (m *mockController) ClearAuthToken() {
+	m.Controller.ClearAuthToken()
+}
+
+func (m *mockController) GetCurrentArtifactName() (string, error) {
+	return m.Controller.GetCurrentArtifactName()
+}
+
+func (m *mockController) HasUpgrade() (bool, *client.UpdateResponse, menderError) {
+	ok, _ := m.Controller.HasUpdate()
+	return ok, nil, nil
+}
+
+func (m *mockController) VerifyUpdate(ctx context.Context) error {
+	return m.Controller.VerifyUpdate(ctx)
+}
+
+func (m *mockController) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
+	update, err := m.Controller.CheckUpdate(ctx)
+	if err != nil {
+		return update, NewTransientError(err)
+	}
+	return update, nil
+}
+
+func (m *mockController) FetchUpdate(ctx context.Context,
+	url string) (io.ReadCloser, int64, error) {
+	return m.Controller.FetchUpdate(ctx, url)
+}
+
+func (m *mockController) ResumeUpdate(ctx context.Context, url string,
+	offset int64) (io.ReadCloser, int64, error) {
+	return m.Controller.ResumeUpdate(ctx, url, offset)
+}
+
+func (m *mockController) InstallArtifact(ctx context.Context, from io.ReadCloser,
+	size int64, name string) error {
+	return m.Controller.InstallArtifact(ctx, from, size, name)
+}
+
+func (m *mockController) ReportUpdateStatus(update client.UpdateResponse,
+	status string) menderError {
+	return m.ReportUpdateSubState(update, status, "")
+}
+
+func (m *mockController) ReportUpdateSubState(update client.UpdateResponse,
+	status, substate string) menderError {
+	if err := m.Controller.ReportUpdateSubState(update, status, substate); err != nil {
+		return NewTransientError(err)
+	}
+	return nil
+}
+
+func (m *mockController) EnableUpdatedPartition() error {
+	return m.Controller.EnableUpdatedPartition()
+}
+
+func (m *mockController) Reboot() error {
+	return m.Controller.Reboot()
+}
+
+func (m *mockController) GetBootState() (*bootState, error) {
+	ok, err := m.Controller.HasUpdate()
+	return &bootState{UpgradeAvailable: ok}, err
+}
+
+func (m *mockController) GetDeviceStatus() deviceStatus {
+	boot, _ := m.GetBootState()
+	return deviceStatus{
+		Authorized: m.Controller.IsAuthorized(),
+		Boot:       boot,
+	}
+}
+
+func (m *mockController) TransitionState(next State, ctx *StateContext) (State, bool) {
+	s, cancelled := next.Handle(ctx, m)
+	m.state = s
+	return s, cancelled
+}
+
+func TestMockControllerUpdateCycle(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	idle := func(s State) bool {
+		switch s.(type) {
+		case *IdleState, *CheckWaitState:
+			return true
+		}
+		return false
+	}
+
+	ms := store.NewMemStore()
+	update := mendertest.NewUpdate("deployment-1", "release-2")
+	device := mendertest.NewController("release-1").
+		OfferUpdate(update, []byte("artifact"))
+	c := newMockController(device)
+
+	// the update is installed, and the device rebooted into it
+	s := runMockStates(&StateContext{store: ms}, c, updateCheckState, idle)
+	assert.Equal(t, doneState, s)
+	assert.Equal(t, 1, device.Reboots)
+	assert.Equal(t, "release-2", device.ArtifactName)
+
+	// once the client is started again, the update is committed
+	s = runMockStates(&StateContext{store: ms}, c, initState, idle)
+	assert.True(t, idle(s))
+	reported := device.Statuses()
+	assert.Equal(t, client.StatusDownloading, reported[0])
+	assert.Equal(t, []string{client.StatusInstalling, client.StatusRebooting,
+		client.StatusSuccess}, reported[len(reported)-3:])
+	assert.Equal(t, update, device.Reports[len(device.Reports)-1].Update)
+	ok, _ := device.HasUpdate()
+	assert.False(t, ok)
+
+	// failed installation is reported; the device keeps running the
+	// artifact it was updated to
+	device.Reports = nil
+	device.OfferUpdate(mendertest.NewUpdate("deployment-2", "release-3"),
+		[]byte("artifact")).FailInstall(installer.ErrDeviceTypeMismatch)
+	s = runMockStates(&StateContext{store: ms}, c, updateCheckState, idle)
+	assert.True(t, idle(s))
+	assert.Equal(t, client.StatusFailure,
+		device.Reports[len(device.Reports)-1].Status)
+	assert.Equal(t, "release-2", device.ArtifactName)
+	assert.Equal(t, 1, device.Reboots)
+
+	// no more updates
+	s = runMockStates(&StateContext{store: ms}, c, updateCheckState, idle)
+	assert.True(t, idle(s))
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"fmt"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+// Exit codes of a single run of the client (-once), so that provisioning
+// scripts and CI jobs can tell the outcome of the deployment apart.
+const (
+	// no update is available, or it may not be installed right now
+	exitNoUpdate = 0
+	// the client failed for another reason, for instance a broken
+	// configuration
+	exitError = 1
+	// 2 is used by -commit if there is no update to commit
+
+	// an update was installed; it is either committed, or activated with
+	// the next reboot if the reboot is left to the user
+	exitUpdateApplied = 3
+	// an update was attempted but failed and was rolled back if possible
+	exitUpdateFailed = 4
+	// the server refused to authorize the device
+	exitAuthFailed = 5
+	// the server could not be reached
+	exitServerUnreachable = 6
+)
+
+var exitCodeNames = map[int]string{
+	exitNoUpdate:          "no update",
+	exitError:             "error",
+	exitUpdateApplied:     "update applied",
+	exitUpdateFailed:      "update failed",
+	exitAuthFailed:        "authorization failed",
+	exitServerUnreachable: "server unreachable",
+}
+
+// exitCodeError ends a single run of the client with the given exit code.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("single run finished: %s (exit code %d)",
+		exitCodeNames[e.code], e.code)
+}
+
+// exitWithCode returns the error ending the run with the given code; nil if
+// the code tells that nothing happened.
+func exitWithCode(code int) error {
+	if code == exitNoUpdate {
+		return nil
+	}
+	return &exitCodeError{code: code}
+}
+
+// oneShotResult returns the exit code of a single run once the handled state
+// and the one it led to tell the outcome; false if the run goes on.
+// authorizeFailures is the number of failed authorization attempts before the
+// state was handled.
+func (d *menderDaemon) oneShotResult(from, to State, authorizeFailures int) (int, bool) {
+	switch s := from.(type) {
+	case *AuthorizeState:
+		if _, ok := to.(*AuthorizeWaitState); !ok {
+			break
+		}
+		// only attempts refused by the server are counted
+		if d.sctx.authorizeFailures > authorizeFailures {
+			return exitAuthFailed, true
+		}
+		return exitServerUnreachable, true
+
+	case *UpdateCheckState:
+		if es, ok := to.(*ErrorState); ok {
+			if client.ServerUnreachable(es.cause) {
+				return exitServerUnreachable, true
+			}
+			return exitError, true
+		}
+		if _, ok := to.(*CheckWaitState); ok {
+			return exitNoUpdate, true
+		}
+
+	case *InventoryUpdateState:
+		// nothing left to do if updates are disabled
+		if !d.mender.UpdatesEnabled() {
+			return exitNoUpdate, true
+		}
+
+	case *UpdateStatusReportState:
+		// the outcome is known once reporting is done, which may take
+		// several attempts or roll back an update failing to be reported
+		d.oneShotStatus = s.status
+
+	case *UpdateInstallState:
+		// the user reboots the device to activate the update
+		if to.Id() == MenderStateDone {
+			return exitUpdateApplied, true
+		}
+	}
+
+	if _, ok := to.(*IdleState); ok && d.oneShotStatus != "" {
+		switch d.oneShotStatus {
+		case client.StatusSuccess:
+			return exitUpdateApplied, true
+		case client.StatusAlreadyInstalled:
+			return exitNoUpdate, true
+		default:
+			return exitUpdateFailed, true
+		}
+	}
+	return 0, false
+}
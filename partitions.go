@@ -18,6 +18,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/mendersoftware/log"
@@ -36,11 +37,16 @@ type partitions struct {
 	BootEnvReadWriter
 	rootfsPartA string
 	rootfsPartB string
-	active      string
-	inactive    string
+	// detected partitions are cached; guarded by lock, as the boot state is
+	// also read from the control socket
+	lock     sync.Mutex
+	active   string
+	inactive string
 }
 
 func (p *partitions) GetInactive() (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if p.inactive != "" {
 		log.Debug("Inactive partition: ", p.inactive)
 		return p.inactive, nil
@@ -49,6 +55,12 @@ func (p *partitions) GetInactive() (string, error) {
 }
 
 func (p *partitions) GetActive() (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.getActive()
+}
+
+func (p *partitions) getActive() (string, error) {
 	if p.active != "" {
 		log.Debug("Active partition: ", p.active)
 		return p.active, nil
@@ -64,7 +76,7 @@ func (p *partitions) getAndCacheInactivePartition() (string, error) {
 		return "", ErrorPartitionNumberSame
 	}
 
-	active, err := p.GetActive()
+	active, err := p.getActive()
 	if err != nil {
 		return "", err
 	}
@@ -149,9 +161,12 @@ func getRootFromMountedDevices(sc StatCommander,
 
 func (p *partitions) getAndCacheActivePartition(rootChecker func(StatCommander, string, *syscall.Stat_t) bool,
 	getMountedDevices func(string) ([]string, error)) (string, error) {
-	mountData, err := p.Command("mount").Output()
+	mountCmd := p.Command("mount")
+	stderr := &commandOutput{}
+	mountCmd.Stderr = stderr
+	mountData, err := mountCmd.Output()
 	if err != nil {
-		return "", err
+		return "", commandError(err, "mount", stderr)
 	}
 
 	mountCandidate := getRootCandidateFromMount(mountData)
@@ -0,0 +1,94 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// how much of the artifact is downloaded ahead of the installation
+	readAheadBufferSize = 4 * 1024 * 1024
+	// size of the chunks the artifact is read in
+	readAheadChunkSize = 64 * 1024
+)
+
+// readAheadReader reads the source in a separate goroutine, up to the size of
+// the buffer ahead of the reader, so that a slow reader does not hold up the
+// source, e.g. the download of the artifact while it is written to the
+// partition. The error of the source is returned once all the data read before
+// it is consumed.
+type readAheadReader struct {
+	src    io.ReadCloser
+	chunks chan []byte
+	// set before chunks is closed
+	err   error
+	cur   []byte
+	done  chan struct{}
+	close sync.Once
+}
+
+func newReadAheadReader(src io.ReadCloser, bufferSize int) io.ReadCloser {
+	slots := bufferSize / readAheadChunkSize
+	if slots < 1 {
+		slots = 1
+	}
+	r := &readAheadReader{
+		src:    src,
+		chunks: make(chan []byte, slots),
+		done:   make(chan struct{}),
+	}
+	go r.fill()
+	return r
+}
+
+func (r *readAheadReader) fill() {
+	defer close(r.chunks)
+	for {
+		buf := make([]byte, readAheadChunkSize)
+		n, err := r.src.Read(buf)
+		if n > 0 {
+			select {
+			case r.chunks <- buf[:n]:
+			case <-r.done:
+				r.err = io.ErrClosedPipe
+				return
+			}
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		chunk, ok := <-r.chunks
+		if !ok {
+			return 0, r.err
+		}
+		r.cur = chunk
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops reading ahead and closes the source.
+func (r *readAheadReader) Close() error {
+	r.close.Do(func() { close(r.done) })
+	return r.src.Close()
+}
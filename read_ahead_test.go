@@ -0,0 +1,140 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingReader struct {
+	io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.Reader.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestReadAheadReader(t *testing.T) {
+	data := make([]byte, 3*readAheadChunkSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	r := newReadAheadReader(ioutil.NopCloser(bytes.NewReader(data)), 2*readAheadChunkSize)
+	read, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.NoError(t, r.Close())
+
+	// the error of the source follows the data read before it
+	r = newReadAheadReader(ioutil.NopCloser(&failingReader{
+		Reader: bytes.NewReader(data),
+		err:    errors.New("connection reset"),
+	}), readAheadBufferSize)
+	read, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, "connection reset")
+	assert.Equal(t, data, read)
+
+	// closed before everything is read
+	r = newReadAheadReader(ioutil.NopCloser(bytes.NewReader(data)), readAheadChunkSize)
+	assert.NoError(t, r.Close())
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+}
+
+// recordingDevice keeps the data of the last installed update.
+type recordingDevice struct {
+	fakeDevice
+	installed *bytes.Buffer
+}
+
+func (d recordingDevice) InstallUpdate(r io.ReadCloser, size int64) error {
+	d.installed.Reset()
+	_, err := io.Copy(d.installed, r)
+	return err
+}
+
+func TestPipelinedInstall(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-pipelined-install-")
+	defer os.RemoveAll(td)
+	DeploymentLogger = NewDeploymentLogManager(td)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	stagingDir := path.Join(td, "staging")
+
+	// installs the update downloaded with the configuration and returns the
+	// data written to the partition
+	install := func(config menderConfig) []byte {
+		srv := cltest.NewClientTestServer()
+		defer srv.Close()
+		upd, err := MakeRootfsImageArtifact(2, false)
+		require.NoError(t, err)
+		_, err = io.Copy(&srv.UpdateDownload.Data, upd)
+		require.NoError(t, err)
+
+		ms := store.NewMemStore()
+		ms.WriteAll(authTokenName, []byte("tokendata"))
+		dev := recordingDevice{installed: &bytes.Buffer{}}
+		config.ServerURL = srv.URL
+		mender := newTestMender(nil, config, testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:  ms,
+				device: dev,
+			},
+		})
+		mender.deviceTypeFile = deviceType
+		require.NoError(t, mender.Authorize())
+
+		update := client.UpdateResponse{ID: "foo"}
+		update.Artifact.ArtifactName = "mender-1.1"
+		update.Artifact.Source.URI = srv.URL + "/api/devices/v1/download"
+
+		ctx := &StateContext{store: ms}
+		var s State = NewUpdateFetchState(update)
+		for i := 0; i < 5; i++ {
+			if _, ok := s.(*UpdateInstallState); ok {
+				break
+			}
+			s, _ = s.Handle(ctx, mender)
+		}
+		require.IsType(t, &UpdateInstallState{}, s)
+		return dev.installed.Bytes()
+	}
+
+	streamed := install(menderConfig{})
+	pipelined := install(menderConfig{PipelinedInstall: true})
+	staged := install(menderConfig{ArtifactStagingDir: stagingDir})
+
+	assert.Equal(t, "test update", string(streamed))
+	assert.Equal(t, streamed, pipelined)
+	assert.Equal(t, streamed, staged)
+}
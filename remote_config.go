@@ -0,0 +1,143 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+)
+
+const remoteConfigName = "remote-config"
+
+// remoteConfigFields are the fields of the configuration the server may
+// change, see client.RemoteConfig; any of them can be kept as configured
+// locally with LocalOverrides.
+var remoteConfigFields = []string{
+	"UpdatePollIntervalSeconds",
+	"InventoryPollIntervalSeconds",
+	"RetryPollIntervalSeconds",
+	"StartupDelayMaxSeconds",
+	"LogLevel",
+}
+
+// logLevelFromCommandLine is true if the log level is given on the command
+// line, which the server can not override.
+var logLevelFromCommandLine bool
+
+func isRemoteConfigField(name string) bool {
+	for _, f := range remoteConfigFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c menderConfig) isLocalOverride(name string) bool {
+	for _, f := range c.LocalOverrides {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withRemoteConfig returns the configuration with the fields delivered by the
+// server applied, except for the ones kept as configured locally. The poll
+// intervals are raised to the configured minimum.
+func (c menderConfig) withRemoteConfig(rc *client.RemoteConfig) menderConfig {
+	if rc == nil {
+		return c
+	}
+	minSeconds := int(c.GetPollIntervalMin() / time.Second)
+	for _, f := range []struct {
+		name  string
+		field *int
+		value int
+		poll  bool
+	}{
+		{"UpdatePollIntervalSeconds", &c.UpdatePollIntervalSeconds, rc.UpdatePollIntervalSeconds, true},
+		{"InventoryPollIntervalSeconds", &c.InventoryPollIntervalSeconds, rc.InventoryPollIntervalSeconds, true},
+		{"RetryPollIntervalSeconds", &c.RetryPollIntervalSeconds, rc.RetryPollIntervalSeconds, false},
+		{"StartupDelayMaxSeconds", &c.StartupDelayMaxSeconds, rc.StartupDelayMaxSeconds, false},
+	} {
+		if f.value <= 0 || c.isLocalOverride(f.name) {
+			continue
+		}
+		if f.poll && f.value < minSeconds {
+			log.Warnf("config: %s of %d delivered by the server is below the "+
+				"minimum of %d; using the minimum", f.name, f.value, minSeconds)
+			f.value = minSeconds
+		}
+		*f.field = f.value
+	}
+	return c
+}
+
+func storeRemoteConfig(s store.Store, rc client.RemoteConfig) {
+	storeJSON(s, remoteConfigName, "the configuration delivered by the server", rc)
+}
+
+func loadRemoteConfig(s store.Store) (*client.RemoteConfig, bool) {
+	var rc client.RemoteConfig
+	if !loadJSON(s, remoteConfigName, "the configuration delivered by the server", &rc) {
+		return nil, false
+	}
+	return &rc, true
+}
+
+func clearRemoteConfig(s store.Store) {
+	clearJSON(s, remoteConfigName, "the configuration delivered by the server")
+}
+
+// applyRemoteConfig merges the configuration delivered by the server into the
+// local one; nil restores the local configuration.
+func (m *mender) applyRemoteConfig(rc *client.RemoteConfig) {
+	m.remoteConfig = rc
+	m.setConfig(m.localConfig.withRemoteConfig(rc))
+	m.applyLogLevel()
+}
+
+// refreshRemoteConfig fetches the configuration delivered by the server, if
+// enabled with ServerConfig, and applies it from the next poll on. It is kept
+// in the store so that it is applied again after a restart; if it can not be
+// fetched, the configuration in use is kept.
+func (m *mender) refreshRemoteConfig(ctx context.Context) {
+	if !m.config.ServerConfig {
+		return
+	}
+	rc, err := client.NewConfig().Fetch(ctx, m.api.Request(m.getAuthToken()),
+		m.config.ServerURL)
+	if err != nil {
+		log.Warnf("failed to fetch the configuration from the server: %v", err)
+		return
+	}
+	if reflect.DeepEqual(rc, m.remoteConfig) {
+		return
+	}
+
+	if rc == nil {
+		log.Info("config: configuration delivered by the server removed")
+		clearRemoteConfig(m.store)
+	} else {
+		log.Infof("config: applying configuration delivered by the server: %+v", *rc)
+		storeRemoteConfig(m.store, *rc)
+	}
+	m.applyRemoteConfig(rc)
+}
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,9 +28,30 @@ import (
 	"github.com/pkg/errors"
 )
 
-// This will be run manually from command line ONLY
+// stdinImageFile is the -rootfs argument selecting an artifact streamed on the
+// standard input, e.g. `curl ... | mender -rootfs -`.
+const stdinImageFile = "-"
+
+// rootfsStdin is where artifacts given as stdinImageFile are read from.
+var rootfsStdin io.Reader = os.Stdin
+
+// artifactSource returns where the artifact at location is installed from, or
+// an empty string if the location is not known.
+func artifactSource(location string) string {
+	if location == "" {
+		return ""
+	}
+	if strings.HasPrefix(location, "http:") ||
+		strings.HasPrefix(location, "https:") {
+		return client.SourceRemote
+	}
+	return client.SourceLocal
+}
+
+// This will be run manually from command line ONLY. The artifact named as the
+// installed one is not installed again, unless reinstall was requested.
 func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
-	vKey []byte) error {
+	installed string, vKeys [][]byte) error {
 	var image io.ReadCloser
 	var imageSize int64
 	var err error
@@ -42,8 +64,9 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
 	log.Debug("Starting device update.")
 
 	updateLocation := *args.imageFile
-	if strings.HasPrefix(updateLocation, "http:") ||
-		strings.HasPrefix(updateLocation, "https:") {
+	// where the artifact is installed from
+	source := artifactSource(updateLocation)
+	if source == client.SourceRemote {
 		log.Infof("Performing remote update from: [%s].", updateLocation)
 
 		var ac *client.ApiClient
@@ -56,8 +79,14 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
 
 		log.Debug("Client initialized. Start downloading image.")
 
-		image, imageSize, err = upclient.FetchUpdate(ac, updateLocation, 0)
+		image, imageSize, err = upclient.FetchUpdate(context.Background(), ac, updateLocation,
+			client.DownloadRetryPolicy{})
 		log.Debugf("Image downloaded: %d [%v] [%v]", imageSize, image, err)
+	} else if updateLocation == stdinImageFile {
+		// the size of a piped artifact is not known up front; it is streamed
+		// to EOF and verified by the installer as any other artifact
+		log.Info("Start updating from artifact read from standard input")
+		image = ioutil.NopCloser(rootfsStdin)
 	} else {
 		// perform update from local file
 		log.Infof("Start updating from local image file: [%s]", updateLocation)
@@ -71,19 +100,51 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
 	}
 	defer image.Close()
 
-	fmt.Fprintf(os.Stdout, "Installing update from the artifact of size %d\n", imageSize)
+	if imageSize > 0 {
+		fmt.Fprintf(os.Stdout, "Installing update from the %s artifact of size %d\n",
+			source, imageSize)
+	} else {
+		fmt.Fprintf(os.Stdout, "Installing update from the %s artifact of unknown size\n",
+			source)
+	}
 	p := &utils.ProgressWriter{
 		Out: os.Stdout,
 		N:   imageSize,
 	}
 	tr := io.TeeReader(image, p)
 
-	err = installer.Install(ioutil.NopCloser(tr), dt, vKey, "", device, *args.runStateScripts)
-	if err != nil {
+	dev := &artifactInstaller{
+		UInstaller:     device,
+		rebootRequired: true,
+	}
+	if args.reinstall == nil || !*args.reinstall {
+		dev.installed = installed
+	}
+	err = installer.Install(ioutil.NopCloser(tr), dt, vKeys, "", dev, *args.runStateScripts)
+	if errors.Cause(err) == installer.ErrArtifactAlreadyInstalled {
+		fmt.Fprintf(os.Stdout, "\nArtifact %s is already installed; "+
+			"use -reinstall to install it again\n", installed)
+		return nil
+	} else if errors.Cause(err) == installer.ErrStateScriptsNotAccepted {
+		log.Error("Will not install artifact with state-scripts when " +
+			"installing from cmd-line. Use -f to override")
+		return err
+	} else if err != nil {
 		log.Errorf("Installation failed: %s", err.Error())
 		return err
 	}
 
+	// updates of custom types are applied by their handlers
+	for _, h := range dev.customUpdates {
+		if err := h.Activate(); err != nil {
+			log.Errorf("Activating update failed: %s", err.Error())
+			return err
+		}
+	}
+	if len(dev.customUpdates) != 0 {
+		return nil
+	}
+
 	err = device.EnableUpdatedPartition()
 	if err != nil {
 		log.Errorf("Enabling updated partition failed: %s", err.Error())
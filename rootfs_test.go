@@ -25,7 +25,7 @@ import (
 )
 
 func Test_doManualUpdate_noParams_fail(t *testing.T) {
-	if err := doRootfs(new(device), runOptionsType{}, "", nil); err == nil {
+	if err := doRootfs(new(device), runOptionsType{}, "", "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -36,7 +36,7 @@ func Test_doManualUpdate_invalidHttpsClientConfig_updateFails(t *testing.T) {
 	runOptions.imageFile = &iamgeFileName
 	runOptions.ServerCert = "non-existing"
 
-	if err := doRootfs(new(device), runOptions, "", nil); err == nil {
+	if err := doRootfs(new(device), runOptions, "", "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -47,7 +47,7 @@ func Test_doManualUpdate_nonExistingFile_fail(t *testing.T) {
 	imageFileName := "non-existing"
 	fakeRunOptions.imageFile = &imageFileName
 
-	if err := doRootfs(&fakeDevice, fakeRunOptions, "", nil); err == nil {
+	if err := doRootfs(&fakeDevice, fakeRunOptions, "", "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -58,7 +58,7 @@ func Test_doManualUpdate_networkUpdateNoClient_fail(t *testing.T) {
 	imageFileName := "http://non-existing"
 	fakeRunOptions.imageFile = &imageFileName
 
-	if err := doRootfs(&fakeDevice, fakeRunOptions, "", nil); err == nil {
+	if err := doRootfs(&fakeDevice, fakeRunOptions, "", "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -76,7 +76,7 @@ func Test_doManualUpdate_networkClientExistsNoServer_fail(t *testing.T) {
 			NoVerify:   false,
 		}
 
-	if err := doRootfs(&fakeDevice, fakeRunOptions, "", nil); err == nil {
+	if err := doRootfs(&fakeDevice, fakeRunOptions, "", "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -97,7 +97,7 @@ func Test_doManualUpdate_installFailing_updateFails(t *testing.T) {
 
 	defer os.Remove("imageFile")
 
-	if err := doRootfs(fd, fakeRunOptions, "", nil); err == nil {
+	if err := doRootfs(fd, fakeRunOptions, "", "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -126,6 +126,74 @@ func Test_doManualUpdate_existingFile_updateSuccess(t *testing.T) {
 	forceRunScriptsFlag := false
 	fakeRunOptions.runStateScripts = &forceRunScriptsFlag
 
-	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", nil)
+	out, err := ioutil.TempFile("", "mendertest")
 	assert.NoError(t, err)
+	defer os.Remove(out.Name())
+	stdout := os.Stdout
+	os.Stdout = out
+	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", "", nil)
+	os.Stdout = stdout
+	assert.NoError(t, err)
+
+	// artifact is installed from local media
+	out.Seek(0, 0)
+	data, _ := ioutil.ReadAll(out)
+	out.Close()
+	assert.Contains(t, string(data), "Installing update from the local artifact of size")
+}
+
+func Test_doManualUpdate_stdin_updateSuccess(t *testing.T) {
+	artifact, err := MakeRootfsImageArtifact(1, false)
+	assert.NoError(t, err)
+
+	// hide everything but Read so that the size of the stream is unknown
+	stdin := rootfsStdin
+	defer func() { rootfsStdin = stdin }()
+	rootfsStdin = struct{ io.Reader }{artifact}
+
+	dev := fakeDevice{consumeUpdate: true}
+	fakeRunOptions := runOptionsType{}
+	imageFileName := stdinImageFile
+	fakeRunOptions.imageFile = &imageFileName
+	forceRunScriptsFlag := false
+	fakeRunOptions.runStateScripts = &forceRunScriptsFlag
+
+	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", "", nil)
+	assert.NoError(t, err)
+}
+
+func Test_doManualUpdate_alreadyInstalled(t *testing.T) {
+	artifact, err := MakeRootfsImageArtifact(1, false)
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "update")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, artifact)
+	assert.NoError(t, err)
+	f.Close()
+
+	// device fails if asked to install the update
+	dev := fakeDevice{retInstallUpdate: errors.New("installed")}
+	fakeRunOptions := runOptionsType{}
+	imageFileName := f.Name()
+	fakeRunOptions.imageFile = &imageFileName
+	forceRunScriptsFlag := false
+	fakeRunOptions.runStateScripts = &forceRunScriptsFlag
+
+	// same artifact is installed; update is skipped
+	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", "mender-1.1", nil)
+	assert.NoError(t, err)
+
+	// different artifact is installed
+	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", "mender-1.0", nil)
+	assert.Error(t, err)
+
+	// reinstall forced
+	reinstall := true
+	fakeRunOptions.reinstall = &reinstall
+	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", "mender-1.1", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "installed")
 }
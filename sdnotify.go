@@ -0,0 +1,77 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+	sdNotifyStatus   = "STATUS="
+)
+
+// systemdNotifier sends service status notifications to systemd using the
+// sd_notify(3) protocol. If the notification socket is not present (the
+// service is not run by systemd or Type=notify is not set) all the
+// notifications are silently dropped.
+type systemdNotifier struct {
+	socket string
+	// interval in which systemd expects watchdog keep-alive messages;
+	// zero if the watchdog is not enabled for the service
+	watchdog time.Duration
+}
+
+func NewSystemdNotifier() *systemdNotifier {
+	n := &systemdNotifier{
+		socket: os.Getenv("NOTIFY_SOCKET"),
+	}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+func (n *systemdNotifier) Notify(state string) error {
+	if n == nil || n.socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to systemd notify socket")
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrapf(err, "failed to send systemd notification")
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often keep-alive messages should be sent; half
+// of the interval systemd is configured with, as recommended by sd_watchdog_enabled(3).
+func (n *systemdNotifier) WatchdogInterval() time.Duration {
+	if n == nil {
+		return 0
+	}
+	return n.watchdog / 2
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeNotifySocket(t *testing.T, dir string) *net.UnixConn {
+	addr := &net.UnixAddr{Name: path.Join(dir, "notify"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	require.NoError(t, err)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSystemdNotifierNoSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+
+	n := NewSystemdNotifier()
+	assert.NoError(t, n.Notify(sdNotifyReady))
+	assert.Equal(t, time.Duration(0), n.WatchdogInterval())
+
+	// notifier is disabled in the configuration
+	n = nil
+	assert.NoError(t, n.Notify(sdNotifyReady))
+	assert.Equal(t, time.Duration(0), n.WatchdogInterval())
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-sdnotify-")
+	defer os.RemoveAll(td)
+
+	conn := fakeNotifySocket(t, td)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path.Join(td, "notify"))
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	n := NewSystemdNotifier()
+	assert.Equal(t, time.Second, n.WatchdogInterval())
+	assert.NoError(t, n.Notify(sdNotifyReady))
+	assert.Equal(t, sdNotifyReady, readNotification(t, conn))
+
+	// no one is listening
+	n.socket = path.Join(td, "bogus")
+	assert.Error(t, n.Notify(sdNotifyReady))
+}
+
+func TestDaemonSystemdNotify(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-sdnotify-")
+	defer os.RemoveAll(td)
+
+	conn := fakeNotifySocket(t, td)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path.Join(td, "notify"))
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	store := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: store,
+			},
+		})
+	mender.state = &fakePreDoneState{
+		baseState{
+			id: MenderStateInit,
+		},
+	}
+
+	d := NewDaemon(mender, store)
+	d.notifier = NewSystemdNotifier()
+
+	assert.NoError(t, d.Run())
+	assert.Equal(t, sdNotifyReady, readNotification(t, conn))
+	assert.Equal(t, sdNotifyWatchdog+"\n"+sdNotifyStatus+"init",
+		readNotification(t, conn))
+}
+
+func TestDaemonIsStuck(t *testing.T) {
+	d := NewDaemon(nil, nil)
+	now := time.Now()
+
+	// no state handled yet
+	d.stuckStateTimeout = time.Minute
+	assert.False(t, d.isStuck(now))
+
+	d.setCurrentState(updateCheckState)
+	assert.False(t, d.isStuck(now))
+	assert.True(t, d.isStuck(now.Add(2*time.Minute)))
+
+	// waiting for the next poll is not being stuck
+	d.setCurrentState(checkWaitState)
+	assert.False(t, d.isStuck(now.Add(2*time.Minute)))
+
+	// detection disabled
+	d.stuckStateTimeout = 0
+	d.setCurrentState(updateCheckState)
+	assert.False(t, d.isStuck(now.Add(2*time.Minute)))
+}
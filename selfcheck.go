@@ -0,0 +1,155 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// name of key written and removed again while checking the store
+const selfCheckProbeName = "self-check-probe"
+
+// selfCheckResult is the outcome of one of the checks run by -self-check; a
+// check that does not apply to the device is skipped.
+type selfCheckResult struct {
+	name    string
+	err     error
+	skipped string
+}
+
+// runSelfCheck verifies that the client can use the data it keeps on the
+// device: the store is readable and writable, the device key loads and the
+// authorization token, if any, is well formed. The key is not checked if ks is
+// nil, e.g. if it is not kept by the client.
+func runSelfCheck(s store.Store, ks *store.Keystore) []selfCheckResult {
+	results := []selfCheckResult{
+		{name: "store", err: checkStore(s)},
+	}
+
+	if ks == nil {
+		results = append(results, selfCheckResult{
+			name:    "device key",
+			skipped: "not kept by the client",
+		})
+	} else {
+		results = append(results, selfCheckResult{
+			name: "device key",
+			err:  checkDeviceKey(ks),
+		})
+	}
+
+	token, err := s.ReadAll(authTokenName)
+	switch {
+	case os.IsNotExist(err):
+		results = append(results, selfCheckResult{
+			name:    "auth token",
+			skipped: "device is not authorized",
+		})
+	case err != nil:
+		results = append(results, selfCheckResult{
+			name: "auth token",
+			err:  errors.Wrap(err, "failed to read auth token"),
+		})
+	default:
+		results = append(results, selfCheckResult{
+			name: "auth token",
+			err:  checkAuthToken(token),
+		})
+	}
+	return results
+}
+
+func checkStore(s store.Store) error {
+	if _, err := s.ReadAll(selfCheckProbeName); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "store is not readable")
+	}
+
+	probe := []byte("mender self-check")
+	if err := s.WriteAll(selfCheckProbeName, probe); err != nil {
+		return errors.Wrap(err, "store is not writable")
+	}
+	defer s.Remove(selfCheckProbeName)
+
+	data, err := s.ReadAll(selfCheckProbeName)
+	if err != nil {
+		return errors.Wrap(err, "store is not readable")
+	}
+	if !bytes.Equal(data, probe) {
+		return errors.New("data read from the store differs from the data written")
+	}
+	return nil
+}
+
+func checkDeviceKey(ks *store.Keystore) error {
+	if err := ks.Load(); err != nil {
+		if store.IsNoKeys(err) {
+			return errors.New("device key is missing")
+		}
+		return errors.Wrap(err, "failed to load device key")
+	}
+	if err := ks.Private().Validate(); err != nil {
+		return errors.Wrap(err, "device key is invalid")
+	}
+	return nil
+}
+
+// checkAuthToken verifies the token is a JSON Web Token; its signature can only
+// be verified by the server.
+func checkAuthToken(token []byte) error {
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return errors.New("auth token is not a JSON Web Token")
+	}
+	for _, part := range parts[:2] {
+		data, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode auth token")
+		}
+		var claims map[string]interface{}
+		if err := json.Unmarshal(data, &claims); err != nil {
+			return errors.Wrap(err, "failed to parse auth token")
+		}
+	}
+	return nil
+}
+
+// printSelfCheck prints the results, one check per line, and returns an error
+// if any of the checks failed.
+func printSelfCheck(out io.Writer, results []selfCheckResult) error {
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Fprintf(out, "%s: FAILED: %v\n", r.name, r.err)
+		case r.skipped != "":
+			fmt.Fprintf(out, "%s: skipped (%s)\n", r.name, r.skipped)
+		default:
+			fmt.Fprintf(out, "%s: OK\n", r.name)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d self-checks failed", failed, len(results))
+	}
+	return nil
+}
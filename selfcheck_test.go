@@ -0,0 +1,84 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestJWT(claims string) []byte {
+	enc := base64.RawURLEncoding
+	return []byte(enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + "." +
+		enc.EncodeToString([]byte("signature")))
+}
+
+func TestSelfCheck(t *testing.T) {
+	ms := store.NewMemStore()
+	ks := store.NewKeystore(store.NewMemStore(), defaultKeyFile)
+	require.NoError(t, ks.Generate())
+	require.NoError(t, ks.Save())
+
+	// not authorized yet
+	out := &bytes.Buffer{}
+	assert.NoError(t, printSelfCheck(out, runSelfCheck(ms, ks)))
+	assert.Equal(t, "store: OK\n"+
+		"device key: OK\n"+
+		"auth token: skipped (device is not authorized)\n", out.String())
+
+	ms.WriteAll(authTokenName, makeTestJWT(`{"sub":"device"}`))
+	out.Reset()
+	assert.NoError(t, printSelfCheck(out, runSelfCheck(ms, nil)))
+	assert.Equal(t, "store: OK\n"+
+		"device key: skipped (not kept by the client)\n"+
+		"auth token: OK\n", out.String())
+	// the probe is removed
+	_, err := ms.ReadAll(selfCheckProbeName)
+	assert.Error(t, err)
+
+	// read only store
+	ms.ReadOnly(true)
+	results := runSelfCheck(ms, ks)
+	assert.Contains(t, results[0].err.Error(), "not writable")
+	assert.NoError(t, results[2].err)
+	ms.ReadOnly(false)
+
+	// disabled store
+	ms.Disable(true)
+	out.Reset()
+	assert.Error(t, printSelfCheck(out, runSelfCheck(ms, ks)))
+	assert.Contains(t, out.String(), "store: FAILED: store is not readable")
+	assert.Contains(t, out.String(), "device key: OK")
+	assert.Contains(t, out.String(), "auth token: FAILED")
+	ms.Disable(false)
+
+	// invalid key and token
+	ks.GetStore().WriteAll(defaultKeyFile, []byte("not a key"))
+	ms.WriteAll(authTokenName, []byte("garbage"))
+	results = runSelfCheck(ms, ks)
+	assert.NoError(t, results[0].err)
+	assert.Error(t, results[1].err)
+	assert.Error(t, results[2].err)
+
+	// key missing
+	ks.GetStore().Remove(defaultKeyFile)
+	results = runSelfCheck(ms, ks)
+	assert.EqualError(t, results[1].err, "device key is missing")
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// name of the file the artifact is downloaded to ahead of installation
+	stagedArtifactName = "artifact.mender"
+	// name of the file holding the artifact while it is being downloaded
+	partialArtifactName = stagedArtifactName + ".partial"
+)
+
+// StagedArtifact describes an artifact that was downloaded to the staging
+// location and is waiting to be installed.
+type StagedArtifact struct {
+	Path string
+	Size int64
+	// hex encoded SHA256 checksum of the artifact
+	Checksum string
+}
+
+// PartialArtifact describes an interrupted download kept in the staging
+// location, so that the download can be resumed.
+type PartialArtifact struct {
+	Path string
+	// location the artifact is downloaded from
+	URI string
+	// number of bytes downloaded and synced to the storage
+	Offset int64
+}
+
+// partialDownloadError is returned by stageArtifact if the download was
+// interrupted and the partially downloaded artifact was kept.
+type partialDownloadError struct {
+	err     error
+	partial PartialArtifact
+}
+
+func (e *partialDownloadError) Error() string {
+	return e.err.Error()
+}
+
+// readErrorRecorder remembers the error of the underlying reader, telling
+// download errors apart from errors writing the artifact.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// stageArtifact downloads the artifact to the staging directory. If the
+// expected size is known, the size of the downloaded artifact must match.
+//
+// The artifact is downloaded to a partial file first, so that an interrupted
+// download is never mistaken for a complete one. If the download breaks and
+// keepPartial is set, the partial file is kept and a *partialDownloadError
+// describing it is returned; the download continues from where it stopped if
+// the partial artifact is passed in as resume, with in streaming the remaining
+// data. In any other case nothing is left behind on failure.
+func stageArtifact(dir string, in io.Reader, size int64,
+	resume *PartialArtifact, keepPartial bool) (StagedArtifact, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return StagedArtifact{}, errors.Wrapf(err,
+			"failed to create artifact staging directory")
+	}
+
+	p := path.Join(dir, partialArtifactName)
+	h := sha256.New()
+	var offset int64
+	if resume != nil {
+		p = resume.Path
+		offset = resume.Offset
+	}
+
+	f, err := openPartialArtifact(p, offset, h)
+	if err != nil {
+		os.Remove(p)
+		return StagedArtifact{}, errors.Wrapf(err, "failed to stage artifact")
+	}
+
+	rec := &readErrorRecorder{r: in}
+	n, err := io.Copy(io.MultiWriter(f, h), rec)
+	n += offset
+	interrupted := err != nil && err == rec.err
+	if err == nil || interrupted {
+		// make sure the downloaded data is stored, also if the download
+		// is to be resumed
+		if serr := f.Sync(); serr != nil {
+			err, interrupted = serr, false
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if interrupted && keepPartial && n > 0 {
+		return StagedArtifact{}, &partialDownloadError{
+			err: errors.Wrapf(err, "artifact download interrupted at %d bytes", n),
+			partial: PartialArtifact{
+				Path:   p,
+				Offset: n,
+			},
+		}
+	}
+	if err == nil && size > 0 && n != size {
+		err = errors.Errorf("size mismatch; expected %d, got %d", size, n)
+	}
+	staged := path.Join(dir, stagedArtifactName)
+	if err == nil {
+		err = os.Rename(p, staged)
+	}
+	if err != nil {
+		os.Remove(p)
+		return StagedArtifact{}, noSpaceError(
+			errors.Wrapf(err, "failed to stage artifact"))
+	}
+
+	return StagedArtifact{
+		Path:     staged,
+		Size:     n,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// openPartialArtifact opens the partial artifact for writing at offset. The
+// data already downloaded is fed to the hash.
+func openPartialArtifact(p string, offset int64, h io.Writer) (*os.File, error) {
+	if offset == 0 {
+		return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := io.CopyN(h, f, offset); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "partial artifact is shorter than expected; "+
+			"got %d of %d bytes", n, offset)
+	}
+	// drop anything written past the offset, which was not synced
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// removePartialArtifact removes the partially downloaded artifact, if any.
+func removePartialArtifact(pa *PartialArtifact) {
+	if pa == nil {
+		return
+	}
+	if err := os.Remove(pa.Path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove partially downloaded artifact: %v", err)
+	}
+}
+
+// openStagedArtifact opens the staged artifact for installation. The checksum
+// is verified again as the artifact might have been corrupted while stored.
+func openStagedArtifact(sa StagedArtifact) (io.ReadCloser, error) {
+	f, err := os.Open(sa.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open staged artifact")
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read staged artifact")
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != sa.Checksum {
+		f.Close()
+		return nil, errors.Errorf("staged artifact %s is corrupted; "+
+			"expected checksum %s, got %s", sa.Path, sa.Checksum, sum)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read staged artifact")
+	}
+	return f, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStageArtifact(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-staging-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	// staging directory is created if missing
+	dir := path.Join(td, "data", "staging")
+	staged, err := stageArtifact(dir, bytes.NewBufferString("artifact"), 8, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(dir, stagedArtifactName), staged.Path)
+	assert.EqualValues(t, 8, staged.Size)
+
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	fi, err = os.Stat(staged.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	in, err := openStagedArtifact(staged)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("artifact"), data)
+
+	// failed download leaves the previously staged artifact intact and no
+	// partial files behind
+	_, err = stageArtifact(dir, bytes.NewBufferString("short"), 8, nil, false)
+	assert.Error(t, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, stagedArtifactName, files[0].Name())
+	in, err = openStagedArtifact(staged)
+	assert.NoError(t, err)
+	in.Close()
+}
+
+// brokenReader returns an error after reading all the data it holds.
+type brokenReader struct {
+	r io.Reader
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestStageArtifactInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-staging-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := "some artifact data"
+	sum := sha256.Sum256([]byte(data))
+
+	// interrupted download which can not be resumed is removed
+	_, err = stageArtifact(dir, &brokenReader{bytes.NewBufferString(data[:5])},
+		int64(len(data)), nil, false)
+	assert.Error(t, err)
+	_, ok := err.(*partialDownloadError)
+	assert.False(t, ok)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+
+	// interrupted download is kept if it can be resumed
+	_, err = stageArtifact(dir, &brokenReader{bytes.NewBufferString(data[:5])},
+		int64(len(data)), nil, true)
+	require.Error(t, err)
+	perr, ok := err.(*partialDownloadError)
+	require.True(t, ok)
+	assert.Equal(t, path.Join(dir, partialArtifactName), perr.partial.Path)
+	assert.EqualValues(t, 5, perr.partial.Offset)
+	partial, err := ioutil.ReadFile(perr.partial.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, data[:5], string(partial))
+
+	// data written past the offset was never synced, and is dropped
+	f, err := os.OpenFile(perr.partial.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	f.WriteString("garbage")
+	f.Close()
+
+	// resume once more, breaking again
+	resume := perr.partial
+	_, err = stageArtifact(dir, &brokenReader{bytes.NewBufferString(data[5:10])},
+		int64(len(data)), &resume, true)
+	require.Error(t, err)
+	perr, ok = err.(*partialDownloadError)
+	require.True(t, ok)
+	assert.EqualValues(t, 10, perr.partial.Offset)
+
+	// resumed download completes with the checksum of the whole artifact
+	resume = perr.partial
+	staged, err := stageArtifact(dir, bytes.NewBufferString(data[10:]),
+		int64(len(data)), &resume, true)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), staged.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), staged.Checksum)
+	in, err := openStagedArtifact(staged)
+	require.NoError(t, err)
+	in.Close()
+	_, err = os.Stat(path.Join(dir, partialArtifactName))
+	assert.True(t, os.IsNotExist(err))
+
+	// artifact of the wrong size is removed, even if resuming is allowed
+	os.Remove(staged.Path)
+	_, err = stageArtifact(dir, bytes.NewBufferString(data),
+		int64(len(data))+1, nil, true)
+	assert.Error(t, err)
+	_, ok = err.(*partialDownloadError)
+	assert.False(t, ok)
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+}
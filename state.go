@@ -14,13 +14,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
 	"github.com/pkg/errors"
 )
@@ -135,10 +140,63 @@ import (
 // StateContext carrying over data that may be used by all state handlers
 type StateContext struct {
 	// data store access
-	store                store.Store
-	lastUpdateCheck      time.Time
+	store           store.Store
+	lastUpdateCheck time.Time
+	// random delay added to the poll interval after the last update check
+	updateCheckJitter time.Duration
+	// time of the first update check after start-up
+	firstUpdateCheck     time.Time
 	lastInventoryUpdate  time.Time
 	fetchInstallAttempts int
+	// number of consecutive failed authorization attempts
+	authorizeFailures int
+	// number of consecutive failed update checks
+	updateCheckFailures int
+	// updates are deferred until the conditions of the device allow them
+	updatesDeferred bool
+	// source of the current time; time.Now if not set
+	clock func() time.Time
+	// source of the timers, following clock; time.After if not set
+	after func(time.Duration) <-chan time.Time
+	// the server asked not to send any requests before this time
+	retryAfter time.Time
+	// time the updated system must be committed by; zero if not limited
+	confirmDeadline time.Time
+	// deployment checked to be still offered to the device before fetching
+	// its update; the check is not repeated when the fetch is retried
+	eligibleDeployment string
+}
+
+func (ctx *StateContext) now() time.Time {
+	if ctx.clock != nil {
+		return ctx.clock()
+	}
+	return time.Now()
+}
+
+func (ctx *StateContext) timer(d time.Duration) <-chan time.Time {
+	if ctx.after != nil {
+		return ctx.after(d)
+	}
+	return time.After(d)
+}
+
+// rateLimited records the delay requested by the server if err was caused by
+// the request being rate limited.
+func (ctx *StateContext) rateLimited(err error) {
+	if delay := client.RetryAfter(err); delay > 0 {
+		log.Warnf("server requested backing off for %v", delay)
+		ctx.retryAfter = ctx.now().Add(delay)
+	}
+}
+
+// retryWait extends the wait interval, so that the next request is not sent
+// earlier than requested by the server.
+func (ctx *StateContext) retryWait(intvl time.Duration) time.Duration {
+	if wait := ctx.retryAfter.Sub(ctx.now()); wait > intvl {
+		return wait
+	}
+	return intvl
 }
 
 type StateRunner interface {
@@ -160,6 +218,13 @@ type StateData struct {
 	UpdateInfo client.UpdateResponse
 	// update status
 	UpdateStatus string
+	// artifact downloaded ahead of installation, if any
+	StagedArtifact *StagedArtifact
+	// interrupted download of the artifact, if any
+	PartialArtifact *PartialArtifact
+	// time the updated system must be committed by, if limited; kept so
+	// that restarting the client does not extend the time
+	ConfirmDeadline *time.Time `json:",omitempty"`
 }
 
 const (
@@ -192,18 +257,22 @@ var (
 	}
 
 	inventoryUpdateState = &InventoryUpdateState{
-		baseState{
-			id: MenderStateInventoryUpdate,
-			t:  ToSync,
+		cancellableState: cancellableState{
+			baseState: baseState{
+				id: MenderStateInventoryUpdate,
+				t:  ToSync,
+			},
 		},
 	}
 
 	checkWaitState = NewCheckWaitState()
 
 	updateCheckState = &UpdateCheckState{
-		baseState{
-			id: MenderStateUpdateCheck,
-			t:  ToSync,
+		cancellableState: cancellableState{
+			baseState: baseState{
+				id: MenderStateUpdateCheck,
+				t:  ToSync,
+			},
 		},
 	}
 
@@ -232,6 +301,9 @@ type WaitState interface {
 	Id() MenderState
 	Cancel() bool
 	Wait(next, same State, wait time.Duration) (State, bool)
+	// Wake cuts the wait in progress short, as if it completed; returns
+	// false if the state is not waiting
+	Wake() bool
 	Transition() Transition
 	SetTransition(t Transition)
 }
@@ -269,12 +341,14 @@ func (b *baseState) SetTransition(tran Transition) {
 type waitState struct {
 	baseState
 	cancel chan bool
+	wakeup chan bool
 }
 
 func NewWaitState(id MenderState, t Transition) WaitState {
 	return &waitState{
 		baseState: baseState{id: id, t: t},
 		cancel:    make(chan bool),
+		wakeup:    make(chan bool),
 	}
 }
 
@@ -289,6 +363,9 @@ func (ws *waitState) Wait(next, same State,
 	case <-ticker.C:
 		log.Debugf("wait complete")
 		return next, false
+	case <-ws.wakeup:
+		log.Debugf("wait cut short")
+		return next, false
 	case <-ws.cancel:
 		log.Infof("wait canceled")
 	}
@@ -300,6 +377,69 @@ func (ws *waitState) Cancel() bool {
 	return true
 }
 
+func (ws *waitState) Wake() bool {
+	select {
+	case ws.wakeup <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancellableState is a helper for states running long operations, such as
+// requests to the server or installing the update. Cancel aborts the
+// operation in progress instead of waiting for it to finish.
+type cancellableState struct {
+	baseState
+	// context of the operation in progress, if any
+	lock   sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// begin starts the operation of the state and returns its context, which is
+// done once the state is cancelled or end is called. If an operation was
+// handed over to the state, its context is returned instead.
+func (cs *cancellableState) begin() context.Context {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.ctx == nil {
+		cs.ctx, cs.cancel = context.WithCancel(context.Background())
+	}
+	return cs.ctx
+}
+
+// end ends the operation in progress.
+func (cs *cancellableState) end() {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.cancel != nil {
+		cs.cancel()
+	}
+	cs.ctx, cs.cancel = nil, nil
+}
+
+// handOver passes the operation in progress on to the given state, which
+// continues it and is responsible for ending it.
+func (cs *cancellableState) handOver(to *cancellableState) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	to.lock.Lock()
+	defer to.lock.Unlock()
+	to.ctx, to.cancel = cs.ctx, cs.cancel
+	cs.ctx, cs.cancel = nil, nil
+}
+
+func (cs *cancellableState) Cancel() bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.cancel == nil {
+		return false
+	}
+	cs.cancel()
+	return true
+}
+
 type updateState struct {
 	baseState
 	update client.UpdateResponse
@@ -326,6 +466,12 @@ func (i *IdleState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	// cleanup state-data if any data is still present after an update
 	RemoveStateData(ctx.store)
+	removeUpdateTimings(ctx.store)
+
+	if c.Decommissioned() {
+		log.Info("device is decommissioned; not contacting the server anymore")
+		return doneState, false
+	}
 
 	// check if client is authorized
 	if c.IsAuthorized() {
@@ -346,11 +492,21 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	// means no update was in progress; we should continue from idle
 	if err != nil && os.IsNotExist(err) {
 		log.Debug("no state data stored")
+		if update, ok := fellBackFromCommitted(ctx, c); ok {
+			return NewUpdateStatusReportState(update, client.StatusFailure), false
+		}
 		return idleState, false
 	}
 
 	if err != nil {
 		log.Errorf("failed to restore state data: %v", err)
+		// the update running from the uncommitted partition is still known;
+		// carry on verifying and committing it
+		if has, update, herr := c.HasUpgrade(); herr == nil && has && update != nil {
+			log.Infof("continuing with update %s found on the uncommitted partition",
+				update.ID)
+			return NewAfterRebootState(*update), false
+		}
 		me := NewFatalError(errors.Wrapf(err, "failed to restore state data"))
 		return NewUpdateErrorState(me, client.UpdateResponse{
 			ID: "unknown",
@@ -374,10 +530,30 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 		}
 		return NewAfterRebootState(sd.UpdateInfo), false
 	}
+	// the update enabled before the reboot, if any, was committed or rolled
+	// back
+	clearUpgradeUpdate(ctx.store)
+
+	// artifact was downloaded ahead of installation; install it now
+	if sd.StagedArtifact != nil &&
+		(sd.Name == MenderStateUpdateFetch || sd.Name == MenderStateUpdateStore) {
+		log.Infof("installing staged artifact: %s", sd.StagedArtifact.Path)
+		return NewStagedUpdateStoreState(*sd.StagedArtifact, sd.UpdateInfo), false
+	}
 
 	// check last known state
 	switch sd.Name {
 
+	// the state data was written by a newer version of the client, and the
+	// state is unknown to this one; nothing can be continued from it
+	case MenderStateUnknown:
+		log.Warnf("dropping state data of update %s stored in an unknown state",
+			sd.UpdateInfo.ID)
+		if err := RemoveStateData(ctx.store); err != nil {
+			log.Errorf("failed to remove state data: %v", err)
+		}
+		return idleState, false
+
 	case MenderStateRollbackReboot:
 		return NewAfterRollbackRebootState(sd.UpdateInfo), false
 
@@ -386,6 +562,28 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 		c.SetNextState(NewUpdateCommitState(sd.UpdateInfo))
 		return idleState, false
 
+	// the client stopped while downloading the artifact; continue the
+	// download, it is resumed where it stopped if possible
+	case MenderStateUpdateFetch:
+		log.Infof("resuming download of update: %s", sd.UpdateInfo.ID)
+		return NewUpdateFetchState(sd.UpdateInfo), false
+
+	// the artifact was being installed while streamed from the server; the
+	// installation can not continue where it stopped, so start over with
+	// downloading it
+	case MenderStateUpdateStore:
+		log.Infof("restarting interrupted installation of update: %s",
+			sd.UpdateInfo.ID)
+		return NewUpdateFetchState(sd.UpdateInfo), false
+
+	// the final status of the update may not have reached the server; send
+	// it again
+	case MenderStateUpdateStatusReport:
+		if sd.UpdateStatus != "" {
+			return NewUpdateStatusReportState(sd.UpdateInfo, sd.UpdateStatus), false
+		}
+		fallthrough
+
 	// invalid entrypoint into the state-machine. Error out.
 	default:
 		if err := DeploymentLogger.Enable(sd.UpdateInfo.ID); err != nil {
@@ -399,9 +597,49 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	}
 }
 
+// fellBackFromCommitted tells if the device is not running the artifact of the
+// update committed most recently, but the one it was updated from; i.e. the
+// bootloader fell back to the previous partition without the client noticing.
+// Returns the update, which is to be reported as failed.
+func fellBackFromCommitted(ctx *StateContext, c Controller) (client.UpdateResponse, bool) {
+	update, ok := loadCommittedUpdate(ctx.store)
+	if !ok {
+		return client.UpdateResponse{}, false
+	}
+	name, err := c.GetCurrentArtifactName()
+	if err != nil {
+		log.Errorf("can not verify the running artifact: %v", err)
+		return client.UpdateResponse{}, false
+	}
+	if name == update.ArtifactName() {
+		return client.UpdateResponse{}, false
+	}
+	clearCommittedUpdate(ctx.store)
+
+	// the artifact may have been installed without the daemon, e.g. from
+	// the command line
+	if previous, err := ctx.store.ReadAll(previousArtifactName); err == nil &&
+		string(previous) != name {
+		log.Infof("running artifact %s installed outside of deployment %s",
+			name, update.ID)
+		return client.UpdateResponse{}, false
+	}
+
+	if err := DeploymentLogger.Enable(update.ID); err != nil {
+		log.Errorf("failed to enable deployment logger: %s", err)
+	}
+	log.Errorf("running artifact %s instead of the committed artifact %s; "+
+		"the device booted into the previous partition", name, update.ArtifactName())
+	// nothing is to be continued from the failed update
+	clearUpgradeUpdate(ctx.store)
+	clearPendingUpdates(ctx.store)
+	clearPendingReport(ctx.store)
+	return *update, true
+}
+
 func committedPartition(c Controller) bool {
 
-	ua, err := c.HasUpgrade()
+	ua, _, err := c.HasUpgrade()
 	if err != nil {
 		// failure to query u-boot
 		return false
@@ -419,10 +657,29 @@ func NewAuthorizeWaitState() State {
 	}
 }
 
+const (
+	// number of consecutive failed authorization attempts after which the
+	// client backs off; the device is most likely rejected or decommissioned
+	authorizeFailuresBeforeBackoff = 10
+	// how many times longer the client waits between authorization attempts
+	// when backing off
+	authorizeBackoffFactor = 12
+)
+
 func (a *AuthorizeWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle authorize wait state")
 	intvl := c.GetRetryPollInterval()
 
+	if ctx.authorizeFailures >= authorizeFailuresBeforeBackoff {
+		intvl *= authorizeBackoffFactor
+		if ctx.authorizeFailures == authorizeFailuresBeforeBackoff {
+			log.Warnf("authorization failed %d times in a row; is the device "+
+				"accepted by the server? Trying only every %v from now on",
+				ctx.authorizeFailures, intvl)
+		}
+	}
+	intvl = ctx.retryWait(intvl)
+
 	log.Debugf("wait %v before next authorization attempt", intvl)
 	return a.Wait(authorizeState, a, intvl)
 }
@@ -436,13 +693,26 @@ func (a *AuthorizeState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	DeploymentLogger.Disable()
 
 	log.Debugf("handle authorize state")
+	if c.Decommissioned() {
+		log.Info("device is decommissioned; not authorizing")
+		return doneState, false
+	}
 	if err := c.Authorize(); err != nil {
 		log.Errorf("authorize failed: %v", err)
 		if !err.IsFatal() {
+			// the device is most likely rejected if the server keeps
+			// refusing to authorize it, but not if it can not be reached
+			if client.ServerUnreachable(err) {
+				log.Warnf("server can not be reached (%s error)", client.Category(err))
+			} else {
+				ctx.authorizeFailures++
+			}
+			ctx.rateLimited(err)
 			return authorizeWaitState, false
 		}
 		return NewErrorState(err), false
 	}
+	ctx.authorizeFailures = 0
 	// if everything is OK we should let Mender figure out what to do
 	// in MenderStateCheckWait state
 	return checkWaitState, false
@@ -470,7 +740,7 @@ func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, boo
 	log.Debug("handle update verify state")
 
 	// look at the update flag
-	has, haserr := c.HasUpgrade()
+	has, _, haserr := c.HasUpgrade()
 	if haserr != nil {
 		log.Errorf("has upgrade check failed: %v", haserr)
 		me := NewFatalError(errors.Wrapf(haserr, "failed to perform 'has upgrade' check"))
@@ -478,6 +748,17 @@ func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, boo
 	}
 
 	if has {
+		if timeout := c.GetUpdateControlTimeout(); timeout > 0 {
+			ctx.confirmDeadline = updateConfirmDeadline(ctx, uv.Update(),
+				timeout)
+		}
+		// the device must prove it is healthy before the update is
+		// committed; rebooting without committing brings back the
+		// previous system
+		if err := verifyUpdate(ctx, c); err != nil {
+			log.Errorf("update verification failed: %v", err)
+			return NewRollbackState(uv.Update(), false, true), false
+		}
 		return NewUpdateCommitState(uv.Update()), false
 	}
 
@@ -491,6 +772,54 @@ func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, boo
 	return NewRollbackState(uv.Update(), false, false), false
 }
 
+// updateConfirmDeadline returns the time the update must be committed by. The
+// deadline is stored with the state data when the update is verified for the
+// first time.
+func updateConfirmDeadline(ctx *StateContext, update client.UpdateResponse,
+	timeout time.Duration) time.Time {
+	sd, err := LoadStateData(ctx.store)
+	if err == nil && sd.ConfirmDeadline != nil && sd.UpdateInfo.ID == update.ID {
+		return *sd.ConfirmDeadline
+	}
+	deadline := ctx.now().Add(timeout)
+	if err == nil {
+		sd.ConfirmDeadline = &deadline
+		err = StoreStateData(ctx.store, sd)
+	}
+	if err != nil {
+		log.Errorf("failed to store the update confirmation deadline: %v", err)
+	}
+	return deadline
+}
+
+// verifyUpdate verifies the update, failing once the confirmation deadline is
+// reached, so that a hanging verification does not keep the update from being
+// rolled back.
+func verifyUpdate(ctx *StateContext, c Controller) error {
+	if c.GetUpdateControlTimeout() <= 0 {
+		return c.VerifyUpdate(context.Background())
+	}
+	wait := ctx.confirmDeadline.Sub(ctx.now())
+	if wait <= 0 {
+		return errors.New("update was not confirmed in time")
+	}
+	// the verification is stopped once the deadline is reached; the result
+	// channel is buffered so that the verifier never blocks on it
+	vctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := make(chan error, 1)
+	go func() {
+		res <- c.VerifyUpdate(vctx)
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.timer(wait):
+		return errors.Errorf("update was not confirmed within %v",
+			c.GetUpdateControlTimeout())
+	}
+}
+
 type UpdateCommitState struct {
 	UpdateState
 }
@@ -537,6 +866,16 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 		return NewRollbackState(uc.Update(), false, true), false
 	}
 
+	if !ctx.confirmDeadline.IsZero() {
+		late := ctx.now().After(ctx.confirmDeadline)
+		ctx.confirmDeadline = time.Time{}
+		if late {
+			log.Errorf("update was not confirmed within %v; rolling back",
+				c.GetUpdateControlTimeout())
+			return NewRollbackState(uc.Update(), false, true), false
+		}
+	}
+
 	err = c.CommitUpdate()
 	if err != nil {
 		log.Errorf("update commit failed: %s", err)
@@ -545,6 +884,8 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 		// possible to perform new update
 		return NewRollbackState(uc.Update(), false, true), false
 	}
+	storeCommittedUpdate(ctx.store, uc.Update())
+	clearUpgradeUpdate(ctx.store)
 
 	log.Info("Storing commit state data")
 	if err := StoreStateData(ctx.store, StateData{
@@ -555,20 +896,43 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 		log.Errorf("failed to write state-data to storage: %v", err)
 	}
 
+	c.RunPostCommitScripts(uc.Update())
+
 	// update is commited now; report status
 	return NewUpdateStatusReportState(uc.Update(), client.StatusSuccess), false
 }
 
 type UpdateCheckState struct {
-	baseState
+	cancellableState
 }
 
 func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle update check state")
 	ctx.lastUpdateCheck = time.Now()
+	ctx.updateCheckJitter = c.GetUpdatePollJitter()
+
+	if c.UpdatesPaused() {
+		log.Infof("updates are paused; skipping update check")
+		return checkWaitState, false
+	}
+
+	if !updateConditionsMet(ctx, c) {
+		return checkWaitState, false
+	}
+
+	// the previous deployment is closed before a new one is started
+	if !sendPendingReport(ctx, c) {
+		return checkWaitState, false
+	}
 
-	update, err := c.CheckUpdate()
+	opCtx := u.begin()
+	defer u.end()
+	update, err := c.CheckUpdate(opCtx)
 
+	if err != nil && opCtx.Err() != nil {
+		log.Infof("update check cancelled")
+		return u, true
+	}
 	if err != nil {
 		if err.Cause() == os.ErrExist {
 			// We are already running image which we are supposed to install.
@@ -577,31 +941,113 @@ func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool)
 		}
 
 		log.Errorf("update check failed: %s", err)
+		ctx.updateCheckFailures++
+		ctx.rateLimited(err)
 		return NewErrorState(err), false
 	}
+	ctx.updateCheckFailures = 0
 
 	if update != nil {
+		if wait := c.MaintenanceWindowWait(); wait > 0 {
+			log.Infof("update %s is installed once the maintenance window opens in %v",
+				update.ArtifactName(), wait)
+			c.NotifyUpdateDeferred(*update, time.Now().Add(wait))
+			return checkWaitState, false
+		}
+		if reason := clientTooOld(*update); reason != "" {
+			return NewUpdateDeclinedState(*update, reason), false
+		}
+		storePendingUpdates(ctx.store, update.Next)
 		return NewUpdateFetchState(*update), false
 	}
 	return checkWaitState, false
 }
 
+// updateConditionsMet tells if the conditions of the device, e.g. the power
+// source, allow updates now; while they do not, the server is polled at the
+// retry interval, so that the updates continue soon after the conditions
+// improve.
+func updateConditionsMet(ctx *StateContext, c Controller) bool {
+	ok, reason := c.UpdateConditionsMet()
+	if !ok {
+		if !ctx.updatesDeferred {
+			log.Infof("updates are deferred: %s", reason)
+		}
+		ctx.updatesDeferred = true
+		return false
+	}
+	if ctx.updatesDeferred {
+		log.Info("conditions allow updates again")
+	}
+	ctx.updatesDeferred = false
+	return true
+}
+
+// clientTooOld returns why the update can not be installed if the server
+// requires a newer version of the client for it; empty otherwise.
+func clientTooOld(update client.UpdateResponse) string {
+	if update.MinClientVersion == "" {
+		return ""
+	}
+	older, ok := versionOlder(VersionString(), update.MinClientVersion)
+	if !ok {
+		log.Warnf("can not compare client version %s with %s required by "+
+			"update %s; installing it anyway", VersionString(),
+			update.MinClientVersion, update.ID)
+		return ""
+	}
+	if !older {
+		return ""
+	}
+	return fmt.Sprintf("client too old: version %s, update requires %s",
+		VersionString(), update.MinClientVersion)
+}
+
+// sendPendingReport sends the success report of the committed update which the
+// server did not accept before, if any. Returns false if it has to be sent
+// again later.
+func sendPendingReport(ctx *StateContext, c Controller) bool {
+	update, ok := loadPendingReport(ctx.store)
+	if !ok {
+		return true
+	}
+	log.Infof("sending pending success report of update %s", update.ID)
+	if err := c.ReportUpdateStatus(update, client.StatusSuccess); err != nil {
+		if !err.IsFatal() {
+			log.Errorf("failed to send pending success report: %v", err)
+			ctx.rateLimited(err)
+			return false
+		}
+		log.Errorf("dropping pending success report: %v", err)
+	}
+	clearPendingReport(ctx.store)
+	return true
+}
+
 type UpdateFetchState struct {
-	baseState
+	cancellableState
 	update client.UpdateResponse
 }
 
 func NewUpdateFetchState(update client.UpdateResponse) State {
 	return &UpdateFetchState{
-		baseState: baseState{
-			id: MenderStateUpdateFetch,
-			t:  ToDownload,
+		cancellableState: cancellableState{
+			baseState: baseState{
+				id: MenderStateUpdateFetch,
+				t:  ToDownload,
+			},
 		},
 		update: update,
 	}
 }
 
 func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	// the server offers the update again once the conditions of the device
+	// allow downloading it
+	if !updateConditionsMet(ctx, c) {
+		return checkWaitState, false
+	}
+
 	// start deployment logging
 	if err := DeploymentLogger.Enable(u.update.ID); err != nil {
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
@@ -609,9 +1055,46 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 	log.Debugf("handle update fetch state")
 
+	// download of the artifact interrupted by the previous attempt
+	var partial *PartialArtifact
+	resumed := false
+	if sd, err := LoadStateData(ctx.store); err == nil &&
+		sd.UpdateInfo.ID == u.update.ID {
+		partial = sd.PartialArtifact
+		resumed = true
+	}
+
+	opCtx := u.begin()
+	defer u.end()
+
+	// the deployment may have been aborted since the update was offered;
+	// the download fails by itself if the server can not be reached, so the
+	// update is fetched if the check fails
+	if ctx.eligibleDeployment != u.update.ID {
+		ok, err := c.DeploymentEligible(opCtx, u.update)
+		if err != nil {
+			log.Warnf("failed to check if deployment %s is still active: %v",
+				u.update.ID, err)
+		} else if !ok {
+			log.Infof("deployment %s is no longer offered to the device; "+
+				"skipping the download", u.update.ID)
+			if partial != nil {
+				removePartialArtifact(partial)
+			}
+			if resumed {
+				if err := RemoveStateData(ctx.store); err != nil {
+					log.Errorf("failed to remove state data: %v", err)
+				}
+			}
+			return checkWaitState, false
+		}
+		ctx.eligibleDeployment = u.update.ID
+	}
+
 	if err := StoreStateData(ctx.store, StateData{
-		Name:       u.Id(),
-		UpdateInfo: u.update,
+		Name:            u.Id(),
+		UpdateInfo:      u.update,
+		PartialArtifact: partial,
 	}); err != nil {
 		log.Errorf("failed to store state data in fetch state: %v", err)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
@@ -622,13 +1105,136 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
-	in, size, err := c.FetchUpdate(u.update.URI())
+	// use delta update if it can be applied to the installed artifact
+	uri := u.update.URI()
+	if name, err := c.GetCurrentArtifactName(); err == nil {
+		uri = u.update.DeltaURI(name)
+	}
+	if uri != u.update.URI() {
+		log.Infof("fetching delta update")
+	}
+
+	dir := c.GetArtifactStagingDir()
+	if partial != nil && (dir == "" || !c.ResumeStagedDownloads() ||
+		partial.URI != uri) {
+		removePartialArtifact(partial)
+		partial = nil
+	}
+
+	// the download is traced as a part of the deployment
+	fetchCtx := client.WithDeploymentID(opCtx, u.update.ID)
+
+	var in io.ReadCloser
+	var size int64
+	var err error
+	if partial != nil {
+		log.Infof("resuming artifact download from offset %d", partial.Offset)
+		in, size, err = c.ResumeUpdate(fetchCtx, uri, partial.Offset)
+		if err != nil {
+			log.Warnf("can not resume artifact download, starting over: %v", err)
+			removePartialArtifact(partial)
+			partial = nil
+		}
+	}
+	if partial == nil {
+		in, size, err = c.FetchUpdate(fetchCtx, uri)
+	}
+	if err != nil && opCtx.Err() != nil {
+		log.Infof("update fetch cancelled")
+		return u, true
+	}
+	if errors.Cause(err) == ErrDownloadTooLarge || errorIs(err, client.ErrUpdateGone) {
+		log.Errorf("update fetch failed: %s", err)
+		return NewUpdateFailedState(u.update, err), false
+	}
 	if err != nil {
 		log.Errorf("update fetch failed: %s", err)
 		return NewFetchStoreRetryState(u, u.update, err), false
 	}
 
-	return NewUpdateStoreState(in, size, u.update), false
+	// the rate is checked as the download goes on, so that it follows the
+	// schedule
+	if c.DownloadRateLimited() {
+		in = newRateLimitedReader(in, c.GetDownloadRateLimit, ctx.now)
+	}
+
+	// checksum advertised by the server is of the full artifact
+	checksum := ""
+	if uri == u.update.URI() {
+		checksum = u.update.Checksum()
+	}
+
+	if dir == "" {
+		if checksum != "" {
+			in = newChecksumReader(in, checksum)
+		}
+		if c.PipelinedInstall() {
+			in = newReadAheadReader(in, readAheadBufferSize)
+		}
+		// the download goes on while the update is installed
+		store := NewUpdateStoreState(in, size, u.update).(*UpdateStoreState)
+		u.handOver(&store.cancellableState)
+		return store, false
+	}
+
+	// download the whole artifact first so that it can be installed even
+	// after restarting the client
+	staged, err := stageArtifact(dir, in, size, partial, c.ResumeStagedDownloads())
+	in.Close()
+	if perr, ok := err.(*partialDownloadError); ok &&
+		(errors.Cause(perr.err) == ErrDownloadTooLarge ||
+			errorIs(perr.err, client.ErrUpdateGone)) {
+		// there is no point in resuming
+		removePartialArtifact(&perr.partial)
+		err = perr.err
+	}
+	if errorIs(err, ErrDownloadTooLarge) || errorIs(err, ErrNoSpace) ||
+		errorIs(err, client.ErrUpdateGone) {
+		log.Errorf("update fetch failed: %s", err)
+		return NewUpdateFailedState(u.update, err), false
+	} else if perr, ok := err.(*partialDownloadError); ok {
+		log.Errorf("update fetch failed: %s", err)
+		perr.partial.URI = uri
+		if serr := StoreStateData(ctx.store, StateData{
+			Name:            u.Id(),
+			UpdateInfo:      u.update,
+			PartialArtifact: &perr.partial,
+		}); serr != nil {
+			log.Errorf("failed to store state data in fetch state: %v", serr)
+			removePartialArtifact(&perr.partial)
+		}
+		if opCtx.Err() != nil {
+			log.Infof("update fetch cancelled")
+			return u, true
+		}
+		return NewFetchStoreRetryState(u, u.update, err), false
+	} else if err != nil && opCtx.Err() != nil {
+		log.Infof("update fetch cancelled")
+		return u, true
+	} else if err != nil {
+		log.Errorf("update fetch failed: %s", err)
+		return NewFetchStoreRetryState(u, u.update, err), false
+	}
+
+	if checksum != "" {
+		if err := verifyChecksum(staged.Checksum, checksum); err != nil {
+			log.Errorf("update fetch failed: %s", err)
+			os.Remove(staged.Path)
+			return NewFetchStoreRetryState(u, u.update, err), false
+		}
+	}
+
+	if err := StoreStateData(ctx.store, StateData{
+		Name:           u.Id(),
+		UpdateInfo:     u.update,
+		StagedArtifact: &staged,
+	}); err != nil {
+		log.Errorf("failed to store state data in fetch state: %v", err)
+		os.Remove(staged.Path)
+		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
+	}
+
+	return NewStagedUpdateStoreState(staged, u.update), false
 }
 
 func (uf *UpdateFetchState) Update() client.UpdateResponse {
@@ -636,27 +1242,68 @@ func (uf *UpdateFetchState) Update() client.UpdateResponse {
 }
 
 type UpdateStoreState struct {
-	baseState
+	cancellableState
 	update client.UpdateResponse
 	// reader for obtaining image data
 	imagein io.ReadCloser
 	// expected image size
 	size int64
+	// artifact downloaded ahead of installation; nil if the artifact is
+	// installed while being downloaded
+	staged *StagedArtifact
 }
 
 func NewUpdateStoreState(in io.ReadCloser, size int64, update client.UpdateResponse) State {
 	return &UpdateStoreState{
-		baseState{
-			id: MenderStateUpdateStore,
-			t:  ToDownload,
+		cancellableState: cancellableState{
+			baseState: baseState{
+				id: MenderStateUpdateStore,
+				t:  ToDownload,
+			},
 		},
-		update,
-		in,
-		size,
+		update:  update,
+		imagein: in,
+		size:    size,
+	}
+}
+
+// NewStagedUpdateStoreState returns a state installing the artifact that was
+// downloaded to the staging location.
+func NewStagedUpdateStoreState(staged StagedArtifact, update client.UpdateResponse) State {
+	return &UpdateStoreState{
+		cancellableState: cancellableState{
+			baseState: baseState{
+				id: MenderStateUpdateStore,
+				t:  ToDownload,
+			},
+		},
+		update: update,
+		size:   staged.Size,
+		staged: &staged,
 	}
 }
 
 func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	opCtx := u.begin()
+	defer u.end()
+
+	if u.staged != nil {
+		in, err := openStagedArtifact(*u.staged)
+		if err != nil {
+			log.Errorf("update install failed: %s", err)
+			// download the artifact again
+			os.Remove(u.staged.Path)
+			return NewFetchStoreRetryState(u, u.update, err), false
+		}
+		u.imagein = in
+		defer func() {
+			// keep the staged artifact for installing once the client is
+			// started again
+			if opCtx.Err() == nil {
+				os.Remove(u.staged.Path)
+			}
+		}()
+	}
 
 	// make sure to close the stream with image data
 	defer u.imagein.Close()
@@ -669,8 +1316,9 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 	log.Debugf("handle update install state")
 
 	if err := StoreStateData(ctx.store, StateData{
-		Name:       u.Id(),
-		UpdateInfo: u.update,
+		Name:           u.Id(),
+		UpdateInfo:     u.update,
+		StagedArtifact: u.staged,
 	}); err != nil {
 		log.Errorf("failed to store state data in install state: %v", err)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
@@ -681,11 +1329,55 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
-	if err := c.InstallUpdate(u.imagein, u.size); err != nil {
+	if err := c.InstallArtifact(opCtx, u.imagein, u.size,
+		u.update.ArtifactName()); err != nil && opCtx.Err() != nil {
+		log.Infof("update install cancelled")
+		return u, true
+	} else if err != nil {
 		log.Errorf("update install failed: %s", err)
+		if errorIs(err, installer.ErrArtifactNameMismatch) ||
+			errorIs(err, installer.ErrArtifactDependsNotSatisfied) ||
+			errorIs(err, installer.ErrDeviceTypeMismatch) ||
+			errorIs(err, installer.ErrSignatureInvalid) ||
+			errorIs(err, ErrDownloadTooLarge) ||
+			errorIs(err, ErrNoSpace) ||
+			errorIs(err, client.ErrUpdateGone) {
+			// the artifact is not the one the server offered, or
+			// does not fit the device; there is no point in retrying
+			return NewUpdateFailedState(u.update, err), false
+		}
+		if errorIs(err, client.ErrReconnectsExhausted) {
+			// the download was resumed as many times as allowed
+			// already; downloading it again would start over
+			return NewUpdateErrorState(NewTransientError(err), u.update), false
+		}
+		if errors.Cause(err) == installer.ErrArtifactAlreadyInstalled {
+			// nothing was written; same as if the server offered the
+			// installed artifact
+			return NewUpdateStatusReportState(u.update,
+				client.StatusAlreadyInstalled), false
+		}
+		if errorIs(err, errDeltaBaseMismatch) {
+			log.Infof("falling back to full update")
+			u.update.Delta = nil
+		}
 		return NewFetchStoreRetryState(u, u.update, err), false
 	}
 
+	if u.staged == nil {
+		// read the rest of the download, so that it is verified in full
+		if _, err := io.Copy(ioutil.Discard, u.imagein); err != nil {
+			log.Errorf("update download failed: %s", err)
+			if errorIs(err, client.ErrUpdateGone) {
+				return NewUpdateFailedState(u.update, err), false
+			}
+			if errorIs(err, client.ErrReconnectsExhausted) {
+				return NewUpdateErrorState(NewTransientError(err), u.update), false
+			}
+			return NewFetchStoreRetryState(u, u.update, err), false
+		}
+	}
+
 	// restart counter so that we are able to retry next time
 	ctx.fetchInstallAttempts = 0
 
@@ -726,11 +1418,37 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 		return NewUpdateErrorState(NewTransientError(merr), is.Update()), false
 	}
 
+	// updates of custom types are applied by their handlers; the partitions
+	// and the boot flags are left as they are
+	if custom, err := c.ActivateCustomUpdate(); err != nil {
+		log.Errorf("update activation failed: %v", err)
+		return NewUpdateErrorState(NewTransientError(err), is.Update()), false
+	} else if custom {
+		log.Infof("update %s of custom type activated", is.Update().ID)
+		c.RunPostCommitScripts(is.Update())
+		return NewUpdateStatusReportState(is.Update(), client.StatusSuccess), false
+	}
+
 	// if install was successful mark inactive partition as active one
+	storeUpgradeUpdate(ctx.store, is.Update())
 	if err := c.EnableUpdatedPartition(); err != nil {
 		return NewUpdateErrorState(NewTransientError(err), is.Update()), false
 	}
 
+	if c.GetRebootStrategy() == rebootStrategyManual {
+		// leave the partition flagged for the next boot; the update will
+		// not be committed, so it is rolled back unless confirmed
+		log.Infof("update %s installed; reboot the device manually", is.Update().ID)
+		if err := RemoveStateData(ctx.store); err != nil {
+			log.Errorf("failed to remove state data: %v", err)
+		}
+		return doneState, false
+	}
+
+	if c.GetRebootStrategy() == rebootStrategyNone || !c.RebootRequired() {
+		log.Info("update takes effect without reboot; committing")
+		return NewUpdateCommitState(is.Update()), false
+	}
 	return NewRebootState(is.Update()), false
 }
 
@@ -756,8 +1474,17 @@ func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State,
 
 	intvl, err := client.GetExponentialBackoffTime(ctx.fetchInstallAttempts, c.GetUpdatePollInterval())
 	if err != nil {
+		// giving up; an interrupted download will not be resumed
+		if sd, lerr := LoadStateData(ctx.store); lerr == nil &&
+			sd.PartialArtifact != nil {
+			removePartialArtifact(sd.PartialArtifact)
+			sd.PartialArtifact = nil
+			if serr := StoreStateData(ctx.store, sd); serr != nil {
+				log.Errorf("failed to store state data: %v", serr)
+			}
+		}
 		if fir.err != nil {
-			return NewUpdateStatusReportState(fir.update, client.StatusFailure), false
+			return NewUpdateFailedState(fir.update, fir.err), false
 		}
 		return NewUpdateErrorState(
 			NewTransientError(err), fir.update), false
@@ -779,12 +1506,42 @@ func NewCheckWaitState() State {
 	}
 }
 
+// the wait between update checks doubles with every consecutive failed check,
+// up to this many times the poll interval, so that the server is not hammered
+// while it is down
+const updateCheckBackoffMax = 16
+
+// updateCheckBackoff returns the wait before the next update check after the
+// given number of consecutive failed checks.
+func updateCheckBackoff(intvl time.Duration, failures int) time.Duration {
+	max := intvl * updateCheckBackoffMax
+	for i := 0; i < failures && intvl < max; i++ {
+		intvl *= 2
+	}
+	return intvl
+}
+
 func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	log.Debugf("handle check wait state")
 
+	// the device may be decommissioned while the daemon is running
+	if c.Decommissioned() {
+		log.Info("device is decommissioned; not contacting the server anymore")
+		return doneState, false
+	}
+
 	// calculate next interval
-	update := ctx.lastUpdateCheck.Add(c.GetUpdatePollInterval())
+	intvl := updateCheckBackoff(c.GetUpdatePollInterval(), ctx.updateCheckFailures)
+	if ctx.updateCheckFailures > 0 {
+		log.Infof("update check failed %d times in a row; next check in %v",
+			ctx.updateCheckFailures, intvl)
+	}
+	intvl += ctx.updateCheckJitter
+	if retry := c.GetRetryPollInterval(); ctx.updatesDeferred && retry < intvl {
+		intvl = retry
+	}
+	update := ctx.lastUpdateCheck.Add(intvl)
 	inventory := ctx.lastInventoryUpdate.Add(c.GetInventoryPollInterval())
 
 	// if we haven't sent inventory so far
@@ -792,6 +1549,15 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 		inventory = ctx.lastInventoryUpdate
 	}
 
+	// first update check after start-up is randomly delayed so that devices
+	// booted at the same time do not check for updates simultaneously
+	if ctx.lastUpdateCheck.IsZero() {
+		if ctx.firstUpdateCheck.IsZero() {
+			ctx.firstUpdateCheck = time.Now().Add(c.GetStartupDelay())
+		}
+		update = ctx.firstUpdateCheck
+	}
+
 	log.Debugf("check wait state; next checks: (update: %v) (inventory: %v)",
 		update, inventory)
 
@@ -804,11 +1570,18 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 		state: updateCheckState,
 	}
 
-	if inventory.Before(update) {
+	// phases disabled by the configuration are never entered
+	if !c.UpdatesEnabled() ||
+		(c.InventoryEnabled() && inventory.Before(update)) {
 		next.when = inventory
 		next.state = inventoryUpdateState
 	}
 
+	// do not contact the server earlier than it asked us to
+	if next.when.Before(ctx.retryAfter) {
+		next.when = ctx.retryAfter
+	}
+
 	now := time.Now()
 	log.Debugf("next check: %v:%v, (%v)", next.when, next.state, now)
 
@@ -825,16 +1598,23 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 }
 
 type InventoryUpdateState struct {
-	baseState
+	cancellableState
 }
 
 func (iu *InventoryUpdateState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	ctx.lastInventoryUpdate = time.Now()
 
-	err := c.InventoryRefresh()
+	opCtx := iu.begin()
+	defer iu.end()
+	err := c.InventoryRefresh(opCtx)
+	if err != nil && opCtx.Err() != nil {
+		log.Infof("inventory update cancelled")
+		return iu, true
+	}
 	if err != nil {
 		log.Warnf("failed to refresh inventory: %v", err)
+		ctx.rateLimited(err)
 		if errors.Cause(err) == errNoArtifactName {
 			return NewErrorState(NewTransientError(err)), false
 		}
@@ -898,7 +1678,7 @@ func (ue *UpdateErrorState) Handle(ctx *StateContext, c Controller) (State, bool
 
 	log.Debug("handle update error state")
 
-	return NewUpdateStatusReportState(ue.update, client.StatusFailure), false
+	return NewUpdateFailedState(ue.update, ue.cause), false
 }
 
 func (ue *UpdateErrorState) Update() client.UpdateResponse {
@@ -910,7 +1690,11 @@ func (ue *UpdateErrorState) Update() client.UpdateResponse {
 // update is deemed as failed.
 type UpdateStatusReportState struct {
 	UpdateState
-	status             string
+	status string
+	// why the update failed, sent to the server along with the status
+	reason string
+	// the update was declined without attempting it
+	declined           bool
 	triesSendingReport int
 	reportSent         bool
 	triesSendingLogs   int
@@ -948,12 +1732,12 @@ func sendDeploymentLogs(update client.UpdateResponse, sentTries *int,
 	return nil
 }
 
-func sendDeploymentStatus(update client.UpdateResponse, status string,
+func sendDeploymentStatus(update client.UpdateResponse, status, substate string,
 	tries *int, sent *bool, c Controller) menderError {
 	// check if the report was already sent
 	if !*sent {
 		*tries++
-		if err := c.ReportUpdateStatus(update, status); err != nil {
+		if err := c.ReportUpdateSubState(update, status, substate); err != nil {
 			return err
 		}
 		*sent = true
@@ -968,6 +1752,10 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 	DeploymentLogger.Enable(usr.Update().ID)
 
 	log.Debug("handle update status report state")
+	if usr.declined && usr.triesSendingReport == 0 {
+		// the reason ends up in the deployment log sent to the server
+		log.Errorf("update %s declined: %s", usr.Update().ID, usr.reason)
+	}
 
 	// Do not store this if artifact-commit scripts are run when leaving the state
 	// as then the scripts will not be rerun
@@ -982,12 +1770,23 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 			return NewReportErrorState(usr.Update(), usr.status), false
 		}
 	}
-	if err := sendDeploymentStatus(usr.Update(), usr.status,
+	// time spent in the update phases is reported along with the final status
+	timings := loadUpdateTimings(ctx.store)
+	if len(timings) != 0 {
+		log.Infof("update timings: %v", timings)
+	}
+	substate := timings.String()
+	if usr.reason != "" {
+		substate = usr.reason
+	}
+
+	if err := sendDeploymentStatus(usr.Update(), usr.status, substate,
 		&usr.triesSendingReport, &usr.reportSent, c); err != nil {
 		log.Errorf("failed to send status to server: %v", err)
 		if err.IsFatal() {
 			return NewReportErrorState(usr.Update(), usr.status), false
 		}
+		ctx.rateLimited(err)
 		return NewUpdateStatusReportRetryState(usr, usr.Update(),
 			usr.status, usr.triesSendingReport), false
 	}
@@ -1001,6 +1800,7 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 				// there is no point in retrying
 				return NewReportErrorState(usr.Update(), usr.status), false
 			}
+			ctx.rateLimited(err)
 			return NewUpdateStatusReportRetryState(usr, usr.Update(), usr.status,
 				usr.triesSendingLogs), false
 		}
@@ -1009,10 +1809,47 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 	log.Debug("reporting complete")
 	// stop deployment logging as the update is completed at this point
 	DeploymentLogger.Disable()
+	removeUpdateTimings(ctx.store)
+
+	// continue with the next update of the chain; the chain stops at the
+	// first failure
+	if usr.status == client.StatusFailure {
+		clearPendingUpdates(ctx.store)
+	} else if next, ok := nextPendingUpdate(ctx.store); ok {
+		log.Infof("installing the next update of the chain: %s", next.ArtifactName())
+		return NewUpdateFetchState(next), false
+	}
 
 	return idleState, false
 }
 
+// NewUpdateDeclinedState reports the failure of the update which is not
+// attempted, along with the reason; nothing is downloaded or installed.
+func NewUpdateDeclinedState(update client.UpdateResponse, reason string) State {
+	return &UpdateStatusReportState{
+		UpdateState: NewUpdateState(MenderStateUpdateStatusReport,
+			ToNone, update),
+		status:   client.StatusFailure,
+		reason:   reason,
+		declined: true,
+	}
+}
+
+// NewUpdateFailedState reports the failure of the update along with its
+// cause, e.g. the output of the failed command, so that it can be seen on the
+// server without going through the deployment log.
+func NewUpdateFailedState(update client.UpdateResponse, cause error) State {
+	usr := &UpdateStatusReportState{
+		UpdateState: NewUpdateState(MenderStateUpdateStatusReport,
+			ToNone, update),
+		status: client.StatusFailure,
+	}
+	if cause != nil {
+		usr.reason = truncateReason(cause.Error())
+	}
+	return usr
+}
+
 type UpdateStatusReportRetryState struct {
 	WaitState
 	reportState  State
@@ -1056,7 +1893,8 @@ func (usr *UpdateStatusReportRetryState) Handle(ctx *StateContext, c Controller)
 	maxTrySending++
 
 	if usr.triesSending < maxTrySending {
-		return usr.Wait(usr.reportState, usr, c.GetRetryPollInterval())
+		return usr.Wait(usr.reportState, usr,
+			ctx.retryWait(c.GetRetryPollInterval()))
 	}
 	return NewReportErrorState(usr.update, usr.status), false
 }
@@ -1084,11 +1922,22 @@ func (res *ReportErrorState) Handle(ctx *StateContext, c Controller) (State, boo
 	DeploymentLogger.Enable(res.Update().ID)
 
 	log.Errorf("handling report error state with status: %v", res.updateStatus)
+	clearPendingUpdates(ctx.store)
 
 	switch res.updateStatus {
 	case client.StatusSuccess:
-		// error while reporting success; rollback
-		return NewRollbackState(res.Update(), true, true), false
+		// error while reporting success of the committed update
+		switch c.GetCommitReportFailure() {
+		case commitReportRetry:
+			log.Infof("success report will be sent again with the next update check")
+			storePendingReport(ctx.store, res.Update())
+			return idleState, false
+		case commitReportIgnore:
+			log.Warnf("success report of update %s is dropped", res.Update().ID)
+			return idleState, false
+		default:
+			return NewRollbackState(res.Update(), true, true), false
+		}
 	case client.StatusFailure:
 		// error while reporting failure;
 		// start from scratch as previous update was broken
@@ -1106,12 +1955,50 @@ func (res *ReportErrorState) Handle(ctx *StateContext, c Controller) (State, boo
 
 type RebootState struct {
 	UpdateState
+	// grace period given to the applications before rebooting
+	grace WaitState
 }
 
 func NewRebootState(update client.UpdateResponse) State {
 	return &RebootState{
 		UpdateState: NewUpdateState(MenderStateReboot,
 			ToArtifactReboot_Enter, update),
+		grace: NewWaitState(MenderStateReboot, ToArtifactReboot_Enter),
+	}
+}
+
+// Cancel cuts the grace period short, and stops the daemon without rebooting.
+func (e *RebootState) Cancel() bool {
+	return e.grace.Cancel()
+}
+
+// waitGracePeriod delays the reboot by the grace period, and by further grace
+// periods while the reboot is vetoed, but no longer than the configured
+// maximum in total. Returns false if the wait was cancelled.
+func (e *RebootState) waitGracePeriod(ctx *StateContext, c Controller) bool {
+	grace, max := c.GetRebootDelay()
+	if grace <= 0 {
+		return true
+	}
+
+	deadline := ctx.now().Add(max)
+	for {
+		wait := grace
+		if left := deadline.Sub(ctx.now()); left < wait {
+			wait = left
+		}
+		if wait <= 0 {
+			log.Warnf("reboot postponed for %v already; rebooting anyway", max)
+			return true
+		}
+
+		log.Infof("rebooting in %v", wait)
+		if _, cancelled := e.grace.Wait(nil, e, wait); cancelled {
+			return false
+		}
+		if !c.RebootVetoed() {
+			return true
+		}
 	}
 }
 
@@ -1125,6 +2012,10 @@ func (e *RebootState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	log.Debug("handling reboot state")
 
+	if !e.waitGracePeriod(ctx, c) {
+		return e, true
+	}
+
 	if err := StoreStateData(ctx.store, StateData{
 		Name:       e.Id(),
 		UpdateInfo: e.Update(),
@@ -1202,7 +2093,7 @@ func (rs *RollbackState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	if rs.swap {
 		if err := c.SwapPartitions(); err != nil {
 			log.Errorf("rollback failed: %s", err)
-			return NewErrorState(NewFatalError(err)), false
+			return NewFatalState(errors.Wrap(err, "rollback failed"), rs.Update()), false
 		}
 	}
 	if rs.reboot {
@@ -1246,7 +2137,7 @@ func (rs *RollbackRebootState) Handle(ctx *StateContext, c Controller) (State, b
 
 	if err := c.Reboot(); err != nil {
 		log.Errorf("error rebooting device: %v", err)
-		return NewErrorState(NewFatalError(err)), false
+		return NewFatalState(errors.Wrap(err, "rollback reboot failed"), rs.Update()), false
 	}
 
 	// we can not reach this point
@@ -1280,6 +2171,36 @@ func (rs *AfterRollbackRebootState) Handle(ctx *StateContext,
 		rs.Update()), false
 }
 
+// FatalState is entered if the device can not recover from a failed update,
+// e.g. if the rollback fails. The failure is recorded in the store, and from
+// then on the client only submits the inventory, which reports the failure,
+// until the operator clears the record. This keeps a broken device from
+// retrying updates over and over.
+type FatalState struct {
+	UpdateState
+	cause error
+}
+
+func NewFatalState(err error, update client.UpdateResponse) State {
+	return &FatalState{
+		UpdateState: NewUpdateState(MenderStateFatal, ToError, update),
+		cause:       err,
+	}
+}
+
+func (f *FatalState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Errorf("unrecoverable failure, giving up updates: %v", f.cause)
+
+	if err := c.SetFatalFailure(f.cause.Error()); err != nil {
+		// updates are attempted again after the restart, nothing else
+		// can be done
+		log.Errorf("failed to record the unrecoverable failure: %v", err)
+	}
+	// let the server know the deployment failed; the deployment log is
+	// sent along
+	return NewUpdateStatusReportState(f.Update(), client.StatusFailure), false
+}
+
 type FinalState struct {
 	baseState
 }
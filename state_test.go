@@ -15,18 +15,29 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"testing"
 	"time"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type stateTestController struct {
@@ -35,8 +46,10 @@ type stateTestController struct {
 	artifactName    string
 	pollIntvl       time.Duration
 	retryIntvl      time.Duration
+	pollJitter      time.Duration
 	hasUpgrade      bool
 	hasUpgradeErr   menderError
+	upgradeUpdate   *client.UpdateResponse
 	state           State
 	updateResp      *client.UpdateResponse
 	updateRespErr   menderError
@@ -49,6 +62,85 @@ type stateTestController struct {
 	logUpdate       client.UpdateResponse
 	logs            []byte
 	inventoryErr    error
+	updatesPaused   bool
+	updatesOff      bool
+	tokenCleared    bool
+	inventoryOff    bool
+	fatalFailure    string
+	decommissioned  bool
+	startupDelay    time.Duration
+	stagingDir      string
+	resumeDownloads bool
+	reportSubState  string
+	deviceStatus    deviceStatus
+	rebootStrategy  string
+	commitReport    string
+	rebooted        bool
+	enabled         bool
+	maintenanceWait time.Duration
+	ineligible      bool
+	eligibleChecks  int
+	deferred        *client.UpdateResponse
+	deferredUntil   time.Time
+	postCommit      *client.UpdateResponse
+	rebootGrace     time.Duration
+	rebootDelayMax  time.Duration
+	// number of times the reboot is vetoed, and how many times it was asked
+	rebootVetoed int
+	rebootVetoes int
+	noReboot     bool
+	// the update is activated by the handler of its custom type
+	customUpdate bool
+	activateErr  error
+	// reports whether updates are allowed now; allowed if not set
+	updateConditions func() (bool, string)
+	verifyErr        error
+	// called when the update is verified, e.g. to advance the clock
+	onVerify       func(ctx context.Context)
+	controlTimeout time.Duration
+}
+
+func (s *stateTestController) VerifyUpdate(ctx context.Context) error {
+	if s.onVerify != nil {
+		s.onVerify(ctx)
+	}
+	return s.verifyErr
+}
+
+func (s *stateTestController) GetUpdateControlTimeout() time.Duration {
+	return s.controlTimeout
+}
+
+func (s *stateTestController) RebootRequired() bool {
+	return !s.noReboot
+}
+
+func (s *stateTestController) ActivateCustomUpdate() (bool, error) {
+	return s.customUpdate, s.activateErr
+}
+
+func (s *stateTestController) GetRebootStrategy() string {
+	if s.rebootStrategy == "" {
+		return rebootStrategySystem
+	}
+	return s.rebootStrategy
+}
+
+func (s *stateTestController) GetCommitReportFailure() string {
+	if s.commitReport == "" {
+		return commitReportRetry
+	}
+	return s.commitReport
+}
+
+func (s *stateTestController) Reboot() error {
+	s.rebooted = true
+	return s.fakeDevice.Reboot()
+}
+
+func (s *stateTestController) EnableUpdatedPartition() error {
+	s.enabled = true
+	return s.fakeDevice.EnableUpdatedPartition()
 }
 
 func (s *stateTestController) GetCurrentArtifactName() (string, error) {
@@ -70,18 +162,134 @@ func (s *stateTestController) GetRetryPollInterval() time.Duration {
 	return s.retryIntvl
 }
 
-func (s *stateTestController) HasUpgrade() (bool, menderError) {
-	return s.hasUpgrade, s.hasUpgradeErr
+func (s *stateTestController) GetUpdatePollJitter() time.Duration {
+	return s.pollJitter
+}
+
+func (s *stateTestController) GetStartupDelay() time.Duration {
+	return s.startupDelay
+}
+
+func (s *stateTestController) GetArtifactStagingDir() string {
+	return s.stagingDir
+}
+
+func (s *stateTestController) ResumeStagedDownloads() bool {
+	return s.resumeDownloads
+}
+
+func (s *stateTestController) PipelinedInstall() bool {
+	return false
+}
+
+func (s *stateTestController) DownloadRateLimited() bool {
+	return false
+}
+
+func (s *stateTestController) GetDownloadRateLimit(now time.Time) int64 {
+	return 0
+}
+
+func (s *stateTestController) HasUpgrade() (bool, *client.UpdateResponse, menderError) {
+	return s.hasUpgrade, s.upgradeUpdate, s.hasUpgradeErr
 }
 
-func (s *stateTestController) CheckUpdate() (*client.UpdateResponse, menderError) {
+func (s *stateTestController) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
 	return s.updateResp, s.updateRespErr
 }
 
-func (s *stateTestController) FetchUpdate(url string) (io.ReadCloser, int64, error) {
+func (s *stateTestController) UpdatesPaused() bool {
+	return s.updatesPaused
+}
+
+func (s *stateTestController) ClearAuthToken() {
+	s.tokenCleared = true
+}
+
+func (s *stateTestController) UpdatesEnabled() bool {
+	return !s.updatesOff && s.fatalFailure == ""
+}
+
+func (s *stateTestController) InventoryEnabled() bool {
+	return !s.inventoryOff
+}
+
+func (s *stateTestController) SetUpdatesPaused(paused bool) error {
+	s.updatesPaused = paused
+	return nil
+}
+
+func (s *stateTestController) FatalFailure() string {
+	return s.fatalFailure
+}
+
+func (s *stateTestController) Decommissioned() bool {
+	return s.decommissioned
+}
+
+func (s *stateTestController) SetFatalFailure(reason string) error {
+	s.fatalFailure = reason
+	return nil
+}
+
+func (s *stateTestController) MaintenanceWindowWait() time.Duration {
+	return s.maintenanceWait
+}
+
+func (s *stateTestController) DeploymentEligible(ctx context.Context,
+	update client.UpdateResponse) (bool, menderError) {
+	s.eligibleChecks++
+	return !s.ineligible, nil
+}
+
+func (s *stateTestController) UpdateConditionsMet() (bool, string) {
+	if s.updateConditions == nil {
+		return true, ""
+	}
+	return s.updateConditions()
+}
+
+func (s *stateTestController) NotifyUpdateDeferred(update client.UpdateResponse,
+	until time.Time) {
+	s.deferred = &update
+	s.deferredUntil = until
+}
+
+func (s *stateTestController) GetRebootDelay() (grace, max time.Duration) {
+	return s.rebootGrace, s.rebootDelayMax
+}
+
+func (s *stateTestController) RebootVetoed() bool {
+	s.rebootVetoes++
+	return s.rebootVetoes <= s.rebootVetoed
+}
+
+func (s *stateTestController) RunPostCommitScripts(update client.UpdateResponse) {
+	s.postCommit = &update
+}
+
+func (s *stateTestController) InstallArtifact(ctx context.Context, from io.ReadCloser,
+	size int64, name string) error {
+	return s.InstallUpdate(from, size)
+}
+
+func (s *stateTestController) GetDeviceStatus() deviceStatus {
+	return s.deviceStatus
+}
+
+func (s *stateTestController) ExportPublicKey() (string, error) {
+	return "", errors.New("no device key")
+}
+
+func (s *stateTestController) FetchUpdate(ctx context.Context, url string) (io.ReadCloser, int64, error) {
 	return s.updater.FetchUpdate(nil, url)
 }
 
+func (s *stateTestController) ResumeUpdate(ctx context.Context, url string,
+	offset int64) (io.ReadCloser, int64, error) {
+	return s.updater.FetchUpdateFrom(nil, url, offset)
+}
+
 func (s *stateTestController) GetCurrentState() State {
 	return s.state
 }
@@ -110,13 +318,19 @@ func (s *stateTestController) ReportUpdateStatus(update client.UpdateResponse, s
 	return s.reportError
 }
 
+func (s *stateTestController) ReportUpdateSubState(update client.UpdateResponse,
+	status, substate string) menderError {
+	s.reportSubState = substate
+	return s.ReportUpdateStatus(update, status)
+}
+
 func (s *stateTestController) UploadLog(update client.UpdateResponse, logs []byte) menderError {
 	s.logUpdate = update
 	s.logs = logs
 	return s.logSendingError
 }
 
-func (s *stateTestController) InventoryRefresh() error {
+func (s *stateTestController) InventoryRefresh(ctx context.Context) error {
 	return s.inventoryErr
 }
 
@@ -124,6 +338,10 @@ func (s *stateTestController) CheckScriptsCompatibility() error {
 	return nil
 }
 
+func (s *stateTestController) ReloadConfig(config menderConfig) {
+	s.pollIntvl = time.Duration(config.UpdatePollIntervalSeconds) * time.Second
+}
+
 type waitStateTest struct {
 	baseState
 }
@@ -134,6 +352,10 @@ func (c *waitStateTest) Wait(next, same State, wait time.Duration) (State, bool)
 	return next, false
 }
 
+func (c *waitStateTest) Wake() bool {
+	return false
+}
+
 func (c *waitStateTest) Stop() {
 	// Noop for now.
 }
@@ -183,6 +405,21 @@ func TestStateWait(t *testing.T) {
 	assert.Equal(t, authorizeWaitState, s)
 	assert.True(t, c)
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
+
+	// nothing to wake up
+	assert.False(t, cs.Wake())
+
+	// wait cut short returns the 'next' state
+	go func() {
+		for !cs.Wake() {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	tstart = time.Now()
+	s, c = cs.Wait(authorizeState, authorizeWaitState, time.Hour)
+	assert.Equal(t, authorizeState, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, time.Now(), tstart, time.Second)
 }
 
 func TestStateError(t *testing.T) {
@@ -234,6 +471,20 @@ func TestStateUpdateError(t *testing.T) {
 	usr, _ := s.(*UpdateStatusReportState)
 	assert.Equal(t, client.StatusFailure, usr.status)
 	assert.Equal(t, update, usr.Update())
+
+	// the cause of the failure is sent along with the status
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	output := &commandOutput{}
+	output.Write([]byte("Cannot access MTD device /mnt/uboot.env\n"))
+	cmdErr := commandError(errors.New("exit status 1"), "fw_setenv", output)
+	s, _ = NewUpdateErrorState(NewTransientError(cmdErr), update).Handle(&ctx, sc)
+	s.Handle(&ctx, sc)
+	assert.Equal(t, client.StatusFailure, sc.reportStatus)
+	assert.Equal(t, "transient error: fw_setenv failed: "+
+		"Cannot access MTD device /mnt/uboot.env: exit status 1", sc.reportSubState)
 }
 
 func TestStateUpdateReportStatus(t *testing.T) {
@@ -443,6 +694,16 @@ func TestStateInit(t *testing.T) {
 	use, _ := s.(*UpdateErrorState)
 	assert.Equal(t, update, use.update)
 
+	// state unknown to this version of the client, e.g. written by a newer
+	// one; the state data is dropped
+	ms.WriteAll(stateDataKey, []byte(`{"Version":1,"Name":"future-state",`+
+		`"UpdateInfo":{"ID":"foobar"}}`))
+	s, c = i.Handle(&ctx, &stateTestController{hasUpgrade: false})
+	assert.IsType(t, &IdleState{}, s)
+	assert.False(t, c)
+	_, err := LoadStateData(ms)
+	assert.True(t, os.IsNotExist(err))
+
 	// update-commit-leave behaviour
 	StoreStateData(ms, StateData{
 		UpdateInfo: update,
@@ -456,19 +717,199 @@ func TestStateInit(t *testing.T) {
 
 }
 
+func TestStateInitUpgradeUpdate(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fakeid"
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	// state data is damaged, but the update running from the uncommitted
+	// partition is known
+	ms.WriteAll(stateDataKey, []byte("garbage"))
+	storeUpgradeUpdate(ms, update)
+	sc := &stateTestController{
+		artifactName:  "fakeid",
+		hasUpgrade:    true,
+		upgradeUpdate: &update,
+	}
+
+	var s State = initState
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &AfterRebootState{}, s)
+
+	for i := 0; i < 10; i++ {
+		if _, ok := s.(*UpdateStatusReportState); ok {
+			break
+		}
+		s, _ = s.Handle(&ctx, sc)
+	}
+	require.IsType(t, &UpdateStatusReportState{}, s)
+	s.Handle(&ctx, sc)
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+	// the committed update is forgotten
+	_, ok := loadUpgradeUpdate(ms)
+	assert.False(t, ok)
+
+	// nothing is known about the update; report an error
+	ms.WriteAll(stateDataKey, []byte("garbage"))
+	s, _ = initState.Handle(&ctx, &stateTestController{hasUpgrade: true})
+	assert.IsType(t, &UpdateErrorState{}, s)
+}
+
+func TestStateInitCommittedArtifact(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	ms.WriteAll(previousArtifactName, []byte("release-1"))
+	sc := &stateTestController{artifactName: "release-2"}
+	s, _ := NewUpdateCommitState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStatusReportState{}, s)
+	RemoveStateData(ms)
+
+	// booted into the committed artifact
+	s, _ = initState.Handle(&ctx, sc)
+	assert.IsType(t, &IdleState{}, s)
+
+	// the bootloader fell back to the previous partition
+	sc = &stateTestController{artifactName: "release-1"}
+	s, _ = initState.Handle(&ctx, sc)
+	require.IsType(t, &UpdateStatusReportState{}, s)
+	s.Handle(&ctx, sc)
+	assert.Equal(t, client.StatusFailure, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+
+	// the failure is reported once
+	RemoveStateData(ms)
+	s, _ = initState.Handle(&ctx, sc)
+	assert.IsType(t, &IdleState{}, s)
+
+	// artifact installed without the daemon
+	storeCommittedUpdate(ms, update)
+	s, _ = initState.Handle(&ctx, &stateTestController{artifactName: "release-3"})
+	assert.IsType(t, &IdleState{}, s)
+	_, ok := loadCommittedUpdate(ms)
+	assert.False(t, ok)
+}
+
+func TestStateInitResume(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fakeid"
+
+	tc := map[string]struct {
+		data   StateData
+		state  State
+		status string
+	}{
+		"download": {
+			data: StateData{
+				Name:       MenderStateUpdateFetch,
+				UpdateInfo: update,
+				PartialArtifact: &PartialArtifact{
+					Path: "/data/mender/artifact.partial",
+				},
+			},
+			state: &UpdateFetchState{},
+		},
+		"streamed install": {
+			data: StateData{
+				Name:       MenderStateUpdateStore,
+				UpdateInfo: update,
+			},
+			state: &UpdateFetchState{},
+		},
+		"staged install": {
+			data: StateData{
+				Name:       MenderStateUpdateStore,
+				UpdateInfo: update,
+				StagedArtifact: &StagedArtifact{
+					Path: "/data/mender/artifact",
+				},
+			},
+			state: &UpdateStoreState{},
+		},
+		"status report": {
+			data: StateData{
+				Name:         MenderStateUpdateStatusReport,
+				UpdateInfo:   update,
+				UpdateStatus: client.StatusSuccess,
+			},
+			state:  &UpdateStatusReportState{},
+			status: client.StatusSuccess,
+		},
+		"status report without status": {
+			data: StateData{
+				Name:       MenderStateUpdateStatusReport,
+				UpdateInfo: update,
+			},
+			state: &UpdateErrorState{},
+		},
+		"install enabled": {
+			data: StateData{
+				Name:       MenderStateUpdateInstall,
+				UpdateInfo: update,
+			},
+			state: &UpdateErrorState{},
+		},
+	}
+
+	for name, test := range tc {
+		ms := store.NewMemStore()
+		ctx := StateContext{
+			store: ms,
+		}
+		require.NoError(t, StoreStateData(ms, test.data))
+
+		s, c := initState.Handle(&ctx, &stateTestController{hasUpgrade: false})
+		assert.IsType(t, test.state, s, name)
+		assert.False(t, c, name)
+		if us, ok := s.(UpdateState); ok {
+			assert.Equal(t, update, us.Update(), name)
+		}
+		if test.status != "" {
+			assert.Equal(t, test.status, s.(*UpdateStatusReportState).status, name)
+		}
+	}
+}
+
 func TestStateAuthorize(t *testing.T) {
 	a := AuthorizeState{}
-	s, c := a.Handle(nil, &stateTestController{})
+	ctx := new(StateContext)
+	s, c := a.Handle(ctx, &stateTestController{})
 	assert.IsType(t, &CheckWaitState{}, s)
 	assert.False(t, c)
 
-	s, c = a.Handle(nil, &stateTestController{
+	s, c = a.Handle(ctx, &stateTestController{
 		authorizeErr: NewTransientError(errors.New("auth fail temp")),
 	})
 	assert.IsType(t, &AuthorizeWaitState{}, s)
 	assert.False(t, c)
 
-	s, c = a.Handle(nil, &stateTestController{
+	s, c = a.Handle(ctx, &stateTestController{
 		authorizeErr: NewFatalError(errors.New("auth error")),
 	})
 	assert.IsType(t, &ErrorState{}, s)
@@ -532,6 +973,73 @@ func TestStateAuthorizeWait(t *testing.T) {
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
 }
 
+type waitRecorder struct {
+	baseState
+	waits []time.Duration
+}
+
+func (w *waitRecorder) Wait(next, same State, wait time.Duration) (State, bool) {
+	w.waits = append(w.waits, wait)
+	return next, false
+}
+
+func (w *waitRecorder) Wake() bool {
+	return false
+}
+
+func TestStateAuthorizeBackoff(t *testing.T) {
+	ctx := new(StateContext)
+	sc := &stateTestController{
+		retryIntvl:   time.Minute,
+		authorizeErr: NewTransientError(errors.New("auth fail temp")),
+	}
+	recorder := &waitRecorder{}
+	aws := &AuthorizeWaitState{WaitState: recorder}
+
+	for i := 0; i < authorizeFailuresBeforeBackoff+2; i++ {
+		s, _ := authorizeState.Handle(ctx, sc)
+		assert.IsType(t, &AuthorizeWaitState{}, s)
+		s, _ = aws.Handle(ctx, sc)
+		assert.Equal(t, authorizeState, s)
+	}
+
+	backoff := time.Minute * authorizeBackoffFactor
+	for i, w := range recorder.waits {
+		if i < authorizeFailuresBeforeBackoff-1 {
+			assert.Equal(t, time.Minute, w)
+		} else {
+			assert.Equal(t, backoff, w)
+		}
+	}
+
+	// successful authorization resets the backoff
+	sc.authorizeErr = nil
+	s, _ := authorizeState.Handle(ctx, sc)
+	assert.IsType(t, &CheckWaitState{}, s)
+	sc.authorizeErr = NewTransientError(errors.New("auth fail temp"))
+	authorizeState.Handle(ctx, sc)
+	aws.Handle(ctx, sc)
+	assert.Equal(t, time.Minute, recorder.waits[len(recorder.waits)-1])
+
+	// failures to reach the server do not count; the device is not
+	// rejected by the server
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	api, _ := client.New(client.Config{})
+	unreachable := client.NewStatus().Report(api, srv.URL,
+		client.StatusReport{DeploymentID: "1", Status: client.StatusSuccess})
+	assert.True(t, client.ServerUnreachable(unreachable))
+
+	ctx = new(StateContext)
+	sc.authorizeErr = NewTransientError(unreachable)
+	for i := 0; i < authorizeFailuresBeforeBackoff+2; i++ {
+		authorizeState.Handle(ctx, sc)
+		aws.Handle(ctx, sc)
+		assert.Equal(t, time.Minute, recorder.waits[len(recorder.waits)-1])
+	}
+	assert.Zero(t, ctx.authorizeFailures)
+}
+
 func TestUpdateVerifyState(t *testing.T) {
 
 	// create directory for storing deployments logs
@@ -585,6 +1093,16 @@ func TestUpdateVerifyState(t *testing.T) {
 	assert.IsType(t, &UpdateCommitState{}, s)
 	assert.False(t, c)
 
+	// health checks failed; reboot into the previous system
+	s, c = uvs.Handle(nil, &stateTestController{
+		hasUpgrade:   true,
+		artifactName: "fakeid",
+		verifyErr:    errors.New("health check failed"),
+	})
+	assert.IsType(t, &RollbackState{}, s)
+	assert.True(t, s.(*RollbackState).reboot)
+	assert.False(t, c)
+
 	// we should continue reporting have upgrade flag is not set
 	s, _ = uvs.Handle(nil, &stateTestController{
 		hasUpgrade:   false,
@@ -593,6 +1111,96 @@ func TestUpdateVerifyState(t *testing.T) {
 	assert.IsType(t, &RollbackState{}, s)
 }
 
+func TestStateUpdateControlTimeout(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fakeid"
+
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	ctx := StateContext{
+		store: store.NewMemStore(),
+		clock: func() time.Time { return now },
+	}
+	sc := &stateTestController{
+		hasUpgrade:     true,
+		artifactName:   "fakeid",
+		controlTimeout: 10 * time.Minute,
+		onVerify:       func(context.Context) { now = now.Add(9 * time.Minute) },
+	}
+
+	// confirmed in time
+	s, _ := NewUpdateVerifyState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.True(t, ctx.confirmDeadline.IsZero())
+
+	// health checks complete, but the update is confirmed too late
+	sc.onVerify = func(context.Context) { now = now.Add(11 * time.Minute) }
+	s, _ = NewUpdateVerifyState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &RollbackState{}, s)
+	assert.True(t, s.(*RollbackState).reboot)
+
+	// verification hangs; the update is rolled back once the deadline is
+	// reached
+	require.NoError(t, StoreStateData(ctx.store, StateData{
+		Name:       MenderStateReboot,
+		UpdateInfo: update,
+	}))
+	stopped := make(chan struct{})
+	deadline := make(chan time.Time, 1)
+	ctx.after = func(d time.Duration) <-chan time.Time {
+		assert.Equal(t, 10*time.Minute, d)
+		return deadline
+	}
+	sc.onVerify = func(vctx context.Context) {
+		deadline <- now.Add(10 * time.Minute)
+		<-vctx.Done()
+		close(stopped)
+	}
+	s, _ = NewUpdateVerifyState(update).Handle(&ctx, sc)
+	assert.IsType(t, &RollbackState{}, s)
+	assert.True(t, s.(*RollbackState).reboot)
+	// and the verification is stopped
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("verification was not stopped")
+	}
+
+	// the deadline is kept over a restart of the client
+	sd, err := LoadStateData(ctx.store)
+	require.NoError(t, err)
+	require.NotNil(t, sd.ConfirmDeadline)
+	assert.True(t, now.Add(10*time.Minute).Equal(*sd.ConfirmDeadline))
+	now = now.Add(11 * time.Minute)
+	verified := false
+	sc.onVerify = func(context.Context) { verified = true }
+	s, _ = NewUpdateVerifyState(update).Handle(&StateContext{
+		store: ctx.store,
+		clock: func() time.Time { return now },
+	}, sc)
+	assert.IsType(t, &RollbackState{}, s)
+	assert.False(t, verified)
+
+	// no limit; the client starts over after the rollback
+	sc.controlTimeout = 0
+	sc.onVerify = nil
+	ctx = StateContext{
+		store: store.NewMemStore(),
+	}
+	s, _ = NewUpdateVerifyState(update).Handle(&ctx, sc)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
 func TestStateUpdateCommit(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -631,6 +1239,84 @@ func TestStateUpdateCommit(t *testing.T) {
 	assert.False(t, c)
 	rs, _ := s.(*RollbackState)
 	assert.Equal(t, update, rs.Update())
+
+	// cleanup scripts run once the update is committed
+	update.Artifact.ArtifactName = "fakeid"
+	cs = NewUpdateCommitState(update)
+	sc = &stateTestController{artifactName: "fakeid"}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusSuccess, s.(*UpdateStatusReportState).status)
+	assert.Equal(t, &update, sc.postCommit)
+}
+
+func TestStateUpdateCheckWaitStartupDelay(t *testing.T) {
+	cws := NewCheckWaitState()
+	ctx := new(StateContext)
+	sc := &stateTestController{
+		pollIntvl:    time.Hour,
+		startupDelay: 50 * time.Millisecond,
+	}
+
+	// inventory is sent right away
+	s, _ := cws.Handle(ctx, sc)
+	assert.IsType(t, &InventoryUpdateState{}, s)
+	first := ctx.firstUpdateCheck
+	assert.False(t, first.IsZero())
+	ctx.lastInventoryUpdate = time.Now()
+
+	// first update check is delayed, but no longer than the configured delay
+	tstart := time.Now()
+	s, c := cws.Handle(ctx, sc)
+	tend := time.Now()
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, first, ctx.firstUpdateCheck)
+	assert.True(t, tend.Sub(tstart) >= first.Sub(tstart))
+	assert.WithinDuration(t, first, tend, 20*time.Millisecond)
+}
+
+func TestStateCheckWaitDisabledPhases(t *testing.T) {
+	run := func(sc *stateTestController) (int, int) {
+		cws := NewCheckWaitState()
+		ctx := new(StateContext)
+		var updates, inventories int
+		for i := 0; i < 6; i++ {
+			s, _ := cws.Handle(ctx, sc)
+			switch s.(type) {
+			case *UpdateCheckState:
+				updates++
+				ctx.lastUpdateCheck = time.Now()
+			case *InventoryUpdateState:
+				inventories++
+				ctx.lastInventoryUpdate = time.Now()
+			default:
+				t.Fatalf("unexpected state: %v", s)
+			}
+		}
+		return updates, inventories
+	}
+
+	updates, inventories := run(&stateTestController{pollIntvl: time.Millisecond})
+	assert.NotZero(t, updates)
+	assert.NotZero(t, inventories)
+
+	// inventory only; update check is never entered
+	updates, inventories = run(&stateTestController{
+		pollIntvl:  time.Millisecond,
+		updatesOff: true,
+	})
+	assert.Zero(t, updates)
+	assert.Equal(t, 6, inventories)
+
+	// updates only; inventory is never sent
+	updates, inventories = run(&stateTestController{
+		pollIntvl:    time.Millisecond,
+		inventoryOff: true,
+	})
+	assert.Equal(t, 6, updates)
+	assert.Zero(t, inventories)
 }
 
 func TestStateUpdateCheckWait(t *testing.T) {
@@ -678,12 +1364,47 @@ func TestStateUpdateCheckWait(t *testing.T) {
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
 }
 
-func TestStateUpdateCheck(t *testing.T) {
-	cs := UpdateCheckState{}
+func TestStateUpdateCheckBackoff(t *testing.T) {
 	ctx := new(StateContext)
+	sc := &stateTestController{
+		updateRespErr: NewTransientError(errors.New("server down")),
+	}
 
-	var s State
-	var c bool
+	// waits escalate with every failed check, up to the limit
+	expected := []time.Duration{2, 4, 8, 16, 16}
+	for i, exp := range expected {
+		s, _ := updateCheckState.Handle(ctx, sc)
+		assert.IsType(t, &ErrorState{}, s)
+		assert.Equal(t, i+1, ctx.updateCheckFailures)
+		assert.Equal(t, exp*time.Minute,
+			updateCheckBackoff(time.Minute, ctx.updateCheckFailures))
+	}
+
+	// the wait state waits longer after failed checks
+	ctx.updateCheckFailures = 2
+	ctx.lastUpdateCheck = time.Now()
+	tstart := time.Now()
+	s, _ := NewCheckWaitState().Handle(ctx, &stateTestController{
+		pollIntvl:    10 * time.Millisecond,
+		inventoryOff: true,
+	})
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.True(t, time.Since(tstart) >= 40*time.Millisecond)
+
+	// reset once the server responds again
+	sc.updateRespErr = nil
+	updateCheckState.Handle(ctx, sc)
+	assert.Equal(t, 0, ctx.updateCheckFailures)
+	assert.Equal(t, time.Minute,
+		updateCheckBackoff(time.Minute, ctx.updateCheckFailures))
+}
+
+func TestStateUpdateCheck(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	var s State
+	var c bool
 
 	// no update
 	s, c = cs.Handle(ctx, &stateTestController{})
@@ -709,6 +1430,54 @@ func TestStateUpdateCheck(t *testing.T) {
 	assert.Equal(t, *update, ufs.update)
 }
 
+func TestStateRateLimited(t *testing.T) {
+	now := time.Now()
+	ctx := &StateContext{
+		clock: func() time.Time { return now },
+	}
+	sc := &stateTestController{
+		pollIntvl:     time.Minute,
+		inventoryErr:  &client.RateLimitError{RetryAfter: time.Hour},
+		updateRespErr: NewTransientError(&client.RateLimitError{RetryAfter: 2 * time.Hour}),
+	}
+
+	// rate limited update check
+	cs := UpdateCheckState{}
+	s, _ := cs.Handle(ctx, sc)
+	assert.IsType(t, &ErrorState{}, s)
+	assert.Equal(t, now.Add(2*time.Hour), ctx.retryAfter)
+
+	recorder := &waitRecorder{}
+	cws := &CheckWaitState{WaitState: recorder}
+	ctx.lastInventoryUpdate = time.Now()
+	cws.Handle(ctx, sc)
+	assert.Len(t, recorder.waits, 1)
+	// the wait respects the delay requested by the server rather than the
+	// poll interval
+	assert.True(t, recorder.waits[0] > time.Hour+59*time.Minute)
+
+	// rate limited inventory update
+	ctx = &StateContext{
+		clock: func() time.Time { return now },
+	}
+	iu := InventoryUpdateState{}
+	s, _ = iu.Handle(ctx, sc)
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.Equal(t, now.Add(time.Hour), ctx.retryAfter)
+
+	ctx.lastUpdateCheck = time.Now()
+	cws.Handle(ctx, sc)
+	assert.Len(t, recorder.waits, 2)
+	assert.True(t, recorder.waits[1] > 59*time.Minute)
+	assert.True(t, recorder.waits[1] <= time.Hour)
+
+	// regular error does not change the wait
+	ctx = new(StateContext)
+	sc.inventoryErr = errors.New("inventory failed")
+	iu.Handle(ctx, sc)
+	assert.True(t, ctx.retryAfter.IsZero())
+}
+
 func TestUpdateCheckSameImage(t *testing.T) {
 	cs := UpdateCheckState{}
 	ctx := new(StateContext)
@@ -892,6 +1661,599 @@ func TestStateUpdateStore(t *testing.T) {
 	assert.IsType(t, &UpdateStatusReportState{}, s)
 }
 
+func TestStateUpdateFetchStaged(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	stagingDir := path.Join(tempDir, "staging")
+
+	data := "test"
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			consumeUpdate: true,
+		},
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+		stagingDir: stagingDir,
+	}
+
+	// artifact is downloaded to the staging location
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.False(t, c)
+	staged := s.(*UpdateStoreState).staged
+	assert.NotNil(t, staged)
+	stagedData, err := ioutil.ReadFile(staged.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(stagedData))
+
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateFetch, sd.Name)
+	assert.Equal(t, staged, sd.StagedArtifact)
+
+	// pretend the client was restarted; installation continues with the staged
+	// artifact
+	ctx = StateContext{
+		store: ms,
+	}
+	s, c = initState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, staged, s.(*UpdateStoreState).staged)
+
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.False(t, c)
+	// staged artifact is not needed anymore
+	_, err = os.Stat(staged.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// staged artifact got corrupted; it must be downloaded again
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString(data))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	staged = s.(*UpdateStoreState).staged
+	ioutil.WriteFile(staged.Path, []byte("tset"), 0600)
+
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	assert.False(t, c)
+	_, err = os.Stat(staged.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// downloaded size does not match the expected one
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString(data))
+	sc.updater.fetchUpdateReturnSize = 100
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+}
+
+func TestStateUpdateFetchChecksum(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	stagingDir := path.Join(tempDir, "staging")
+
+	data := "test"
+	sum := sha256.Sum256([]byte(data))
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.Source.URI = "https://mender.io/artifact"
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			consumeUpdate: true,
+		},
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString("tset")),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+		pollIntvl: 5 * time.Minute,
+	}
+
+	// corrupted download is detected once installed, and retried
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.False(t, c)
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	assert.False(t, c)
+	assert.True(t, errorIs(s.(*FetchStoreRetryState).err, ErrChecksumMismatch))
+
+	s.(*FetchStoreRetryState).WaitState = &waitStateTest{}
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.False(t, c)
+
+	// the whole download is verified, even if the installer does not read
+	// it to the end
+	sc.fakeDevice.consumeUpdate = false
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString("tset"))
+	s, _ = s.Handle(&ctx, sc)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	// correct download is installed
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString(data))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.False(t, c)
+
+	// corrupted staged download is removed and retried
+	sc.stagingDir = stagingDir
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString("tset"))
+	s, c = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	assert.False(t, c)
+	files, err := ioutil.ReadDir(stagingDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString(data))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.NotNil(t, s.(*UpdateStoreState).staged)
+}
+
+func TestStateUpdateFetchResume(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	stagingDir := path.Join(tempDir, "staging")
+	partialPath := path.Join(stagingDir, partialArtifactName)
+
+	data := "test"
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(
+				&brokenReader{bytes.NewBufferString(data[:2])}),
+			fetchUpdateReturnSize: int64(len(data)),
+		},
+		stagingDir:      stagingDir,
+		resumeDownloads: true,
+		pollIntvl:       5 * time.Minute,
+	}
+
+	// interrupted download is kept for resuming
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	sd, err := LoadStateData(ms)
+	require.NoError(t, err)
+	require.NotNil(t, sd.PartialArtifact)
+	assert.Equal(t, partialPath, sd.PartialArtifact.Path)
+	assert.EqualValues(t, 2, sd.PartialArtifact.Offset)
+
+	// download continues where it stopped
+	sc.updater.resumeUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString(data[2:]))
+	sc.updater.resumeUpdateReturnSize = int64(len(data))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStoreState{}, s)
+	stagedData, err := ioutil.ReadFile(s.(*UpdateStoreState).staged.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(stagedData))
+
+	// download starts over if it can not be resumed
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(
+		&brokenReader{bytes.NewBufferString(data[:2])})
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	sc.updater.resumeUpdateReturnError = client.ErrResumeNotSupported
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(bytes.NewBufferString(data))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStoreState{}, s)
+	stagedData, err = ioutil.ReadFile(s.(*UpdateStoreState).staged.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(stagedData))
+
+	// partial download is removed once fetching is given up
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(
+		&brokenReader{bytes.NewBufferString(data[:2])})
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	_, err = os.Stat(partialPath)
+	assert.NoError(t, err)
+
+	ctx.fetchInstallAttempts = 12
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	_, err = os.Stat(partialPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// without resuming enabled nothing is left behind
+	sc.resumeDownloads = false
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(
+		&brokenReader{bytes.NewBufferString(data[:2])})
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	_, err = os.Stat(partialPath)
+	assert.True(t, os.IsNotExist(err))
+	sd, err = LoadStateData(ms)
+	require.NoError(t, err)
+	assert.Nil(t, sd.PartialArtifact)
+}
+
+func TestStateUpdateFetchTooLarge(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	stagingDir := path.Join(tempDir, "staging")
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnError: ErrDownloadTooLarge,
+		},
+	}
+
+	// declared size is over the limit; the failure is reported right away
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// download goes over the limit; nothing is kept for resuming
+	sc.stagingDir = stagingDir
+	sc.resumeDownloads = true
+	sc.updater = fakeUpdater{
+		fetchUpdateReturnReadCloser: &artifactSizeLimiter{
+			ReadCloser: ioutil.NopCloser(bytes.NewBufferString("0123456789")),
+			max:        5,
+		},
+		fetchUpdateReturnSize: 5,
+	}
+	s, c = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+	_, err := os.Stat(path.Join(stagingDir, partialArtifactName))
+	assert.True(t, os.IsNotExist(err))
+
+	// install of a streamed artifact goes over the limit; neither is there
+	// any point in retrying other errors caused by the artifact itself
+	for _, err := range []error{
+		ErrDownloadTooLarge,
+		ErrNoSpace,
+		installer.ErrDeviceTypeMismatch,
+		installer.ErrSignatureInvalid,
+	} {
+		sc.fakeDevice.retInstallUpdate = err
+		s, c = NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("data")),
+			4, update).Handle(&ctx, sc)
+		assert.IsType(t, &UpdateStatusReportState{}, s, err.Error())
+		assert.False(t, c)
+	}
+}
+
+func TestStateUpdateFetchGone(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	stagingDir := path.Join(tempDir, "staging")
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	gone := pkgerrors.Wrap(client.ErrUpdateGone, "410 Gone")
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnError: gone,
+		},
+	}
+
+	// the update removed from the server is not downloaded again
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// nor is the download resumed if it is removed in the meantime
+	sc.stagingDir = stagingDir
+	sc.resumeDownloads = true
+	sc.updater = fakeUpdater{
+		fetchUpdateReturnReadCloser: ioutil.NopCloser(
+			&failingReader{bytes.NewBufferString("data"), gone}),
+		fetchUpdateReturnSize: 10,
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	_, err := os.Stat(path.Join(stagingDir, partialArtifactName))
+	assert.True(t, os.IsNotExist(err))
+
+	// a streamed download fails the same way
+	sc.fakeDevice.retInstallUpdate = gone
+	s, _ = NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("data")),
+		4, update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
+func TestStateUpdateStoreReconnectsExhausted(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{}
+	sc.fakeDevice.retInstallUpdate = pkgerrors.Wrap(
+		client.ErrReconnectsExhausted, "reading artifact")
+
+	// the download is not started over once it was resumed as many times
+	// as allowed
+	s, c := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("data")),
+		4, update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	assert.Zero(t, ctx.fetchInstallAttempts)
+}
+
+func TestStateUpdateFetchCancel(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	sent := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/download" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Length", "8192")
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		close(sent)
+		// stall the download
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL:          srv.URL,
+			ArtifactStagingDir: path.Join(tempDir, "staging"),
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.Source.URI = srv.URL + "/download"
+	fs := NewUpdateFetchState(update)
+
+	go func() {
+		<-sent
+		// let the download get going
+		time.Sleep(100 * time.Millisecond)
+		fs.Cancel()
+	}()
+
+	res := make(chan bool)
+	go func() {
+		_, c := fs.Handle(&StateContext{store: ms}, mender)
+		res <- c
+	}()
+
+	// download is aborted right away instead of waiting for it to finish
+	select {
+	case c := <-res:
+		assert.True(t, c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch state was not cancelled")
+	}
+	assert.False(t, fs.Cancel())
+}
+
+func TestStateUpdateStoreDeltaBaseMismatch(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Delta = &client.DeltaSource{
+		BaseArtifactName: "release-1",
+		URI:              "https://delta",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			retInstallUpdate: errDeltaBaseMismatch,
+		},
+		pollIntvl: time.Minute,
+	}
+
+	data := "delta"
+	uis := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+
+	// retry with the full update
+	s, c := uis.Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	assert.False(t, c)
+	assert.Nil(t, s.(*FetchStoreRetryState).update.Delta)
+}
+
+func TestStateUpdateStoreArtifactNameMismatch(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.ArtifactName = "release-2"
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			retInstallUpdate: installer.ErrArtifactNameMismatch,
+		},
+		pollIntvl: time.Minute,
+	}
+
+	data := "artifact"
+	uis := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+
+	// not retried, failure is reported
+	s, _ := uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	usr, _ := s.(*UpdateStatusReportState)
+	assert.Equal(t, client.StatusFailure, usr.status)
+
+	// artifact is installed already; nothing to do
+	sc.fakeDevice.retInstallUpdate = installer.ErrArtifactAlreadyInstalled
+	uis = NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+	s, _ = uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	usr, _ = s.(*UpdateStatusReportState)
+	assert.Equal(t, client.StatusAlreadyInstalled, usr.status)
+}
+
+// customUpdateComposer writes the rootfs image as an update of a custom type
+type customUpdateComposer struct {
+	handlers.Composer
+}
+
+func (c customUpdateComposer) GetType() string {
+	return "custom-update"
+}
+
+// testUpdateHandler records the custom update it installs and activates
+type testUpdateHandler struct {
+	installed string
+	activated bool
+}
+
+func (h *testUpdateHandler) InstallFile(r io.Reader, name string, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	h.installed = string(data)
+	return err
+}
+
+func (h *testUpdateHandler) Activate() error {
+	h.activated = true
+	return nil
+}
+
+func TestStateUpdateCustomType(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	var reports []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			data, _ := ioutil.ReadAll(r.Body)
+			reports = append(reports, string(data))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	h := &testUpdateHandler{}
+	require.NoError(t, installer.RegisterUpdateHandler("custom-update", h))
+	defer installer.RegisterUpdateHandler("custom-update", nil)
+
+	env := &fakeBootEnv{}
+	runner := newTestOSCalls("", 0)
+	device := NewDevice(env, &runner, deviceConfig{
+		rootfsPartA: "/dev/mmcblk0p2",
+		rootfsPartB: "/dev/mmcblk0p3",
+	})
+	device.active = "/dev/mmcblk0p2"
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+		testMenderPieces{MenderPieces: MenderPieces{store: ms, device: device}})
+	mender.artifactInfoFile = path.Join(tempDir, "artifact_info")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=foo-1"), 0600)
+	mender.deviceTypeFile = path.Join(tempDir, "device_type")
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=foo"), 0600)
+
+	upd, err := MakeFakeUpdate("custom update data")
+	require.NoError(t, err)
+	defer os.Remove(upd)
+	art := bytes.NewBuffer(nil)
+	err = awriter.NewWriter(art).WriteArtifact("mender", 2, []string{"foo"},
+		"custom-1", &awriter.Updates{
+			U: []handlers.Composer{customUpdateComposer{handlers.NewRootfsV2(upd)}},
+		}, &artifact.Scripts{})
+	require.NoError(t, err)
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "custom-1"
+	ctx := &StateContext{store: ms}
+
+	// installed and activated by the handler; the device is not rebooted
+	// and the boot flags are neither switched nor committed
+	var s State = NewUpdateStoreState(ioutil.NopCloser(art), int64(art.Len()), update)
+	for i := 0; i < 10; i++ {
+		if _, ok := s.(*IdleState); ok {
+			break
+		}
+		assert.NotEqual(t, MenderStateReboot, s.Id())
+		assert.NotEqual(t, MenderStateUpdateCommit, s.Id())
+		s, _ = s.Handle(ctx, mender)
+	}
+	assert.IsType(t, &IdleState{}, s)
+
+	assert.Equal(t, "custom update data", h.installed)
+	assert.True(t, h.activated)
+	assert.Nil(t, env.writeVars)
+	require.NotEmpty(t, reports)
+	assert.Contains(t, reports[len(reports)-1], client.StatusSuccess)
+	_, ok := loadUpgradeUpdate(ms)
+	assert.False(t, ok)
+}
+
 func TestStateUpdateInstallRetry(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -954,6 +2316,69 @@ func TestStateUpdateInstallRetry(t *testing.T) {
 	assert.False(t, c)
 }
 
+func TestStateRebootStrategy(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+
+	for _, strategy := range []string{
+		rebootStrategySystem,
+		rebootStrategyCommand,
+	} {
+		ctx := StateContext{
+			store: store.NewMemStore(),
+		}
+		sc := &stateTestController{
+			rebootStrategy: strategy,
+		}
+		s, _ := NewUpdateInstallState(update).Handle(&ctx, sc)
+		assert.IsType(t, &RebootState{}, s)
+		s, _ = s.Handle(&ctx, sc)
+		assert.IsType(t, &FinalState{}, s)
+		assert.True(t, sc.rebooted)
+	}
+
+	// update takes effect without reboot
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		rebootStrategy: rebootStrategyNone,
+	}
+	s, _ := NewUpdateInstallState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, sc.rebooted)
+
+	// artifact declares the reboot is not needed
+	sc = &stateTestController{
+		noReboot: true,
+	}
+	s, _ = NewUpdateInstallState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.False(t, sc.rebooted)
+
+	// update is installed and the partition enabled, the device is
+	// rebooted by hand
+	require.NoError(t, StoreStateData(ctx.store, StateData{
+		Name:       MenderStateUpdateInstall,
+		UpdateInfo: update,
+	}))
+	sc = &stateTestController{
+		rebootStrategy: rebootStrategyManual,
+	}
+	s, _ = NewUpdateInstallState(update).Handle(&ctx, sc)
+	assert.Equal(t, doneState, s)
+	assert.True(t, sc.enabled)
+	assert.False(t, sc.rebooted)
+	_, err := ctx.store.ReadAll(stateDataKey)
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestStateReboot(t *testing.T) {
 	update := client.UpdateResponse{
 		ID: "foo",
@@ -1003,6 +2428,65 @@ func TestStateReboot(t *testing.T) {
 	assert.IsType(t, &RollbackState{}, s)
 }
 
+func TestStateRebootGracePeriod(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+
+	tcs := []struct {
+		vetoed   int
+		max      time.Duration
+		delay    time.Duration
+		askedFor int
+	}{
+		// reboot right after the grace period
+		{vetoed: 0, max: time.Second, delay: 50 * time.Millisecond, askedFor: 1},
+		// every veto adds another grace period
+		{vetoed: 2, max: time.Second, delay: 150 * time.Millisecond, askedFor: 3},
+		// the reboot is not postponed for longer than the maximum
+		{vetoed: 100, max: 120 * time.Millisecond, delay: 120 * time.Millisecond, askedFor: 3},
+	}
+	for _, tc := range tcs {
+		sc := &stateTestController{
+			rebootGrace:    50 * time.Millisecond,
+			rebootDelayMax: tc.max,
+			rebootVetoed:   tc.vetoed,
+		}
+		start := time.Now()
+		s, c := NewRebootState(update).Handle(&ctx, sc)
+		took := time.Since(start)
+		assert.IsType(t, &FinalState{}, s)
+		assert.False(t, c)
+		assert.Equal(t, client.StatusRebooting, sc.reportStatus)
+		assert.True(t, took >= tc.delay, "rebooted after %v", took)
+		assert.True(t, took < tc.delay+80*time.Millisecond, "rebooted after %v", took)
+		assert.Equal(t, tc.askedFor, sc.rebootVetoes)
+	}
+
+	// cancelled before rebooting
+	sc := &stateTestController{
+		rebootGrace:    time.Hour,
+		rebootDelayMax: time.Hour,
+	}
+	rs := NewRebootState(update)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		rs.Cancel()
+	}()
+	s, c := rs.Handle(&ctx, sc)
+	assert.Equal(t, rs, s)
+	assert.True(t, c)
+	assert.Empty(t, sc.reportStatus)
+	assert.Zero(t, sc.rebootVetoes)
+}
+
 func TestStateRollback(t *testing.T) {
 	update := client.UpdateResponse{
 		ID: "foo",
@@ -1018,7 +2502,7 @@ func TestStateRollback(t *testing.T) {
 		fakeDevice: fakeDevice{
 			retRollback: NewFatalError(errors.New("rollback failed")),
 		}})
-	assert.IsType(t, &ErrorState{}, s)
+	assert.IsType(t, &FatalState{}, s)
 	assert.False(t, c)
 
 	s, c = rs.Handle(nil, &stateTestController{})
@@ -1026,6 +2510,66 @@ func TestStateRollback(t *testing.T) {
 	assert.False(t, c)
 }
 
+func TestStateFatal(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+				device: &fakeDevice{
+					retRollback: errors.New("rollback failed"),
+				},
+			},
+		})
+	assert.True(t, mender.UpdatesEnabled())
+
+	// rollback can not be done
+	ctx := &StateContext{store: ms}
+	s, c := NewRollbackState(update, true, false).Handle(ctx, mender)
+	assert.IsType(t, &FatalState{}, s)
+	assert.False(t, c)
+
+	// the failure is recorded and reported
+	s, c = s.Handle(ctx, mender)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+	assert.False(t, c)
+	reason, err := ms.ReadAll(fatalFailureName)
+	assert.NoError(t, err)
+	assert.Contains(t, string(reason), "rollback failed")
+	assert.Contains(t, mender.GetDeviceStatus().FatalFailure, "rollback failed")
+
+	// no more update checks, only the inventory is submitted
+	assert.False(t, mender.UpdatesEnabled())
+	ctx = &StateContext{
+		store:               ms,
+		lastUpdateCheck:     time.Now().Add(-2 * time.Hour),
+		lastInventoryUpdate: time.Now().Add(-time.Hour),
+	}
+	mender.config.UpdatePollIntervalSeconds = 60
+	mender.config.InventoryPollIntervalSeconds = 60
+	s, c = checkWaitState.Handle(ctx, mender)
+	assert.Equal(t, inventoryUpdateState, s)
+	assert.False(t, c)
+
+	// the record survives restarts until the operator clears it
+	assert.Equal(t, string(reason), newTestMender(nil, menderConfig{},
+		testMenderPieces{MenderPieces: MenderPieces{store: ms}}).FatalFailure())
+	assert.NoError(t, mender.SetFatalFailure(""))
+	assert.True(t, mender.UpdatesEnabled())
+	s, c = checkWaitState.Handle(ctx, mender)
+	assert.Equal(t, updateCheckState, s)
+	assert.False(t, c)
+}
+
 func TestStateFinal(t *testing.T) {
 	rs := FinalState{}
 
@@ -1079,10 +2623,28 @@ func TestStateReportError(t *testing.T) {
 	}
 	sc := &stateTestController{}
 
-	// update succeeded, but we failed to report the status to the server,
-	// rollback happens next
+	// update succeeded, but we failed to report the status to the server;
+	// the report is kept to be sent again later
 	res := NewReportErrorState(update, client.StatusSuccess)
 	s, c := res.Handle(ctx, sc)
+	assert.IsType(t, &IdleState{}, s)
+	assert.False(t, c)
+	pending, ok := loadPendingReport(ms)
+	assert.True(t, ok)
+	assert.Equal(t, update, pending)
+	clearPendingReport(ms)
+
+	// or dropped
+	sc.commitReport = commitReportIgnore
+	s, c = res.Handle(ctx, sc)
+	assert.IsType(t, &IdleState{}, s)
+	assert.False(t, c)
+	_, ok = loadPendingReport(ms)
+	assert.False(t, ok)
+
+	// or the update is rolled back
+	sc.commitReport = commitReportRollback
+	s, c = res.Handle(ctx, sc)
 	assert.IsType(t, &RollbackState{}, s)
 	assert.False(t, c)
 
@@ -1120,6 +2682,64 @@ func TestStateReportError(t *testing.T) {
 	assert.Equal(t, err, nil)
 }
 
+func TestStatePendingSuccessReport(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	// server rejects the first success report
+	var reports []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		reports = append(reports, string(data))
+		if len(reports) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+		testMenderPieces{MenderPieces: MenderPieces{store: ms}})
+	mender.artifactInfoFile = path.Join(tempDir, "artifact_info")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=foo-1"), 0600)
+	mender.deviceTypeFile = path.Join(tempDir, "device_type")
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=foo"), 0600)
+	ctx := &StateContext{store: ms}
+
+	update := client.UpdateResponse{ID: "foo"}
+	usr := NewUpdateStatusReportState(update, client.StatusSuccess)
+	s, _ := usr.Handle(ctx, mender)
+	require.IsType(t, &UpdateStatusReportRetryState{}, s)
+	assert.Len(t, reports, 1)
+
+	// out of retries
+	s, _ = NewUpdateStatusReportRetryState(usr, update, client.StatusSuccess,
+		100).Handle(ctx, mender)
+	require.IsType(t, &ReportErrorState{}, s)
+	s, _ = s.Handle(ctx, mender)
+	assert.IsType(t, &IdleState{}, s)
+
+	// report is delivered with the next update check
+	s, _ = updateCheckState.Handle(ctx, mender)
+	assert.Equal(t, checkWaitState, s)
+	require.Len(t, reports, 2)
+	assert.Contains(t, reports[1], `"status":"success"`)
+	_, ok := loadPendingReport(ms)
+	assert.False(t, ok)
+
+	// and only once
+	s, _ = updateCheckState.Handle(ctx, mender)
+	assert.Equal(t, checkWaitState, s)
+	assert.Len(t, reports, 2)
+}
+
 func TestMaxSendingAttempts(t *testing.T) {
 	assert.Equal(t, minReportSendRetries,
 		maxSendingAttempts(time.Second, 0*time.Second, minReportSendRetries))
@@ -1129,3 +2749,241 @@ func TestMaxSendingAttempts(t *testing.T) {
 	assert.Equal(t, minReportSendRetries,
 		maxSendingAttempts(time.Second, time.Second, minReportSendRetries))
 }
+
+func TestStateUpdateCheckPaused(t *testing.T) {
+	ctx := StateContext{}
+	sc := &stateTestController{
+		updateResp: &client.UpdateResponse{
+			ID: "foo",
+		},
+		updatesPaused: true,
+	}
+
+	s, c := updateCheckState.Handle(&ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.False(t, c)
+	assert.False(t, ctx.lastUpdateCheck.IsZero())
+
+	sc.updatesPaused = false
+	s, _ = updateCheckState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+}
+
+func TestStateUpdateCheckMaintenanceWindow(t *testing.T) {
+	update := &client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	ctx := StateContext{}
+	sc := &stateTestController{
+		updateResp:      update,
+		maintenanceWait: 2 * time.Hour,
+	}
+
+	// installation deferred until the window opens
+	s, _ := updateCheckState.Handle(&ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	require.NotNil(t, sc.deferred)
+	assert.Equal(t, "release-2", sc.deferred.ArtifactName())
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), sc.deferredUntil, time.Minute)
+
+	// window is open
+	sc = &stateTestController{
+		updateResp: update,
+	}
+	s, _ = updateCheckState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Nil(t, sc.deferred)
+}
+
+func TestStateUpdateConditions(t *testing.T) {
+	update := &client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	onBattery := true
+	ctx := new(StateContext)
+	sc := &stateTestController{
+		updateResp:   update,
+		pollIntvl:    time.Hour,
+		retryIntvl:   10 * time.Millisecond,
+		inventoryOff: true,
+		updateConditions: func() (bool, string) {
+			if onBattery {
+				return false, "running on battery"
+			}
+			return true, ""
+		},
+	}
+
+	// nothing is checked for while the device runs on battery
+	s, _ := updateCheckState.Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.True(t, ctx.updatesDeferred)
+
+	// the conditions are checked again at the retry interval
+	tstart := time.Now()
+	s, _ = NewCheckWaitState().Handle(ctx, sc)
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.True(t, time.Since(tstart) < time.Minute)
+
+	// a pending download is deferred as well
+	s, _ = NewUpdateFetchState(*update).Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Empty(t, sc.reportStatus)
+
+	// the update continues once the device is plugged in
+	onBattery = false
+	s, _ = updateCheckState.Handle(ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.False(t, ctx.updatesDeferred)
+}
+
+func TestStateUpdateFetchIneligible(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	// eligibility is checked when the update is fetched, not when it is
+	// offered
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		updateResp: update,
+		ineligible: true,
+		updater: fakeUpdater{
+			fetchUpdateReturnError: errors.New("fetched"),
+		},
+	}
+	s, _ := updateCheckState.Handle(&ctx, sc)
+	require.IsType(t, &UpdateFetchState{}, s)
+
+	// deployment aborted before the download; nothing is downloaded
+	s, _ = s.Handle(&ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Empty(t, sc.reportStatus)
+	_, err := LoadStateData(ctx.store)
+	assert.True(t, os.IsNotExist(err))
+
+	// download resumed after a restart is dropped as well
+	require.NoError(t, StoreStateData(ctx.store, StateData{
+		Name:       MenderStateUpdateFetch,
+		UpdateInfo: *update,
+	}))
+	s, _ = NewUpdateFetchState(*update).Handle(&ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Empty(t, sc.reportStatus)
+	_, err = LoadStateData(ctx.store)
+	assert.True(t, os.IsNotExist(err))
+
+	// still offered; checked only once for the retries of the fetch
+	sc.ineligible = false
+	sc.eligibleChecks = 0
+	s, _ = NewUpdateFetchState(*update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	s, _ = NewUpdateFetchState(*update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	assert.Equal(t, 1, sc.eligibleChecks)
+}
+
+func TestStateUpdateCheckClientTooOld(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	version := Version
+	defer func() { Version = version }()
+	Version = "1.7.0"
+
+	update := &client.UpdateResponse{
+		ID:               "foo",
+		MinClientVersion: "1.8.0",
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		updateResp: update,
+	}
+
+	// declined without downloading anything
+	s, _ := updateCheckState.Handle(&ctx, sc)
+	require.IsType(t, &UpdateStatusReportState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.Equal(t, idleState, s)
+	assert.Equal(t, client.StatusFailure, sc.reportStatus)
+	assert.Equal(t, "client too old: version 1.7.0, update requires 1.8.0",
+		sc.reportSubState)
+
+	// recent enough
+	Version = "1.8.0"
+	sc = &stateTestController{
+		updateResp: update,
+	}
+	s, _ = updateCheckState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+}
+
+func TestStateUpdateChain(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	makeUpdate := func(id string) client.UpdateResponse {
+		u := client.UpdateResponse{ID: id}
+		u.Artifact.ArtifactName = "artifact-" + id
+		return u
+	}
+	first := makeUpdate("1")
+	first.Next = []client.UpdateResponse{makeUpdate("2"), makeUpdate("3")}
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{
+		updateResp: &first,
+	}
+
+	// the first update is installed, the rest is queued
+	s, _ := updateCheckState.Handle(&ctx, sc)
+	require.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, "1", s.(*UpdateFetchState).update.ID)
+	assert.Len(t, loadPendingUpdates(ms), 2)
+
+	// the following ones are installed in order once the previous succeeds
+	for _, id := range []string{"2", "3"} {
+		s, _ = NewUpdateStatusReportState(s.(*UpdateFetchState).update,
+			client.StatusSuccess).Handle(&ctx, sc)
+		require.IsType(t, &UpdateFetchState{}, s)
+		assert.Equal(t, id, s.(*UpdateFetchState).update.ID)
+		assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+		assert.Empty(t, s.(*UpdateFetchState).update.Next)
+	}
+	s, _ = NewUpdateStatusReportState(s.(*UpdateFetchState).update,
+		client.StatusSuccess).Handle(&ctx, sc)
+	assert.Equal(t, idleState, s)
+	assert.Equal(t, "3", sc.reportUpdate.ID)
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+
+	// chain stops at the first failure
+	s, _ = updateCheckState.Handle(&ctx, sc)
+	require.IsType(t, &UpdateFetchState{}, s)
+	s, _ = NewUpdateStatusReportState(first, client.StatusFailure).Handle(&ctx, sc)
+	assert.Equal(t, idleState, s)
+	assert.Equal(t, "1", sc.reportUpdate.ID)
+	assert.Equal(t, client.StatusFailure, sc.reportStatus)
+	assert.Empty(t, loadPendingUpdates(ms))
+	_, err := ms.ReadAll(pendingUpdatesKey)
+	assert.True(t, os.IsNotExist(err))
+}
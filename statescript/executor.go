@@ -52,6 +52,10 @@ type Launcher struct {
 	Timeout                 int
 	RetryInterval           int
 	RetryTimeout            int
+	// returns variables added to the environment of the scripts, such as
+	// the details of the deployment in progress; called every time the
+	// scripts are run
+	Environment func() []string
 }
 
 func (l *Launcher) getRetryInterval() time.Duration {
@@ -72,7 +76,7 @@ func (l *Launcher) getRetryTimeout() time.Duration {
 	return defaultStateScriptRetryInterval
 }
 
-//TODO: we can optimize for reading directories once and then creating
+// TODO: we can optimize for reading directories once and then creating
 // a map with all the scripts that needs to be executed.
 func (l Launcher) CheckRootfsScriptsVersion() error {
 	// first check if we are having some scripts
@@ -181,9 +185,12 @@ func (l Launcher) getTimeout() time.Duration {
 	return t
 }
 
-func execute(name string, timeout time.Duration) error {
+func execute(name string, env []string, timeout time.Duration) error {
 
 	cmd := exec.Command(name)
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	var stderr io.ReadCloser
 	var err error
@@ -252,11 +259,12 @@ func retCode(err error) int {
 
 // Catches a script that requests a retry in a loop. Is limited by the total window given to a script demanding a
 // retry.
-func executeScript(s os.FileInfo, dir string, l Launcher, timeout time.Duration, ignoreError bool) error {
+func executeScript(s os.FileInfo, dir string, l Launcher, env []string,
+	timeout time.Duration, ignoreError bool) error {
 
 	iet := time.Now()
 	for {
-		err := execute(filepath.Join(dir, s.Name()), timeout)
+		err := execute(filepath.Join(dir, s.Name()), env, timeout)
 		switch ret := retCode(err); ret {
 		case 0:
 			// success
@@ -309,6 +317,11 @@ func (l Launcher) ExecuteAll(state, action string, ignoreError bool,
 	execBits := os.FileMode(syscall.S_IXUSR | syscall.S_IXGRP | syscall.S_IXOTH)
 	timeout := l.getTimeout()
 
+	var env []string
+	if l.Environment != nil && len(scr) != 0 {
+		env = l.Environment()
+	}
+
 	for _, s := range scr {
 		// check if script is executable
 		if s.Mode()&execBits == 0 {
@@ -337,7 +350,7 @@ func (l Launcher) ExecuteAll(state, action string, ignoreError bool,
 			}()
 		}
 
-		if err = executeScript(s, dir, l, timeout, ignoreError); err != nil {
+		if err = executeScript(s, dir, l, env, timeout, ignoreError); err != nil {
 			return err
 		}
 	}
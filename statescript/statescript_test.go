@@ -203,7 +203,7 @@ func TestExecutor(t *testing.T) {
 	log.SetOutput(&buf)
 	fileP, err := createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_00", "#!/bin/bash \necho 'error data' >&2")
 	assert.NoError(t, err)
-	err = execute(fileP.Name(), 100) // give the script plenty of time to run
+	err = execute(fileP.Name(), nil, 100) // give the script plenty of time to run
 	assert.NoError(t, err)
 	assert.Contains(t, buf.String(), "error data")
 
@@ -212,14 +212,14 @@ func TestExecutor(t *testing.T) {
 	// write more than 10KB to stderr
 	fileP, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_11", "#!/bin/bash \nhead -c 89999 </dev/urandom >&2\n exit 1")
 	assert.NoError(t, err)
-	err = execute(fileP.Name(), 100)
+	err = execute(fileP.Name(), nil, 100)
 	assert.EqualError(t, err, "exit status 1")
 	assert.Contains(t, buf.String(), "Truncated to 10KB")
 
 	// add a script that will time-out, and die
 	filep, err := createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_10_btoot", "!#/bin/bash \nsleep 2")
 	assert.NoError(t, err)
-	ret := retCode(execute(filep.Name(), 1))
+	ret := retCode(execute(filep.Name(), nil, 1))
 	assert.Equal(t, ret, -1)
 
 	// Test retry-later functionality
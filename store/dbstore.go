@@ -177,6 +177,42 @@ func (db *DBStore) Remove(name string) error {
 	return nil
 }
 
+// Keys returns the names of all entries; LMDB keeps the keys sorted.
+func (db *DBStore) Keys() ([]string, error) {
+	if db.env == nil {
+		return nil, ErrDBStoreNotInitialized
+	}
+
+	var keys []string
+	err := db.env.View(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+
+		cur, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		for {
+			k, _, err := cur.Get(nil, nil, lmdb.Next)
+			if lmdb.IsNotFound(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			keys = append(keys, string(k))
+		}
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list keys")
+	}
+	return keys, nil
+}
+
 func (db *DBStore) OpenWrite(name string) (WriteCloserCommitter, error) {
 	dbw := DBStoreWrite{
 		dbs:  db,
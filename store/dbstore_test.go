@@ -72,6 +72,10 @@ func TestDBStore(t *testing.T) {
 	err = w.Commit()
 	assert.NoError(t, err)
 
+	keys, err := d.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, keys)
+
 	// try ReadAll()
 	wdata, err := d.ReadAll("bar")
 	assert.NoError(t, err)
@@ -18,6 +18,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/mendersoftware/log"
 )
@@ -125,6 +126,15 @@ func (d DirStore) CommitFile(name string) error {
 	return err
 }
 
+// Chmod changes the mode of the temporary file.
+func (df DirFile) Chmod(mode os.FileMode) error {
+	f, ok := df.WriteCloser.(*os.File)
+	if !ok {
+		return nil
+	}
+	return f.Chmod(mode)
+}
+
 func (df DirFile) Commit() error {
 	return df.dirstore.CommitFile(df.name)
 }
@@ -132,3 +142,21 @@ func (df DirFile) Commit() error {
 func (d DirStore) Remove(name string) error {
 	return os.Remove(d.getPath(name))
 }
+
+// Keys returns the names of all committed entries; the temporary copies of
+// entries being written are skipped.
+func (d DirStore) Keys() ([]string, error) {
+	infos, err := ioutil.ReadDir(d.basepath)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), "~") {
+			continue
+		}
+		keys = append(keys, info.Name())
+	}
+	return keys, nil
+}
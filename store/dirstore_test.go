@@ -90,6 +90,11 @@ func TestDirStore(t *testing.T) {
 	assert.False(t, pathExists(d.getPath("bar")))
 	out.Close()
 
+	// entry not committed yet is not listed
+	keys, err := d.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, keys)
+
 	// commit the file now
 	out.Commit()
 	assert.False(t, pathExists(d.getTempPath("bar")))
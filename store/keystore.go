@@ -18,7 +18,9 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"io"
 	"io/ioutil"
@@ -30,16 +32,31 @@ import (
 
 const (
 	RsaKeyLength = 3072
+
+	// the private key must not be accessible by anyone but the owner
+	keyFileMode os.FileMode = 0600
 )
 
 var (
-	errNoKeys = errors.New("no keys")
+	errNoKeys                 = errors.New("no keys")
+	errInsecureKeyPermissions = errors.New("insecure key file permissions")
 )
 
 type Keystore struct {
 	store   Store
 	private *rsa.PrivateKey
 	keyName string
+	// load the key even if it is accessible by other users
+	allowInsecurePermissions bool
+}
+
+// implemented by store entries backed by files
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+type chmodder interface {
+	Chmod(mode os.FileMode) error
 }
 
 func (k *Keystore) GetStore() Store {
@@ -54,6 +71,12 @@ func (k *Keystore) GetKeyName() string {
 	return k.keyName
 }
 
+// SetAllowInsecurePermissions controls whether a key file that can be accessed
+// by users other than the owner is loaded or rejected.
+func (k *Keystore) SetAllowInsecurePermissions(allow bool) {
+	k.allowInsecurePermissions = allow
+}
+
 func NewKeystore(store Store, name string) *Keystore {
 	if store == nil {
 		return nil
@@ -77,6 +100,10 @@ func (k *Keystore) Load() error {
 	}
 	defer inf.Close()
 
+	if err := k.checkPermissions(inf); err != nil {
+		return err
+	}
+
 	k.private, err = loadFromPem(inf)
 	if err != nil {
 		log.Errorf("failed to load key: %s", err)
@@ -96,6 +123,15 @@ func (k *Keystore) Save() error {
 		return err
 	}
 
+	// restrict the permissions before any key data is written; the entry
+	// is then committed atomically with the correct mode
+	if f, ok := outf.(chmodder); ok {
+		if err := f.Chmod(keyFileMode); err != nil {
+			outf.Close()
+			return errors.Wrapf(err, "failed to set key file permissions")
+		}
+	}
+
 	err = saveToPem(outf, k.private)
 	if err != nil {
 		// make sure to close the file
@@ -110,6 +146,39 @@ func (k *Keystore) Save() error {
 	return outf.Commit()
 }
 
+// Remove deletes the stored key and forgets the loaded one; it is not an error
+// if there is no key.
+func (k *Keystore) Remove() error {
+	k.private = nil
+	if err := k.store.Remove(k.keyName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (k *Keystore) checkPermissions(in io.Reader) error {
+	f, ok := in.(statter)
+	if !ok {
+		// not backed by a file
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to check key file permissions")
+	}
+	if mode := fi.Mode().Perm(); mode&^keyFileMode != 0 {
+		if k.allowInsecurePermissions {
+			log.Warnf("private key %s is accessible by other users (mode %v)",
+				k.keyName, mode)
+			return nil
+		}
+		return errors.Wrapf(errInsecureKeyPermissions,
+			"private key %s is accessible by other users (mode %v, expected %v); "+
+				"refusing to load it", k.keyName, mode, keyFileMode)
+	}
+	return nil
+}
+
 func (k *Keystore) Generate() error {
 	key, err := rsa.GenerateKey(rand.Reader, RsaKeyLength)
 	if err != nil {
@@ -150,6 +219,20 @@ func (k *Keystore) PublicPEM() (string, error) {
 	return buf.String(), nil
 }
 
+// Fingerprint returns the hex encoded SHA256 digest of the DER encoded public
+// key.
+func (k *Keystore) Fingerprint() (string, error) {
+	if k.private == nil {
+		return "", errNoKeys
+	}
+	data, err := x509.MarshalPKIXPublicKey(k.Public())
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal public key")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 func (k *Keystore) Sign(data []byte) ([]byte, error) {
 	hash := crypto.SHA256
 	h := hash.New()
@@ -163,6 +246,10 @@ func IsNoKeys(e error) bool {
 	return e == errNoKeys
 }
 
+func IsInsecureKeyPermissions(e error) bool {
+	return errors.Cause(e) == errInsecureKeyPermissions
+}
+
 func loadFromPem(in io.Reader) (*rsa.PrivateKey, error) {
 	data, err := ioutil.ReadAll(in)
 	if err != nil {
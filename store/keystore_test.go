@@ -17,8 +17,13 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -131,6 +136,14 @@ func TestKeystore(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedaspem, aspem)
 
+	sum := sha256.Sum256(data)
+	fp, err := k.Fingerprint()
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fp)
+
+	_, err = NewKeystore(ms, "bar").Fingerprint()
+	assert.True(t, IsNoKeys(err))
+
 	tosigndata := []byte("foobar")
 	s, err := k.Sign(tosigndata)
 	assert.NoError(t, err)
@@ -150,3 +163,40 @@ func TestKeystoreLoadPem(t *testing.T) {
 	assert.Nil(t, nk)
 	assert.Error(t, err)
 }
+
+func TestKeystorePermissions(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-keystore-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	ds := NewDirStore(td)
+	k := NewKeystore(ds, "key")
+	assert.NoError(t, k.Generate())
+
+	// leftover temporary file with loose permissions must not affect the
+	// mode of the saved key
+	assert.NoError(t, ioutil.WriteFile(path.Join(td, "key~"), nil, 0644))
+	assert.NoError(t, k.Save())
+
+	fi, err := os.Stat(path.Join(td, "key"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	k = NewKeystore(ds, "key")
+	assert.NoError(t, k.Load())
+
+	// world readable key is refused
+	assert.NoError(t, os.Chmod(path.Join(td, "key"), 0644))
+	k = NewKeystore(ds, "key")
+	err = k.Load()
+	assert.Error(t, err)
+	assert.True(t, IsInsecureKeyPermissions(err))
+	assert.False(t, IsNoKeys(err))
+	assert.Contains(t, err.Error(), "accessible by other users")
+	assert.Nil(t, k.Private())
+
+	// unless explicitly allowed
+	k.SetAllowInsecurePermissions(true)
+	assert.NoError(t, k.Load())
+	assert.NotNil(t, k.Private())
+}
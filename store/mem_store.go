@@ -19,6 +19,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
 )
 
 var (
@@ -45,8 +47,10 @@ type MemStoreData struct {
 	data []byte
 }
 
-// in-memory store for testing purposes
+// in-memory store for testing purposes; safe for concurrent use, like the
+// database store
 type MemStore struct {
+	lock     sync.Mutex
 	data     map[string]*MemStoreData
 	readonly bool
 	disable  bool
@@ -57,6 +61,8 @@ func (ms *MemStore) OpenRead(name string) (io.ReadCloser, error) {
 	if ms.disable {
 		return nil, errDisabled
 	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
 	v, ok := ms.data[name]
 	if ok == false {
 		return nil, os.ErrNotExist
@@ -74,7 +80,9 @@ func (ms *MemStore) OpenWrite(name string) (WriteCloserCommitter, error) {
 		return nil, errReadOnly
 	}
 
+	ms.lock.Lock()
 	ms.data[name] = &MemStoreData{}
+	ms.lock.Unlock()
 
 	msw := &MemStoreWriter{
 		bytes.Buffer{},
@@ -111,16 +119,34 @@ func (ms *MemStore) Commit(name string, data []byte) error {
 	if ms.readonly {
 		return errReadOnly
 	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
 	d := ms.data[name]
 	d.data = data
 	return nil
 }
 
 func (ms *MemStore) Remove(name string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
 	delete(ms.data, name)
 	return nil
 }
 
+func (ms *MemStore) Keys() ([]string, error) {
+	if ms.disable {
+		return nil, errDisabled
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	keys := make([]string, 0, len(ms.data))
+	for k := range ms.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 func (ms *MemStore) ReadOnly(ro bool) {
 	ms.readonly = ro
 }
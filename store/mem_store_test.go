@@ -53,6 +53,10 @@ func TestMemStore(t *testing.T) {
 	err = ms.WriteAll("test", testValue)
 	assert.NoError(t, err)
 
+	keys, err := ms.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo", "test"}, keys)
+
 	err = ms.Close()
 	assert.NoError(t, err)
 }
@@ -65,3 +65,12 @@ func (ms *MockStore) Remove(name string) error {
 	ret := ms.Called(name)
 	return ret.Error(0)
 }
+
+func (ms *MockStore) Keys() ([]string, error) {
+	ret := ms.Called()
+	keys := ret.Get(0)
+	if keys == nil {
+		return nil, ret.Error(1)
+	}
+	return ret.Get(0).([]string), ret.Error(1)
+}
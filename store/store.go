@@ -13,7 +13,14 @@
 //    limitations under the License.
 package store
 
-import "io"
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/pkg/errors"
+)
 
 // wrapper for io.WriteCloser with extra Commit() method
 type WriteCloserCommitter interface {
@@ -39,6 +46,27 @@ type Store interface {
 	OpenWrite(name string) (WriteCloserCommitter, error)
 	// remove an entry
 	Remove(name string) error
+	// list the names of all entries, sorted
+	Keys() ([]string, error)
 	// close the store
 	Close() error
 }
+
+// IsNoSpace returns true if err was caused by the storage the store is kept on
+// running out of space.
+func IsNoSpace(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case *lmdb.OpError:
+		if lmdb.IsMapFull(e) {
+			return true
+		}
+		err = e.Errno
+	default:
+		err = e
+	}
+	return err == syscall.ENOSPC
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsNoSpace(t *testing.T) {
+	assert.True(t, IsNoSpace(syscall.ENOSPC))
+	assert.True(t, IsNoSpace(&os.PathError{Op: "write", Err: syscall.ENOSPC}))
+	assert.True(t, IsNoSpace(errors.Wrap(
+		&os.SyscallError{Syscall: "write", Err: syscall.ENOSPC}, "writing")))
+	assert.True(t, IsNoSpace(&lmdb.OpError{Op: "mdb_put", Errno: lmdb.MapFull}))
+	assert.True(t, IsNoSpace(&lmdb.OpError{Op: "mdb_txn_commit", Errno: syscall.ENOSPC}))
+	assert.False(t, IsNoSpace(syscall.EIO))
+	assert.False(t, IsNoSpace(errors.New("foo")))
+	assert.False(t, IsNoSpace(nil))
+}
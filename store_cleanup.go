@@ -0,0 +1,102 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+const (
+	// name of key holding the time the stale entries were first found in
+	// the store
+	staleKeysName = "stale-keys"
+	// how often the daemon cleans up the store and the deployment logs
+	storeCleanupInterval = time.Hour
+)
+
+// staleStoreEntries tell, for each of the store entries which may be left
+// behind, whether the entry is stale; entries not listed here are never
+// removed.
+var staleStoreEntries = map[string]func(s store.Store, data []byte) bool{
+	// provides of an artifact whose installation was not committed
+	artifactProvidesPendingName: func(s store.Store, data []byte) bool {
+		_, err := LoadStateData(s)
+		return os.IsNotExist(err)
+	},
+	// written by a self check which was interrupted
+	selfCheckProbeName: func(s store.Store, data []byte) bool {
+		return true
+	},
+	// token cleared by earlier versions of the client
+	authTokenName: func(s store.Store, data []byte) bool {
+		return len(data) == 0
+	},
+}
+
+// cleanupStore removes the stale entries of the store once they are older
+// than ttl. As the store does not keep track of the time entries are written,
+// the age of an entry is counted from the first cleanup that found it stale.
+func cleanupStore(s store.Store, ttl time.Duration, now time.Time) error {
+	keys, err := s.Keys()
+	if err != nil {
+		return errors.Wrapf(err, "failed to list store entries")
+	}
+
+	seen := map[string]time.Time{}
+	if data, err := s.ReadAll(staleKeysName); err == nil {
+		if err := json.Unmarshal(data, &seen); err != nil {
+			log.Warnf("failed to parse stale store entries: %v", err)
+		}
+	}
+
+	stale := map[string]time.Time{}
+	for _, key := range keys {
+		isStale, ok := staleStoreEntries[key]
+		if !ok {
+			continue
+		}
+		data, err := s.ReadAll(key)
+		if err != nil || !isStale(s, data) {
+			continue
+		}
+		since, ok := seen[key]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < ttl {
+			stale[key] = since
+			continue
+		}
+		log.Infof("removing stale store entry %s", key)
+		if err := s.Remove(key); err != nil {
+			log.Warnf("failed to remove stale store entry %s: %v", key, err)
+			stale[key] = since
+		}
+	}
+
+	if len(stale) == 0 {
+		if len(seen) != 0 {
+			return s.Remove(staleKeysName)
+		}
+		return nil
+	}
+	data, _ := json.Marshal(stale)
+	return s.WriteAll(staleKeysName, data)
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupStore(t *testing.T) {
+	ms := store.NewMemStore()
+	now := time.Now()
+	ttl := 24 * time.Hour
+
+	ms.WriteAll(authTokenName, []byte{})
+	ms.WriteAll(selfCheckProbeName, []byte("foo"))
+	ms.WriteAll(artifactProvidesPendingName, []byte("{}"))
+	StoreStateData(ms, StateData{Name: MenderStateUpdateStore})
+	ms.WriteAll("some-entry", []byte("foo"))
+
+	// found for the first time; kept until it expires
+	assert.NoError(t, cleanupStore(ms, ttl, now))
+
+	// the update is over, the pending provides become stale
+	now = now.Add(12 * time.Hour)
+	RemoveStateData(ms)
+	assert.NoError(t, cleanupStore(ms, ttl, now))
+	keys, _ := ms.Keys()
+	assert.Equal(t, []string{artifactProvidesPendingName, authTokenName,
+		selfCheckProbeName, "some-entry", staleKeysName}, keys)
+
+	now = now.Add(13 * time.Hour)
+	assert.NoError(t, cleanupStore(ms, ttl, now))
+	keys, _ = ms.Keys()
+	assert.Equal(t, []string{artifactProvidesPendingName, "some-entry",
+		staleKeysName}, keys)
+
+	// entries which are not stale are never removed
+	ms.WriteAll(authTokenName, []byte("token"))
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, cleanupStore(ms, ttl, now))
+	keys, _ = ms.Keys()
+	assert.Equal(t, []string{authTokenName, "some-entry"}, keys)
+
+	ms.Disable(true)
+	assert.Error(t, cleanupStore(ms, ttl, now))
+}
+
+func TestDaemonStaleDataCleanup(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	now := time.Now()
+	for i, age := range []time.Duration{time.Hour, 72 * time.Hour} {
+		name := filepath.Join(tempDir,
+			fmt.Sprintf(logFileNameScheme, i+1, fmt.Sprintf("deployment-%d", i)))
+		assert.NoError(t, ioutil.WriteFile(name, []byte("{}"), 0600))
+		assert.NoError(t, os.Chtimes(name, now.Add(-age), now.Add(-age)))
+	}
+
+	ms := store.NewMemStore()
+	ms.WriteAll(selfCheckProbeName, []byte("foo"))
+
+	// disabled by default
+	d := NewDaemon(&stateTestController{}, ms)
+	d.cleanup(now)
+	logs, _ := DeploymentLogger.getSortedLogFiles()
+	assert.Len(t, logs, 2)
+
+	d.staleDataTTL = 48 * time.Hour
+	d.cleanup(now)
+	logs, _ = DeploymentLogger.getSortedLogFiles()
+	assert.Len(t, logs, 1)
+	_, err := DeploymentLogger.findLogsForSpecificID("deployment-0")
+	assert.NoError(t, err)
+	_, err = ms.ReadAll(staleKeysName)
+	assert.NoError(t, err)
+
+	// not repeated until the interval passes
+	name := filepath.Join(tempDir, fmt.Sprintf(logFileNameScheme, 2, "deployment-2"))
+	assert.NoError(t, ioutil.WriteFile(name, []byte("{}"), 0600))
+	assert.NoError(t, os.Chtimes(name, now.Add(-72*time.Hour), now.Add(-72*time.Hour)))
+	d.cleanup(now.Add(30 * time.Minute))
+	logs, _ = DeploymentLogger.getSortedLogFiles()
+	assert.Len(t, logs, 2)
+	d.cleanup(now.Add(49 * time.Hour))
+	_, err = ms.ReadAll(selfCheckProbeName)
+	assert.True(t, os.IsNotExist(err))
+	logs, _ = DeploymentLogger.getSortedLogFiles()
+	assert.Empty(t, logs)
+}
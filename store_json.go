@@ -0,0 +1,67 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/store"
+)
+
+// storeJSON writes v encoded as JSON to the store entry name. The client works
+// on without the entry, so failures are only logged; desc names the entry in
+// the log.
+func storeJSON(s store.Store, name, desc string, v interface{}) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = s.WriteAll(name, data)
+	}
+	if err != nil {
+		log.Errorf("failed to store %s: %v", desc, err)
+	}
+}
+
+// loadJSON decodes the store entry name into v. Returns false if there is no
+// such entry, or if it can not be parsed, in which case it is removed.
+func loadJSON(s store.Store, name, desc string, v interface{}) bool {
+	if s == nil {
+		return false
+	}
+	data, err := s.ReadAll(name)
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Errorf("failed to parse %s: %v", desc, err)
+		clearJSON(s, name, desc)
+		return false
+	}
+	return true
+}
+
+// clearJSON removes the store entry name, if there is one.
+func clearJSON(s store.Store, name, desc string) {
+	if s == nil {
+		return
+	}
+	if _, err := s.ReadAll(name); err == nil {
+		if err := s.Remove(name); err != nil {
+			log.Errorf("failed to remove %s: %v", desc, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreJSON(t *testing.T) {
+	ms := store.NewMemStore()
+	var v inventoryVersion
+	assert.False(t, loadJSON(ms, "entry", "entry", &v))
+
+	storeJSON(ms, "entry", "entry", inventoryVersion{Hash: "abc", Version: "1"})
+	assert.True(t, loadJSON(ms, "entry", "entry", &v))
+	assert.Equal(t, inventoryVersion{Hash: "abc", Version: "1"}, v)
+
+	clearJSON(ms, "entry", "entry")
+	_, err := ms.ReadAll("entry")
+	assert.True(t, os.IsNotExist(err))
+	clearJSON(ms, "entry", "entry")
+
+	// entry which can not be parsed is removed
+	ms.WriteAll("entry", []byte("{"))
+	assert.False(t, loadJSON(ms, "entry", "entry", &v))
+	_, err = ms.ReadAll("entry")
+	assert.True(t, os.IsNotExist(err))
+
+	// no store
+	storeJSON(nil, "entry", "entry", v)
+	assert.False(t, loadJSON(nil, "entry", "entry", &v))
+	clearJSON(nil, "entry", "entry")
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrStoreNoSpace is returned if an entry can not be written to the
+	// store even after removing old data
+	ErrStoreNoSpace = errors.New("not enough space for the data store")
+)
+
+// nonEssentialKeys are the store entries the client works without; they are
+// not written while the store is low on space.
+var nonEssentialKeys = map[string]bool{
+	updateTimingsKey:          true,
+	updateCheckValidatorsName: true,
+	staleKeysName:             true,
+	inventoryVersionName:      true,
+	remoteConfigName:          true,
+}
+
+// spaceRecoveringStore frees space for the store once a write fails because the
+// storage is full, and tries the write again, so that the state data and the
+// authorization token can still be written. If there is still not enough
+// space, the non-essential entries are not written until a write succeeds.
+type spaceRecoveringStore struct {
+	store.Store
+	// removes old data kept on the same storage as the store
+	free func()
+
+	lock       sync.Mutex
+	lowOnSpace bool
+}
+
+func newSpaceRecoveringStore(s store.Store, free func()) *spaceRecoveringStore {
+	return &spaceRecoveringStore{
+		Store: s,
+		free:  free,
+	}
+}
+
+// LowOnSpace returns true if the store ran out of space, and removing old data
+// did not help.
+func (s *spaceRecoveringStore) LowOnSpace() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lowOnSpace
+}
+
+func (s *spaceRecoveringStore) setLowOnSpace(low bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lowOnSpace = low
+}
+
+func (s *spaceRecoveringStore) WriteAll(name string, data []byte) error {
+	if nonEssentialKeys[name] && s.LowOnSpace() {
+		log.Debugf("store is low on space; not writing %s", name)
+		return nil
+	}
+
+	err := s.Store.WriteAll(name, data)
+	if err == nil {
+		s.setLowOnSpace(false)
+		return nil
+	}
+	if !store.IsNoSpace(err) {
+		return err
+	}
+
+	log.Warnf("no space left for store entry %s; removing old data", name)
+	s.free()
+
+	if err := s.Store.WriteAll(name, data); err != nil {
+		if !store.IsNoSpace(err) {
+			return err
+		}
+		log.Errorf("no space left for store entry %s after removing old data", name)
+		s.setLowOnSpace(true)
+		return errors.Wrapf(ErrStoreNoSpace, "failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// freeStoreSpace removes the data the client can do without from the storage
+// the store is kept on: the logs of the past deployments and the stale store
+// entries.
+func freeStoreSpace(s store.Store, now time.Time) {
+	if DeploymentLogger != nil {
+		DeploymentLogger.RemoveLogsOlderThan(now)
+	}
+	if err := cleanupStore(s, 0, now); err != nil {
+		log.Warnf("failed to remove stale store entries: %v", err)
+	}
+}
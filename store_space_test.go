@@ -0,0 +1,118 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fullStore fails the writes as if the storage was full while full is set
+type fullStore struct {
+	store.Store
+	full   bool
+	writes []string
+}
+
+func (s *fullStore) WriteAll(name string, data []byte) error {
+	s.writes = append(s.writes, name)
+	if s.full {
+		return &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+	}
+	return s.Store.WriteAll(name, data)
+}
+
+func TestSpaceRecoveringStore(t *testing.T) {
+	fs := &fullStore{Store: store.NewMemStore(), full: true}
+	freed := 0
+	s := newSpaceRecoveringStore(fs, func() {
+		freed++
+		fs.full = false
+	})
+
+	// space is freed and the write is tried again
+	assert.NoError(t, s.WriteAll(stateDataKey, []byte("state")))
+	assert.Equal(t, 1, freed)
+	assert.Equal(t, []string{stateDataKey, stateDataKey}, fs.writes)
+	assert.False(t, s.LowOnSpace())
+	data, _ := s.ReadAll(stateDataKey)
+	assert.Equal(t, []byte("state"), data)
+
+	// freeing space does not help
+	s.free = func() { freed++ }
+	fs.full = true
+	fs.writes = nil
+	err := s.WriteAll(authTokenName, []byte("token"))
+	assert.Equal(t, ErrStoreNoSpace, errors.Cause(err))
+	assert.Equal(t, 2, freed)
+	assert.Equal(t, []string{authTokenName, authTokenName}, fs.writes)
+	assert.True(t, s.LowOnSpace())
+
+	// non-essential entries are not written while low on space
+	fs.writes = nil
+	assert.NoError(t, s.WriteAll(updateTimingsKey, []byte("timings")))
+	assert.Empty(t, fs.writes)
+	_, err = s.ReadAll(updateTimingsKey)
+	assert.True(t, os.IsNotExist(err))
+
+	// other errors are returned as they are
+	fs.Store.(*store.MemStore).ReadOnly(true)
+	fs.full = false
+	err = s.WriteAll(authTokenName, []byte("token"))
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrStoreNoSpace, errors.Cause(err))
+	assert.Equal(t, 2, freed)
+
+	// successful write means there is space again
+	fs.Store.(*store.MemStore).ReadOnly(false)
+	assert.NoError(t, s.WriteAll(authTokenName, []byte("token")))
+	assert.False(t, s.LowOnSpace())
+	assert.NoError(t, s.WriteAll(updateTimingsKey, []byte("timings")))
+	data, _ = s.ReadAll(updateTimingsKey)
+	assert.Equal(t, []byte("timings"), data)
+}
+
+func TestFreeStoreSpace(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-free-space-")
+	defer os.RemoveAll(td)
+
+	oldLogger := DeploymentLogger
+	defer func() { DeploymentLogger = oldLogger }()
+	DeploymentLogger = NewDeploymentLogManager(td)
+
+	oldLog := filepath.Join(td, "deployments.0002.old.log")
+	ioutil.WriteFile(oldLog, []byte("old"), 0600)
+	assert.NoError(t, DeploymentLogger.Enable("current"))
+	defer DeploymentLogger.Disable()
+	DeploymentLogger.WriteLog([]byte("current"))
+
+	ms := store.NewMemStore()
+	ms.WriteAll(stateDataKey, []byte("state"))
+	ms.WriteAll(selfCheckProbeName, []byte("foo"))
+
+	freeStoreSpace(ms, time.Now().Add(time.Second))
+
+	logs, _ := filepath.Glob(filepath.Join(td, "deployments.*"))
+	assert.Equal(t, []string{filepath.Join(td, "deployments.0001.current.log")}, logs)
+	keys, _ := ms.Keys()
+	assert.Equal(t, []string{stateDataKey}, keys)
+}
@@ -216,15 +216,17 @@ func TestTransitionReporting(t *testing.T) {
 	update := client.UpdateResponse{
 		Artifact: struct {
 			Source struct {
-				URI    string
-				Expire string
+				URI      string
+				Expire   string
+				Checksum string `json:"checksum,omitempty"`
 			}
 			CompatibleDevices []string `json:"device_types_compatible"`
 			ArtifactName      string   `json:"artifact_name"`
 		}{
 			Source: struct {
-				URI    string
-				Expire string
+				URI      string
+				Expire   string
+				Checksum string `json:"checksum,omitempty"`
 			}{
 				URI: strings.Join([]string{"www.example.com", "test"}, "/"),
 			},
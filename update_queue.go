@@ -0,0 +1,175 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+)
+
+const (
+	// name of key holding the updates of the chain offered by the server
+	// that are still to be installed; the chain spans reboots
+	pendingUpdatesKey = "pending-updates"
+	// longest chain of updates that is accepted
+	maxPendingUpdates = 5
+	// name of key holding the committed update whose success report was not
+	// accepted by the server yet
+	pendingReportKey = "pending-success-report"
+	// name of key holding the update whose partition was enabled; it lets
+	// the client tell which update it is running after the reboot
+	upgradeUpdateKey = "upgrade-update"
+	// name of key holding the update committed most recently; the device
+	// is expected to run its artifact until the next update
+	committedUpdateKey = "committed-update"
+)
+
+// storePendingUpdates replaces the queue of updates installed one after
+// another once the current update succeeds.
+func storePendingUpdates(s store.Store, updates []client.UpdateResponse) {
+	if s == nil {
+		return
+	}
+	if len(updates) == 0 {
+		clearPendingUpdates(s)
+		return
+	}
+	if len(updates) > maxPendingUpdates {
+		log.Warnf("update chain is too long; only the first %d updates are queued",
+			maxPendingUpdates)
+		updates = updates[:maxPendingUpdates]
+	}
+
+	queue := make([]client.UpdateResponse, 0, len(updates))
+	for _, u := range updates {
+		// chains are not nested
+		u.Next = nil
+		queue = append(queue, u)
+	}
+	storeJSON(s, pendingUpdatesKey, "pending updates", queue)
+}
+
+func loadPendingUpdates(s store.Store) []client.UpdateResponse {
+	if s == nil {
+		return nil
+	}
+	data, err := s.ReadAll(pendingUpdatesKey)
+	if err != nil {
+		return nil
+	}
+	var queue []client.UpdateResponse
+	if err := json.Unmarshal(data, &queue); err != nil {
+		log.Errorf("failed to parse pending updates: %v", err)
+		return nil
+	}
+	return queue
+}
+
+// nextPendingUpdate removes the first update from the queue and returns it.
+func nextPendingUpdate(s store.Store) (client.UpdateResponse, bool) {
+	queue := loadPendingUpdates(s)
+	if len(queue) == 0 {
+		return client.UpdateResponse{}, false
+	}
+	storePendingUpdates(s, queue[1:])
+	return queue[0], true
+}
+
+func clearPendingUpdates(s store.Store) {
+	if s == nil {
+		return
+	}
+	if _, err := s.ReadAll(pendingUpdatesKey); err == nil {
+		if err := s.Remove(pendingUpdatesKey); err != nil {
+			log.Errorf("failed to remove pending updates: %v", err)
+		}
+	}
+}
+
+// storePendingReport keeps the success report of the committed update, so
+// that it is sent again with the following update checks.
+func storePendingReport(s store.Store, update client.UpdateResponse) {
+	if s == nil {
+		return
+	}
+	data, _ := json.Marshal(update)
+	if err := s.WriteAll(pendingReportKey, data); err != nil {
+		log.Errorf("failed to store pending success report: %v", err)
+	}
+}
+
+func loadPendingReport(s store.Store) (client.UpdateResponse, bool) {
+	var update client.UpdateResponse
+	if s == nil {
+		return update, false
+	}
+	data, err := s.ReadAll(pendingReportKey)
+	if err != nil {
+		return update, false
+	}
+	if err := json.Unmarshal(data, &update); err != nil {
+		log.Errorf("failed to parse pending success report: %v", err)
+		clearPendingReport(s)
+		return update, false
+	}
+	return update, true
+}
+
+func clearPendingReport(s store.Store) {
+	if s == nil {
+		return
+	}
+	if err := s.Remove(pendingReportKey); err != nil {
+		log.Errorf("failed to remove pending success report: %v", err)
+	}
+}
+
+// storeUpgradeUpdate records the update which is about to be enabled for the
+// next boot.
+func storeUpgradeUpdate(s store.Store, update client.UpdateResponse) {
+	storeJSON(s, upgradeUpdateKey, "upgrade update", update)
+}
+
+func loadUpgradeUpdate(s store.Store) (*client.UpdateResponse, bool) {
+	var update client.UpdateResponse
+	if !loadJSON(s, upgradeUpdateKey, "upgrade update", &update) {
+		return nil, false
+	}
+	return &update, true
+}
+
+func clearUpgradeUpdate(s store.Store) {
+	clearJSON(s, upgradeUpdateKey, "upgrade update")
+}
+
+// storeCommittedUpdate records the update the device is expected to run from
+// now on.
+func storeCommittedUpdate(s store.Store, update client.UpdateResponse) {
+	storeJSON(s, committedUpdateKey, "committed update", update)
+}
+
+func loadCommittedUpdate(s store.Store) (*client.UpdateResponse, bool) {
+	var update client.UpdateResponse
+	if !loadJSON(s, committedUpdateKey, "committed update", &update) {
+		return nil, false
+	}
+	return &update, true
+}
+
+func clearCommittedUpdate(s store.Store) {
+	clearJSON(s, committedUpdateKey, "committed update")
+}
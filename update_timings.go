@@ -0,0 +1,93 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/store"
+)
+
+const (
+	// name of key the time spent in the update phases is stored under; the
+	// update spans reboots
+	updateTimingsKey = "update-timings"
+)
+
+var (
+	// phases of the update, in order, and the states belonging to them
+	updatePhases      = []string{"fetch", "install", "commit"}
+	updatePhaseStates = map[MenderState]string{
+		MenderStateUpdateFetch:   "fetch",
+		MenderStateUpdateStore:   "install",
+		MenderStateUpdateInstall: "install",
+		MenderStateUpdateCommit:  "commit",
+	}
+)
+
+// updateTimings holds the wall-clock time spent in each phase of the update.
+type updateTimings map[string]time.Duration
+
+func loadUpdateTimings(s store.Store) updateTimings {
+	timings := updateTimings{}
+	if s == nil {
+		return timings
+	}
+	data, err := s.ReadAll(updateTimingsKey)
+	if err != nil {
+		return timings
+	}
+	if err := json.Unmarshal(data, &timings); err != nil {
+		log.Warnf("failed to parse update timings: %v", err)
+	}
+	return timings
+}
+
+// recordUpdateTiming adds the time spent in the state to its update phase.
+func recordUpdateTiming(s store.Store, state MenderState, d time.Duration) {
+	phase, ok := updatePhaseStates[state]
+	if !ok || s == nil {
+		return
+	}
+
+	timings := loadUpdateTimings(s)
+	timings[phase] += d
+	data, _ := json.Marshal(timings)
+	if err := s.WriteAll(updateTimingsKey, data); err != nil {
+		log.Warnf("failed to store update timings: %v", err)
+	}
+}
+
+func removeUpdateTimings(s store.Store) {
+	if s == nil {
+		return
+	}
+	if _, err := s.ReadAll(updateTimingsKey); err == nil {
+		s.Remove(updateTimingsKey)
+	}
+}
+
+func (t updateTimings) String() string {
+	var phases []string
+	for _, phase := range updatePhases {
+		if d, ok := t[phase]; ok {
+			phases = append(phases, fmt.Sprintf("%s: %v", phase, d))
+		}
+	}
+	return strings.Join(phases, ", ")
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockClock struct {
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	return c.now
+}
+
+// timedTestState pretends handling the state takes the given time
+type timedTestState struct {
+	baseState
+	clock *mockClock
+	takes time.Duration
+}
+
+func (s *timedTestState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	s.clock.now = s.clock.now.Add(s.takes)
+	return doneState, false
+}
+
+func TestUpdateTimings(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+
+	clock := &mockClock{now: time.Now()}
+	ctx := &StateContext{
+		store: ms,
+		clock: clock.Now,
+	}
+
+	for _, s := range []*timedTestState{
+		{baseState{id: MenderStateUpdateFetch}, clock, 2 * time.Minute},
+		// fetch was retried
+		{baseState{id: MenderStateUpdateFetch}, clock, time.Minute},
+		{baseState{id: MenderStateUpdateStore}, clock, 4 * time.Minute},
+		{baseState{id: MenderStateUpdateInstall}, clock, time.Second},
+		// not part of any phase
+		{baseState{id: MenderStateReboot}, clock, time.Hour},
+		{baseState{id: MenderStateUpdateCommit}, clock, 3 * time.Second},
+	} {
+		mender.TransitionState(s, ctx)
+	}
+
+	assert.Equal(t, updateTimings{
+		"fetch":   3 * time.Minute,
+		"install": 4*time.Minute + time.Second,
+		"commit":  3 * time.Second,
+	}, loadUpdateTimings(ms))
+
+	// timings are reported with the final status
+	sc := &stateTestController{}
+	usr := NewUpdateStatusReportState(client.UpdateResponse{ID: "foo"},
+		client.StatusSuccess)
+	s, _ := usr.Handle(ctx, sc)
+	assert.Equal(t, idleState, s)
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+	assert.Equal(t, "fetch: 3m0s, install: 4m1s, commit: 3s", sc.reportSubState)
+
+	// and removed once reported
+	assert.Empty(t, loadUpdateTimings(ms))
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"github.com/pkg/errors"
+)
+
+// causeError exposes the root cause of err to errors.Is and errors.As of the
+// standard library. The errors wrapped with github.com/pkg/errors do not
+// implement Unwrap, hence the sentinel errors would not be found through them
+// otherwise.
+type causeError struct {
+	err error
+}
+
+func (c *causeError) Error() string {
+	return c.err.Error()
+}
+
+func (c *causeError) Cause() error {
+	return c.err
+}
+
+func (c *causeError) Unwrap() error {
+	return errors.Cause(c.err)
+}
+
+// WithCause returns err, matched by errors.Is of the standard library against
+// the error it was caused by.
+func WithCause(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &causeError{err: err}
+}
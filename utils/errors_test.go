@@ -0,0 +1,35 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	stderrors "errors"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithCause(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	wrapped := errors.Wrap(errors.Wrap(sentinel, "inner"), "outer")
+	assert.False(t, stderrors.Is(wrapped, sentinel))
+
+	err := WithCause(wrapped)
+	assert.True(t, stderrors.Is(err, sentinel))
+	assert.Equal(t, sentinel, errors.Cause(err))
+	assert.Equal(t, wrapped.Error(), err.Error())
+
+	assert.Nil(t, WithCause(nil))
+}
@@ -13,6 +13,11 @@
 //    limitations under the License.
 package main
 
+import (
+	"strconv"
+	"strings"
+)
+
 var (
 	// Version information of current build
 	Version string
@@ -24,3 +29,54 @@ func VersionString() string {
 	}
 	return "unknown"
 }
+
+// parseVersion returns the numeric components of a version such as 1.7.0 or
+// v1.7.0-build3; anything following the dotted numbers is ignored.
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(version, "v")
+	end := strings.IndexFunc(version, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	})
+	if end >= 0 {
+		version = version[:end]
+	}
+
+	var parts []int
+	for _, p := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// versionOlder returns true if the version is older than min; missing
+// components are zero, so that 1.7 equals 1.7.0. The second return value is
+// false if either of the versions can not be compared, e.g. for builds of
+// unreleased code.
+func versionOlder(version, min string) (bool, bool) {
+	v, ok := parseVersion(version)
+	if !ok {
+		return false, false
+	}
+	m, ok := parseVersion(min)
+	if !ok {
+		return false, false
+	}
+
+	for i := 0; i < len(v) || i < len(m); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(m) {
+			b = m[i]
+		}
+		if a != b {
+			return a < b, true
+		}
+	}
+	return false, true
+}
@@ -32,3 +32,25 @@ func TestVersionVersion(t *testing.T) {
 	// tag takes priority over other settings
 	assert.Equal(t, "foo", v)
 }
+
+func TestVersionOlder(t *testing.T) {
+	tc := []struct {
+		version, min string
+		older, ok    bool
+	}{
+		{"1.7.0", "1.7.0", false, true},
+		{"1.7.0", "1.8.0", true, true},
+		{"1.10.0", "1.9.2", false, true},
+		{"1.7", "1.7.0", false, true},
+		{"1.7", "1.7.1", true, true},
+		{"v2.0.0-build3", "1.9", false, true},
+		{"1.6.1b1", "1.7", true, true},
+		{"unknown", "1.7.0", false, false},
+		{"1.7.0", "latest", false, false},
+	}
+	for _, c := range tc {
+		older, ok := versionOlder(c.version, c.min)
+		assert.Equal(t, c.older, older, "%s < %s", c.version, c.min)
+		assert.Equal(t, c.ok, ok, "%s < %s", c.version, c.min)
+	}
+}